@@ -20,6 +20,21 @@ type Node struct {
 	Right *Node
 }
 
+// Join describes how a JOIN action matches records from another collection to its input. As is
+// the key the matches are added under, and Flatten returns a row per match instead.
+type Join struct {
+	Left    string
+	Right   string
+	As      string
+	Flatten bool
+}
+
+// Aggregate is a single aggregate computed by an AGGREGATE action. Field is empty for COUNT.
+type Aggregate struct {
+	Function string
+	Field    string
+}
+
 type Token struct {
 	Type  string
 	Value string
@@ -37,6 +52,7 @@ type FlagStruct struct {
 	Paren       bool
 	SingleQuote bool
 	DoubleQuote bool
+	Regex       bool
 }
 
 type Action struct {
@@ -45,18 +61,66 @@ type Action struct {
 	Resource   string
 	IDs        []string
 	Fields     []string
+	Projection []Projection
 	Limit      int
+	Offset     int
+	After      string
 	Filter     Node
 	Order      string
 	OrderDir   string
 	Data       []map[string]interface{}
 	User       string
 	JQ         string
+	Unique     bool
+	Text       bool
+	DryRun     bool
+	Explain    bool
+	Aggregates []Aggregate
+	Group      []string
+	Join       Join
+	Search     Search
+	Access     Access
+	Policy     Node
+}
+
+// POLICY_VARIABLE starts the values of a policy's filter which are replaced with the fields of
+// the user the policy is applied to
+const POLICY_VARIABLE = "$user."
+
+// Access limits the fields of a collection the user running an action can see and write, as set
+// by their permit. Allow, when set, lists the only visible fields and Deny lists hidden ones.
+type Access struct {
+	Allow []string
+	Deny  []string
+}
+
+// Restricted reports whether any fields are hidden
+func (a Access) Restricted() bool {
+	return len(a.Allow) > 0 || len(a.Deny) > 0
+}
+
+// Hidden reports whether a field, or the field a dotted path starts at, is hidden. Record IDs are
+// always visible.
+func (a Access) Hidden(field string) bool {
+	field = strings.Split(field, ".")[0]
+	if field == "" {
+		return false
+	}
+	if len(a.Allow) > 0 && !utils.Contains(a.Allow, field) {
+		return true
+	}
+	return utils.Contains(a.Deny, field)
+}
+
+// Search ranks the records of a GET by how relevant a field is to a set of search terms
+type Search struct {
+	Field string
+	Terms string
 }
 
 // Determine the type of a token based on its value
 func determineType(value string, token *Token) {
-	ops := []string{">", ">=", "=", "<=", "<", "!="}
+	ops := []string{">", ">=", "=", "<=", "<", "!=", "CONTAINS", "IN", "LIKE", "ILIKE", "STARTSWITH", "MATCHES"}
 	logic := []string{"AND", "OR", "XOR", "NOT"}
 	resources := []string{"DATABASE", "RECORD", "COLLECTION", "USER", "PERMIT"}
 	if len(value) == 0 {
@@ -109,6 +173,9 @@ func determineType(value string, token *Token) {
 	case "FILTER":
 		token.Type = "FILTER"
 		token.Value = strings.ToUpper(value)
+	case "EXISTS":
+		token.Type = "EXISTS"
+		token.Value = strings.ToUpper(value)
 	case "ORDERASC":
 		token.Type = "ORDERASC"
 		token.Value = strings.ToUpper(value)
@@ -118,6 +185,16 @@ func determineType(value string, token *Token) {
 	case "JQ":
 		token.Type = "JQ"
 		token.Value = strings.ToUpper(value)
+	// Transactions
+	case "BEGIN":
+		token.Type = "BEGIN"
+		token.Value = strings.ToUpper(value)
+	case "COMMIT":
+		token.Type = "COMMIT"
+		token.Value = strings.ToUpper(value)
+	case "ROLLBACK":
+		token.Type = "ROLLBACK"
+		token.Value = strings.ToUpper(value)
 	default:
 		val := strings.ToUpper(value)
 		// Check the more open-ended types
@@ -142,6 +219,9 @@ func determineType(value string, token *Token) {
 			token.Type = "DICT"
 		} else if value[0:1] == "(" {
 			token.Type = "NESTED"
+		} else if len(value) > 1 && value[0:1] == "/" && value[len(value)-1:] == "/" {
+			token.Type = "REGEX"
+			token.Value = strings.ReplaceAll(value[1:len(value)-1], "\\/", "/")
 		} else if res, _ := regexp.MatchString("^-?\\d+$", value); res {
 			token.Type = "INT"
 		} else if res, _ := regexp.MatchString("^-?\\d+\\.\\d+$", value); res {
@@ -182,6 +262,21 @@ func getPatterns() (map[string]interface{}, error) {
 	return output, nil
 }
 
+// describeTokens returns the token types of an action, which are checked against the grammar,
+// along with its syntax as written for error messages
+func describeTokens(tokens []Token) (string, string) {
+	types := make([]string, len(tokens))
+	syntax := make([]string, len(tokens))
+	for idx, token := range tokens {
+		types[idx] = token.Type
+		syntax[idx] = token.Value
+		if token.Type == "STRING" {
+			syntax[idx] = "\"" + token.Value + "\""
+		}
+	}
+	return strings.Join(types, " "), strings.Join(syntax, " ")
+}
+
 // Check a provided action against the AQL grammar to ensure that it is syntactically correct
 func checkPattern(actionString, actionSyntax, pattern string) error {
 	if res, _ := regexp.MatchString(pattern, actionString); !res {
@@ -208,6 +303,7 @@ func checkPattern(actionString, actionSyntax, pattern string) error {
 
 // Given a list of filter tokens, produce a tree that represents the logical and conditional operations
 func handleConditionals(tokens []Token) Node {
+	tokens = handleNullChecks(tokens)
 	nodes := make([]Node, 0)
 	LOGIC := []string{"AND", "OR", "XOR"}
 
@@ -221,6 +317,13 @@ func handleConditionals(tokens []Token) Node {
 			nodeC := Node{Value: tokens[idx].Value, Left: &nodeL, Right: &nodeR}
 			nodes = append(nodes, nodeC)
 			idx++
+		} else if tokens[idx].Type == "EXISTS" {
+			nodeL := Node{Value: tokens[idx+1].Value}
+			nodes = append(nodes, Node{Value: tokens[idx].Value, Left: &nodeL, Right: &Node{}})
+			idx++
+		} else if tokens[idx].Type == "NULLCHECK" {
+			nodeL := Node{Value: tokens[idx-1].Value}
+			nodes = append(nodes, Node{Value: tokens[idx].Value, Left: &nodeL, Right: &Node{}})
 		} else if utils.Contains(LOGIC, tokens[idx].Value) || tokens[idx].Value == "NOT" || tokens[idx].Type == "NESTED" {
 			node := Node{Value: tokens[idx].Value}
 			nodes = append(nodes, node)
@@ -262,11 +365,88 @@ func handleConditionals(tokens []Token) Node {
 	return *head
 }
 
+// handleNullChecks replaces IS NULL, IS NOT NULL, and IS MISSING following a field in a filter
+// with a single NULLCHECK token. IS, NULL, and MISSING are only keywords in this position so that
+// they can still be used as field names.
+func handleNullChecks(tokens []Token) []Token {
+	output := make([]Token, 0, len(tokens))
+	for idx := 0; idx < len(tokens); idx++ {
+		token := tokens[idx]
+		if token.Type != "FIELD" || strings.ToUpper(token.Value) != "IS" || idx == 0 || (tokens[idx-1].Type != "FIELD" && tokens[idx-1].Type != "IDENTIFIER") {
+			output = append(output, token)
+			continue
+		}
+		check := ""
+		length := 0
+		if idx+2 < len(tokens) && tokens[idx+1].Value == "NOT" && tokens[idx+2].Type == "FIELD" && strings.ToUpper(tokens[idx+2].Value) == "NULL" {
+			check = "IS NOT NULL"
+			length = 2
+		} else if idx+1 < len(tokens) && tokens[idx+1].Type == "FIELD" && utils.Contains([]string{"NULL", "MISSING"}, strings.ToUpper(tokens[idx+1].Value)) {
+			check = "IS " + strings.ToUpper(tokens[idx+1].Value)
+			length = 1
+		}
+		if check == "" {
+			output = append(output, token)
+			continue
+		}
+		output = append(output, Token{Type: "NULLCHECK", Value: check})
+		idx += length
+	}
+	return output
+}
+
+// checkFilterValues ensures that lists are only compared with IN, which only takes a list,
+// that string patterns are strings, and that regular expressions compile
+func checkFilterValues(tokens []Token) error {
+	for idx := 0; idx+1 < len(tokens); idx++ {
+		if tokens[idx].Type != "OP" {
+			continue
+		}
+		op := tokens[idx].Value
+		value := tokens[idx+1]
+		if (op == "IN") != (value.Type == "LIST") || (value.Type == "REGEX" && op != "MATCHES") {
+			return errors.New(fmt.Sprintf("Invalid filter value %v for operator %v", value.Value, op))
+		}
+		if utils.Contains([]string{"LIKE", "ILIKE", "STARTSWITH", "MATCHES"}, op) && value.Type != "STRING" && value.Type != "REGEX" {
+			return errors.New(fmt.Sprintf("Invalid filter value %v for operator %v, patterns must be strings", value.Value, op))
+		}
+		if op == "MATCHES" {
+			if _, err := regexp.Compile(value.Value); err != nil {
+				return errors.New(fmt.Sprintf("Invalid regular expression %v: %v", value.Value, err))
+			}
+		}
+	}
+	return nil
+}
+
+// ParseFilter parses a filter expression on its own, such as the filter of a policy. Values may be
+// policy variables, which are left in the tree to be replaced when the filter is applied.
+func ParseFilter(input string) (Node, error) {
+	patterns, err := getPatterns()
+	if err != nil {
+		return Node{}, err
+	}
+	tokens := handleNullChecks(parseString("FILTER " + strings.TrimSpace(input)))
+	for idx := 1; idx < len(tokens); idx++ {
+		if tokens[idx-1].Type == "OP" && tokens[idx].Type == "FIELD" && strings.HasPrefix(tokens[idx].Value, POLICY_VARIABLE) {
+			tokens[idx].Type = "STRING"
+		}
+	}
+	actionString, actionSyntax := describeTokens(tokens)
+	if err := checkPattern(actionString, actionSyntax, patterns["FILTER"].(string)); err != nil {
+		return Node{}, err
+	}
+	if err := checkFilterValues(tokens[1:]); err != nil {
+		return Node{}, err
+	}
+	return handleConditionals(tokens[1:]), nil
+}
+
 // Parse a list or dictionary into the action's data field
 func handleData(token Token, currentAction *Action) error {
 	if token.Type == "LIST" {
 		var d interface{}
-		err := json.Unmarshal([]byte(token.Value), &d)
+		err := utils.DecodeJSON([]byte(token.Value), &d)
 		if err != nil {
 			return err
 		}
@@ -277,7 +457,7 @@ func handleData(token Token, currentAction *Action) error {
 		currentAction.Data = tmp
 	} else {
 		var d interface{}
-		err := json.Unmarshal([]byte(token.Value), &d)
+		err := utils.DecodeJSON([]byte(token.Value), &d)
 		if err != nil {
 			return err
 		}
@@ -326,6 +506,181 @@ func handleFields(token Token, currentAction *Action) error {
 	return nil
 }
 
+// handleIndexKeywords retypes INDEX, UNIQUE, and TEXT where they are used as keywords. They are only
+// keywords within index actions so that they can still be used as field names elsewhere.
+func handleIndexKeywords(tokenAction []Token) {
+	if len(tokenAction) < 2 || !utils.Contains([]string{"GET", "POST", "PUT", "PATCH", "DELETE"}, tokenAction[0].Type) {
+		return
+	}
+	if tokenAction[1].Type != "FIELD" || strings.ToUpper(tokenAction[1].Value) != "INDEX" {
+		return
+	}
+	tokenAction[1].Type = "RESOURCE"
+	tokenAction[1].Value = "INDEX"
+	if len(tokenAction) != 5 || tokenAction[4].Type != "FIELD" {
+		return
+	}
+	keyword := strings.ToUpper(tokenAction[4].Value)
+	if (tokenAction[0].Type == "POST" && (keyword == "UNIQUE" || keyword == "TEXT")) || (tokenAction[0].Type == "DELETE" && keyword == "TEXT") {
+		tokenAction[4].Type = keyword
+		tokenAction[4].Value = keyword
+	}
+}
+
+// handleResourceKeywords retypes KEY, POLICY and ROLE where they are the resource of an action. Like
+// INDEX they are only keywords in this position so that they can still be used as field names.
+func handleResourceKeywords(tokenAction []Token) {
+	if len(tokenAction) < 2 || !utils.Contains([]string{"GET", "POST", "PUT", "PATCH", "DELETE"}, tokenAction[0].Type) {
+		return
+	}
+	resource := strings.ToUpper(tokenAction[1].Value)
+	if tokenAction[1].Type == "FIELD" && utils.Contains([]string{"KEY", "POLICY", "ROLE"}, resource) {
+		tokenAction[1].Type = "RESOURCE"
+		tokenAction[1].Value = resource
+	}
+}
+
+// handleSearchKeyword retypes SEARCH when it starts an action. Like OFFSET it is only a keyword in
+// this position so that it can still be used as a field name.
+func handleSearchKeyword(tokenAction []Token) {
+	if len(tokenAction) == 0 || tokenAction[0].Type != "FIELD" || strings.ToUpper(tokenAction[0].Value) != "SEARCH" {
+		return
+	}
+	tokenAction[0].Type = "SEARCH"
+	tokenAction[0].Value = "SEARCH"
+}
+
+// handleDryRunKeyword retypes the DRYRUN keyword which can follow PUT COLLECTION. Like INDEX it is
+// only a keyword in this position so that it can still be used as a field name.
+func handleDryRunKeyword(tokenAction []Token) {
+	if len(tokenAction) != 5 || tokenAction[0].Type != "PUT" || tokenAction[1].Value != "COLLECTION" {
+		return
+	}
+	if tokenAction[4].Type == "FIELD" && strings.ToUpper(tokenAction[4].Value) == "DRYRUN" {
+		tokenAction[4].Type = "DRYRUN"
+		tokenAction[4].Value = "DRYRUN"
+	}
+}
+
+// handlePageKeywords retypes OFFSET and AFTER when they start an action. They are only keywords
+// in this position so that they can still be used as field names.
+func handlePageKeywords(tokenAction []Token) {
+	if len(tokenAction) == 0 || tokenAction[0].Type != "FIELD" {
+		return
+	}
+	switch strings.ToUpper(tokenAction[0].Value) {
+	case "OFFSET":
+		tokenAction[0].Type = "OFFSET"
+		tokenAction[0].Value = "OFFSET"
+	case "AFTER":
+		tokenAction[0].Type = "AFTER"
+		tokenAction[0].Value = "AFTER"
+	}
+}
+
+// aggregateFunctions are the functions which can be used in an AGGREGATE action besides COUNT
+var aggregateFunctions = []string{"SUM", "AVG", "MIN", "MAX", "DISTINCT"}
+
+// handleAggregateKeywords retypes AGGREGATE, its functions, and BY within an AGGREGATE action.
+// Functions other than COUNT are followed by the field they apply to, so a field can share a
+// function's name.
+func handleAggregateKeywords(tokenAction []Token) {
+	if len(tokenAction) == 0 || tokenAction[0].Type != "FIELD" || strings.ToUpper(tokenAction[0].Value) != "AGGREGATE" {
+		return
+	}
+	tokenAction[0].Type = "AGGREGATE"
+	tokenAction[0].Value = "AGGREGATE"
+	for idx := 1; idx < len(tokenAction); idx++ {
+		value := strings.ToUpper(tokenAction[idx].Value)
+		if tokenAction[idx].Type != "FIELD" {
+			continue
+		}
+		if value == "BY" {
+			tokenAction[idx].Type = "BY"
+			tokenAction[idx].Value = "BY"
+			return
+		}
+		if utils.Contains(aggregateFunctions, value) {
+			tokenAction[idx].Type = "FUNCTION"
+			tokenAction[idx].Value = value
+			idx++
+		}
+	}
+}
+
+// handleJoinKeywords retypes JOIN and the ON, AS, and FLATTEN keywords within a JOIN action
+func handleJoinKeywords(tokenAction []Token) {
+	if len(tokenAction) < 3 || tokenAction[0].Type != "FIELD" || strings.ToUpper(tokenAction[0].Value) != "JOIN" {
+		return
+	}
+	tokenAction[0].Type = "JOIN"
+	tokenAction[0].Value = "JOIN"
+	keywords := map[int]string{2: "ON", 6: "AS"}
+	if len(tokenAction) == 7 || len(tokenAction) == 9 {
+		keywords[len(tokenAction)-1] = "FLATTEN"
+	}
+	for idx, keyword := range keywords {
+		if idx < len(tokenAction) && tokenAction[idx].Type == "FIELD" && strings.ToUpper(tokenAction[idx].Value) == keyword {
+			tokenAction[idx].Type = keyword
+			tokenAction[idx].Value = keyword
+		}
+	}
+}
+
+// handleOrderKeywords lets ORDERASC and ORDERDSC order on the count field returned by AGGREGATE
+func handleOrderKeywords(tokenAction []Token) {
+	if len(tokenAction) != 2 || (tokenAction[0].Type != "ORDERASC" && tokenAction[0].Type != "ORDERDSC") {
+		return
+	}
+	if tokenAction[1].Type == "COUNT" {
+		tokenAction[1].Type = "FIELD"
+		tokenAction[1].Value = "count"
+	}
+}
+
+// handleAggregates parses the functions and grouping of an AGGREGATE action
+func handleAggregates(tokens []Token, currentAction *Action) error {
+	for idx := 0; idx < len(tokens); idx++ {
+		switch tokens[idx].Type {
+		case "COUNT":
+			currentAction.Aggregates = append(currentAction.Aggregates, Aggregate{Function: "COUNT"})
+		case "FUNCTION":
+			idx++
+			currentAction.Aggregates = append(currentAction.Aggregates, Aggregate{Function: tokens[idx-1].Value, Field: tokens[idx].Value})
+		case "BY":
+			idx++
+			if tokens[idx].Type != "LIST" {
+				currentAction.Group = []string{tokens[idx].Value}
+				continue
+			}
+			var d interface{}
+			if err := json.Unmarshal([]byte(tokens[idx].Value), &d); err != nil {
+				return err
+			}
+			for _, v := range d.([]interface{}) {
+				field, ok := v.(string)
+				if !ok {
+					return errors.New(fmt.Sprintf("Invalid group field %v", v))
+				}
+				currentAction.Group = append(currentAction.Group, field)
+			}
+		}
+	}
+	return nil
+}
+
+// canFuseAggregate reports whether an AGGREGATE can read the records of the GET before it
+// itself, which lets it answer from the collection's indices without reading every record
+func canFuseAggregate(action Action) bool {
+	if action.Type != "GET" || action.Resource != "RECORD" {
+		return false
+	}
+	if action.Limit != 0 || action.Offset != 0 || action.After != "" || action.Search.Field != "" {
+		return false
+	}
+	return len(action.Fields) == 0 || action.Fields[0] == "*"
+}
+
 // buildActions takes a list of tokens and figures out which actions should be created to operate
 // within Ceres.
 func buildActions(tokens []Token, patterns map[string]interface{}) ([]Action, error) {
@@ -350,20 +705,19 @@ func buildActions(tokens []Token, patterns map[string]interface{}) ([]Action, er
 	// Look through each action list and build/modify the action object from it
 	// TODO: break each "case" out into its own function for readability/maintainability
 	for _, tokenAction := range tokenActions {
-		command := tokenAction[0]
-		actionString := ""
-		actionSyntax := ""
-		for _, token := range tokenAction {
-			actionString += token.Type + " "
-			if token.Type != "STRING" {
-				actionSyntax += token.Value
-			} else {
-				actionSyntax += "\"" + token.Value + "\""
-			}
-			actionSyntax += " "
+		handlePageKeywords(tokenAction)
+		handleIndexKeywords(tokenAction)
+		handleResourceKeywords(tokenAction)
+		handleDryRunKeyword(tokenAction)
+		handleAggregateKeywords(tokenAction)
+		handleOrderKeywords(tokenAction)
+		handleJoinKeywords(tokenAction)
+		handleSearchKeyword(tokenAction)
+		if tokenAction[0].Type == "FILTER" {
+			tokenAction = handleNullChecks(tokenAction)
 		}
-		actionString = actionString[:len(actionString)-1]
-		actionSyntax = actionSyntax[:len(actionSyntax)-1]
+		command := tokenAction[0]
+		actionString, actionSyntax := describeTokens(tokenAction)
 
 		switch command.Type {
 		case "GET":
@@ -381,7 +735,7 @@ func buildActions(tokens []Token, patterns map[string]interface{}) ([]Action, er
 			currentAction = Action{Type: "GET"}
 			currentAction.Resource = tokenAction[1].Value
 
-			if currentAction.Resource == "USER" {
+			if currentAction.Resource == "USER" || currentAction.Resource == "KEY" || currentAction.Resource == "ROLE" {
 				if len(tokenAction) > 2 {
 					if err := handleFields(tokenAction[2], &currentAction); err != nil {
 						return nil, err
@@ -398,6 +752,13 @@ func buildActions(tokens []Token, patterns map[string]interface{}) ([]Action, er
 					}
 				}
 			}
+			if len(currentAction.Fields) > 0 {
+				projection, err := ParseProjection(currentAction.Fields)
+				if err != nil {
+					return nil, err
+				}
+				currentAction.Projection = projection
+			}
 
 			firstFlag = false
 		case "POST":
@@ -415,7 +776,12 @@ func buildActions(tokens []Token, patterns map[string]interface{}) ([]Action, er
 			currentAction = Action{Type: "POST"}
 			currentAction.Resource = tokenAction[1].Value
 
-			if currentAction.Resource == "USER" {
+			if currentAction.Resource == "INDEX" {
+				currentAction.Identifier = tokenAction[2].Value
+				currentAction.Fields = []string{tokenAction[3].Value}
+				currentAction.Unique = len(tokenAction) > 4 && tokenAction[4].Type == "UNIQUE"
+				currentAction.Text = len(tokenAction) > 4 && tokenAction[4].Type == "TEXT"
+			} else if currentAction.Resource == "USER" || currentAction.Resource == "KEY" || currentAction.Resource == "ROLE" {
 				if len(tokenAction) > 2 {
 					if err := handleData(tokenAction[2], &currentAction); err != nil {
 						return nil, err
@@ -449,7 +815,7 @@ func buildActions(tokens []Token, patterns map[string]interface{}) ([]Action, er
 			currentAction = Action{Type: "PUT"}
 			currentAction.Resource = tokenAction[1].Value
 
-			if currentAction.Resource == "USER" {
+			if currentAction.Resource == "USER" || currentAction.Resource == "KEY" || currentAction.Resource == "ROLE" {
 				if len(tokenAction) > 2 {
 					if err := handleData(tokenAction[2], &currentAction); err != nil {
 						return nil, err
@@ -465,6 +831,10 @@ func buildActions(tokens []Token, patterns map[string]interface{}) ([]Action, er
 						return nil, err
 					}
 				}
+
+				if len(tokenAction) > 4 && tokenAction[4].Type == "DRYRUN" {
+					currentAction.DryRun = true
+				}
 			}
 
 			firstFlag = false
@@ -513,7 +883,11 @@ func buildActions(tokens []Token, patterns map[string]interface{}) ([]Action, er
 			currentAction = Action{Type: "DELETE"}
 			currentAction.Resource = tokenAction[1].Value
 
-			if currentAction.Resource == "USER" {
+			if currentAction.Resource == "INDEX" {
+				currentAction.Identifier = tokenAction[2].Value
+				currentAction.Fields = []string{tokenAction[3].Value}
+				currentAction.Text = len(tokenAction) > 4
+			} else if currentAction.Resource == "USER" || currentAction.Resource == "KEY" || currentAction.Resource == "ROLE" {
 				if len(tokenAction) > 2 {
 					if err := handleIDs(tokenAction[2], &currentAction); err != nil {
 						return nil, err
@@ -542,12 +916,62 @@ func buildActions(tokens []Token, patterns map[string]interface{}) ([]Action, er
 			}
 			currentAction = Action{Type: "COUNT"}
 			firstFlag = false
+		case "JOIN":
+			if !firstFlag {
+				actions = append(actions, currentAction)
+			}
+			pattern := patterns["JOIN"].(string)
+			if err := checkPattern(actionString, actionSyntax, pattern); err != nil {
+				return nil, err
+			}
+			if tokenAction[4].Value != "=" {
+				return nil, errors.New(fmt.Sprintf("Invalid join operator %v, records can only be joined on equal fields", tokenAction[4].Value))
+			}
+			currentAction = Action{Type: "JOIN", Resource: "RECORD", Identifier: tokenAction[1].Value}
+			currentAction.Join = Join{Left: tokenAction[3].Value, Right: tokenAction[5].Value}
+			currentAction.Join.As = strings.Split(tokenAction[1].Value, ".")[1]
+			if len(tokenAction) > 7 && tokenAction[6].Type == "AS" {
+				currentAction.Join.As = tokenAction[7].Value
+			}
+			currentAction.Join.Flatten = tokenAction[len(tokenAction)-1].Type == "FLATTEN"
+			firstFlag = false
+		case "AGGREGATE":
+			pattern := patterns["AGGREGATE"].(string)
+			if err := checkPattern(actionString, actionSyntax, pattern); err != nil {
+				return nil, err
+			}
+			source := currentAction
+			if !firstFlag && !canFuseAggregate(source) {
+				actions = append(actions, currentAction)
+			}
+			currentAction = Action{Type: "AGGREGATE"}
+			if !firstFlag && canFuseAggregate(source) {
+				currentAction.Resource = source.Resource
+				currentAction.Identifier = source.Identifier
+				currentAction.Filter = source.Filter
+			}
+			if err := handleAggregates(tokenAction[1:], &currentAction); err != nil {
+				return nil, err
+			}
+			firstFlag = false
 		case "FILTER":
 			pattern := patterns["FILTER"].(string)
 			if err := checkPattern(actionString, actionSyntax, pattern); err != nil {
 				return nil, err
 			}
+			if err := checkFilterValues(tokenAction[1:]); err != nil {
+				return nil, err
+			}
 			currentAction.Filter = handleConditionals(tokenAction[1:])
+		case "SEARCH":
+			pattern := patterns["SEARCH"].(string)
+			if err := checkPattern(actionString, actionSyntax, pattern); err != nil {
+				return nil, err
+			}
+			if currentAction.Type != "GET" || currentAction.Resource != "RECORD" {
+				return nil, errors.New("SEARCH can only follow GET RECORD")
+			}
+			currentAction.Search = Search{Field: tokenAction[1].Value, Terms: tokenAction[2].Value}
 		case "LIMIT":
 			pattern := patterns["LIMIT"].(string)
 			if err := checkPattern(actionString, actionSyntax, pattern); err != nil {
@@ -558,6 +982,25 @@ func buildActions(tokens []Token, patterns map[string]interface{}) ([]Action, er
 				return nil, err
 			}
 			currentAction.Limit = val
+		case "OFFSET":
+			pattern := patterns["OFFSET"].(string)
+			if err := checkPattern(actionString, actionSyntax, pattern); err != nil {
+				return nil, err
+			}
+			val, err := strconv.Atoi(tokenAction[1].Value)
+			if err != nil {
+				return nil, err
+			}
+			if val < 0 {
+				return nil, errors.New(fmt.Sprintf("Invalid offset %v", val))
+			}
+			currentAction.Offset = val
+		case "AFTER":
+			pattern := patterns["AFTER"].(string)
+			if err := checkPattern(actionString, actionSyntax, pattern); err != nil {
+				return nil, err
+			}
+			currentAction.After = tokenAction[1].Value
 		case "ORDERASC":
 			pattern := patterns["ORDERASC"].(string)
 			if err := checkPattern(actionString, actionSyntax, pattern); err != nil {
@@ -582,6 +1025,19 @@ func buildActions(tokens []Token, patterns map[string]interface{}) ([]Action, er
 			}
 			currentAction = Action{Type: "JQ"}
 			currentAction.JQ = tokenAction[1].Value
+		case "BEGIN", "COMMIT", "ROLLBACK":
+			if !firstFlag {
+				actions = append(actions, currentAction)
+			}
+			pattern, ok := patterns[command.Type].(string)
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("Invalid action type %v", command.Type))
+			}
+			if err := checkPattern(actionString, actionSyntax, pattern); err != nil {
+				return nil, err
+			}
+			currentAction = Action{Type: command.Type}
+			firstFlag = false
 		}
 	}
 	actions = append(actions, currentAction)
@@ -601,7 +1057,13 @@ func parseString(input string) []Token {
 		if idx > 0 {
 			look_behind = text[idx-1]
 		}
-		if char == "\"" && look_behind != "\\" && !flags.SingleQuote {
+		if flags.Regex {
+			// Regular expressions are read up to the next unescaped "/"
+			buffer += char
+			if char == "/" && look_behind != "\\" {
+				flags.Regex = false
+			}
+		} else if char == "\"" && look_behind != "\\" && !flags.SingleQuote {
 			flags.Quote = !flags.Quote
 			flags.DoubleQuote = !flags.DoubleQuote
 			buffer += char
@@ -657,6 +1119,11 @@ func parseString(input string) []Token {
 						tokens = append(tokens, child)
 						buffer = ""
 					}
+				case "/":
+					if buffer == "" && !flags.Bracket && !flags.Brace && !flags.Paren {
+						flags.Regex = true
+					}
+					buffer += char
 				case ",":
 					if flags.Bracket || flags.Brace || flags.Paren {
 						buffer += char
@@ -693,9 +1160,17 @@ func Parse(input string) ([]Action, error) {
 	if err != nil {
 		return nil, err
 	}
+	// A leading EXPLAIN asks how the rest of the query would be run rather than running it
+	explain := len(tokens) > 1 && strings.ToUpper(tokens[0].Value) == "EXPLAIN" && tokens[0].Type != "STRING"
+	if explain {
+		tokens = tokens[1:]
+	}
 	actions, err := buildActions(tokens, patterns)
 	if err != nil {
 		return nil, err
 	}
+	for idx := range actions {
+		actions[idx].Explain = explain
+	}
 	return actions, nil
 }
@@ -248,7 +248,7 @@ func TestGetPatterns(t *testing.T) {
 	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb/config/config.json")
 	config.ReadConfigFile()
 
-	expectedData := "^FILTER (?:LOGIC )?(?:(?:(?:LOGIC )?FIELD OP (?:STRING|INT|FLOAT|BOOL))|NESTED)(?: (?:LOGIC (?:LOGIC )?FIELD OP (?:STRING|INT|FLOAT|BOOL))|NESTED)*$"
+	expectedData := "^FILTER (?:LOGIC )?(?:(?:(?:LOGIC )?(?:(?:FIELD|IDENTIFIER) OP (?:STRING|INT|FLOAT|BOOL|LIST|REGEX)|EXISTS (?:FIELD|IDENTIFIER)|(?:FIELD|IDENTIFIER) NULLCHECK))|NESTED)(?: ?LOGIC ?)?(?: (?:LOGIC (?:LOGIC )?(?:(?:FIELD|IDENTIFIER) OP (?:STRING|INT|FLOAT|BOOL|LIST|REGEX)|EXISTS (?:FIELD|IDENTIFIER)|(?:FIELD|IDENTIFIER) NULLCHECK))|NESTED)*$"
 	var expectedError error
 	expectedError = nil
 
@@ -333,6 +333,20 @@ func TestHandleConditionals(t *testing.T) {
 	if node4.Value != "AND" {
 		t.Errorf("Incorrect node value, got: %v, want: %v", node4.Value, "AND")
 	}
+
+	tokens5 := []Token{{Type: "LOGIC", Value: "NOT"}, {Type: "EXISTS", Value: "EXISTS"}, {Type: "IDENTIFIER", Value: "meta.env"}, {Type: "LOGIC", Value: "AND"}, {Type: "FIELD", Value: "tags"}, {Type: "OP", Value: "IN"}, {Type: "LIST", Value: `["a"]`}}
+	node5 := handleConditionals(tokens5)
+
+	if node5.Value != "AND" || node5.Left.Value != "NOT" || node5.Left.Right.Value != "EXISTS" || node5.Left.Right.Left.Value != "meta.env" || node5.Right.Value != "IN" {
+		t.Errorf("Incorrect node value, got: %v, want: %v", node5, "NOT EXISTS meta.env AND tags IN [\"a\"]")
+	}
+
+	tokens6 := parseString("deleted IS NULL AND (is IS NOT NULL OR meta.env is missing)")
+	node6 := handleConditionals(tokens6)
+
+	if node6.Value != "AND" || node6.Left.Value != "IS NULL" || node6.Left.Left.Value != "deleted" || node6.Right.Value != "OR" || node6.Right.Left.Value != "IS NOT NULL" || node6.Right.Left.Left.Value != "is" || node6.Right.Right.Value != "IS MISSING" || node6.Right.Right.Left.Value != "meta.env" {
+		t.Errorf("Incorrect node value, got: %v, want: %v", node6, "deleted IS NULL AND (is IS NOT NULL OR meta.env IS MISSING)")
+	}
 }
 
 func TestHandleDataList(t *testing.T) {
@@ -1030,6 +1044,20 @@ func TestParseString(t *testing.T) {
 	if !reflect.DeepEqual(tokens, expectedTokens) {
 		t.Errorf("Tokens were incorrect, got: %v, want: %v", tokens, expectedTokens)
 	}
+
+	inputString = "FILTER path MATCHES /^a\\/b (c|d)$/"
+	expectedTokens = []Token{
+		{Type: "FILTER", Value: "FILTER"},
+		{Type: "FIELD", Value: "path"},
+		{Type: "OP", Value: "MATCHES"},
+		{Type: "REGEX", Value: "^a/b (c|d)$"},
+	}
+
+	tokens = parseString(inputString)
+
+	if !reflect.DeepEqual(tokens, expectedTokens) {
+		t.Errorf("Tokens were incorrect, got: %v, want: %v", tokens, expectedTokens)
+	}
 }
 
 func TestParse(t *testing.T) {
@@ -1044,6 +1072,350 @@ func TestParse(t *testing.T) {
 		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
 	}
 
+	inputString = "BEGIN | POST RECORD db.foo {\"foo\":\"bar\"} | COMMIT"
+
+	actions, err := Parse(inputString)
+
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+
+	expectedTypes := []string{"BEGIN", "POST", "COMMIT"}
+	actionTypes := []string{}
+	for _, action := range actions {
+		actionTypes = append(actionTypes, action.Type)
+	}
+
+	if !reflect.DeepEqual(actionTypes, expectedTypes) {
+		t.Errorf("Action types were incorrect, got: %v, want: %v", actionTypes, expectedTypes)
+	}
+
+	inputString = "POST INDEX db.foo address.city UNIQUE | GET INDEX db.foo"
+
+	actions, err = Parse(inputString)
+
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+
+	expectedAction := Action{Type: "POST", Resource: "INDEX", Identifier: "db.foo", Fields: []string{"address.city"}, Unique: true}
+	if len(actions) != 2 || !reflect.DeepEqual(actions[0], expectedAction) {
+		t.Errorf("Actions were incorrect, got: %v, want: %v", actions, expectedAction)
+	}
+
+	inputString = "POST INDEX db.foo body TEXT | DELETE INDEX db.foo body TEXT"
+
+	actions, err = Parse(inputString)
+
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+
+	expectedAction = Action{Type: "POST", Resource: "INDEX", Identifier: "db.foo", Fields: []string{"body"}, Text: true}
+	if len(actions) != 2 || !reflect.DeepEqual(actions[0], expectedAction) || !actions[1].Text {
+		t.Errorf("Actions were incorrect, got: %v, want: %v", actions, expectedAction)
+	}
+
+	inputString = "GET RECORD db.foo | FILTER search = \"x\" | SEARCH body \"quick fox\" | LIMIT 2"
+
+	actions, err = Parse(inputString)
+
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+
+	expectedSearch := Search{Field: "body", Terms: "quick fox"}
+	if len(actions) != 1 || actions[0].Search != expectedSearch || actions[0].Filter.Left.Value != "search" || actions[0].Limit != 2 {
+		t.Errorf("Actions were incorrect, got: %v, want: %v", actions, expectedSearch)
+	}
+
+	inputString = "GET USER | SEARCH body \"quick fox\""
+
+	_, err = Parse(inputString)
+
+	if err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "SEARCH can only follow GET RECORD")
+	}
+
+	inputString = "PUT COLLECTION db.foo {\"a\":\"STRING\"} DRYRUN"
+
+	actions, err = Parse(inputString)
+
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+
+	if len(actions) != 1 || !actions[0].DryRun || actions[0].Resource != "COLLECTION" {
+		t.Errorf("Actions were incorrect, got: %v, want: %v", actions, "PUT COLLECTION with DryRun")
+	}
+
+	inputString = "EXPLAIN GET RECORD db.foo | FILTER a = 1 AND b > 2 | DELETE RECORD db.foo -"
+
+	actions, err = Parse(inputString)
+
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+
+	if len(actions) != 2 || !actions[0].Explain || !actions[1].Explain || actions[0].Filter.Value != "AND" || actions[1].Type != "DELETE" {
+		t.Errorf("Actions were incorrect, got: %v, want: %v", actions, "GET RECORD and DELETE RECORD with Explain")
+	}
+
+	inputString = "POST KEY {\"name\":\"ci\"} | GET KEY | DELETE KEY \"abc\""
+
+	actions, err = Parse(inputString)
+
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+
+	if len(actions) != 3 || actions[0].Resource != "KEY" || actions[0].Data[0]["name"] != "ci" || actions[1].Resource != "KEY" || !reflect.DeepEqual(actions[2].IDs, []string{"abc"}) {
+		t.Errorf("Actions were incorrect, got: %v, want: %v", actions, "POST, GET, and DELETE KEY")
+	}
+
+	inputString = "POST POLICY db.foo {\"name\":\"tenant\",\"role\":\"READ\",\"filter\":\"tenant = $user.tenant\"} | GET POLICY db.foo | DELETE POLICY db.foo \"tenant\""
+
+	actions, err = Parse(inputString)
+
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+
+	if len(actions) != 3 || actions[0].Resource != "POLICY" || actions[0].Identifier != "db.foo" || actions[0].Data[0]["name"] != "tenant" || actions[1].Resource != "POLICY" || !reflect.DeepEqual(actions[2].IDs, []string{"tenant"}) {
+		t.Errorf("Actions were incorrect, got: %v, want: %v", actions, "POST, GET, and DELETE POLICY")
+	}
+
+	inputString = "GET RECORD db.foo policy | FILTER policy = 1"
+
+	actions, err = Parse(inputString)
+
+	if err != nil || len(actions) != 1 || actions[0].Filter.Left.Value != "policy" {
+		t.Errorf("Actions were incorrect, got: %v, %v, want: %v", actions, err, "GET RECORD filtered on policy")
+	}
+
+	inputString = "POST ROLE {\"name\":\"auditor\",\"inherits\":[\"READ\"]} | GET ROLE name | DELETE ROLE \"abc\""
+
+	actions, err = Parse(inputString)
+
+	if err != nil || len(actions) != 3 || actions[0].Resource != "ROLE" || actions[0].Data[0]["name"] != "auditor" || !reflect.DeepEqual(actions[1].Fields, []string{"name"}) || !reflect.DeepEqual(actions[2].IDs, []string{"abc"}) {
+		t.Errorf("Actions were incorrect, got: %v, %v, want: %v", actions, err, "POST, GET, and DELETE ROLE")
+	}
+
+	inputString = "GET RECORD db.foo role | FILTER role = 1"
+
+	actions, err = Parse(inputString)
+
+	if err != nil || len(actions) != 1 || actions[0].Filter.Left.Value != "role" {
+		t.Errorf("Actions were incorrect, got: %v, %v, want: %v", actions, err, "GET RECORD filtered on role")
+	}
+
+	inputString = "GET RECORD db.foo key | FILTER key = 1"
+
+	actions, err = Parse(inputString)
+
+	if err != nil || len(actions) != 1 || actions[0].Filter.Left.Value != "key" {
+		t.Errorf("Actions were incorrect, got: %v, %v, want: %v", actions, err, "GET RECORD filtered on key")
+	}
+
+	inputString = "GET RECORD db.foo explain"
+
+	actions, err = Parse(inputString)
+
+	if err != nil || len(actions) != 1 || actions[0].Explain {
+		t.Errorf("Actions were incorrect, got: %v, %v, want: %v", actions, err, "GET RECORD without Explain")
+	}
+
+	inputString = "GET RECORD db.foo offset | LIMIT 10 | OFFSET 20 | AFTER 'abc'"
+
+	actions, err = Parse(inputString)
+
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+
+	if len(actions) != 1 || actions[0].Limit != 10 || actions[0].Offset != 20 || actions[0].After != "abc" || !reflect.DeepEqual(actions[0].Fields, []string{"offset"}) {
+		t.Errorf("Actions were incorrect, got: %v, want: %v", actions, "GET RECORD with Limit 10, Offset 20, and After abc")
+	}
+
+	inputString = "GET RECORD db.foo * | FILTER a = 1 | AGGREGATE COUNT SUM price MAX sum BY [\"category\",\"region\"] | ORDERDSC count"
+
+	actions, err = Parse(inputString)
+
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+
+	expectedAggregates := []Aggregate{{Function: "COUNT"}, {Function: "SUM", Field: "price"}, {Function: "MAX", Field: "sum"}}
+	if len(actions) != 1 || actions[0].Type != "AGGREGATE" || actions[0].Identifier != "db.foo" || actions[0].Filter.Value != "=" || actions[0].Order != "count" {
+		t.Errorf("Actions were incorrect, got: %v, want: %v", actions, "AGGREGATE on db.foo ordered by count")
+	} else if !reflect.DeepEqual(actions[0].Aggregates, expectedAggregates) || !reflect.DeepEqual(actions[0].Group, []string{"category", "region"}) {
+		t.Errorf("Aggregates were incorrect, got: %v %v, want: %v %v", actions[0].Aggregates, actions[0].Group, expectedAggregates, []string{"category", "region"})
+	}
+
+	inputString = "GET RECORD db.foo * | LIMIT 10 | AGGREGATE AVG price BY category"
+
+	actions, err = Parse(inputString)
+
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+
+	if len(actions) != 2 || actions[1].Identifier != "" || !reflect.DeepEqual(actions[1].Group, []string{"category"}) {
+		t.Errorf("Actions were incorrect, got: %v, want: %v", actions, "GET RECORD followed by AGGREGATE")
+	}
+
+	inputString = "GET RECORD db.foo * | AGGREGATE BY category"
+
+	_, err = Parse(inputString)
+
+	if err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+
+	inputString = "GET RECORD db.orders * | JOIN db.customers ON customer.id = .id AS buyer FLATTEN"
+
+	actions, err = Parse(inputString)
+
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+
+	expectedJoin := Join{Left: "customer.id", Right: ".id", As: "buyer", Flatten: true}
+	if len(actions) != 2 || actions[1].Type != "JOIN" || actions[1].Resource != "RECORD" || actions[1].Identifier != "db.customers" || actions[1].Join != expectedJoin {
+		t.Errorf("Actions were incorrect, got: %v, want: %v", actions, expectedJoin)
+	}
+
+	inputString = "GET RECORD db.orders * | JOIN db.customers ON customer = id"
+
+	actions, err = Parse(inputString)
+
+	expectedJoin = Join{Left: "customer", Right: "id", As: "customers"}
+	if err != nil || len(actions) != 2 || actions[1].Join != expectedJoin {
+		t.Errorf("Actions were incorrect, got: %v %v, want: %v", actions, err, expectedJoin)
+	}
+
+	inputString = "GET RECORD db.orders * | JOIN db.customers ON customer < id"
+
+	_, err = Parse(inputString)
+
+	if err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+
+	inputString = `GET RECORD db.people ["address.city","tags[-1]","name AS n","price * (qty + 1) AS total"]`
+
+	actions, err = Parse(inputString)
+
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+
+	expectedNames := []string{"address.city", "tags[-1]", "n", "total"}
+	if len(actions) != 1 || len(actions[0].Projection) != len(expectedNames) {
+		t.Errorf("Projection was incorrect, got: %v, want: %v", actions, expectedNames)
+	} else {
+		for idx, name := range expectedNames {
+			if actions[0].Projection[idx].Name != name {
+				t.Errorf("Projection name was incorrect, got: %v, want: %v", actions[0].Projection[idx].Name, name)
+			}
+		}
+		expectedSteps := []PathStep{{Key: "tags"}, {Index: -1, IsIndex: true}}
+		if !reflect.DeepEqual(actions[0].Projection[1].Expr.Steps, expectedSteps) {
+			t.Errorf("Path was incorrect, got: %v, want: %v", actions[0].Projection[1].Expr.Steps, expectedSteps)
+		}
+		if total := actions[0].Projection[3].Expr; total.Op != "*" || total.Args[1].Op != "+" {
+			t.Errorf("Expression was incorrect, got: %v, want: %v", total, "price * (qty + 1)")
+		}
+	}
+
+	inputString = "GET RECORD db.people address.city"
+
+	actions, err = Parse(inputString)
+
+	if err != nil || len(actions) != 1 || len(actions[0].Projection) != 1 || actions[0].Projection[0].Expr.Op != "PATH" {
+		t.Errorf("Actions were incorrect, got: %v %v, want: %v", actions, err, "address.city")
+	}
+
+	inputString = `GET RECORD db.people ["price * (qty"]`
+
+	_, err = Parse(inputString)
+
+	if err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+
+	inputString = "GET RECORD db.foo * | FILTER tags CONTAINS \"x\""
+
+	actions, err = Parse(inputString)
+
+	if err != nil || len(actions) != 1 || actions[0].Filter.Value != "CONTAINS" || actions[0].Filter.Right.Value != "x" {
+		t.Errorf("Actions were incorrect, got: %v %v, want: %v", actions, err, "tags CONTAINS x")
+	}
+
+	if err := checkFilterValues([]Token{{Type: "FIELD", Value: "a"}, {Type: "OP", Value: "IN"}, {Type: "STRING", Value: "b"}}); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+
+	if err := checkFilterValues([]Token{{Type: "FIELD", Value: "a"}, {Type: "OP", Value: "IN"}, {Type: "LIST", Value: `["b"]`}}); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+
+	inputString = "GET RECORD db.foo * | FILTER name ILIKE \"al%\""
+
+	actions, err = Parse(inputString)
+
+	if err != nil || len(actions) != 1 || actions[0].Filter.Value != "ILIKE" || actions[0].Filter.Right.Value != "al%" {
+		t.Errorf("Actions were incorrect, got: %v %v, want: %v", actions, err, "name ILIKE al%")
+	}
+
+	if err := checkFilterValues([]Token{{Type: "FIELD", Value: "a"}, {Type: "OP", Value: "MATCHES"}, {Type: "REGEX", Value: "["}}); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+
+	if err := checkFilterValues([]Token{{Type: "FIELD", Value: "a"}, {Type: "OP", Value: "LIKE"}, {Type: "INT", Value: "1"}}); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+
+	inputString = "GET RECORD db.foo * | FILTER tags IN [\"a\", \"b\"] AND path MATCHES /^a+$/"
+
+	actions, err = Parse(inputString)
+
+	if err != nil || len(actions) != 1 || actions[0].Filter.Value != "AND" || actions[0].Filter.Left.Value != "IN" || actions[0].Filter.Right.Value != "MATCHES" || actions[0].Filter.Right.Right.Value != "^a+$" {
+		t.Errorf("Actions were incorrect, got: %v %v, want: %v", actions, err, "tags IN [a, b] AND path MATCHES /^a+$/")
+	}
+
+	inputString = "GET RECORD db.foo * | FILTER NOT EXISTS meta.env OR deleted IS NULL"
+
+	actions, err = Parse(inputString)
+
+	if err != nil || len(actions) != 1 || actions[0].Filter.Value != "OR" || actions[0].Filter.Left.Value != "NOT" || actions[0].Filter.Left.Right.Value != "EXISTS" || actions[0].Filter.Right.Value != "IS NULL" {
+		t.Errorf("Actions were incorrect, got: %v %v, want: %v", actions, err, "NOT EXISTS meta.env OR deleted IS NULL")
+	}
+
+	inputString = "GET RECORD db.foo * | FILTER deleted IS NOT NULL AND meta.env IS MISSING"
+
+	actions, err = Parse(inputString)
+
+	if err != nil || len(actions) != 1 || actions[0].Filter.Left.Value != "IS NOT NULL" || actions[0].Filter.Right.Value != "IS MISSING" || actions[0].Filter.Right.Left.Value != "meta.env" {
+		t.Errorf("Actions were incorrect, got: %v %v, want: %v", actions, err, "deleted IS NOT NULL AND meta.env IS MISSING")
+	}
+
+	inputString = "GET RECORD db.foo * | FILTER tags IN \"a\""
+
+	_, err = Parse(inputString)
+
+	if err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+
+	inputString = "GET RECORD db.foo * | OFFSET -1"
+
+	_, err = Parse(inputString)
+
+	if err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+
 	inputString = "GET RECORD"
 
 	_, err = Parse(inputString)
@@ -1061,3 +1433,48 @@ func TestParse(t *testing.T) {
 		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
 	}
 }
+
+func TestAccess(t *testing.T) {
+	access := Access{}
+	if access.Restricted() || access.Hidden("email") {
+		t.Errorf("Access was incorrect, got: %v, want: %v", access, "unrestricted")
+	}
+
+	access = Access{Deny: []string{"email"}}
+	for field, want := range map[string]bool{"email": true, "email.domain": true, "name": false, ".id": false} {
+		if got := access.Hidden(field); got != want {
+			t.Errorf("Hidden was incorrect for %v, got: %v, want: %v", field, got, want)
+		}
+	}
+
+	access = Access{Allow: []string{"name", "email"}, Deny: []string{"email"}}
+	for field, want := range map[string]bool{"name": false, "email": true, "age": true, ".id": false} {
+		if got := access.Hidden(field); got != want {
+			t.Errorf("Hidden was incorrect for %v, got: %v, want: %v", field, got, want)
+		}
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb/config/config.json")
+	config.ReadConfigFile()
+
+	node, err := ParseFilter("tenant = $user.tenant AND level < 3")
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if node.Value != "AND" || node.Left.Left.Value != "tenant" || node.Left.Right.Value != "$user.tenant" {
+		t.Errorf("Filter was incorrect, got: %v, want: %v", node, "tenant = $user.tenant AND level < 3")
+	}
+
+	node, err = ParseFilter("owner = \"bob\"")
+	if err != nil || node.Value != "=" || node.Right.Value != "bob" {
+		t.Errorf("Filter was incorrect, got: %v, %v, want: %v", node, err, "owner = bob")
+	}
+
+	for _, input := range []string{"", "tenant =", "tenant = other", "tenant IN $user.tenants"} {
+		if _, err := ParseFilter(input); err == nil {
+			t.Errorf("Error was incorrect for %v, got: %v, want: %v", input, err, "<non-nil>")
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// projection.go
+
+package aql
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Projection is a single entry in the field list of a GET action. It outputs the value of Expr
+// under Name, which is the entry's text unless it is given with AS. An entry of "*" outputs every
+// field of the record.
+type Projection struct {
+	Name string
+	Expr Expr
+}
+
+// Expr is an expression in a field list. Op is "PATH" for a field path, "LITERAL" for a constant,
+// "NEG" for negation, or the arithmetic operator applied to Args.
+type Expr struct {
+	Op    string
+	Path  string
+	Steps []PathStep
+	Value interface{}
+	Args  []Expr
+}
+
+// PathStep is a single step of a field path, either a key of a DICT or an index of a LIST.
+// Negative indices count back from the end of the list.
+type PathStep struct {
+	Key     string
+	Index   int
+	IsIndex bool
+}
+
+// ParseProjection parses the field list of a GET action
+func ParseProjection(fields []string) ([]Projection, error) {
+	output := make([]Projection, 0, len(fields))
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "*" {
+			output = append(output, Projection{Name: "*"})
+			continue
+		}
+		p := projectionParser{}
+		if err := p.lex(field); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid field '%v', %v", field, err))
+		}
+		projection, err := p.parseProjection(field)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid field '%v', %v", field, err))
+		}
+		output = append(output, projection)
+	}
+	return output, nil
+}
+
+// ParsePath splits a field path such as "address.city" or "tags[0]" into its steps
+func ParsePath(path string) ([]PathStep, error) {
+	steps := make([]PathStep, 0)
+	for _, part := range strings.Split(path, ".") {
+		key := part
+		indices := ""
+		if idx := strings.Index(part, "["); idx != -1 {
+			key = part[:idx]
+			indices = part[idx:]
+		}
+		if key != "" {
+			steps = append(steps, PathStep{Key: key})
+		}
+		for indices != "" {
+			end := strings.Index(indices, "]")
+			if indices[0] != '[' || end == -1 {
+				return nil, errors.New(fmt.Sprintf("invalid list index in '%v'", path))
+			}
+			index, err := strconv.Atoi(indices[1:end])
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid list index in '%v'", path))
+			}
+			steps = append(steps, PathStep{Index: index, IsIndex: true})
+			indices = indices[end+1:]
+		}
+	}
+	if len(steps) == 0 {
+		return nil, errors.New(fmt.Sprintf("invalid path '%v'", path))
+	}
+	return steps, nil
+}
+
+type projectionToken struct {
+	kind  string
+	value string
+}
+
+type projectionParser struct {
+	tokens []projectionToken
+	pos    int
+}
+
+func isPathChar(char byte) bool {
+	return char == '_' || char == '-' || char == '.' || char == '[' || char == ']' ||
+		(char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9')
+}
+
+// lex splits an entry into operators, strings, and words. A "-" inside a word is part of a field
+// name, so subtraction has to be surrounded by spaces.
+func (p *projectionParser) lex(input string) error {
+	for idx := 0; idx < len(input); {
+		char := input[idx]
+		switch {
+		case char == ' ' || char == '\t':
+			idx++
+		case strings.IndexByte("+-*/%()", char) != -1:
+			p.tokens = append(p.tokens, projectionToken{kind: "OP", value: string(char)})
+			idx++
+		case char == '"' || char == '\'':
+			end := strings.IndexByte(input[idx+1:], char)
+			if end == -1 {
+				return errors.New("unterminated string")
+			}
+			p.tokens = append(p.tokens, projectionToken{kind: "STRING", value: input[idx+1 : idx+1+end]})
+			idx += end + 2
+		case isPathChar(char):
+			start := idx
+			for idx < len(input) && isPathChar(input[idx]) {
+				idx++
+			}
+			p.tokens = append(p.tokens, projectionToken{kind: "WORD", value: input[start:idx]})
+		default:
+			return errors.New(fmt.Sprintf("unexpected character '%c'", char))
+		}
+	}
+	return nil
+}
+
+func (p *projectionParser) peek() projectionToken {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return projectionToken{}
+}
+
+func (p *projectionParser) isOp(ops string) bool {
+	token := p.peek()
+	return token.kind == "OP" && strings.Contains(ops, token.value)
+}
+
+func (p *projectionParser) parseProjection(field string) (Projection, error) {
+	expr, err := p.parseExpr()
+	if err != nil {
+		return Projection{}, err
+	}
+	projection := Projection{Name: field, Expr: expr}
+	if token := p.peek(); token.kind == "WORD" && strings.ToUpper(token.value) == "AS" {
+		p.pos++
+		name := p.peek()
+		if name.kind != "WORD" && name.kind != "STRING" {
+			return Projection{}, errors.New("expected a name after AS")
+		}
+		projection.Name = name.value
+		p.pos++
+	}
+	if p.pos < len(p.tokens) {
+		return Projection{}, errors.New(fmt.Sprintf("unexpected '%v'", p.peek().value))
+	}
+	return projection, nil
+}
+
+func (p *projectionParser) parseExpr() (Expr, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return Expr{}, err
+	}
+	for p.isOp("+-") {
+		op := p.peek().value
+		p.pos++
+		right, err := p.parseTerm()
+		if err != nil {
+			return Expr{}, err
+		}
+		left = Expr{Op: op, Args: []Expr{left, right}}
+	}
+	return left, nil
+}
+
+func (p *projectionParser) parseTerm() (Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return Expr{}, err
+	}
+	for p.isOp("*/%") {
+		op := p.peek().value
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return Expr{}, err
+		}
+		left = Expr{Op: op, Args: []Expr{left, right}}
+	}
+	return left, nil
+}
+
+func (p *projectionParser) parseUnary() (Expr, error) {
+	if p.isOp("-") {
+		p.pos++
+		arg, err := p.parseUnary()
+		if err != nil {
+			return Expr{}, err
+		}
+		return Expr{Op: "NEG", Args: []Expr{arg}}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *projectionParser) parsePrimary() (Expr, error) {
+	token := p.peek()
+	p.pos++
+	switch token.kind {
+	case "STRING":
+		return Expr{Op: "LITERAL", Value: token.value}, nil
+	case "WORD":
+		if intVal, err := strconv.ParseInt(token.value, 10, 64); err == nil {
+			return Expr{Op: "LITERAL", Value: intVal}, nil
+		}
+		if floatVal, err := strconv.ParseFloat(token.value, 64); err == nil && token.value[0] >= '0' && token.value[0] <= '9' {
+			return Expr{Op: "LITERAL", Value: floatVal}, nil
+		}
+		switch token.value {
+		case "true":
+			return Expr{Op: "LITERAL", Value: true}, nil
+		case "false":
+			return Expr{Op: "LITERAL", Value: false}, nil
+		case "null":
+			return Expr{Op: "LITERAL", Value: nil}, nil
+		}
+		steps, err := ParsePath(token.value)
+		if err != nil {
+			return Expr{}, err
+		}
+		return Expr{Op: "PATH", Path: token.value, Steps: steps}, nil
+	case "OP":
+		if token.value == "(" {
+			expr, err := p.parseExpr()
+			if err != nil {
+				return Expr{}, err
+			}
+			if !p.isOp(")") {
+				return Expr{}, errors.New("expected ')'")
+			}
+			p.pos++
+			return expr, nil
+		}
+		return Expr{}, errors.New(fmt.Sprintf("unexpected '%v'", token.value))
+	}
+	return Expr{}, errors.New("unexpected end of field")
+}
@@ -0,0 +1,421 @@
+// audit.go
+
+// Package audit keeps a log of every query the server handles. Entries are appended to a file in
+// the home directory and chained together by hash, so that an entry which is changed or removed
+// breaks the chain. The log can be read through the read-only _audit database, which entries are
+// copied into before it is queried.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"ceresdb/aql"
+	"ceresdb/collection"
+	"ceresdb/config"
+	"ceresdb/database"
+	"ceresdb/index"
+	"ceresdb/logging"
+	"ceresdb/record"
+	"ceresdb/schema"
+	"ceresdb/utils"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LOG_FILE_NAME is the file in the home directory entries are appended to
+const LOG_FILE_NAME = "audit.log"
+
+// DATABASE and COLLECTION are where entries can be queried
+const DATABASE = "_audit"
+const COLLECTION = "log"
+
+// Schema is the schema of the collection entries are copied into. Verified is false for entries
+// whose hash does not match their contents or the entry before them. Queries and errors can be
+// longer than an indexed value is allowed to be, so they are left unindexed.
+var Schema = map[string]interface{}{
+	"sequence":      "INT",
+	"time":          "TIMESTAMP",
+	"username":      "STRING",
+	"source":        "STRING",
+	"action":        "STRING",
+	"query":         "ANY",
+	"identifiers":   "LIST",
+	"ids":           "LIST",
+	"authenticated": "BOOL",
+	"success":       "BOOL",
+	"error":         "ANY",
+	"previous":      "STRING",
+	"hash":          "STRING",
+	"verified":      "BOOL",
+}
+
+// Entry is a single query in the log. Username is who the query claimed to be, which is only
+// checked if Authenticated is set.
+type Entry struct {
+	Sequence      int      `json:"sequence"`
+	Time          string   `json:"time"`
+	Username      string   `json:"username"`
+	Source        string   `json:"source"`
+	Action        string   `json:"action"`
+	Query         string   `json:"query"`
+	Identifiers   []string `json:"identifiers"`
+	IDs           []string `json:"ids"`
+	Authenticated bool     `json:"authenticated"`
+	Success       bool     `json:"success"`
+	Error         string   `json:"error"`
+	Previous      string   `json:"previous"`
+	Hash          string   `json:"hash"`
+}
+
+// REDACTED replaces the values of password fields in the queries entries are recorded with
+const REDACTED = "[REDACTED]"
+
+// passwordPattern matches a password field in the JSON data of a query along with its value
+var passwordPattern = regexp.MustCompile(`("password"\s*:\s*)(?:"(?:[^"\\]|\\.)*"|[^\s,}\]]+)`)
+
+var mutex sync.Mutex
+var lastSequence int
+var lastHash string
+
+// synced is the sequence of the last entry copied into the _audit database, or -1 before it has
+// been read. syncedOffset is where that entry ends in the log and syncedHash is its hash, so only
+// the entries after it are read the next time.
+var synced = -1
+var syncedOffset int64
+var syncedHash string
+
+func logPath() string {
+	return filepath.Join(config.Config.HomeDir, LOG_FILE_NAME)
+}
+
+// computeHash returns the hash of an entry, which covers every field but the hash itself
+func computeHash(entry Entry) string {
+	entry.Hash = ""
+	entryBytes, _ := json.Marshal(entry)
+	sum := sha256.Sum256(entryBytes)
+	return hex.EncodeToString(sum[:])
+}
+
+// readEntries reads the entries of the log which start at or after offset, along with the offset
+// just past each of them. A final line which cannot be parsed was cut short while being written,
+// so it is left out and torn is set, while any other line which cannot be parsed is an error.
+func readEntries(offset int64) (entries []Entry, ends []int64, torn bool, err error) {
+	f, err := os.Open(logPath())
+	if os.IsNotExist(err) {
+		return []Entry{}, []int64{}, false, nil
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, nil, false, err
+	}
+	entries = make([]Entry, 0)
+	ends = make([]int64, 0)
+	reader := bufio.NewReader(f)
+	var invalid error
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return nil, nil, false, readErr
+		}
+		offset += int64(len(line))
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			if invalid != nil {
+				return nil, nil, false, invalid
+			}
+			var entry Entry
+			if err := json.Unmarshal(trimmed, &entry); err != nil {
+				invalid = errors.New(fmt.Sprintf("Invalid audit log entry after sequence %v: %v", lastEntrySequence(entries), err))
+			} else {
+				entries = append(entries, entry)
+				ends = append(ends, offset)
+			}
+		}
+		if readErr == io.EOF {
+			return entries, ends, invalid != nil, nil
+		}
+	}
+}
+
+func lastEntrySequence(entries []Entry) int {
+	if len(entries) == 0 {
+		return 0
+	}
+	return entries[len(entries)-1].Sequence
+}
+
+// verify reports for each entry whether its hash matches its contents and the entry before it,
+// where previous is the hash of the entry before the first
+func verify(entries []Entry, previous string) []bool {
+	verified := make([]bool, len(entries))
+	for idx, entry := range entries {
+		verified[idx] = entry.Previous == previous && entry.Hash == computeHash(entry)
+		previous = entry.Hash
+	}
+	return verified
+}
+
+// Load reads the end of the log so new entries can be chained to it. An entry which was cut short
+// while being written is cut off the log so the next entry starts on a line of its own. A broken
+// chain is returned as an error but the log can still be appended to.
+func Load() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	lastSequence, lastHash = 0, ""
+	synced, syncedOffset, syncedHash = -1, 0, ""
+	entries, ends, torn, err := readEntries(0)
+	if err != nil {
+		return err
+	}
+	size := int64(0)
+	if len(ends) > 0 {
+		size = ends[len(ends)-1]
+	}
+	if torn {
+		logging.WARN(fmt.Sprintf("Audit log entry after sequence %v was cut short while being written, removing it", lastEntrySequence(entries)))
+		if err := os.Truncate(logPath(), size); err != nil {
+			return err
+		}
+	}
+	if err := endLine(size); err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	lastSequence = entries[len(entries)-1].Sequence
+	lastHash = entries[len(entries)-1].Hash
+	for idx, ok := range verify(entries, "") {
+		if !ok {
+			return errors.New(fmt.Sprintf("audit log chain is broken at sequence %v", entries[idx].Sequence))
+		}
+	}
+	return nil
+}
+
+// endLine makes sure the log, which is size bytes long, ends with a newline, which a write cut
+// short just before it lacks
+func endLine(size int64) error {
+	if size == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(logPath(), os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, size-1); err != nil {
+		return err
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+	if _, err := f.WriteAt([]byte("\n"), size); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Redact replaces the values of password fields in a query, such as those of the users a query
+// creates or replaces, so that they are never written to the log
+func Redact(query string) string {
+	return passwordPattern.ReplaceAllString(query, `${1}"`+REDACTED+`"`)
+}
+
+// Record appends an entry to the log, chaining it to the entry before it. Passwords in the entry's
+// query are redacted first.
+func Record(entry Entry) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	entry.Query = Redact(entry.Query)
+	entry.Sequence = lastSequence + 1
+	entry.Time = time.Now().UTC().Format(time.RFC3339)
+	entry.Previous = lastHash
+	entry.Hash = computeHash(entry)
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(logPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// A write which fails partway is cut off so that the next entry starts on a line of its own
+	if _, err := f.Write(append(entryBytes, '\n')); err != nil {
+		f.Truncate(info.Size())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	lastSequence = entry.Sequence
+	lastHash = entry.Hash
+	return nil
+}
+
+// CheckDatabase creates the database and collection entries are queried from
+func CheckDatabase() error {
+	if !schema.DatabaseExists(DATABASE) {
+		if err := database.Post(DATABASE); err != nil {
+			return err
+		}
+	}
+	if _, ok := schema.GetCollection(DATABASE, COLLECTION); !ok {
+		return collection.Post(DATABASE, COLLECTION, Schema)
+	}
+	return nil
+}
+
+// Sync copies the entries which have been logged since the last sync into the _audit database.
+// The log is read from where the last synced entry ends, so each entry is only read once.
+func Sync() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if synced < 0 {
+		ids, err := index.All(DATABASE, COLLECTION)
+		if err != nil {
+			return err
+		}
+		data, err := record.Get(DATABASE, COLLECTION, utils.RemoveDuplicateValues(ids))
+		if err != nil {
+			return err
+		}
+		sequence := 0
+		for _, datum := range data {
+			if val, err := strconv.Atoi(utils.FormatValue(datum["sequence"])); err == nil && val > sequence {
+				sequence = val
+			}
+		}
+		entries, ends, _, err := readEntries(0)
+		if err != nil {
+			return err
+		}
+		syncedOffset, syncedHash = 0, ""
+		for idx, entry := range entries {
+			if entry.Sequence > sequence {
+				break
+			}
+			syncedOffset, syncedHash = ends[idx], entry.Hash
+		}
+		synced = sequence
+	}
+	entries, ends, _, err := readEntries(syncedOffset)
+	if err != nil {
+		return err
+	}
+	verified := verify(entries, syncedHash)
+	data := make([]map[string]interface{}, 0)
+	for idx, entry := range entries {
+		if entry.Sequence <= synced {
+			continue
+		}
+		data = append(data, document(entry, verified[idx]))
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	if len(data) > 0 {
+		if err := record.Post(DATABASE, COLLECTION, data); err != nil {
+			return err
+		}
+	}
+	last := len(entries) - 1
+	synced, syncedOffset, syncedHash = entries[last].Sequence, ends[last], entries[last].Hash
+	return nil
+}
+
+// document returns the record an entry is copied into the _audit database as
+func document(entry Entry, verified bool) map[string]interface{} {
+	identifiers := make([]interface{}, len(entry.Identifiers))
+	for idx, identifier := range entry.Identifiers {
+		identifiers[idx] = identifier
+	}
+	ids := make([]interface{}, len(entry.IDs))
+	for idx, id := range entry.IDs {
+		ids[idx] = id
+	}
+	return map[string]interface{}{
+		"sequence":      entry.Sequence,
+		"time":          entry.Time,
+		"username":      entry.Username,
+		"source":        entry.Source,
+		"action":        entry.Action,
+		"query":         entry.Query,
+		"identifiers":   identifiers,
+		"ids":           ids,
+		"authenticated": entry.Authenticated,
+		"success":       entry.Success,
+		"error":         entry.Error,
+		"previous":      entry.Previous,
+		"hash":          entry.Hash,
+		"verified":      verified,
+	}
+}
+
+// Targets reports whether an action runs against the _audit database
+func Targets(action aql.Action) bool {
+	return strings.Split(action.Identifier, ".")[0] == DATABASE
+}
+
+// Identifiers returns what each action of a query ran against
+func Identifiers(actions []aql.Action) []string {
+	identifiers := make([]string, 0)
+	for _, action := range actions {
+		if action.Resource == "" {
+			continue
+		}
+		identifier := action.Resource
+		if action.Identifier != "" {
+			identifier += " " + action.Identifier
+		}
+		identifiers = append(identifiers, identifier)
+	}
+	return utils.RemoveDuplicateValues(identifiers)
+}
+
+// RequestedIDs returns the ids of the records a write action asks to change, which a policy may
+// narrow further. The ids of new records are not known until they are written so posts have none.
+func RequestedIDs(action aql.Action, previousIDs []string, previousData []map[string]interface{}) []string {
+	if !utils.Contains([]string{"RECORD", "USER", "KEY", "ROLE", "PERMIT"}, action.Resource) {
+		return nil
+	}
+	switch action.Type {
+	case "PATCH", "DELETE":
+		if len(action.IDs) > 0 && action.IDs[0] == "-" {
+			return previousIDs
+		}
+		return action.IDs
+	case "PUT":
+		data := action.Data
+		if len(data) == 0 {
+			data = previousData
+		}
+		ids := make([]string, 0, len(data))
+		for _, datum := range data {
+			if id, ok := datum[".id"].(string); ok {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package audit
+
+import (
+	"ceresdb/aql"
+	"ceresdb/config"
+	"ceresdb/database"
+	"ceresdb/freespace"
+	"ceresdb/index"
+	"ceresdb/record"
+	"ceresdb/schema"
+	"ceresdb/utils"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRecord(t *testing.T) {
+	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb/config/config.json")
+	config.ReadConfigFile()
+	config.Config.HomeDir = t.TempDir()
+
+	if err := Load(); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	Record(Entry{Username: "foo", Action: "QUERY", Query: "DELETE RECORD db.bar \"abc\"", Success: true})
+	Record(Entry{Username: "foo", Action: "LOGIN", Error: "invalid password"})
+
+	entries, _, _, err := readEntries(0)
+	if err != nil || len(entries) != 2 {
+		t.Errorf("Entries were incorrect, got: %v, %v, want: %v", entries, err, "two entries")
+	}
+	if entries[0].Sequence != 1 || entries[1].Sequence != 2 || entries[1].Previous != entries[0].Hash {
+		t.Errorf("Entries were incorrect, got: %v, want: %v", entries, "entries chained in sequence")
+	}
+	if err := Load(); err != nil || lastSequence != 2 || lastHash != entries[1].Hash {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+
+	// Changing an entry breaks the chain
+	path := filepath.Join(config.Config.HomeDir, LOG_FILE_NAME)
+	contents, _ := os.ReadFile(path)
+	os.WriteFile(path, []byte(strings.Replace(string(contents), "db.bar", "db.baz", 1)), 0600)
+	if err := Load(); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+	entries, _, _, _ = readEntries(0)
+	if verified := verify(entries, ""); !reflect.DeepEqual(verified, []bool{false, true}) {
+		t.Errorf("Verified was incorrect, got: %v, want: %v", verified, []bool{false, true})
+	}
+}
+
+func TestTornEntry(t *testing.T) {
+	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb/config/config.json")
+	config.ReadConfigFile()
+	config.Config.HomeDir = t.TempDir()
+	path := filepath.Join(config.Config.HomeDir, LOG_FILE_NAME)
+
+	Load()
+	Record(Entry{Username: "foo", Action: "QUERY", Query: "GET DATABASE", Success: true})
+	Record(Entry{Username: "foo", Action: "QUERY", Query: "GET USER", Success: true})
+
+	// An entry cut short is left out and removed, and the chain carries on from the one before it
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	f.Write([]byte(`{"sequence":3,"ti`))
+	f.Close()
+	entries, _, torn, err := readEntries(0)
+	if err != nil || !torn || len(entries) != 2 {
+		t.Errorf("Entries were incorrect, got: %v, %v, %v, want: %v", len(entries), torn, err, "two entries and a torn line")
+	}
+	if err := Load(); err != nil || lastSequence != 2 {
+		t.Errorf("Load was incorrect, got: %v, %v, want: %v", err, lastSequence, "<nil>, 2")
+	}
+	Record(Entry{Username: "foo", Action: "QUERY", Query: "GET ROLE", Success: true})
+	entries, _, torn, err = readEntries(0)
+	if err != nil || torn || len(entries) != 3 || entries[2].Sequence != 3 || !reflect.DeepEqual(verify(entries, ""), []bool{true, true, true}) {
+		t.Errorf("Entries were incorrect, got: %v, %v, %v, want: %v", entries, torn, err, "three verified entries")
+	}
+
+	// An entry missing only its newline is kept and given one
+	contents, _ := os.ReadFile(path)
+	os.WriteFile(path, contents[:len(contents)-1], 0600)
+	if err := Load(); err != nil || lastSequence != 3 {
+		t.Errorf("Load was incorrect, got: %v, %v, want: %v", err, lastSequence, "<nil>, 3")
+	}
+	if repaired, _ := os.ReadFile(path); !reflect.DeepEqual(repaired, contents) {
+		t.Errorf("Log was incorrect, got: %q, want: %q", repaired, contents)
+	}
+
+	// Entries after the last one read are read from where it ends
+	all, ends, _, _ := readEntries(0)
+	entries, _, _, err = readEntries(ends[1])
+	if err != nil || len(entries) != 1 || entries[0].Sequence != 3 || !verify(entries, all[1].Hash)[0] {
+		t.Errorf("Entries were incorrect, got: %v, %v, want: %v", entries, err, "the third entry")
+	}
+}
+
+func TestSync(t *testing.T) {
+	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb/config/config.json")
+	config.ReadConfigFile()
+	freespace.LoadFreeSpace()
+	schema.LoadSchema()
+	config.Config.HomeDir = t.TempDir()
+	if err := CheckDatabase(); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	defer database.Delete(DATABASE)
+
+	records := func() []map[string]interface{} {
+		ids, _ := index.All(DATABASE, COLLECTION)
+		data, _ := record.Get(DATABASE, COLLECTION, utils.RemoveDuplicateValues(ids))
+		return data
+	}
+	Load()
+	Record(Entry{Username: "foo", Action: "QUERY", Query: "GET DATABASE", Success: true})
+	Record(Entry{Username: "foo", Action: "QUERY", Query: "GET USER", Success: true})
+	if err := Sync(); err != nil || len(records()) != 2 {
+		t.Errorf("Sync was incorrect, got: %v, %v, want: %v", len(records()), err, "2 records")
+	}
+
+	// Only entries after the last synced one are read and copied, still chained to it
+	offset := syncedOffset
+	Record(Entry{Username: "foo", Action: "QUERY", Query: "GET ROLE", Success: true})
+	if err := Sync(); err != nil || syncedOffset <= offset || synced != 3 {
+		t.Errorf("Sync was incorrect, got: %v, %v, %v, want: %v", syncedOffset, synced, err, "3 entries synced")
+	}
+	data := records()
+	if len(data) != 3 {
+		t.Errorf("Records were incorrect, got: %v, want: %v", data, "3 records")
+	}
+	for _, datum := range data {
+		if datum["verified"] != true {
+			t.Errorf("Record was incorrect, got: %v, want: %v", datum, "verified")
+		}
+	}
+
+	// Syncing again after loading finds where the synced entries end from the _audit database
+	Load()
+	if err := Sync(); err != nil || syncedOffset <= offset || len(records()) != 3 {
+		t.Errorf("Sync was incorrect, got: %v, %v, %v, want: %v", syncedOffset, len(records()), err, "3 records")
+	}
+}
+
+func TestRedact(t *testing.T) {
+	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb/config/config.json")
+	config.ReadConfigFile()
+	config.Config.HomeDir = t.TempDir()
+
+	queries := []string{
+		`POST USER {"username":"bob","password":"hunter2","role":"READ"}`,
+		`PUT USER [{".id":"abc","username":"bob", "password" : "\"hunter2","role":"READ"}]`,
+		`PATCH USER "abc" {"password":"hunter2"}`,
+	}
+	for _, query := range queries {
+		Record(Entry{Username: "admin", Action: "QUERY", Query: query, Success: true})
+	}
+	contents, _ := os.ReadFile(filepath.Join(config.Config.HomeDir, LOG_FILE_NAME))
+	if strings.Contains(string(contents), "hunter2") || strings.Count(string(contents), REDACTED) != len(queries) {
+		t.Errorf("Log was incorrect, got: %v, want: %v", string(contents), "every password redacted")
+	}
+	entries, _, _, _ := readEntries(0)
+	if len(entries) != len(queries) || entries[0].Query != `POST USER {"username":"bob","password":"[REDACTED]","role":"READ"}` {
+		t.Errorf("Entries were incorrect, got: %v, want: %v", entries, "queries with passwords redacted")
+	}
+	if query := Redact(`POST USER {"username":"bob","password":12345,"role":"READ"}`); strings.Contains(query, "12345") {
+		t.Errorf("Query was incorrect, got: %v, want: %v", query, "password redacted")
+	}
+}
+
+func TestIdentifiers(t *testing.T) {
+	actions := []aql.Action{
+		{Type: "GET", Resource: "RECORD", Identifier: "db.foo"},
+		{Type: "DELETE", Resource: "RECORD", Identifier: "db.foo", IDs: []string{"-"}},
+		{Type: "POST", Resource: "USER"},
+		{Type: "COUNT"},
+	}
+	identifiers := Identifiers(actions)
+	if !reflect.DeepEqual(identifiers, []string{"RECORD db.foo", "USER"}) {
+		t.Errorf("Identifiers were incorrect, got: %v, want: %v", identifiers, []string{"RECORD db.foo", "USER"})
+	}
+}
+
+func TestRequestedIDs(t *testing.T) {
+	previousIDs := []string{"a.0", "a.1"}
+	previousData := []map[string]interface{}{{".id": "a.0"}, {".id": "a.1"}}
+	tests := []struct {
+		action aql.Action
+		want   []string
+	}{
+		{aql.Action{Type: "DELETE", Resource: "RECORD", IDs: []string{"-"}}, previousIDs},
+		{aql.Action{Type: "PATCH", Resource: "RECORD", IDs: []string{"b.0"}}, []string{"b.0"}},
+		{aql.Action{Type: "PUT", Resource: "RECORD"}, previousIDs},
+		{aql.Action{Type: "PUT", Resource: "USER", Data: []map[string]interface{}{{".id": "c.0"}}}, []string{"c.0"}},
+		{aql.Action{Type: "POST", Resource: "RECORD"}, nil},
+		{aql.Action{Type: "DELETE", Resource: "POLICY", IDs: []string{"tenant"}}, nil},
+		{aql.Action{Type: "GET", Resource: "RECORD"}, nil},
+	}
+	for _, test := range tests {
+		if ids := RequestedIDs(test.action, previousIDs, previousData); !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("IDs were incorrect for %v %v, got: %v, want: %v", test.action.Type, test.action.Resource, ids, test.want)
+		}
+	}
+}
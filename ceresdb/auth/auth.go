@@ -2,13 +2,19 @@ package auth
 
 import (
 	"ceresdb/aql"
+	"ceresdb/audit"
 	"ceresdb/collection"
 	"ceresdb/config"
 	"ceresdb/database"
 	"ceresdb/manager"
+	"ceresdb/permit"
 	"ceresdb/record"
+	"ceresdb/role"
+	"ceresdb/schema"
+	"ceresdb/user"
 	"ceresdb/utils"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -28,7 +34,7 @@ func CheckAuthDatabase() error {
 	}
 	if !utils.Contains(databases, "_auth") {
 		database.Post("_auth")
-		collection.Post("_auth", "_users", map[string]interface{}{"username": "STRING", "password": "STRING", "role": "STRING"})
+		collection.Post("_auth", "_users", user.Schema)
 		defaultPassword := os.Getenv("CERESDB_DEFAULT_ADMIN_PASSWORD")
 		if defaultPassword == "" {
 			defaultPassword = "ceresdb"
@@ -43,6 +49,30 @@ func CheckAuthDatabase() error {
 			return err
 		}
 	}
+	// API keys were added after the _auth database, so older instances need their collection
+	if _, ok := schema.GetCollection("_auth", "_keys"); !ok {
+		if err := collection.Post("_auth", "_keys", user.KeySchema); err != nil {
+			return err
+		}
+	}
+	// As were custom roles
+	if _, ok := schema.GetCollection("_auth", "_roles"); !ok {
+		if err := collection.Post("_auth", "_roles", role.Schema); err != nil {
+			return err
+		}
+	}
+	// And user attributes
+	users, _ := schema.GetCollection("_auth", "_users")
+	if _, ok := users.Types["attributes"]; !ok {
+		newSchema := make(map[string]interface{})
+		for key, field := range users.AllFields() {
+			newSchema[key] = field.Document()
+		}
+		newSchema["attributes"] = user.Schema["attributes"]
+		if _, err := collection.Migrate("_auth", "_users", newSchema, false); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -60,179 +90,269 @@ func comparePasswords(hashedPassword string, plainPassword string) bool {
 	return true
 }
 
-func VerifyCredentials(username, password string) error {
-	nodeL := aql.Node{Value: "username"}
-	nodeR := aql.Node{Value: username}
-	nodeC := aql.Node{Value: "=", Left: &nodeL, Right: &nodeR}
-	getAction := aql.Action{Type: "GET", Resource: "USER", Filter: nodeC}
+// Session is an authenticated caller of the API. The user's role and their permits are read once
+// per request and reused for every action the request runs.
+type Session struct {
+	Username string
+	Role     string
+	permits  map[string]map[string]interface{}
+	// fields are the user's own fields which policies can refer to
+	fields map[string]interface{}
+	// definitions are the custom roles, see roles
+	definitions map[string]role.Definition
+}
+
+// lookupUser reads the record of a user by their username
+func lookupUser(username string) (map[string]interface{}, error) {
+	getAction := aql.Action{Type: "GET", Resource: "USER", Filter: fieldEquals("username", username)}
 	data, err := manager.ProcessAction(getAction, []string{}, []map[string]interface{}{}, true)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if len(data) != 1 {
-		return errors.New("user does not exist")
+		return nil, errors.New("user does not exist")
+	}
+	return data[0], nil
+}
+
+func fieldEquals(field, value string) aql.Node {
+	nodeL := aql.Node{Value: field}
+	nodeR := aql.Node{Value: value}
+	return aql.Node{Value: "=", Left: &nodeL, Right: &nodeR}
+}
+
+func VerifyCredentials(username, password string) error {
+	_, err := Authenticate(username+":"+password, "")
+	return err
+}
+
+// Authenticate verifies the credentials of a request, which are either a username and password
+// separated by a colon or a bearer token holding a session token or an API key
+func Authenticate(credentials, token string) (*Session, error) {
+	var username, password string
+	var err error
+	switch {
+	case token == "":
+		parts := strings.SplitN(credentials, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("invalid credentials")
+		}
+		username, password = parts[0], parts[1]
+	case user.IsKey(token):
+		getAction := aql.Action{Type: "GET", Resource: "KEY", Filter: fieldEquals("hash", user.HashKey(token))}
+		data, err := manager.ProcessAction(getAction, []string{}, []map[string]interface{}{}, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) != 1 {
+			return nil, errors.New("invalid API key")
+		}
+		username = data[0]["username"].(string)
+	default:
+		if username, err = verifySession(token); err != nil {
+			return nil, err
+		}
 	}
-	if !comparePasswords(data[0]["password"].(string), password) {
-		return errors.New("invalid password")
+	datum, err := lookupUser(username)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	// Only passwords need checking, tokens and keys were verified above
+	if token == "" && !comparePasswords(datum["password"].(string), password) {
+		return nil, errors.New("invalid password")
+	}
+	fields := make(map[string]interface{})
+	if attributes, ok := datum["attributes"].(map[string]interface{}); ok {
+		for key, val := range attributes {
+			fields[key] = val
+		}
+	}
+	fields["username"] = username
+	fields["role"] = datum["role"]
+	return &Session{Username: username, Role: datum["role"].(string), permits: make(map[string]map[string]interface{}), fields: fields}, nil
 }
 
-func VerifyUserAction(username, password string, action aql.Action) error {
-	dbLevel := []string{"RECORD", "COLLECTION", "PERMIT"}
-	nodeL := aql.Node{Value: "username"}
-	nodeR := aql.Node{Value: username}
-	nodeC := aql.Node{Value: "=", Left: &nodeL, Right: &nodeR}
-	getAction := aql.Action{Type: "GET", Resource: "USER", Filter: nodeC}
-	data, err := manager.ProcessAction(getAction, []string{}, []map[string]interface{}{}, true)
+// databasePermit returns the permit a session's user has on a database
+func (s *Session) databasePermit(database string) (map[string]interface{}, error) {
+	if datum, ok := s.permits[database]; ok {
+		return datum, nil
+	}
+	getAction := aql.Action{Type: "GET", Resource: "PERMIT", Identifier: database, Filter: fieldEquals("username", s.Username)}
+	data, err := manager.ProcessAction(getAction, []string{}, []map[string]interface{}{}, false)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if len(data) != 1 {
-		return errors.New("user does not exist")
+		return nil, errors.New("user is not permitted to access this database")
 	}
-	if !comparePasswords(data[0]["password"].(string), password) {
-		return errors.New("invalid password")
+	s.permits[database] = data[0]
+	return data[0], nil
+}
+
+// scope returns the role a session's user has for an action and the fields it can access. Record
+// and index actions are scoped to their collection, other resources to the database. The _audit
+// database has no permits, the user's own role is used instead.
+func (s *Session) scope(action aql.Action) (string, aql.Access, error) {
+	parts := strings.Split(action.Identifier, ".")
+	if parts[0] == audit.DATABASE {
+		return s.Role, aql.Access{}, nil
 	}
-	role := data[0]["role"].(string)
+	datum, err := s.databasePermit(parts[0])
+	if err != nil {
+		return "", aql.Access{}, err
+	}
+	col := ""
+	if len(parts) > 1 && (action.Resource == "RECORD" || action.Resource == "INDEX") {
+		col = parts[1]
+	}
+	return permit.Scope(datum, col)
+}
 
-	if utils.Contains(dbLevel, action.Resource) {
-		parts := strings.Split(action.Identifier, ".")
-		database := parts[0]
-		getAction := aql.Action{Type: "GET", Resource: "PERMIT", Identifier: database, Filter: nodeC}
-		data, err = manager.ProcessAction(getAction, []string{}, []map[string]interface{}{}, false)
+// FieldAccess returns the fields of a collection a session's user can access with a record action
+func FieldAccess(session *Session, action aql.Action) (aql.Access, error) {
+	if action.Resource != "RECORD" {
+		return aql.Access{}, nil
+	}
+	_, access, err := session.scope(action)
+	return access, err
+}
+
+// RowPolicy returns the filter the policies of a collection limit a session's user to for a record
+// action, or an empty node if none apply. A policy applies to the user it names or to users with
+// its role on the collection, and a record can be accessed if it matches any that apply.
+func RowPolicy(session *Session, action aql.Action) (aql.Node, error) {
+	parts := strings.Split(action.Identifier, ".")
+	if action.Resource != "RECORD" || len(parts) != 2 {
+		return aql.Node{}, nil
+	}
+	policies := schema.GetPolicies(parts[0], parts[1])
+	if len(policies) == 0 {
+		return aql.Node{}, nil
+	}
+	role, _, err := session.scope(action)
+	if err != nil {
+		return aql.Node{}, err
+	}
+	var combined aql.Node
+	for _, policy := range policies {
+		if policy.User != session.Username && (policy.User != "" || policy.Role != role) {
+			continue
+		}
+		node, err := aql.ParseFilter(policy.Filter)
 		if err != nil {
-			return err
+			return aql.Node{}, err
 		}
-		if len(data) != 1 {
-			return errors.New("user is not permitted to access this database")
+		if err := session.bindVariables(&node, policy.Name); err != nil {
+			return aql.Node{}, err
 		}
-		dbRole := data[0]["role"].(string)
-		switch action.Type {
-		case "COUNT":
-			return nil
-		case "DELETE":
-			if action.Resource == "PERMIT" || action.Resource == "COLLECTION" {
-				if !utils.Contains([]string{"ADMIN"}, dbRole) {
-					return errors.New("access denied")
-				}
-			} else {
-				if !utils.Contains([]string{"WRITE", "ADMIN"}, dbRole) {
-					return errors.New("access denied")
-				}
-			}
-			return nil
-		case "FILTER":
-			return nil
-		case "GET":
-			return nil
-		case "LIMIT":
-			return nil
-		case "ORDERASC":
-			return nil
-		case "ORDERDSC":
-			return nil
-		case "PATCH":
-			if action.Resource == "PERMIT" || action.Resource == "COLLECTION" {
-				if !utils.Contains([]string{"ADMIN"}, dbRole) {
-					return errors.New("access denied")
-				}
-			} else {
-				if !utils.Contains([]string{"WRITE", "ADMIN"}, dbRole) {
-					return errors.New("access denied")
-				}
-			}
-			return nil
-		case "POST":
-			if action.Resource == "PERMIT" || action.Resource == "COLLECTION" {
-				if !utils.Contains([]string{"ADMIN"}, dbRole) {
-					return errors.New("access denied")
-				}
-			} else {
-				if !utils.Contains([]string{"WRITE", "ADMIN"}, dbRole) {
-					return errors.New("access denied")
-				}
-			}
-			return nil
-		case "PUT":
-			if action.Resource == "PERMIT" || action.Resource == "COLLECTION" {
-				if !utils.Contains([]string{"ADMIN"}, dbRole) {
-					return errors.New("access denied")
-				}
-			} else {
-				if !utils.Contains([]string{"WRITE", "ADMIN"}, dbRole) {
-					return errors.New("access denied")
-				}
-			}
-			return nil
+		if combined.Value == "" {
+			combined = node
+		} else {
+			left, right := combined, node
+			combined = aql.Node{Value: "OR", Left: &left, Right: &right}
 		}
-	} else {
-		switch action.Type {
-		case "COUNT":
-			return nil
-		case "DELETE":
-			if action.Resource == "USER" {
-				if !utils.Contains([]string{"ADMIN"}, role) {
-					return errors.New("access denied")
-				}
-			} else {
-				if !utils.Contains([]string{"WRITE", "ADMIN"}, role) {
-					return errors.New("access denied")
-				}
-			}
-			return nil
-		case "FILTER":
-			return nil
-		case "GET":
-			return nil
-		case "LIMIT":
-			return nil
-		case "ORDERASC":
-			return nil
-		case "ORDERDSC":
-			return nil
-		case "JQ":
-			return nil
-		case "PATCH":
-			if action.Resource == "USER" {
-				if !utils.Contains([]string{"ADMIN"}, role) {
-					return errors.New("access denied")
-				}
-			} else {
-				if !utils.Contains([]string{"WRITE", "ADMIN"}, role) {
-					return errors.New("access denied")
-				}
-			}
-			return nil
-		case "POST":
-			if action.Resource == "USER" {
-				if !utils.Contains([]string{"ADMIN"}, role) {
-					return errors.New("access denied")
-				}
-			} else {
-				if !utils.Contains([]string{"WRITE", "ADMIN"}, role) {
-					return errors.New("access denied")
-				}
-			}
-			return nil
-		case "PUT":
-			if action.Resource == "USER" {
-				if !utils.Contains([]string{"ADMIN"}, role) {
-					return errors.New("access denied")
-				}
-			} else {
-				if !utils.Contains([]string{"WRITE", "ADMIN"}, role) {
-					return errors.New("access denied")
-				}
-			}
+	}
+	return combined, nil
+}
+
+// bindVariables replaces the policy variables in a filter with the session user's fields. A
+// policy which refers to a field the user does not have denies access rather than matching
+// nothing, so that the missing field is noticed.
+func (s *Session) bindVariables(node *aql.Node, policy string) error {
+	if node == nil {
+		return nil
+	}
+	if strings.HasPrefix(node.Value, aql.POLICY_VARIABLE) {
+		field := strings.TrimPrefix(node.Value, aql.POLICY_VARIABLE)
+		val, ok := s.fields[field]
+		if !ok || val == nil {
+			return errors.New(fmt.Sprintf("access denied, policy %v requires the user field %v", policy, field))
+		}
+		node.Value = utils.FormatValue(val)
+		return nil
+	}
+	if err := s.bindVariables(node.Left, policy); err != nil {
+		return err
+	}
+	return s.bindVariables(node.Right, policy)
+}
+
+// roles returns the custom role definitions, which are read once per session
+func (s *Session) roles() (map[string]role.Definition, error) {
+	if s.definitions != nil {
+		return s.definitions, nil
+	}
+	definitions, err := manager.Roles()
+	if err != nil {
+		return nil, err
+	}
+	s.definitions = definitions
+	return definitions, nil
+}
+
+// VerifyUserAction checks that the role of a session's user grants an action. Actions which only
+// read their resource need it to grant GET, and the role used for database resources is the one
+// the user's permit gives them there. Every action on the _audit database needs the AUDIT
+// privilege.
+func VerifyUserAction(session *Session, action aql.Action) error {
+	dbLevel := []string{"RECORD", "COLLECTION", "PERMIT", "INDEX", "POLICY"}
+	readTypes := []string{"GET", "COUNT", "AGGREGATE", "JOIN"}
+
+	// Actions without a resource only work with the output of the actions before them
+	if action.Resource == "" {
+		if utils.Contains([]string{"COUNT", "AGGREGATE", "JQ", "BEGIN", "COMMIT", "ROLLBACK"}, action.Type) {
 			return nil
 		}
+		return errors.New("invalid action type")
+	}
+	privilege := action.Type
+	if utils.Contains(readTypes, privilege) {
+		privilege = "GET"
+	}
+	if !utils.Contains(role.Actions, privilege) {
+		return errors.New("invalid action type")
+	}
+
+	resource := action.Resource
+	if audit.Targets(action) {
+		resource = "AUDIT"
+	}
+	userRole := session.Role
+	if utils.Contains(dbLevel, action.Resource) {
+		dbRole, _, err := session.scope(action)
+		if err != nil {
+			return err
+		}
+		userRole = dbRole
+	}
+	definitions, err := session.roles()
+	if err != nil {
+		return err
+	}
+	if !role.Allows(definitions, userRole, privilege, resource) {
+		return errors.New("access denied")
 	}
-	return errors.New("invalid action type")
+	return nil
+}
+
+// VerifySnapshot checks that the role of a session's user grants GET on SNAPSHOT, as a snapshot
+// holds every database along with the users and their credentials
+func VerifySnapshot(session *Session) error {
+	definitions, err := session.roles()
+	if err != nil {
+		return err
+	}
+	if !role.Allows(definitions, session.Role, "GET", "SNAPSHOT") {
+		return errors.New("access denied")
+	}
+	return nil
 }
 
 func ProtectWrite(action aql.Action) error {
-	resources := []string{"RECORD", "COLLECTION"}
+	if audit.Targets(action) && utils.Contains([]string{"POST", "PUT", "PATCH", "DELETE"}, action.Type) {
+		return errors.New("_audit database is read-only")
+	}
+	resources := []string{"RECORD", "COLLECTION", "POLICY"}
 	if utils.Contains(resources, action.Resource) {
 		parts := strings.Split(action.Identifier, ".")
 		db := parts[0]
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"ceresdb/aql"
+	"ceresdb/config"
+	"ceresdb/role"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSessionToken(t *testing.T) {
+	tokenSecret = []byte("secret")
+
+	token, expires, err := IssueSession("foo")
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if expires.Before(time.Now().Add(DEFAULT_SESSION_TTL*time.Second - time.Minute)) {
+		t.Errorf("Expiry was incorrect, got: %v, want: %v", expires, "an hour from now")
+	}
+	username, err := verifySession(token)
+	if err != nil || username != "foo" {
+		t.Errorf("Username was incorrect, got: %v, %v, want: %v", username, err, "foo")
+	}
+
+	tampered := signToken(sessionClaims{Subject: "admin", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	tokenSecret = []byte("other")
+	if _, err := verifySession(tampered); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "invalid session token")
+	}
+
+	expired := signToken(sessionClaims{Subject: "foo", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	if _, err := verifySession(expired); err == nil || err.Error() != "session token has expired" {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "session token has expired")
+	}
+
+	for _, token := range []string{"", "abc", "a.b.c", tokenHeader + ".e30." + tokenSignature(tokenHeader+".e30")} {
+		if _, err := verifySession(token); err == nil {
+			t.Errorf("Error was incorrect, got: %v, want: %v", err, "invalid session token")
+		}
+	}
+}
+
+func TestLoadTokenSecret(t *testing.T) {
+	config.Config.HomeDir = t.TempDir()
+	config.Config.TokenSecret = ""
+
+	if err := LoadTokenSecret(); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	generated := string(tokenSecret)
+	data, _ := os.ReadFile(filepath.Join(config.Config.HomeDir, TOKEN_SECRET_FILE))
+	if len(generated) != 64 || string(data) != generated {
+		t.Errorf("Secret was incorrect, got: %v, want: %v", generated, string(data))
+	}
+	LoadTokenSecret()
+	if string(tokenSecret) != generated {
+		t.Errorf("Secret was incorrect, got: %v, want: %v", string(tokenSecret), generated)
+	}
+
+	config.Config.TokenSecret = "configured"
+	LoadTokenSecret()
+	if string(tokenSecret) != "configured" {
+		t.Errorf("Secret was incorrect, got: %v, want: %v", string(tokenSecret), "configured")
+	}
+}
+
+func TestBindVariables(t *testing.T) {
+	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb/config/config.json")
+	config.ReadConfigFile()
+	session := &Session{Username: "foo", fields: map[string]interface{}{"username": "foo", "tenant": "acme", "level": json.Number("3")}}
+
+	node, _ := aql.ParseFilter("tenant = $user.tenant AND owner = $user.username OR level < $user.level")
+	if err := session.bindVariables(&node, "tenant"); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if node.Left.Left.Right.Value != "acme" || node.Left.Right.Right.Value != "foo" || node.Right.Right.Value != "3" {
+		t.Errorf("Filter was incorrect, got: %v, want: %v", node, "tenant = acme AND owner = foo OR level < 3")
+	}
+
+	node, _ = aql.ParseFilter("region = $user.region")
+	if err := session.bindVariables(&node, "region"); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+}
+
+func TestVerifyUserAction(t *testing.T) {
+	definitions := map[string]role.Definition{
+		"AUDITOR": {Name: "AUDITOR", Inherits: []string{"READ"}},
+		"ONBOARD": {Name: "ONBOARD", Inherits: []string{"AUDITOR"}, Privileges: []role.Privilege{{Action: "POST", Resource: "USER"}}},
+	}
+	tests := []struct {
+		role   string
+		action aql.Action
+		want   bool
+	}{
+		{"READ", aql.Action{Type: "GET", Resource: "USER"}, true},
+		{"READ", aql.Action{Type: "POST", Resource: "DATABASE", Identifier: "foo"}, false},
+		{"WRITE", aql.Action{Type: "POST", Resource: "DATABASE", Identifier: "foo"}, true},
+		{"WRITE", aql.Action{Type: "POST", Resource: "USER"}, false},
+		{"ADMIN", aql.Action{Type: "DELETE", Resource: "ROLE", IDs: []string{"abc"}}, true},
+		{"AUDITOR", aql.Action{Type: "POST", Resource: "KEY"}, true},
+		{"AUDITOR", aql.Action{Type: "POST", Resource: "USER"}, false},
+		{"ONBOARD", aql.Action{Type: "POST", Resource: "USER"}, true},
+		{"ONBOARD", aql.Action{Type: "DELETE", Resource: "USER"}, false},
+		{"OWNER", aql.Action{Type: "GET", Resource: "USER"}, false},
+		{"OWNER", aql.Action{Type: "JQ", JQ: "."}, true},
+		{"READ", aql.Action{Type: "GET", Resource: "RECORD", Identifier: "_audit.log"}, false},
+		{"ADMIN", aql.Action{Type: "GET", Resource: "RECORD", Identifier: "_audit.log"}, true},
+	}
+	for _, test := range tests {
+		session := &Session{Username: "foo", Role: test.role, definitions: definitions}
+		err := VerifyUserAction(session, test.action)
+		if (err == nil) != test.want {
+			t.Errorf("Error was incorrect for %v %v %v, got: %v, want allowed: %v", test.role, test.action.Type, test.action.Resource, err, test.want)
+		}
+	}
+	for name, want := range map[string]bool{"READ": false, "WRITE": false, "ADMIN": true, "ONBOARD": false} {
+		session := &Session{Username: "foo", Role: name, definitions: definitions}
+		if err := VerifySnapshot(session); (err == nil) != want {
+			t.Errorf("Error was incorrect for %v snapshot, got: %v, want allowed: %v", name, err, want)
+		}
+	}
+	if err := ProtectWrite(aql.Action{Type: "DELETE", Resource: "DATABASE", Identifier: "_audit"}); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "_audit database is read-only")
+	}
+}
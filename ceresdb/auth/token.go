@@ -0,0 +1,115 @@
+// token.go
+
+package auth
+
+import (
+	"ceresdb/config"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DEFAULT_SESSION_TTL is the number of seconds a session token is valid for when session-ttl is
+// not configured
+const DEFAULT_SESSION_TTL = 3600
+
+// TOKEN_SECRET_FILE is the file in the home directory holding the generated signing secret when
+// token-secret is not configured
+const TOKEN_SECRET_FILE = "token_secret"
+
+// tokenHeader is the header of every session token, which are JWTs signed with HMAC-SHA256
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+var tokenSecret []byte
+
+type sessionClaims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// LoadTokenSecret reads the secret session tokens are signed with. Without a configured secret one
+// is generated and kept in the home directory, so tokens stay valid across restarts.
+func LoadTokenSecret() error {
+	if config.Config.TokenSecret != "" {
+		tokenSecret = []byte(config.Config.TokenSecret)
+		return nil
+	}
+	path := filepath.Join(config.Config.HomeDir, TOKEN_SECRET_FILE)
+	data, err := os.ReadFile(path)
+	if err == nil && len(data) > 0 {
+		tokenSecret = data
+		return nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	encoded := []byte(hex.EncodeToString(secret))
+	if err := os.WriteFile(path, encoded, 0600); err != nil {
+		return err
+	}
+	tokenSecret = encoded
+	return nil
+}
+
+// IssueSession returns a signed session token for a user along with the time it expires
+func IssueSession(username string) (string, time.Time, error) {
+	if len(tokenSecret) == 0 {
+		return "", time.Time{}, errors.New("session tokens are not available")
+	}
+	ttl := config.Config.SessionTTL
+	if ttl <= 0 {
+		ttl = DEFAULT_SESSION_TTL
+	}
+	now := time.Now()
+	expires := now.Add(time.Duration(ttl) * time.Second)
+	token := signToken(sessionClaims{Subject: username, IssuedAt: now.Unix(), ExpiresAt: expires.Unix()})
+	return token, expires, nil
+}
+
+func signToken(claims sessionClaims) string {
+	claimBytes, _ := json.Marshal(claims)
+	payload := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(claimBytes)
+	return payload + "." + tokenSignature(payload)
+}
+
+func tokenSignature(payload string) string {
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifySession checks a session token's signature and expiry, returning the user it was issued to
+func verifySession(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(tokenSecret) == 0 || len(parts) != 3 || parts[0] != tokenHeader {
+		return "", errors.New("invalid session token")
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(tokenSignature(parts[0]+"."+parts[1]))) {
+		return "", errors.New("invalid session token")
+	}
+	claimBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.New("invalid session token")
+	}
+	var claims sessionClaims
+	if err := json.Unmarshal(claimBytes, &claims); err != nil || claims.Subject == "" {
+		return "", errors.New("invalid session token")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return "", errors.New("session token has expired")
+	}
+	return claims.Subject, nil
+}
@@ -3,42 +3,50 @@ package collection
 import (
 	"ceresdb/config"
 	"ceresdb/freespace"
+	"ceresdb/index"
+	"ceresdb/record"
 	"ceresdb/schema"
+	"ceresdb/wal"
 	"errors"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 )
 
-func Delete(database, collection string) error {
+func Delete(database, collection string) (err error) {
+	wal.Begin()
+	defer func() { err = wal.End(err) }()
+
 	dataPath := filepath.Join(config.Config.DataDir, database, collection)
 	indexPath := filepath.Join(config.Config.IndexDir, database, collection)
-	if err := os.RemoveAll(dataPath); err != nil {
+	if err := wal.RemoveAll(dataPath); err != nil {
 		return err
 	}
-	if err := os.RemoveAll(indexPath); err != nil {
+	if err := wal.RemoveAll(indexPath); err != nil {
 		return err
 	}
 	freespaceDB := freespace.FreeSpace.Databases[database]
 	delete(freespaceDB.Collections, collection)
 	freespace.FreeSpace.Databases[database] = freespaceDB
-	schemaDB := schema.Schema.Databases[database]
-	delete(schemaDB.Collections, collection)
-	schema.Schema.Databases[database] = schemaDB
-	freespace.WriteFreeSpace()
-	schema.WriteSchema()
-	return nil
+	schema.DeleteCollection(database, collection)
+	if err := freespace.WriteFreeSpace(); err != nil {
+		return err
+	}
+	if err := schema.DeletePolicies(database, collection); err != nil {
+		return err
+	}
+	return schema.WriteSchema()
 }
 
 func Get(database string) ([]map[string]interface{}, error) {
 	var collections []map[string]interface{}
-	dirInfo, err := ioutil.ReadDir(filepath.Join(config.Config.DataDir, database))
+	dirNames, err := wal.ReadDir(filepath.Join(config.Config.DataDir, database))
 	if err != nil {
 		return collections, err
 	}
 
-	for _, dir := range dirInfo {
-		collections = append(collections, map[string]interface{}{"name": dir.Name(), "schema": schema.Schema.Databases[database].Collections[dir.Name()].Types})
+	for _, dirName := range dirNames {
+		schemaCol, _ := schema.GetCollection(database, dirName)
+		collections = append(collections, map[string]interface{}{"name": dirName, "schema": schemaCol.Document()})
 	}
 	return collections, nil
 }
@@ -47,62 +55,98 @@ func Patch() error {
 	return errors.New("PATCH action is unsupported on resource COLLECTION")
 }
 
-func Post(database, collection string, newSchema map[string]interface{}) error {
-	schemaTypes := make(map[string]string)
-	for k, v := range newSchema {
-		schemaTypes[k] = v.(string)
-	}
-	if err := schema.ValidateSchemaCollection(schemaTypes); err != nil {
+func Post(database, collection string, newSchema map[string]interface{}) (err error) {
+	wal.Begin()
+	defer func() { err = wal.End(err) }()
+
+	newCol, err := schema.ParseCollection(newSchema)
+	if err != nil {
 		return err
 	}
 	dataPath := filepath.Join(config.Config.DataDir, database, collection)
 	indexPath := filepath.Join(config.Config.IndexDir, database, collection)
-	if err := os.MkdirAll(dataPath, 0755); err != nil {
+	if err := wal.MkdirAll(dataPath); err != nil {
 		return err
 	}
-	if err := os.MkdirAll(indexPath, 0755); err != nil {
+	if err := wal.MkdirAll(indexPath); err != nil {
 		return err
 	}
 	allPath := filepath.Join(config.Config.IndexDir, database, collection, "all")
-	os.WriteFile(allPath, []byte(""), 0644)
+	if err := wal.WriteFile(allPath, []byte("")); err != nil {
+		return err
+	}
+	if err := index.WriteDefinitions(database, collection, index.Definitions{Auto: true, Indices: []index.Definition{}, Nulls: true}); err != nil {
+		return err
+	}
 	freespaceDB := freespace.FreeSpace.Databases[database]
 	if freespaceDB.Collections == nil {
 		freespaceDB.Collections = make(map[string]freespace.FreeSpaceCollection)
 	}
 	freespaceDB.Collections[collection] = freespace.FreeSpaceCollection{}
 	freespace.FreeSpace.Databases[database] = freespaceDB
-	schemaDB := schema.Schema.Databases[database]
-	schemaCol := schema.SchemaCollection{}
-	if schemaDB.Collections == nil {
-		schemaDB.Collections = make(map[string]schema.SchemaCollection)
-	}
-	if val, ok := schemaDB.Collections[collection]; ok {
-		schemaCol = val
-	}
-	schemaCol.Types = schemaTypes
-	schemaDB.Collections[collection] = schemaCol
-	schema.Schema.Databases[database] = schemaDB
-	freespace.WriteFreeSpace()
-	schema.WriteSchema()
-	return nil
+	schema.SetCollection(database, collection, newCol)
+	for _, field := range newCol.UniqueFields() {
+		if err := index.SetUnique(database, collection, field, true, nil, newCol.Types); err != nil {
+			return err
+		}
+	}
+	if err := freespace.WriteFreeSpace(); err != nil {
+		return err
+	}
+	return schema.WriteSchema()
 }
 
 func Put(database, collection string, newSchema map[string]interface{}) error {
-	schemaDB := schema.Schema.Databases[database]
-	schemaCol := schema.SchemaCollection{}
-	schemaTypes := make(map[string]string)
-	if schemaDB.Collections == nil {
-		schemaDB.Collections = make(map[string]schema.SchemaCollection)
+	_, err := Migrate(database, collection, newSchema, false)
+	return err
+}
+
+// updateUnique applies the unique constraints added or removed by a schema change. Existing
+// records are checked against new constraints so that the change fails if any are duplicated.
+func updateUnique(database, collection string, oldCol, newCol schema.SchemaCollection) error {
+	var data []map[string]interface{}
+	for _, field := range newCol.UniqueFields() {
+		if oldCol.Unique[field] {
+			continue
+		}
+		if data == nil {
+			ids, err := index.All(database, collection)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			data, err = record.Get(database, collection, ids)
+			if err != nil {
+				return err
+			}
+		}
+		if err := index.SetUnique(database, collection, field, true, data, newCol.Types); err != nil {
+			return err
+		}
 	}
-	for k, v := range newSchema {
-		schemaTypes[k] = v.(string)
+	for _, field := range oldCol.UniqueFields() {
+		if newCol.Unique[field] {
+			continue
+		}
+		if err := index.SetUnique(database, collection, field, false, nil, newCol.Types); err != nil {
+			return err
+		}
 	}
-	if err := schema.ValidateSchemaCollection(schemaTypes); err != nil {
+	return nil
+}
+
+// AddUnique adds a unique constraint on a field of an existing collection
+func AddUnique(database, collection, field string) (err error) {
+	wal.Begin()
+	defer func() { err = wal.End(err) }()
+
+	oldCol, _ := schema.GetCollection(database, collection)
+	newCol := schema.SchemaCollection{Types: oldCol.Types, Unique: map[string]bool{field: true}, Fields: oldCol.Fields}
+	for key, unique := range oldCol.Unique {
+		newCol.Unique[key] = unique
+	}
+	if err := updateUnique(database, collection, oldCol, newCol); err != nil {
 		return err
 	}
-	schemaCol.Types = schemaTypes
-	schemaDB.Collections[collection] = schemaCol
-	schema.Schema.Databases[database] = schemaDB
-	schema.WriteSchema()
-	return nil
+	schema.SetCollection(database, collection, newCol)
+	return schema.WriteSchema()
 }
@@ -3,6 +3,8 @@ package collection
 import (
 	"ceresdb/config"
 	"ceresdb/freespace"
+	"ceresdb/index"
+	"ceresdb/record"
 	"ceresdb/schema"
 	"os"
 	"path/filepath"
@@ -107,3 +109,101 @@ func TestPatch(t *testing.T) {
 		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
 	}
 }
+
+func TestMigrate(t *testing.T) {
+	createDatabase("foo")
+
+	Post("foo", "bar", map[string]interface{}{"a": "STRING", "b": "INT", "c": "STRING"})
+	record.Post("foo", "bar", []map[string]interface{}{{"a": "x", "b": 1.0, "c": "1.5"}, {"a": "y", "b": 2.0, "c": "foo"}})
+	ids, _ := index.All("foo", "bar")
+	data, _ := record.Get("foo", "bar", ids)
+	var failingID interface{}
+	for _, datum := range data {
+		if datum["a"] == "y" {
+			failingID = datum[".id"]
+		}
+	}
+
+	newSchema := map[string]interface{}{"a": "STRING", "b": "FLOAT", "c": "FLOAT"}
+	failures, err := Migrate("foo", "bar", newSchema, true)
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if len(failures) != 1 || failures[0][".id"] != failingID {
+		t.Errorf("Failures were incorrect, got: %v, want: %v", failures, failingID)
+	}
+	if schema.Schema.Databases["foo"].Collections["bar"].Types["b"] != "INT" {
+		t.Errorf("Schema was incorrect, got: %v, want: %v", schema.Schema.Databases["foo"].Collections["bar"].Types, "unchanged")
+	}
+
+	_, err = Migrate("foo", "bar", newSchema, false)
+	if err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+
+	newSchema = map[string]interface{}{"a": "STRING UNIQUE", "b": "FLOAT", "d": map[string]interface{}{"type": "BOOL", "default": false}}
+	_, err = Migrate("foo", "bar", newSchema, false)
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	ids, _ = index.All("foo", "bar")
+	data, _ = record.Get("foo", "bar", ids)
+	for _, datum := range data {
+		if _, ok := datum["c"]; ok || datum["d"] != false {
+			t.Errorf("Record was incorrect, got: %v", datum)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(config.Config.IndexDir, "foo", "bar", "c")); !os.IsNotExist(err) {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<not exist>")
+	}
+	ids, err = index.Get("foo", "bar", "d", "false")
+	if err != nil || len(ids) != 2 {
+		t.Errorf("Indices were incorrect, got: %v, want: %v", ids, "2 ids")
+	}
+
+	_, err = Migrate("foo", "bar", map[string]interface{}{"a": "STRING", "b": "FLOAT UNIQUE", "d": "BOOL UNIQUE"}, false)
+	if err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+	deleteDatabase("foo")
+}
+
+func TestReindex(t *testing.T) {
+	createDatabase("foo")
+	defer deleteDatabase("foo")
+
+	Post("foo", "bar", map[string]interface{}{"a": "STRING", "b": "INT NULLABLE"})
+	record.Post("foo", "bar", []map[string]interface{}{{"a": "x", "b": 1.0}, {"a": "y", "b": nil}, {"a": "z", "b": 3.0}})
+	definitions, _ := index.ReadDefinitions("foo", "bar")
+	definitions.Nulls = false
+	index.WriteDefinitions("foo", "bar", definitions)
+
+	// A rebuild interrupted after its first chunk carries on from the records it had not indexed
+	ids, _ := index.All("foo", "bar")
+	if err := startReindex("foo", "bar"); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if err := reindexChunk("foo", "bar", ids[:1], 1); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if definitions, _ := index.ReadDefinitions("foo", "bar"); definitions.Nulls {
+		t.Errorf("Nulls was incorrect, got: %v, want: %v", definitions.Nulls, false)
+	}
+	if err := Reindex("foo", "bar"); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if definitions, _ := index.ReadDefinitions("foo", "bar"); !definitions.Nulls {
+		t.Errorf("Nulls was incorrect, got: %v, want: %v", definitions.Nulls, true)
+	}
+	reindexed, _ := index.All("foo", "bar")
+	if !reflect.DeepEqual(reindexed, ids) {
+		t.Errorf("Indices were incorrect, got: %v, want: %v", reindexed, ids)
+	}
+	nulls, err := index.Lookup("foo", "bar", "b", nil)
+	if err != nil || len(nulls) != 1 {
+		t.Errorf("Indices were incorrect, got: %v, %v, want: %v", nulls, err, "1 id")
+	}
+	if _, err := os.Stat(filepath.Join(config.Config.IndexDir, "foo", "bar", REINDEX_FILE_NAME)); !os.IsNotExist(err) {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<not exist>")
+	}
+}
@@ -0,0 +1,262 @@
+// migrate.go
+
+package collection
+
+import (
+	"ceresdb/config"
+	"ceresdb/index"
+	"ceresdb/logging"
+	"ceresdb/record"
+	"ceresdb/schema"
+	"ceresdb/utils"
+	"ceresdb/wal"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// migrationProgressInterval is how many records are handled between progress messages
+const migrationProgressInterval = 1000
+
+// Migrate changes the schema of a collection, converting every stored record to the new schema
+// and rebuilding the collection's indices. Records which cannot be converted stop the migration
+// before anything is changed. A dry run changes nothing and instead returns the records which
+// would fail, along with the reason for each.
+func Migrate(database, collection string, newSchema map[string]interface{}, dryRun bool) (output []map[string]interface{}, err error) {
+	wal.Begin()
+	defer func() { err = wal.End(err) }()
+
+	newCol, err := schema.ParseCollection(newSchema)
+	if err != nil {
+		return nil, err
+	}
+	oldCol, _ := schema.GetCollection(database, collection)
+
+	ids, err := index.All(database, collection)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	data, err := record.Get(database, collection, ids)
+	if err != nil {
+		return nil, err
+	}
+	name := database + "." + collection
+	logging.INFO(fmt.Sprintf("Migrating collection %v: converting %v records", name, len(data)))
+
+	migrated := make([]map[string]interface{}, 0, len(data))
+	failures := make([]map[string]interface{}, 0)
+	uniqueValues := make(map[string]map[string]bool)
+	for _, field := range newCol.UniqueFields() {
+		uniqueValues[field] = make(map[string]bool)
+	}
+	for idx, datum := range data {
+		newDatum, err := newCol.MigrateRecord(datum)
+		if err == nil {
+			err = checkDuplicates(newDatum, uniqueValues)
+		}
+		if err != nil {
+			failures = append(failures, map[string]interface{}{".id": datum[".id"], "error": err.Error()})
+		} else {
+			migrated = append(migrated, newDatum)
+		}
+		if (idx+1)%migrationProgressInterval == 0 {
+			logging.INFO(fmt.Sprintf("Migrating collection %v: converted %v of %v records", name, idx+1, len(data)))
+		}
+	}
+	if dryRun {
+		logging.INFO(fmt.Sprintf("Dry run of migration for collection %v: %v of %v records would fail", name, len(failures), len(data)))
+		return failures, nil
+	}
+	if len(failures) > 0 {
+		return nil, errors.New(fmt.Sprintf("Cannot migrate collection %v, %v records do not conform to the new schema, first failure: %v: %v", name, len(failures), failures[0][".id"], failures[0]["error"]))
+	}
+
+	schema.SetCollection(database, collection, newCol)
+	if err := schema.WriteSchema(); err != nil {
+		return nil, err
+	}
+	if err := record.Rewrite(database, collection, migrated); err != nil {
+		return nil, err
+	}
+	if err := migrateDefinitions(database, collection, oldCol, newCol); err != nil {
+		return nil, err
+	}
+	if err := index.Clear(database, collection); err != nil {
+		return nil, err
+	}
+	for idx, datum := range migrated {
+		if err := index.Add(database, collection, datum, newCol.Types); err != nil {
+			return nil, err
+		}
+		if (idx+1)%migrationProgressInterval == 0 {
+			logging.INFO(fmt.Sprintf("Migrating collection %v: indexed %v of %v records", name, idx+1, len(migrated)))
+		}
+	}
+	logging.INFO(fmt.Sprintf("Migrated collection %v: %v records", name, len(migrated)))
+	return []map[string]interface{}{{"collection": name, "records": len(migrated)}}, nil
+}
+
+// REINDEX_FILE_NAME lists the IDs of the records a collection's indices are being rebuilt from,
+// and REINDEX_PROGRESS_FILE_NAME how many of them have been indexed so far. Both live in the
+// collection's index directory until the rebuild finishes, so one which is interrupted carries on
+// where it stopped the next time it runs.
+const REINDEX_FILE_NAME = ".reindex"
+const REINDEX_PROGRESS_FILE_NAME = ".reindex-progress"
+
+// reindexChunkSize is how many records are indexed in each write-ahead log batch
+const reindexChunkSize = 1000
+
+// Reindex rebuilds every index of a collection from its records, such as for collections indexed
+// before null values were. Records are indexed in chunks which are each committed on their own,
+// and the collection is only marked as indexing nulls once every chunk has been.
+func Reindex(database, collection string) error {
+	indexPath := filepath.Join(config.Config.IndexDir, database, collection)
+	if !wal.Exists(filepath.Join(indexPath, REINDEX_FILE_NAME)) {
+		if err := startReindex(database, collection); err != nil {
+			return err
+		}
+	}
+	data, err := wal.ReadFile(filepath.Join(indexPath, REINDEX_FILE_NAME))
+	if err != nil {
+		return err
+	}
+	ids := strings.Fields(string(data))
+	progress, err := wal.ReadFile(filepath.Join(indexPath, REINDEX_PROGRESS_FILE_NAME))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	done, _ := strconv.Atoi(strings.TrimSpace(string(progress)))
+	for done < len(ids) {
+		end := done + reindexChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err := reindexChunk(database, collection, ids[done:end], end); err != nil {
+			return err
+		}
+		done = end
+		logging.INFO(fmt.Sprintf("Reindexing collection %v.%v: indexed %v of %v records", database, collection, done, len(ids)))
+	}
+	if err := finishReindex(database, collection); err != nil {
+		return err
+	}
+	logging.INFO(fmt.Sprintf("Reindexed collection %v.%v: %v records", database, collection, len(ids)))
+	return nil
+}
+
+// startReindex clears a collection's indices, noting which records they are rebuilt from as the
+// list of every record is one of the indices cleared
+func startReindex(database, collection string) (err error) {
+	wal.Begin()
+	defer func() { err = wal.End(err) }()
+
+	ids, err := index.All(database, collection)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := index.Clear(database, collection); err != nil {
+		return err
+	}
+	indexPath := filepath.Join(config.Config.IndexDir, database, collection)
+	if err := wal.WriteFile(filepath.Join(indexPath, REINDEX_FILE_NAME), []byte(strings.Join(utils.RemoveDuplicateValues(ids), "\n"))); err != nil {
+		return err
+	}
+	return wal.WriteFile(filepath.Join(indexPath, REINDEX_PROGRESS_FILE_NAME), []byte("0"))
+}
+
+// reindexChunk indexes a chunk of records, noting how many records have been indexed along with it
+func reindexChunk(database, collection string, ids []string, done int) (err error) {
+	wal.Begin()
+	defer func() { err = wal.End(err) }()
+
+	data, err := record.Get(database, collection, ids)
+	if err != nil {
+		return err
+	}
+	types := schema.Get(database, collection)
+	for _, datum := range data {
+		if err := index.Add(database, collection, datum, types); err != nil {
+			return err
+		}
+	}
+	indexPath := filepath.Join(config.Config.IndexDir, database, collection)
+	return wal.WriteFile(filepath.Join(indexPath, REINDEX_PROGRESS_FILE_NAME), []byte(strconv.Itoa(done)))
+}
+
+// finishReindex marks a collection as indexing nulls and removes the notes of its rebuild
+func finishReindex(database, collection string) (err error) {
+	wal.Begin()
+	defer func() { err = wal.End(err) }()
+
+	definitions, err := index.ReadDefinitions(database, collection)
+	if err != nil {
+		return err
+	}
+	definitions.Nulls = true
+	if err := index.WriteDefinitions(database, collection, definitions); err != nil {
+		return err
+	}
+	indexPath := filepath.Join(config.Config.IndexDir, database, collection)
+	if err := wal.Remove(filepath.Join(indexPath, REINDEX_FILE_NAME)); err != nil {
+		return err
+	}
+	return wal.Remove(filepath.Join(indexPath, REINDEX_PROGRESS_FILE_NAME))
+}
+
+// checkDuplicates records the values of a migrated record's unique fields, reporting any value
+// which an earlier record already holds
+func checkDuplicates(datum map[string]interface{}, uniqueValues map[string]map[string]bool) error {
+	for field, seen := range uniqueValues {
+		val, ok := datum[field]
+		if !ok || val == nil {
+			continue
+		}
+		key := fmt.Sprintf("%v", val)
+		if seen[key] {
+			return errors.New(fmt.Sprintf("Value %v for unique field %v already exists", val, field))
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// migrateDefinitions brings a collection's index definitions in line with its new schema,
+// dropping indices on removed fields and applying unique constraints
+func migrateDefinitions(database, collection string, oldCol, newCol schema.SchemaCollection) error {
+	definitions, err := index.ReadDefinitions(database, collection)
+	if err != nil {
+		return err
+	}
+	for _, definition := range append([]index.Definition{}, definitions.Indices...) {
+		if _, ok := newCol.Types[strings.Split(definition.Field, ".")[0]]; ok {
+			continue
+		}
+		if definition.Text {
+			definitions.RemoveText(definition.Field)
+		} else {
+			definitions.Remove(definition.Field)
+		}
+	}
+	for _, field := range oldCol.UniqueFields() {
+		if newCol.Unique[field] {
+			continue
+		}
+		definition, ok := definitions.Find(field)
+		if !ok {
+			continue
+		}
+		if definitions.Automatic(database, field, newCol.Types) {
+			definitions.Remove(field)
+		} else {
+			definition.Unique = false
+			definitions.Set(definition)
+		}
+	}
+	for _, field := range newCol.UniqueFields() {
+		definitions.Set(index.Definition{Field: field, Unique: true, Status: index.StatusReady})
+	}
+	return index.WriteDefinitions(database, collection, definitions)
+}
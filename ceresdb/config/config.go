@@ -25,6 +25,11 @@ type ConfigObject struct {
 	Port             int    `json:"port" binding:"required" env:"PORT"`
 	Leader           string `json:"leader" env:"LEADER"`
 	FollowerAuth     string `json:"follower_auth" env:"FOLLOWER_AUTH"`
+	QueryWorkers     int    `json:"query-workers" env:"QUERY_WORKERS"`
+	QueueDepth       int    `json:"queue-depth" env:"QUEUE_DEPTH"`
+	QueryTimeout     int    `json:"query-timeout" env:"QUERY_TIMEOUT"`
+	TokenSecret      string `json:"token-secret" env:"TOKEN_SECRET"`
+	SessionTTL       int    `json:"session-ttl" env:"SESSION_TTL"`
 }
 
 var Config ConfigObject
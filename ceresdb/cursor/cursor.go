@@ -3,6 +3,7 @@
 package cursor
 
 import (
+	"ceresdb/utils"
 	"encoding/json"
 )
 
@@ -25,28 +26,56 @@ const (
 	OpError
 )
 
+// Cursor tracks the position of a single pass over the lines of a data file. Each read or write
+// uses its own Cursor so that queries can run concurrently.
+type Cursor struct {
+	Index      int
+	Mode       IOMode
+	LowerBound int
+	UpperBound int
+}
+
+// Index, Mode, LowerBound, and UpperBound hold the state of the package-level cursor used by
+// Initialize, Next, and Advance
 var Index int
 var Mode IOMode
 var LowerBound int
 var UpperBound int
 
+func New(lowerBound, upperBound int, mode IOMode) *Cursor {
+	return &Cursor{Index: -1, Mode: mode, LowerBound: lowerBound, UpperBound: upperBound}
+}
+
 func Initialize(lowerBound, upperBound int, mode IOMode) {
-	Index = -1
-	Mode = mode
+	c := New(lowerBound, upperBound, mode)
+	Index = c.Index
+	Mode = c.Mode
+	LowerBound = c.LowerBound
+	UpperBound = c.UpperBound
+}
+
+func Next(line string, datum map[string]interface{}) (IOOp, map[string]interface{}, string, error) {
+	c := Cursor{Index: Index, Mode: Mode, LowerBound: LowerBound, UpperBound: UpperBound}
+	op, outInterface, outString, err := c.Next(line, datum)
+	Index = c.Index
+	return op, outInterface, outString, err
+}
+
+func Advance(lowerBound, upperBound int) {
 	LowerBound = lowerBound
 	UpperBound = upperBound
 }
 
-func Next(line string, datum map[string]interface{}) (IOOp, map[string]interface{}, string, error) {
-	Index += 1
-	if Index >= LowerBound && Index <= UpperBound {
-		switch Mode {
+func (c *Cursor) Next(line string, datum map[string]interface{}) (IOOp, map[string]interface{}, string, error) {
+	c.Index += 1
+	if c.Index >= c.LowerBound && c.Index <= c.UpperBound {
+		switch c.Mode {
 		case ModeRead:
 			var outInterface map[string]interface{}
 			if line == "" {
 				return OpRead, outInterface, "", nil
 			}
-			err := json.Unmarshal([]byte(line), &outInterface)
+			err := utils.DecodeJSON([]byte(line), &outInterface)
 			if err != nil {
 				return OpError, nil, "", err
 			}
@@ -54,7 +83,7 @@ func Next(line string, datum map[string]interface{}) (IOOp, map[string]interface
 		case ModeWrite:
 			var outString string
 			var outInterface map[string]interface{}
-			json.Unmarshal([]byte(line), &outInterface)
+			utils.DecodeJSON([]byte(line), &outInterface)
 			outBytes, err := json.Marshal(datum)
 			if err != nil {
 				return OpError, nil, "", err
@@ -65,13 +94,13 @@ func Next(line string, datum map[string]interface{}) (IOOp, map[string]interface
 			var outString string
 			var outInterface map[string]interface{}
 			outString = "\n"
-			json.Unmarshal([]byte(line), &outInterface)
+			utils.DecodeJSON([]byte(line), &outInterface)
 			return OpDelete, outInterface, outString, nil
 		case ModePatch:
 			var outString string
 			var outInterface map[string]interface{}
 			tmpInterface := make(map[string]interface{})
-			json.Unmarshal([]byte(line), &outInterface)
+			utils.DecodeJSON([]byte(line), &outInterface)
 			for key, val := range outInterface {
 				if _, ok := datum[key]; !ok {
 					tmpInterface[key] = val
@@ -87,13 +116,13 @@ func Next(line string, datum map[string]interface{}) (IOOp, map[string]interface
 			return OpWrite, outInterface, outString, nil
 		}
 	}
-	if Index == UpperBound+1 {
+	if c.Index == c.UpperBound+1 {
 		return OpNext, nil, "", nil
 	}
 	return OpJump, nil, "", nil
 }
 
-func Advance(lowerBound, upperBound int) {
-	LowerBound = lowerBound
-	UpperBound = upperBound
+func (c *Cursor) Advance(lowerBound, upperBound int) {
+	c.LowerBound = lowerBound
+	c.UpperBound = upperBound
 }
@@ -343,3 +343,28 @@ func TestAdvance(t *testing.T) {
 		t.Errorf("LowerBound was incorrect, got: %d, want: %d", UpperBound, expectedUpperBound)
 	}
 }
+
+func TestNewIndependent(t *testing.T) {
+	first := New(0, 16, ModeRead)
+	second := New(4, 8, ModeRead)
+
+	first.Next("{\"foo\":\"bar\"}", nil)
+	first.Next("{\"foo\":\"bar\"}", nil)
+	second.Next("{\"foo\":\"bar\"}", nil)
+
+	if first.Index != 1 {
+		t.Errorf("Index was incorrect, got: %d, want: %d", first.Index, 1)
+	}
+	if second.Index != 0 {
+		t.Errorf("Index was incorrect, got: %d, want: %d", second.Index, 0)
+	}
+
+	second.Advance(10, 12)
+
+	if second.LowerBound != 10 || second.UpperBound != 12 {
+		t.Errorf("Bounds were incorrect, got: %d-%d, want: %d-%d", second.LowerBound, second.UpperBound, 10, 12)
+	}
+	if first.LowerBound != 0 || first.UpperBound != 16 {
+		t.Errorf("Bounds were incorrect, got: %d-%d, want: %d-%d", first.LowerBound, first.UpperBound, 0, 16)
+	}
+}
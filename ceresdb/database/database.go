@@ -4,37 +4,46 @@ import (
 	"ceresdb/collection"
 	"ceresdb/config"
 	"ceresdb/freespace"
+	"ceresdb/permit"
 	"ceresdb/record"
 	"ceresdb/schema"
+	"ceresdb/wal"
 	"errors"
-	"io/ioutil"
-	"os"
 	"path/filepath"
 )
 
-func Delete(database string) error {
+func Delete(database string) (err error) {
+	wal.Begin()
+	defer func() { err = wal.End(err) }()
+
 	dataPath := filepath.Join(config.Config.DataDir, database)
 	indexPath := filepath.Join(config.Config.IndexDir, database)
-	if err := os.RemoveAll(dataPath); err != nil {
+	if err := wal.RemoveAll(dataPath); err != nil {
 		return err
 	}
-	if err := os.RemoveAll(indexPath); err != nil {
+	if err := wal.RemoveAll(indexPath); err != nil {
 		return err
 	}
 	delete(freespace.FreeSpace.Databases, database)
-	delete(schema.Schema.Databases, database)
-	return nil
+	schema.DeleteDatabase(database)
+	if err := freespace.WriteFreeSpace(); err != nil {
+		return err
+	}
+	if err := schema.DeletePolicies(database, ""); err != nil {
+		return err
+	}
+	return schema.WriteSchema()
 }
 
 func Get() ([]map[string]interface{}, error) {
 	var databases []map[string]interface{}
-	dirInfo, err := ioutil.ReadDir(config.Config.DataDir)
+	dirNames, err := wal.ReadDir(config.Config.DataDir)
 	if err != nil {
 		return databases, err
 	}
 
-	for _, dir := range dirInfo {
-		databases = append(databases, map[string]interface{}{"name": dir.Name()})
+	for _, dirName := range dirNames {
+		databases = append(databases, map[string]interface{}{"name": dirName})
 	}
 	return databases, nil
 }
@@ -43,21 +52,30 @@ func Patch() error {
 	return errors.New("PATCH action is unsupported on resource DATABASE")
 }
 
-func Post(database string) error {
+func Post(database string) (err error) {
+	wal.Begin()
+	defer func() { err = wal.End(err) }()
+
 	dataPath := filepath.Join(config.Config.DataDir, database)
 	indexPath := filepath.Join(config.Config.IndexDir, database)
-	if err := os.MkdirAll(dataPath, 0755); err != nil {
+	if err := wal.MkdirAll(dataPath); err != nil {
 		return err
 	}
-	if err := os.MkdirAll(indexPath, 0755); err != nil {
+	if err := wal.MkdirAll(indexPath); err != nil {
 		return err
 	}
 	freespace.FreeSpace.Databases[database] = freespace.FreeSpaceDatabase{}
-	schema.Schema.Databases[database] = schema.SchemaDatabase{}
-	freespace.WriteFreeSpace()
-	schema.WriteSchema()
+	schema.PostDatabase(database)
+	if err := freespace.WriteFreeSpace(); err != nil {
+		return err
+	}
+	if err := schema.WriteSchema(); err != nil {
+		return err
+	}
 	if database != "_auth" {
-		collection.Post(database, "_users", map[string]interface{}{"username": "STRING", "role": "STRING"})
+		if err := collection.Post(database, "_users", permit.Schema); err != nil {
+			return err
+		}
 		inputData := []map[string]interface{}{{"username": "ceresdb", "role": "ADMIN"}}
 		err := record.Post(database, "_users", inputData)
 		if err != nil {
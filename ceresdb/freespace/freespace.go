@@ -4,6 +4,7 @@ package freespace
 
 import (
 	"ceresdb/config"
+	"ceresdb/wal"
 	"encoding/json"
 	"io/ioutil"
 	"os"
@@ -113,7 +114,5 @@ func WriteFreeSpace() error {
 	}
 
 	freeSpaceContents, _ := json.MarshalIndent(output, "", "    ")
-	_ = ioutil.WriteFile(path, freeSpaceContents, 0644)
-
-	return nil
+	return wal.WriteFile(path, freeSpaceContents)
 }
@@ -0,0 +1,407 @@
+// definitions.go
+
+package index
+
+import (
+	"ceresdb/config"
+	"ceresdb/utils"
+	"ceresdb/wal"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DEFINITIONS_FILE_NAME is the file in each collection's index directory which lists the
+// collection's indices. Collections without one index every top-level field automatically.
+const DEFINITIONS_FILE_NAME = ".definitions"
+
+const (
+	StatusBuilding = "building"
+	StatusReady    = "ready"
+	StatusFailed   = "failed"
+)
+
+type Definition struct {
+	Field  string `json:"field"`
+	Unique bool   `json:"unique"`
+	// Text definitions are full-text indices, which are kept separately from a field's index
+	Text   bool   `json:"text,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Definitions struct {
+	// Auto indexes every top-level field whose schema type can be indexed, in addition to the
+	// explicit definitions in Indices
+	Auto    bool         `json:"auto"`
+	Indices []Definition `json:"indices"`
+	// Nulls is set for collections whose indices include null values. Collections indexed before
+	// null values were are reindexed when the server starts.
+	Nulls bool `json:"nulls"`
+}
+
+// indexedValue is a single value of a datum which is written to an index
+type indexedValue struct {
+	field     string
+	fieldType string
+	value     interface{}
+	unique    bool
+}
+
+func definitionsPath(database, collection string) string {
+	return filepath.Join(config.Config.IndexDir, database, collection, DEFINITIONS_FILE_NAME)
+}
+
+// ReadDefinitions returns the index definitions of a collection
+func ReadDefinitions(database, collection string) (Definitions, error) {
+	definitions := Definitions{Auto: true, Indices: []Definition{}}
+	data, err := wal.ReadFile(definitionsPath(database, collection))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return definitions, nil
+		}
+		return definitions, err
+	}
+	err = json.Unmarshal(data, &definitions)
+	return definitions, err
+}
+
+// WriteDefinitions replaces the index definitions of a collection
+func WriteDefinitions(database, collection string, definitions Definitions) error {
+	data, err := json.Marshal(definitions)
+	if err != nil {
+		return err
+	}
+	return wal.WriteFile(definitionsPath(database, collection), data)
+}
+
+// Find returns the definition for a field, if there is one
+func (d Definitions) Find(field string) (Definition, bool) {
+	return d.find(field, false)
+}
+
+// FindText returns the full-text definition for a field, if there is one
+func (d Definitions) FindText(field string) (Definition, bool) {
+	return d.find(field, true)
+}
+
+func (d Definitions) find(field string, text bool) (Definition, bool) {
+	for _, definition := range d.Indices {
+		if definition.Field == field && definition.Text == text {
+			return definition, true
+		}
+	}
+	return Definition{}, false
+}
+
+// Set adds a definition, replacing any existing definition of the same kind for the same field
+func (d *Definitions) Set(definition Definition) {
+	for idx := range d.Indices {
+		if d.Indices[idx].Field == definition.Field && d.Indices[idx].Text == definition.Text {
+			d.Indices[idx] = definition
+			return
+		}
+	}
+	d.Indices = append(d.Indices, definition)
+}
+
+// Remove drops the definition for a field
+func (d *Definitions) Remove(field string) {
+	d.remove(field, false)
+}
+
+// RemoveText drops the full-text definition for a field
+func (d *Definitions) RemoveText(field string) {
+	d.remove(field, true)
+}
+
+func (d *Definitions) remove(field string, text bool) {
+	for idx := range d.Indices {
+		if d.Indices[idx].Field == field && d.Indices[idx].Text == text {
+			d.Indices = append(d.Indices[:idx], d.Indices[idx+1:]...)
+			return
+		}
+	}
+}
+
+// textFields returns the fields with a full-text index which is ready to use
+func (d Definitions) textFields() []string {
+	output := make([]string, 0)
+	for _, definition := range d.Indices {
+		if definition.Text && definition.Status == StatusReady {
+			output = append(output, definition.Field)
+		}
+	}
+	return output
+}
+
+// autoIndexed reports whether a top-level field is indexed automatically
+func autoIndexed(database, field, fieldType string) bool {
+	if field == ".id" {
+		return false
+	}
+	if field == "password" && database == "_auth" {
+		return false
+	}
+	return !utils.Contains(InvalidSchemaTypes, fieldType)
+}
+
+// Materialize turns the automatically indexed fields of a collection into explicit definitions
+// so that they can be dropped individually
+func (d *Definitions) Materialize(database string, schemaData map[string]string) {
+	if !d.Auto {
+		return
+	}
+	d.Auto = false
+	fields := make([]string, 0, len(schemaData))
+	for field := range schemaData {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		if !autoIndexed(database, field, schemaData[field]) {
+			continue
+		}
+		if _, ok := d.Find(field); ok {
+			continue
+		}
+		d.Indices = append(d.Indices, Definition{Field: field, Status: StatusReady})
+	}
+}
+
+// Automatic reports whether a field is indexed because the collection indexes every top-level
+// field automatically
+func (d Definitions) Automatic(database, field string, schemaData map[string]string) bool {
+	if !d.Auto {
+		return false
+	}
+	fieldType, ok := schemaData[field]
+	return ok && autoIndexed(database, field, fieldType)
+}
+
+// Indexed reports whether a field or path has an index which can be used to answer filters,
+// along with the type its values are indexed as
+func (d Definitions) Indexed(database, field string, schemaData map[string]string) (bool, string) {
+	if d.Automatic(database, field, schemaData) {
+		return true, schemaData[field]
+	}
+	// Indices on LIST fields hold the lists' elements, so they can only answer CONTAINS
+	if schemaData[field] == "LIST" {
+		return false, "LIST"
+	}
+	if definition, ok := d.Find(field); ok {
+		return definition.Status == StatusReady, FieldType(field, schemaData)
+	}
+	return false, FieldType(field, schemaData)
+}
+
+// ElementsIndexed reports whether a LIST field has an index of its elements which can be used to
+// answer CONTAINS filters
+func (d Definitions) ElementsIndexed(field string, schemaData map[string]string) bool {
+	definition, ok := d.Find(field)
+	return ok && definition.Status == StatusReady && schemaData[field] == "LIST"
+}
+
+// FieldType returns the type a field or path is indexed as. Paths into DICT fields and the
+// elements of LIST fields have no declared type so their values are indexed as ANY.
+func FieldType(field string, schemaData map[string]string) string {
+	if fieldType, ok := schemaData[field]; ok && fieldType != "LIST" {
+		return fieldType
+	}
+	return "ANY"
+}
+
+// Resolve looks up a dotted path such as "address.city" within a datum
+func Resolve(datum map[string]interface{}, path string) (interface{}, bool) {
+	if val, ok := datum[path]; ok {
+		return val, true
+	}
+	parts := strings.Split(path, ".")
+	var current interface{} = datum
+	for _, part := range parts {
+		currentMap, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = currentMap[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// isScalar reports whether a value can be compared within an index. Nulls are indexed separately.
+func isScalar(val interface{}) bool {
+	if val == nil {
+		return false
+	}
+	if _, ok := val.([]interface{}); ok {
+		return false
+	}
+	if _, ok := val.(map[string]interface{}); ok {
+		return false
+	}
+	return true
+}
+
+// values returns every value of a datum which is written to the collection's indices
+func (d Definitions) values(database string, datum map[string]interface{}, schemaData map[string]string) []indexedValue {
+	output := make([]indexedValue, 0)
+	seen := make(map[string]int)
+	if d.Auto {
+		for key, val := range datum {
+			if !autoIndexed(database, key, schemaData[key]) || (val != nil && !isScalar(val)) {
+				continue
+			}
+			seen[key] = len(output)
+			output = append(output, indexedValue{field: key, fieldType: schemaData[key], value: val})
+		}
+	}
+	for _, definition := range d.Indices {
+		if definition.Status != StatusReady || definition.Text {
+			continue
+		}
+		if idx, ok := seen[definition.Field]; ok {
+			output[idx].unique = definition.Unique
+			continue
+		}
+		val, ok := Resolve(datum, definition.Field)
+		if list, isList := val.([]interface{}); isList && schemaData[definition.Field] == "LIST" {
+			output = append(output, elementValues(definition.Field, list)...)
+			continue
+		}
+		if !ok || (val != nil && !isScalar(val)) {
+			continue
+		}
+		output = append(output, indexedValue{field: definition.Field, fieldType: FieldType(definition.Field, schemaData), value: val, unique: definition.Unique})
+	}
+	return output
+}
+
+// elementValues returns the distinct scalar elements of a LIST field which are written to its
+// index
+func elementValues(field string, list []interface{}) []indexedValue {
+	output := make([]indexedValue, 0, len(list))
+	seen := make(map[string]bool, len(list))
+	for _, element := range list {
+		if !isScalar(element) || seen[valueFileName(element)] {
+			continue
+		}
+		seen[valueFileName(element)] = true
+		output = append(output, indexedValue{field: field, fieldType: "ANY", value: element})
+	}
+	return output
+}
+
+// Build writes the index for a single definition from a set of records, replacing anything
+// already in the index's directory
+func Build(database, collection string, definition Definition, data []map[string]interface{}, schemaData map[string]string) error {
+	if definition.Text {
+		return BuildText(database, collection, definition.Field, data)
+	}
+	fieldPath := filepath.Join(config.Config.IndexDir, database, collection, definition.Field)
+	if err := wal.RemoveAll(fieldPath); err != nil {
+		return err
+	}
+	definitions := Definitions{Indices: []Definition{{Field: definition.Field, Unique: definition.Unique, Status: StatusReady}}}
+	for _, datum := range data {
+		for _, val := range definitions.values(database, datum, schemaData) {
+			filePath := filepath.Join(fieldPath, valueFileName(val.value))
+			if err := checkUnique(database, collection, datum[".id"].(string), val, filePath); err != nil {
+				return err
+			}
+			if err := addValue(database, collection, datum[".id"].(string), val); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Drop removes the index for a field
+func Drop(database, collection, field string) error {
+	return wal.RemoveAll(filepath.Join(config.Config.IndexDir, database, collection, field))
+}
+
+func valueFileName(val interface{}) string {
+	if val == nil {
+		return base64.StdEncoding.EncodeToString([]byte(NULL_FIELD_VALUE))
+	}
+	stringVal := utils.FormatValue(val)
+	if len(stringVal) == 0 {
+		stringVal = EMPTY_FIELD_VALUE
+	}
+	return base64.StdEncoding.EncodeToString([]byte(stringVal))
+}
+
+func checkUnique(database, collection, id string, val indexedValue, filePath string) error {
+	if !val.unique || val.value == nil || !wal.Exists(filePath) {
+		return nil
+	}
+	ids, err := readIDs(database, collection, val.field, filepath.Base(filePath))
+	if err != nil {
+		return err
+	}
+	for _, existing := range ids {
+		if existing != id {
+			return errors.New(fmt.Sprintf("Value %v for unique field %v already exists", val.value, val.field))
+		}
+	}
+	return nil
+}
+
+// SetUnique adds or removes the unique constraint on a field's index. Adding the constraint
+// rebuilds the index from data so that any existing duplicates are reported.
+func SetUnique(database, collection, field string, unique bool, data []map[string]interface{}, schemaData map[string]string) error {
+	definitions, err := ReadDefinitions(database, collection)
+	if err != nil {
+		return err
+	}
+	definition, defined := definitions.Find(field)
+	if unique {
+		if defined && definition.Unique && definition.Status == StatusReady {
+			return nil
+		}
+		definition = Definition{Field: field, Unique: true, Status: StatusReady}
+		if err := Build(database, collection, definition, data, schemaData); err != nil {
+			return err
+		}
+		definitions.Set(definition)
+	} else {
+		if !defined || !definition.Unique {
+			return nil
+		}
+		if definitions.Automatic(database, field, schemaData) {
+			definitions.Remove(field)
+		} else {
+			definition.Unique = false
+			definitions.Set(definition)
+		}
+	}
+	return WriteDefinitions(database, collection, definitions)
+}
+
+// Clear removes every index of a collection, keeping its definitions, so that the indices can be
+// rebuilt by adding each record again
+func Clear(database, collection string) error {
+	indexPath := filepath.Join(config.Config.IndexDir, database, collection)
+	names, err := wal.ReadDir(indexPath)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == DEFINITIONS_FILE_NAME {
+			continue
+		}
+		if err := wal.RemoveAll(filepath.Join(indexPath, name)); err != nil {
+			return err
+		}
+	}
+	return wal.WriteFile(filepath.Join(indexPath, "all"), []byte(""))
+}
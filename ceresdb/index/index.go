@@ -4,9 +4,8 @@ package index
 
 import (
 	"ceresdb/config"
-	"ceresdb/utils"
+	"ceresdb/wal"
 	"encoding/base64"
-	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -16,99 +15,107 @@ var InvalidSchemaTypes = []string{"DICT", "LIST", "ANY"}
 
 const EMPTY_FIELD_VALUE = ".ceresdb.empty-value"
 
+// NULL_FIELD_VALUE is the value file holding the records whose field is null. Nulls are left out
+// of sorted runs so that they never match comparisons and always come last when ordering.
+const NULL_FIELD_VALUE = ".ceresdb.null-value"
+
 func Add(database, collection string, datum map[string]interface{}, schemaData map[string]string) error {
-	for key, val := range datum {
-		if utils.Contains(InvalidSchemaTypes, schemaData[key]) {
-			continue
-		}
-		if key == ".id" {
-			continue
-		}
-		if key == "password" && database == "_auth" {
-			continue
-		}
-		if _, ok := val.([]interface{}); ok {
-			continue
-		}
-		if _, ok := val.(map[string]interface{}); ok {
-			continue
-		}
-		stringVal := fmt.Sprintf("%v", val)
-		if len(stringVal) == 0 {
-			stringVal = EMPTY_FIELD_VALUE
-		}
-		encodedVal := base64.StdEncoding.EncodeToString([]byte(stringVal))
-		dirPath := filepath.Join(config.Config.IndexDir, database, collection, key)
-		filePath := filepath.Join(dirPath, encodedVal)
-		allPath := filepath.Join(config.Config.IndexDir, database, collection, "all")
-		if _, err := os.Stat(dirPath); os.IsNotExist(err) {
-			err = os.MkdirAll(dirPath, 0755)
-			if err != nil {
-				return err
-			}
-		}
-		f, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
+	definitions, err := ReadDefinitions(database, collection)
+	if err != nil {
+		return err
+	}
+	id := datum[".id"].(string)
+	values := definitions.values(database, datum, schemaData)
+	for _, val := range values {
+		filePath := filepath.Join(config.Config.IndexDir, database, collection, val.field, valueFileName(val.value))
+		if err := checkUnique(database, collection, id, val, filePath); err != nil {
 			return err
 		}
-		_, err = f.WriteString(datum[".id"].(string) + "\n")
-		if err != nil {
+	}
+	for _, val := range values {
+		if err := addValue(database, collection, id, val); err != nil {
 			return err
 		}
-		f.Close()
-		f, err = os.OpenFile(allPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
+	}
+	for _, field := range definitions.textFields() {
+		if err := addText(database, collection, field, datum); err != nil {
 			return err
 		}
-		_, err = f.WriteString(datum[".id"].(string) + "\n")
-		if err != nil {
+	}
+	// "all" holds an entry for each indexed value of a record, and at least one for every record
+	// so that records without indexed values can still be listed
+	allPath := filepath.Join(config.Config.IndexDir, database, collection, "all")
+	entries := len(values)
+	if entries == 0 {
+		entries = 1
+	}
+	return wal.AppendFile(allPath, []byte(strings.Repeat(id+"\n", entries)))
+}
+
+func addValue(database, collection, id string, val indexedValue) error {
+	encodedVal := valueFileName(val.value)
+	filePath := filepath.Join(config.Config.IndexDir, database, collection, val.field, encodedVal)
+	isNewValue := !wal.Exists(filePath)
+	if err := wal.AppendFile(filePath, []byte(id+"\n")); err != nil {
+		return err
+	}
+	if isNewValue && val.value != nil {
+		if err := addOrdered(database, collection, val.field, val.fieldType, encodedVal); err != nil {
 			return err
 		}
-		f.Close()
 	}
 	return nil
 }
 
 func Delete(database, collection string, datum map[string]interface{}, schemaData map[string]string) error {
-	for key, val := range datum {
-		if key == ".id" {
-			continue
-		}
-		if key == "password" && database == "_auth" {
-			continue
-		}
-		if utils.Contains(InvalidSchemaTypes, schemaData[key]) {
-			continue
-		}
-		stringVal := fmt.Sprintf("%v", val)
-		if len(stringVal) == 0 {
-			stringVal = EMPTY_FIELD_VALUE
-		}
-		encodedVal := base64.StdEncoding.EncodeToString([]byte(stringVal))
-		filePath := filepath.Join(config.Config.IndexDir, database, collection, key, encodedVal)
-		data, err := os.ReadFile(filePath)
+	definitions, err := ReadDefinitions(database, collection)
+	if err != nil {
+		return err
+	}
+	id := datum[".id"].(string)
+	for _, val := range definitions.values(database, datum, schemaData) {
+		encodedVal := valueFileName(val.value)
+		filePath := filepath.Join(config.Config.IndexDir, database, collection, val.field, encodedVal)
+		data, err := wal.ReadFile(filePath)
 		if err != nil {
 			return err
 		}
 		indices := strings.Split(string(data), "\n")
-		indices = removeIndex(indices, datum[".id"].(string))
+		indices = removeIndex(indices, id)
 		if len(indices) == 1 {
-			if err = os.Remove(filePath); err != nil {
+			if err = wal.Remove(filePath); err != nil {
+				return err
+			}
+			if val.value == nil {
+				continue
+			}
+			if err = deleteOrdered(database, collection, val.field, val.fieldType, encodedVal); err != nil {
 				return err
 			}
 		} else {
-			os.WriteFile(filePath, []byte(strings.Join(indices, "\n")), 0644)
+			if err = wal.WriteFile(filePath, []byte(strings.Join(indices, "\n"))); err != nil {
+				return err
+			}
 		}
-		allPath := filepath.Join(config.Config.IndexDir, database, collection, "all")
-		data, err = os.ReadFile(allPath)
-		if err != nil {
+	}
+	for _, field := range definitions.textFields() {
+		if err := deleteText(database, collection, field, datum); err != nil {
 			return err
 		}
-		indices = strings.Split(string(data), "\n")
-		indices = removeIndex(indices, datum[".id"].(string))
-		os.WriteFile(allPath, []byte(strings.Join(indices, "\n")), 0644)
 	}
-	return nil
+	allPath := filepath.Join(config.Config.IndexDir, database, collection, "all")
+	data, err := wal.ReadFile(allPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	indices := strings.Split(string(data), "\n")
+	for idx := linearSearch(indices, id); idx != -1; idx = linearSearch(indices, id) {
+		indices = removeIndex(indices, id)
+	}
+	return wal.WriteFile(allPath, []byte(strings.Join(indices, "\n")))
 }
 
 func Update(database, collection string, oldDatum, newDatum map[string]interface{}, schemaData map[string]string) error {
@@ -124,7 +131,7 @@ func Update(database, collection string, oldDatum, newDatum map[string]interface
 func Get(database, collection, key, value string) ([]string, error) {
 	encodedVal := base64.StdEncoding.EncodeToString([]byte(value))
 	filePath := filepath.Join(config.Config.IndexDir, database, collection, key, encodedVal)
-	data, err := os.ReadFile(filePath)
+	data, err := wal.ReadFile(filePath)
 	if err != nil {
 		return nil, err
 	}
@@ -132,9 +139,23 @@ func Get(database, collection, key, value string) ([]string, error) {
 	return indices[:len(indices)-1], nil
 }
 
+// Lookup returns the IDs of the records whose indexed field holds value
+func Lookup(database, collection, key string, value interface{}) ([]string, error) {
+	filePath := filepath.Join(config.Config.IndexDir, database, collection, key, valueFileName(value))
+	data, err := wal.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	indices := strings.Split(string(data), "\n")
+	return indices[:len(indices)-1], nil
+}
+
 func All(database, collection string) ([]string, error) {
 	filePath := filepath.Join(config.Config.IndexDir, database, collection, "all")
-	data, err := os.ReadFile(filePath)
+	data, err := wal.ReadFile(filePath)
 	if err != nil {
 		return nil, err
 	}
@@ -2,11 +2,13 @@ package index
 
 import (
 	"ceresdb/config"
+	"ceresdb/wal"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -329,3 +331,590 @@ func TestAll(t *testing.T) {
 	}
 
 }
+
+func TestOrderedKey(t *testing.T) {
+	ints := []string{"-100", "-3", "0", "2", "10", "1000"}
+	floats := []string{"-1.5", "-0.25", "0", "0.5", "3", "12.75"}
+	strs := []string{EMPTY_FIELD_VALUE, "a", "ab", "b", "ba"}
+	timestamps := []string{"1969-12-31T23:59:59Z", "2026-01-01T00:00:00Z", "2026-01-01T00:00:00.5Z", "2026-01-01T01:00:00.25+00:30", "2026-01-01T01:00:00Z"}
+	dates := []string{"1900-06-01", "2025-12-31", "2026-01-01"}
+	durations := []string{"-1h", "0s", "500ms", "30m", "1h0m0s", "25h"}
+
+	for fieldType, values := range map[string][]string{"INT": ints, "FLOAT": floats, "STRING": strs, "TIMESTAMP": timestamps, "DATE": dates, "DURATION": durations} {
+		previous := ""
+		for idx, value := range values {
+			key, err := OrderedKey(fieldType, value)
+			if err != nil {
+				t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+			}
+			if idx > 0 && key <= previous {
+				t.Errorf("Key for %v %v was out of order, got: %v, want greater than: %v", fieldType, value, key, previous)
+			}
+			previous = key
+		}
+	}
+
+	if _, err := OrderedKey("INT", "1.5"); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+
+	dateKey, _ := OrderedKey("TIMESTAMP", "2026-01-01")
+	timestampKey, _ := OrderedKey("TIMESTAMP", "2026-01-01T00:00:00Z")
+	if dateKey != timestampKey {
+		t.Errorf("Key was incorrect, got: %v, want: %v", dateKey, timestampKey)
+	}
+	for fieldType, value := range map[string]string{"TIMESTAMP": "yesterday", "DATE": "2026-13-01", "DURATION": "5", "UUID": "1234"} {
+		if _, err := OrderedKey(fieldType, value); err == nil {
+			t.Errorf("Error for %v %v was incorrect, got: %v, want: %v", fieldType, value, err, "<non-nil>")
+		}
+	}
+}
+
+func addOrderedTestData(count int) map[string]string {
+	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb/config/config.json")
+	config.ReadConfigFile()
+	os.RemoveAll(config.Config.HomeDir + "/indices/db1/ordered")
+
+	// A single batch keeps the test from syncing every record to disk separately
+	wal.Begin()
+	defer wal.Commit()
+	schemaData := map[string]string{"name": "STRING", "count": "INT"}
+	for idx := 0; idx < count; idx++ {
+		datum := map[string]interface{}{
+			".id":   fmt.Sprintf("id-%d", idx),
+			"name":  fmt.Sprintf("name-%03d", idx%100),
+			"count": float64(idx - count/2),
+		}
+		Add("db1", "ordered", datum, schemaData)
+	}
+	return schemaData
+}
+
+func TestRange(t *testing.T) {
+	addOrderedTestData(600)
+	defer os.RemoveAll(config.Config.HomeDir + "/indices/db1/ordered")
+
+	expectedIDs := []string{"id-598", "id-599"}
+	ids, err := Range("db1", "ordered", "count", "INT", ">", "297")
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if !reflect.DeepEqual(ids, expectedIDs) {
+		t.Errorf("IDs were incorrect, got: %v, want: %v", ids, expectedIDs)
+	}
+
+	expectedIDs = []string{"id-0", "id-1", "id-2"}
+	ids, _ = Range("db1", "ordered", "count", "INT", "<=", "-298")
+	if !reflect.DeepEqual(ids, expectedIDs) {
+		t.Errorf("IDs were incorrect, got: %v, want: %v", ids, expectedIDs)
+	}
+
+	expectedIDs = []string{"id-300"}
+	ids, _ = Range("db1", "ordered", "count", "INT", "=", "0")
+	if !reflect.DeepEqual(ids, expectedIDs) {
+		t.Errorf("IDs were incorrect, got: %v, want: %v", ids, expectedIDs)
+	}
+
+	ids, _ = Range("db1", "ordered", "count", "INT", "!=", "0")
+	if len(ids) != 599 {
+		t.Errorf("Length was incorrect, got: %v, want: %v", len(ids), 599)
+	}
+
+	expectedIDs = []string{"id-99", "id-199", "id-299", "id-399", "id-499", "id-599"}
+	ids, _ = Range("db1", "ordered", "name", "STRING", ">=", "name-099")
+	if !reflect.DeepEqual(ids, expectedIDs) {
+		t.Errorf("IDs were incorrect, got: %v, want: %v", ids, expectedIDs)
+	}
+
+	_, err = Range("db1", "ordered", "count", "INT", "<", "foo")
+	if err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	addOrderedTestData(200)
+	defer os.RemoveAll(config.Config.HomeDir + "/indices/db1/ordered")
+
+	ids, err := Prefix("db1", "ordered", "name", "name-05")
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if len(ids) != 20 {
+		t.Errorf("Length was incorrect, got: %v, want: %v", len(ids), 20)
+	}
+
+	ids, err = PrefixMatch("db1", "ordered", "name", "", func(value string) bool { return strings.HasSuffix(value, "7") })
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if len(ids) != 20 {
+		t.Errorf("Length was incorrect, got: %v, want: %v", len(ids), 20)
+	}
+}
+
+func TestOrdered(t *testing.T) {
+	addOrderedTestData(600)
+	defer os.RemoveAll(config.Config.HomeDir + "/indices/db1/ordered")
+
+	collect := func(descending bool, count int) []string {
+		output := []string{}
+		err := Ordered("db1", "ordered", "count", descending, func(ids []string) (bool, error) {
+			output = append(output, ids...)
+			return count == 0 || len(output) < count, nil
+		})
+		if err != nil {
+			t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+		}
+		return output
+	}
+
+	expectedIDs := []string{"id-599", "id-598", "id-597"}
+	ids := collect(true, 3)
+	if !reflect.DeepEqual(ids, expectedIDs) {
+		t.Errorf("IDs were incorrect, got: %v, want: %v", ids, expectedIDs)
+	}
+
+	expectedIDs = []string{"id-0", "id-1", "id-2"}
+	ids = collect(false, 3)
+	if !reflect.DeepEqual(ids, expectedIDs) {
+		t.Errorf("IDs were incorrect, got: %v, want: %v", ids, expectedIDs)
+	}
+
+	ascending := collect(false, 0)
+	descending := collect(true, 0)
+	if len(ascending) != 600 || len(descending) != 600 {
+		t.Errorf("Length was incorrect, got: %v and %v, want: %v", len(ascending), len(descending), 600)
+	}
+	for idx := range descending {
+		if descending[idx] != ascending[len(ascending)-1-idx] {
+			t.Errorf("IDs were incorrect, got: %v, want: %v", descending[idx], ascending[len(ascending)-1-idx])
+			break
+		}
+	}
+
+	err := Ordered("db1", "missing", "count", false, func(ids []string) (bool, error) {
+		t.Errorf("IDs were incorrect, got: %v, want: %v", ids, "<none>")
+		return true, nil
+	})
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+}
+
+func TestValues(t *testing.T) {
+	addOrderedTestData(10)
+	defer os.RemoveAll(config.Config.HomeDir + "/indices/db1/ordered")
+
+	values := []interface{}{}
+	err := Values("db1", "ordered", "count", "INT", func(value interface{}, ids []string) error {
+		if len(ids) != 1 {
+			t.Errorf("Length was incorrect, got: %v, want: %v", len(ids), 1)
+		}
+		values = append(values, value)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	expectedValues := []interface{}{int64(-5), int64(-4), int64(-3), int64(-2), int64(-1), int64(0), int64(1), int64(2), int64(3), int64(4)}
+	if !reflect.DeepEqual(values, expectedValues) {
+		t.Errorf("Values were incorrect, got: %v, want: %v", values, expectedValues)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	schemaData := addOrderedTestData(10)
+	defer os.RemoveAll(config.Config.HomeDir + "/indices/db1/ordered")
+
+	os.Remove(config.Config.HomeDir + "/indices/db1/ordered/count/" + ORDERED_FILE_NAME)
+	ids, _ := Range("db1", "ordered", "count", "INT", ">=", "3")
+	if len(ids) != 0 {
+		t.Errorf("Length was incorrect, got: %v, want: %v", len(ids), 0)
+	}
+
+	err := Migrate("db1", "ordered", schemaData)
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+
+	expectedIDs := []string{"id-8", "id-9"}
+	ids, _ = Range("db1", "ordered", "count", "INT", ">=", "3")
+	if !reflect.DeepEqual(ids, expectedIDs) {
+		t.Errorf("IDs were incorrect, got: %v, want: %v", ids, expectedIDs)
+	}
+}
+
+func TestOrderedDelta(t *testing.T) {
+	schemaData := addOrderedTestData(10)
+	defer os.RemoveAll(config.Config.HomeDir + "/indices/db1/ordered")
+
+	// New values are appended to the delta instead of rewriting the sorted run
+	fieldPath := config.Config.HomeDir + "/indices/db1/ordered/count/"
+	run, _ := os.ReadFile(fieldPath + ORDERED_FILE_NAME)
+	if lines := strings.Count(string(run), "\n"); lines != 1 {
+		t.Errorf("Run lines were incorrect, got: %v, want: %v", lines, 1)
+	}
+	Delete("db1", "ordered", map[string]interface{}{".id": "id-0", "name": "name-000", "count": float64(-5)}, schemaData)
+	Add("db1", "ordered", map[string]interface{}{".id": "id-10", "name": "name-010", "count": float64(-5)}, schemaData)
+	Delete("db1", "ordered", map[string]interface{}{".id": "id-9", "name": "name-009", "count": float64(4)}, schemaData)
+	delta, _ := os.ReadFile(fieldPath + ORDERED_DELTA_FILE_NAME)
+	if lines := strings.Count(string(delta), "\n"); lines != 12 {
+		t.Errorf("Delta lines were incorrect, got: %v, want: %v", lines, 12)
+	}
+
+	expectedIDs := []string{"id-10", "id-1", "id-2", "id-3", "id-4", "id-5", "id-6", "id-7", "id-8"}
+	ids, _ := Range("db1", "ordered", "count", "INT", "<", "10")
+	if !reflect.DeepEqual(ids, expectedIDs) {
+		t.Errorf("IDs were incorrect, got: %v, want: %v", ids, expectedIDs)
+	}
+	descending := []string{}
+	Ordered("db1", "ordered", "count", true, func(ids []string) (bool, error) {
+		descending = append(descending, ids...)
+		return true, nil
+	})
+	expectedIDs = []string{"id-8", "id-7", "id-6", "id-5", "id-4", "id-3", "id-2", "id-1", "id-10"}
+	if !reflect.DeepEqual(descending, expectedIDs) {
+		t.Errorf("IDs were incorrect, got: %v, want: %v", descending, expectedIDs)
+	}
+
+	// A large enough delta is compacted into the run
+	wal.Begin()
+	for idx := 0; idx < 3000; idx++ {
+		Add("db1", "ordered", map[string]interface{}{".id": fmt.Sprintf("new-%d", idx), "count": float64(1000 + idx)}, schemaData)
+	}
+	wal.Commit()
+	run, _ = os.ReadFile(fieldPath + ORDERED_FILE_NAME)
+	delta, _ = os.ReadFile(fieldPath + ORDERED_DELTA_FILE_NAME)
+	if len(delta) >= len(run) {
+		t.Errorf("Sizes were incorrect, got: %v and %v, want: %v", len(run), len(delta), "a compacted run")
+	}
+	ids, _ = Range("db1", "ordered", "count", "INT", ">=", "0")
+	if len(ids) != 3004 {
+		t.Errorf("Length was incorrect, got: %v, want: %v", len(ids), 3004)
+	}
+}
+
+func TestDefinitions(t *testing.T) {
+	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb/config/config.json")
+	config.ReadConfigFile()
+	os.RemoveAll(config.Config.HomeDir + "/indices/db1/defined")
+	defer os.RemoveAll(config.Config.HomeDir + "/indices/db1/defined")
+
+	schemaData := map[string]string{"name": "STRING", "age": "INT", "address": "DICT"}
+	definitions := Definitions{Auto: true, Indices: []Definition{{Field: "address.city", Status: StatusReady}}}
+	definitions.Materialize("db1", schemaData)
+	expectedFields := []string{"address.city", "age", "name"}
+	fields := []string{}
+	for _, definition := range definitions.Indices {
+		fields = append(fields, definition.Field)
+	}
+	if !reflect.DeepEqual(fields, expectedFields) {
+		t.Errorf("Fields were incorrect, got: %v, want: %v", fields, expectedFields)
+	}
+
+	definitions.Remove("age")
+	definitions.Set(Definition{Field: "name", Unique: true, Status: StatusReady})
+	if err := WriteDefinitions("db1", "defined", definitions); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+
+	datum := map[string]interface{}{".id": "id-0", "name": "ann", "age": float64(30), "address": map[string]interface{}{"city": "Paris"}}
+	if err := Add("db1", "defined", datum, schemaData); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if _, err := os.Stat(config.Config.HomeDir + "/indices/db1/defined/age"); !os.IsNotExist(err) {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "not exist")
+	}
+
+	expectedIDs := []string{"id-0"}
+	ids, _ := Range("db1", "defined", "address.city", "ANY", "=", "Paris")
+	if !reflect.DeepEqual(ids, expectedIDs) {
+		t.Errorf("IDs were incorrect, got: %v, want: %v", ids, expectedIDs)
+	}
+
+	datum = map[string]interface{}{".id": "id-1", "name": "ann", "age": float64(40), "address": map[string]interface{}{"city": "Rome"}}
+	if err := Add("db1", "defined", datum, schemaData); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+	ids, _ = Range("db1", "defined", "address.city", "ANY", "=", "Rome")
+	if len(ids) != 0 {
+		t.Errorf("Length was incorrect, got: %v, want: %v", len(ids), 0)
+	}
+
+	data := []map[string]interface{}{
+		{".id": "id-0", "name": "ann", "address": map[string]interface{}{"zip": float64(75)}},
+		{".id": "id-1", "name": "bob", "address": map[string]interface{}{"zip": float64(100)}},
+	}
+	if err := Build("db1", "defined", Definition{Field: "address.zip"}, data, schemaData); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	expectedIDs = []string{"id-1"}
+	ids, _ = Range("db1", "defined", "address.zip", "ANY", ">", "80")
+	if !reflect.DeepEqual(ids, expectedIDs) {
+		t.Errorf("IDs were incorrect, got: %v, want: %v", ids, expectedIDs)
+	}
+
+	data[1]["name"] = "ann"
+	if err := Build("db1", "defined", Definition{Field: "name", Unique: true}, data, schemaData); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+}
+
+func TestListElements(t *testing.T) {
+	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb/config/config.json")
+	config.ReadConfigFile()
+	os.RemoveAll(config.Config.HomeDir + "/indices/db1/listed")
+	defer os.RemoveAll(config.Config.HomeDir + "/indices/db1/listed")
+
+	schemaData := map[string]string{"tags": "LIST"}
+	definitions := Definitions{Indices: []Definition{{Field: "tags", Status: StatusReady}}}
+	if err := WriteDefinitions("db1", "listed", definitions); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if indexed, _ := definitions.Indexed("db1", "tags", schemaData); indexed {
+		t.Errorf("Indexed was incorrect, got: %v, want: %v", indexed, false)
+	}
+	if !definitions.ElementsIndexed("tags", schemaData) {
+		t.Errorf("ElementsIndexed was incorrect, got: %v, want: %v", false, true)
+	}
+
+	datum := map[string]interface{}{".id": "id-0", "tags": []interface{}{"x", "y", "y", json.Number("1"), map[string]interface{}{}}}
+	if err := Add("db1", "listed", datum, schemaData); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	expectedIDs := []string{"id-0"}
+	for _, value := range []string{"x", "y", "1"} {
+		ids, _ := Range("db1", "listed", "tags", "ANY", "=", value)
+		if !reflect.DeepEqual(ids, expectedIDs) {
+			t.Errorf("IDs were incorrect, got: %v, want: %v", ids, expectedIDs)
+		}
+	}
+
+	if err := Delete("db1", "listed", datum, schemaData); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	ids, _ := Range("db1", "listed", "tags", "ANY", "=", "y")
+	if len(ids) != 0 {
+		t.Errorf("Length was incorrect, got: %v, want: %v", len(ids), 0)
+	}
+}
+
+func TestText(t *testing.T) {
+	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb/config/config.json")
+	config.ReadConfigFile()
+	os.RemoveAll(config.Config.HomeDir + "/indices/db1/texts")
+	defer os.RemoveAll(config.Config.HomeDir + "/indices/db1/texts")
+
+	expectedTerms := []string{"cat", "chase", "mice", "hop", "poni", "caress", "agre", "happi", "fox"}
+	terms := Terms("The Cats chased the mice, hopping ponies; caresses agreed happy foxes")
+	if !reflect.DeepEqual(terms, expectedTerms) {
+		t.Errorf("Terms were incorrect, got: %v, want: %v", terms, expectedTerms)
+	}
+
+	schemaData := map[string]string{"body": "STRING"}
+	definitions := Definitions{Indices: []Definition{{Field: "body", Text: true, Status: StatusReady}}}
+	if err := WriteDefinitions("db1", "texts", definitions); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if _, ok := definitions.Find("body"); ok {
+		t.Errorf("Find was incorrect, got: %v, want: %v", ok, false)
+	}
+	if _, ok := definitions.FindText("body"); !ok {
+		t.Errorf("FindText was incorrect, got: %v, want: %v", ok, true)
+	}
+
+	data := []map[string]interface{}{
+		{".id": "id-0", "body": "a cat sat on a mat"},
+		{".id": "id-1", "body": "cats chasing cats"},
+		{".id": "id-2", "body": "a dog"},
+	}
+	for _, datum := range data {
+		if err := Add("db1", "texts", datum, schemaData); err != nil {
+			t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+		}
+	}
+	scores, err := Search("db1", "texts", "body", "Cat")
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if len(scores) != 2 || scores["id-1"] <= scores["id-0"] {
+		t.Errorf("Scores were incorrect, got: %v, want: %v", scores, "id-1 ranked above id-0")
+	}
+
+	if err := Delete("db1", "texts", data[1], schemaData); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	scores, _ = Search("db1", "texts", "body", "cat dog")
+	if len(scores) != 2 || scores["id-1"] != 0 {
+		t.Errorf("Scores were incorrect, got: %v, want: %v", scores, "id-0 and id-2")
+	}
+
+	// Removing a record marks it in its terms' files and keeps the aggregates up to date
+	fieldPath := textPath("db1", "texts", "body")
+	stats, _ := readTextStats(fieldPath)
+	if stats != (textStats{documents: 2, total: 4, removed: 2}) {
+		t.Errorf("Stats were incorrect, got: %v, want: %v", stats, textStats{documents: 2, total: 4, removed: 2})
+	}
+	contents, _ := os.ReadFile(filepath.Join(fieldPath, termFileName("cat")))
+	if string(contents) != "id-0 1 3\nid-1 2 3\n-id-1\n" {
+		t.Errorf("Term file was incorrect, got: %q, want: %q", contents, "id-0 1 3\nid-1 2 3\n-id-1\n")
+	}
+	if err := Add("db1", "texts", map[string]interface{}{".id": "id-1", "body": "a chase"}, schemaData); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if err := compactText(fieldPath); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	contents, _ = os.ReadFile(filepath.Join(fieldPath, termFileName("cat")))
+	if string(contents) != "id-0 1 3\n" {
+		t.Errorf("Term file was incorrect, got: %q, want: %q", contents, "id-0 1 3\n")
+	}
+	scores, _ = Search("db1", "texts", "body", "chasing")
+	if len(scores) != 1 || scores["id-1"] <= 0 {
+		t.Errorf("Scores were incorrect, got: %v, want: %v", scores, "id-1")
+	}
+
+	if err := BuildText("db1", "texts", "body", data[1:2]); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	scores, _ = Search("db1", "texts", "body", "cat")
+	if len(scores) != 1 || scores["id-1"] <= 0 {
+		t.Errorf("Scores were incorrect, got: %v, want: %v", scores, "id-1")
+	}
+}
+
+func TestNull(t *testing.T) {
+	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb/config/config.json")
+	config.ReadConfigFile()
+	os.RemoveAll(config.Config.HomeDir + "/indices/db1/nulls")
+	defer os.RemoveAll(config.Config.HomeDir + "/indices/db1/nulls")
+
+	schemaData := map[string]string{"n": "INT"}
+	data := []map[string]interface{}{
+		{".id": "id-0", "n": int64(1)},
+		{".id": "id-1", "n": nil},
+		{".id": "id-2"},
+	}
+	for _, datum := range data {
+		if err := Add("db1", "nulls", datum, schemaData); err != nil {
+			t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+		}
+	}
+	expectedIDs := []string{"id-1"}
+	ids, err := Null("db1", "nulls", "n")
+	if err != nil || !reflect.DeepEqual(ids, expectedIDs) {
+		t.Errorf("IDs were incorrect, got: %v, %v, want: %v", ids, err, expectedIDs)
+	}
+	expectedIDs = []string{"id-0"}
+	ids, _ = Range("db1", "nulls", "n", "INT", "!=", "2")
+	if !reflect.DeepEqual(ids, expectedIDs) {
+		t.Errorf("IDs were incorrect, got: %v, want: %v", ids, expectedIDs)
+	}
+
+	if err := Delete("db1", "nulls", data[1], schemaData); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	ids, _ = Null("db1", "nulls", "n")
+	if len(ids) != 0 {
+		t.Errorf("Length was incorrect, got: %v, want: %v", len(ids), 0)
+	}
+}
+
+func TestCount(t *testing.T) {
+	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb/config/config.json")
+	config.ReadConfigFile()
+	os.RemoveAll(config.Config.HomeDir + "/indices/db1/counts")
+	defer os.RemoveAll(config.Config.HomeDir + "/indices/db1/counts")
+
+	schemaData := map[string]string{"n": "INT"}
+	for idx, val := range []int64{1, 2, 2, 2, 3, 4, 5, 6, 7, 8} {
+		datum := map[string]interface{}{".id": fmt.Sprintf("id-%v", idx), "n": val}
+		if err := Add("db1", "counts", datum, schemaData); err != nil {
+			t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+		}
+	}
+	tests := []struct {
+		value    string
+		expected int
+	}{
+		{"2", 3},
+		{"8", 1},
+		{"9", 0},
+	}
+	for _, test := range tests {
+		count, err := Count("db1", "counts", "n", "INT", test.value)
+		if err != nil || count != test.expected {
+			t.Errorf("Count was incorrect, got: %v, %v, want: %v", count, err, test.expected)
+		}
+	}
+	if _, err := Count("db1", "counts", "n", "INT", "abc"); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "Invalid INT value: abc")
+	}
+
+	low, _ := Fraction("db1", "counts", "n", "INT", "1")
+	middle, _ := Fraction("db1", "counts", "n", "INT", "5")
+	high, _ := Fraction("db1", "counts", "n", "INT", "100")
+	if low != 0 || middle <= low || middle >= high || high != 1 {
+		t.Errorf("Fractions were incorrect, got: %v, %v, %v, want: %v", low, middle, high, "0 < middle < 1")
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		fieldType string
+		operator  string
+		stored    interface{}
+		value     string
+		expected  bool
+	}{
+		{"INT", ">", float64(10), "9", true},
+		{"INT", "<=", float64(10), "9", false},
+		{"STRING", "=", "foo", "foo", true},
+		{"ANY", "=", float64(1), "1", true},
+		{"ANY", "<", "10", "9", false},
+		{"ANY", "<", float64(10), "abc", false},
+		{"ANY", "!=", true, "1", true},
+		{"ANY", "=", nil, "1", false},
+		{"ANY", "!=", map[string]interface{}{}, "1", true},
+	}
+	for _, test := range tests {
+		matched, err := Matches(test.fieldType, test.operator, test.stored, test.value)
+		if err != nil {
+			t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+		}
+		if matched != test.expected {
+			t.Errorf("Match of %v %v %v was incorrect, got: %v, want: %v", test.stored, test.operator, test.value, matched, test.expected)
+		}
+	}
+}
+
+func TestSetUnique(t *testing.T) {
+	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb/config/config.json")
+	config.ReadConfigFile()
+	os.RemoveAll(config.Config.HomeDir + "/indices/db1/unique")
+	defer os.RemoveAll(config.Config.HomeDir + "/indices/db1/unique")
+
+	schemaData := map[string]string{"name": "STRING"}
+	data := []map[string]interface{}{{".id": "id-0", "name": "ann"}, {".id": "id-1", "name": "ann"}}
+	if err := SetUnique("db1", "unique", "name", true, data, schemaData); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+	if err := SetUnique("db1", "unique", "name", true, data[:1], schemaData); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if err := Add("db1", "unique", data[1], schemaData); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+
+	if err := SetUnique("db1", "unique", "name", false, nil, schemaData); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	definitions, _ := ReadDefinitions("db1", "unique")
+	if _, ok := definitions.Find("name"); ok {
+		t.Errorf("Definition was incorrect, got: %v, want: %v", definitions.Indices, "[]")
+	}
+	if err := Add("db1", "unique", data[1], schemaData); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+}
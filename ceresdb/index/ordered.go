@@ -0,0 +1,895 @@
+// ordered.go
+
+package index
+
+import (
+	"bufio"
+	"ceresdb/config"
+	"ceresdb/schema"
+	"ceresdb/utils"
+	"ceresdb/wal"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ORDERED_FILE_NAME is the sorted-run file kept in each field's index directory. Every line is
+// "<key> <value file name>" where the key is an order-preserving encoding of the value, so that
+// the lines sort in the same order as the typed values they represent. The name cannot clash
+// with a value file as "." is not part of the base64 alphabet.
+const ORDERED_FILE_NAME = ".ordered"
+
+// ORDERED_DELTA_FILE_NAME is appended to as values are added to or removed from a field, rather
+// than rewriting the sorted run each time. Every line is "+<line>" or "-<line>" for a line of the
+// sorted run. Reads merge it into the run, and once it outgrows ORDERED_DELTA_SIZE and
+// 1/ORDERED_DELTA_RATIO of the run it is compacted into a new run, which keeps the cost of
+// rewriting the run constant per value written.
+const ORDERED_DELTA_FILE_NAME = ".ordered-delta"
+const ORDERED_DELTA_SIZE = 64 * 1024
+const ORDERED_DELTA_RATIO = 16
+
+// SCAN_BLOCK_SIZE is the size below which a binary search falls back to reading lines in order
+const SCAN_BLOCK_SIZE = 4096
+
+func orderedPath(database, collection, key string) string {
+	return filepath.Join(config.Config.IndexDir, database, collection, key, ORDERED_FILE_NAME)
+}
+
+func deltaPath(database, collection, key string) string {
+	return filepath.Join(config.Config.IndexDir, database, collection, key, ORDERED_DELTA_FILE_NAME)
+}
+
+// OrderedKey encodes a value of the given schema type so that comparing encoded keys as strings
+// orders them the same as comparing the values themselves
+func OrderedKey(fieldType, value string) (string, error) {
+	if value == EMPTY_FIELD_VALUE {
+		value = ""
+	}
+	switch fieldType {
+	case "BOOL":
+		boolVal, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Invalid BOOL value: %v", value))
+		}
+		if boolVal {
+			return "1", nil
+		}
+		return "0", nil
+	case "INT":
+		intVal, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			floatVal, floatErr := strconv.ParseFloat(value, 64)
+			if floatErr != nil || floatVal != math.Trunc(floatVal) {
+				return "", errors.New(fmt.Sprintf("Invalid INT value: %v", value))
+			}
+			intVal = int64(floatVal)
+		}
+		return fmt.Sprintf("%016x", uint64(intVal)^(1<<63)), nil
+	case "FLOAT":
+		floatVal, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Invalid FLOAT value: %v", value))
+		}
+		bits := math.Float64bits(floatVal)
+		if bits&(1<<63) == 0 {
+			bits ^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return fmt.Sprintf("%016x", bits), nil
+	case "TIMESTAMP":
+		// Filters on timestamps can also be written as dates, which are midnight UTC
+		t, err := schema.ParseTimestamp(value)
+		if err != nil {
+			var dateErr error
+			if t, dateErr = schema.ParseDate(value); dateErr != nil {
+				return "", err
+			}
+		}
+		return fmt.Sprintf("%016x%08x", uint64(t.Unix())^(1<<63), t.Nanosecond()), nil
+	case "DATE":
+		t, err := schema.ParseDate(value)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%016x", uint64(t.Unix())^(1<<63)), nil
+	case "DURATION":
+		d, err := schema.ParseDuration(value)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%016x", uint64(d)^(1<<63)), nil
+	case "UUID":
+		canonical, err := schema.Canonical("UUID", value)
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString([]byte(canonical)), nil
+	case "ANY":
+		// Values without a declared type are tagged with the type they parse as so that values
+		// of different types never compare equal and each type sorts as a separate run
+		if value == "true" || value == "false" {
+			key, _ := OrderedKey("BOOL", value)
+			return "1" + key, nil
+		}
+		if key, err := OrderedKey("FLOAT", value); err == nil {
+			return "2" + key, nil
+		}
+		key, _ := OrderedKey("STRING", value)
+		return "3" + key, nil
+	}
+	return hex.EncodeToString([]byte(value)), nil
+}
+
+func orderedLine(fieldType, fileName string) (string, error) {
+	decodedVal, err := base64.StdEncoding.DecodeString(fileName)
+	if err != nil {
+		return "", err
+	}
+	key, err := OrderedKey(fieldType, string(decodedVal))
+	if err != nil {
+		return "", err
+	}
+	return key + " " + fileName, nil
+}
+
+func parseOrderedLine(line string) (string, string) {
+	parts := strings.SplitN(line, " ", 2)
+	if len(parts) != 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func readOrderedLines(path string) ([]string, error) {
+	data, err := wal.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	lines := strings.Split(string(data), "\n")
+	return lines[:len(lines)-1], nil
+}
+
+func writeOrderedLines(path string, lines []string) error {
+	if len(lines) == 0 {
+		if wal.Exists(path) {
+			return wal.Remove(path)
+		}
+		return nil
+	}
+	return wal.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+// addOrdered inserts a value file into the sorted run of its field
+func addOrdered(database, collection, key, fieldType, fileName string) error {
+	line, err := orderedLine(fieldType, fileName)
+	if err != nil {
+		return err
+	}
+	if !wal.Exists(orderedPath(database, collection, key)) {
+		if err := removeDelta(database, collection, key); err != nil {
+			return err
+		}
+		return writeOrderedLines(orderedPath(database, collection, key), []string{line})
+	}
+	return appendDelta(database, collection, key, "+"+line)
+}
+
+// deleteOrdered removes a value file from the sorted run of its field
+func deleteOrdered(database, collection, key, fieldType, fileName string) error {
+	line, err := orderedLine(fieldType, fileName)
+	if err != nil {
+		return err
+	}
+	if !wal.Exists(orderedPath(database, collection, key)) {
+		return nil
+	}
+	return appendDelta(database, collection, key, "-"+line)
+}
+
+// appendDelta records a change to the sorted run of a field, compacting the changes into the run
+// once there are enough of them
+func appendDelta(database, collection, key, change string) error {
+	if err := wal.AppendFile(deltaPath(database, collection, key), []byte(change+"\n")); err != nil {
+		return err
+	}
+	runSize, err := fileSize(orderedPath(database, collection, key))
+	if err != nil {
+		return err
+	}
+	deltaSize, err := fileSize(deltaPath(database, collection, key))
+	if err != nil {
+		return err
+	}
+	if deltaSize <= ORDERED_DELTA_SIZE || deltaSize*ORDERED_DELTA_RATIO <= runSize {
+		return nil
+	}
+	r, err := openOrdered(database, collection, key)
+	if err != nil || r == nil {
+		return err
+	}
+	defer r.file.Close()
+	lines := make([]string, 0)
+	err = r.walk("", func(valueKey, fileName string) (bool, error) {
+		lines = append(lines, valueKey+" "+fileName)
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeOrderedLines(orderedPath(database, collection, key), lines); err != nil {
+		return err
+	}
+	return removeDelta(database, collection, key)
+}
+
+func fileSize(path string) (int64, error) {
+	f, err := wal.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+	return f.Size()
+}
+
+func removeDelta(database, collection, key string) error {
+	path := deltaPath(database, collection, key)
+	if wal.Exists(path) {
+		return wal.Remove(path)
+	}
+	return nil
+}
+
+// readDelta returns the lines added to a sorted run since it was last compacted, in sorted
+// order, and those removed since
+func readDelta(path string) ([]string, map[string]bool, error) {
+	data, err := wal.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, map[string]bool{}, nil
+		}
+		return nil, nil, err
+	}
+	present := make(map[string]bool)
+	for _, change := range strings.Split(string(data), "\n") {
+		if len(change) < 2 {
+			continue
+		}
+		present[change[1:]] = change[0] == '+'
+	}
+	added := make([]string, 0)
+	removed := make(map[string]bool)
+	for line, isPresent := range present {
+		if isPresent {
+			added = append(added, line)
+		} else {
+			removed[line] = true
+		}
+	}
+	sort.Strings(added)
+	return added, removed, nil
+}
+
+// orderedRun is an open sorted-run file along with the changes made to it since it was written
+type orderedRun struct {
+	file wal.File
+	size int64
+	// added holds lines which may not be in the file yet in sorted order, and removed the lines
+	// in the file which should be skipped
+	added   []string
+	removed map[string]bool
+}
+
+func openOrdered(database, collection, key string) (*orderedRun, error) {
+	f, err := wal.Open(orderedPath(database, collection, key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	size, err := f.Size()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	added, removed, err := readDelta(deltaPath(database, collection, key))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &orderedRun{file: f, size: size, added: added, removed: removed}, nil
+}
+
+// addedFrom returns the index of the first added line whose key is not less than target
+func (r *orderedRun) addedFrom(target string) int {
+	return sort.Search(len(r.added), func(idx int) bool {
+		valueKey, _ := parseOrderedLine(r.added[idx])
+		return valueKey >= target
+	})
+}
+
+// lineStart returns the offset of the first line starting at or after offset
+func (r *orderedRun) lineStart(offset int64) (int64, error) {
+	if offset == 0 {
+		return 0, nil
+	}
+	buf := make([]byte, 256)
+	pos := offset - 1
+	for pos < r.size {
+		n, err := r.file.ReadAt(buf, pos)
+		if idx := strings.IndexByte(string(buf[:n]), '\n'); idx != -1 {
+			return pos + int64(idx) + 1, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		pos += int64(n)
+		if n == 0 {
+			break
+		}
+	}
+	return r.size, nil
+}
+
+// keyAt returns the key of the line starting at offset
+func (r *orderedRun) keyAt(offset int64) (string, error) {
+	reader := bufio.NewReader(io.NewSectionReader(r.file, offset, r.size-offset))
+	line, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	key, _ := parseOrderedLine(strings.TrimSuffix(line, "\n"))
+	return key, nil
+}
+
+// search returns the offset of the first line whose key is not less than target. It binary
+// searches the file until the remaining range is small enough to read through.
+func (r *orderedRun) search(target string) (int64, error) {
+	lo, hi := int64(0), r.size
+	for hi-lo > SCAN_BLOCK_SIZE {
+		mid, err := r.lineStart((lo + hi) / 2)
+		if err != nil {
+			return 0, err
+		}
+		if mid >= hi {
+			break
+		}
+		key, err := r.keyAt(mid)
+		if err != nil {
+			return 0, err
+		}
+		if key < target {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	offset := lo
+	reader := bufio.NewReader(io.NewSectionReader(r.file, lo, r.size-lo))
+	for offset < r.size {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		key, _ := parseOrderedLine(strings.TrimSuffix(line, "\n"))
+		if key >= target {
+			return offset, nil
+		}
+		offset += int64(len(line))
+		if err == io.EOF {
+			break
+		}
+	}
+	return r.size, nil
+}
+
+// walk calls fn with every key and value file name from the first key not less than from
+// onwards until fn returns false
+func (r *orderedRun) walk(from string, fn func(valueKey, fileName string) (bool, error)) error {
+	offset, err := r.search(from)
+	if err != nil {
+		return err
+	}
+	added := r.added[r.addedFrom(from):]
+	emit := func(line string) (bool, error) {
+		valueKey, fileName := parseOrderedLine(line)
+		return fn(valueKey, fileName)
+	}
+	reader := bufio.NewReader(io.NewSectionReader(r.file, offset, r.size-offset))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if len(line) > 0 {
+			for len(added) > 0 && added[0] < line {
+				if more, err := emit(added[0]); err != nil || !more {
+					return err
+				}
+				added = added[1:]
+			}
+			if len(added) > 0 && added[0] == line {
+				added = added[1:]
+			}
+			if !r.removed[line] {
+				if more, err := emit(line); err != nil || !more {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	for _, line := range added {
+		if more, err := emit(line); err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkReverse calls fn with every key and value file name from the end of the run backwards
+// until fn returns false
+func (r *orderedRun) walkReverse(fn func(valueKey, fileName string) (bool, error)) error {
+	added := r.added
+	emit := func(line string) (bool, error) {
+		valueKey, fileName := parseOrderedLine(line)
+		return fn(valueKey, fileName)
+	}
+	end := r.size
+	// rest holds the start of a line which began before the block last read
+	rest := ""
+	for end > 0 {
+		start := end - SCAN_BLOCK_SIZE
+		if start < 0 {
+			start = 0
+		}
+		buf := make([]byte, end-start)
+		if _, err := r.file.ReadAt(buf, start); err != nil && err != io.EOF {
+			return err
+		}
+		lines := strings.Split(string(buf)+rest, "\n")
+		rest = ""
+		if start > 0 {
+			rest = lines[0]
+			lines = lines[1:]
+		}
+		for idx := len(lines) - 1; idx >= 0; idx-- {
+			line := lines[idx]
+			if line == "" {
+				continue
+			}
+			for len(added) > 0 && added[len(added)-1] > line {
+				if more, err := emit(added[len(added)-1]); err != nil || !more {
+					return err
+				}
+				added = added[:len(added)-1]
+			}
+			if len(added) > 0 && added[len(added)-1] == line {
+				added = added[:len(added)-1]
+			}
+			if !r.removed[line] {
+				if more, err := emit(line); err != nil || !more {
+					return err
+				}
+			}
+		}
+		end = start
+	}
+	for idx := len(added) - 1; idx >= 0; idx-- {
+		if more, err := emit(added[idx]); err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+func readIDs(database, collection, key, fileName string) ([]string, error) {
+	data, err := wal.ReadFile(filepath.Join(config.Config.IndexDir, database, collection, key, fileName))
+	if err != nil {
+		return nil, err
+	}
+	ids := strings.Split(string(data), "\n")
+	return ids[:len(ids)-1], nil
+}
+
+// Count returns the number of records whose indexed field is equal to value
+func Count(database, collection, key, fieldType, value string) (int, error) {
+	target, err := OrderedKey(fieldType, value)
+	if err != nil {
+		return 0, err
+	}
+	r, err := openOrdered(database, collection, key)
+	if err != nil || r == nil {
+		return 0, err
+	}
+	defer r.file.Close()
+	count := 0
+	err = r.walk(target, func(valueKey, fileName string) (bool, error) {
+		if valueKey != target {
+			return false, nil
+		}
+		ids, err := readIDs(database, collection, key, fileName)
+		count = len(ids)
+		return false, err
+	})
+	return count, err
+}
+
+// Fraction estimates the share of an indexed field's values which sort before value, from where
+// the value falls within the field's sorted run
+func Fraction(database, collection, key, fieldType, value string) (float64, error) {
+	target, err := OrderedKey(fieldType, value)
+	if err != nil {
+		return 0, err
+	}
+	r, err := openOrdered(database, collection, key)
+	if err != nil || r == nil {
+		return 0, err
+	}
+	defer r.file.Close()
+	offset, err := r.search(target)
+	if err != nil {
+		return 0, err
+	}
+	total := r.size
+	below := r.addedFrom(target)
+	for idx, line := range r.added {
+		total += int64(len(line) + 1)
+		if idx < below {
+			offset += int64(len(line) + 1)
+		}
+	}
+	if total == 0 {
+		return 0, nil
+	}
+	return float64(offset) / float64(total), nil
+}
+
+// Null returns the IDs of records whose field is null
+func Null(database, collection, key string) ([]string, error) {
+	ids, err := readIDs(database, collection, key, valueFileName(nil))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	return ids, err
+}
+
+// Range returns the IDs of records whose field compares to value with operator, in ascending
+// order of the field's value. Records whose field is null never match.
+func Range(database, collection, key, fieldType, operator, value string) ([]string, error) {
+	target, err := OrderedKey(fieldType, value)
+	if err != nil {
+		return nil, err
+	}
+	r, err := openOrdered(database, collection, key)
+	if err != nil || r == nil {
+		return []string{}, err
+	}
+	defer r.file.Close()
+
+	output := make([]string, 0)
+	collect := func(fileName string) error {
+		ids, err := readIDs(database, collection, key, fileName)
+		if err != nil {
+			return err
+		}
+		output = append(output, ids...)
+		return nil
+	}
+
+	// Values indexed as ANY are only ordered against values of the same type
+	scope := ""
+	if fieldType == "ANY" {
+		scope = target[:1]
+	}
+	inScope := func(valueKey string) bool { return strings.HasPrefix(valueKey, scope) }
+
+	var start string
+	// match reports whether a key is within the range and whether any later key could be
+	var match func(valueKey string) (bool, bool)
+	switch operator {
+	case "=":
+		start = target
+		match = func(valueKey string) (bool, bool) { return valueKey == target, valueKey == target }
+	case ">=":
+		start = target
+		match = func(valueKey string) (bool, bool) { return inScope(valueKey), inScope(valueKey) }
+	case ">":
+		start = target
+		match = func(valueKey string) (bool, bool) { return valueKey != target && inScope(valueKey), inScope(valueKey) }
+	case "<":
+		start = scope
+		match = func(valueKey string) (bool, bool) { return valueKey < target, valueKey < target }
+	case "<=":
+		start = scope
+		match = func(valueKey string) (bool, bool) { return valueKey <= target, valueKey <= target }
+	case "!=":
+		match = func(valueKey string) (bool, bool) { return valueKey != target, true }
+	default:
+		return nil, errors.New(fmt.Sprintf("Invalid comparison operator: %v", operator))
+	}
+	err = r.walk(start, func(valueKey, fileName string) (bool, error) {
+		matched, more := match(valueKey)
+		if matched {
+			if err := collect(fileName); err != nil {
+				return false, err
+			}
+		}
+		return more, nil
+	})
+	return output, err
+}
+
+// Ordered calls fn with the IDs of the records holding each value of an indexed field, in
+// ascending order of the value or descending if descending is set, until fn returns false
+func Ordered(database, collection, key string, descending bool, fn func(ids []string) (bool, error)) error {
+	r, err := openOrdered(database, collection, key)
+	if err != nil || r == nil {
+		return err
+	}
+	defer r.file.Close()
+	visit := func(valueKey, fileName string) (bool, error) {
+		ids, err := readIDs(database, collection, key, fileName)
+		if err != nil {
+			return false, err
+		}
+		return fn(ids)
+	}
+	if descending {
+		return r.walkReverse(visit)
+	}
+	return r.walk("", visit)
+}
+
+// Values calls fn with every value of an indexed field, typed by the field's schema type, along
+// with the IDs of the records holding it, in ascending order of the value
+func Values(database, collection, key, fieldType string, fn func(value interface{}, ids []string) error) error {
+	r, err := openOrdered(database, collection, key)
+	if err != nil || r == nil {
+		return err
+	}
+	defer r.file.Close()
+	return r.walk("", func(valueKey, fileName string) (bool, error) {
+		decodedVal, err := base64.StdEncoding.DecodeString(fileName)
+		if err != nil {
+			return false, err
+		}
+		value, err := typedValue(fieldType, string(decodedVal))
+		if err != nil {
+			return false, err
+		}
+		ids, err := readIDs(database, collection, key, fileName)
+		if err != nil {
+			return false, err
+		}
+		return true, fn(value, ids)
+	})
+}
+
+// typedValue converts a value read from an index file name back to its schema type
+func typedValue(fieldType, value string) (interface{}, error) {
+	if value == EMPTY_FIELD_VALUE {
+		value = ""
+	}
+	switch fieldType {
+	case "INT":
+		return strconv.ParseInt(value, 10, 64)
+	case "FLOAT":
+		return strconv.ParseFloat(value, 64)
+	case "BOOL":
+		return strconv.ParseBool(value)
+	}
+	return value, nil
+}
+
+// Prefix returns the IDs of records whose STRING field starts with prefix, in ascending order
+// of the field's value
+func Prefix(database, collection, key, prefix string) ([]string, error) {
+	return PrefixMatch(database, collection, key, prefix, nil)
+}
+
+// PrefixMatch returns the IDs of records whose STRING field starts with prefix and, if match is
+// given, whose value it matches, in ascending order of the field's value. Only the values in the
+// index are read, so an empty prefix matches every value without reading any records.
+func PrefixMatch(database, collection, key, prefix string, match func(value string) bool) ([]string, error) {
+	target := hex.EncodeToString([]byte(prefix))
+	r, err := openOrdered(database, collection, key)
+	if err != nil || r == nil {
+		return []string{}, err
+	}
+	defer r.file.Close()
+	output := make([]string, 0)
+	err = r.walk(target, func(valueKey, fileName string) (bool, error) {
+		if !strings.HasPrefix(valueKey, target) {
+			return false, nil
+		}
+		if match != nil {
+			decodedVal, err := base64.StdEncoding.DecodeString(fileName)
+			if err != nil {
+				return false, err
+			}
+			value, _ := typedValue("STRING", string(decodedVal))
+			if !match(value.(string)) {
+				return true, nil
+			}
+		}
+		ids, err := readIDs(database, collection, key, fileName)
+		if err != nil {
+			return false, err
+		}
+		output = append(output, ids...)
+		return true, nil
+	})
+	return output, err
+}
+
+// Migrate builds the sorted run for every indexed field of a collection which does not have
+// one yet, such as indices written before sorted runs existed
+func Migrate(database, collection string, schemaData map[string]string) error {
+	collectionPath := filepath.Join(config.Config.IndexDir, database, collection)
+	names, err := wal.ReadDir(collectionPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	definitions, err := ReadDefinitions(database, collection)
+	if err != nil {
+		return err
+	}
+	for _, key := range names {
+		fieldPath := filepath.Join(collectionPath, key)
+		if info, err := os.Stat(fieldPath); err != nil || !info.IsDir() || key == TEXT_DIR_NAME {
+			continue
+		}
+		fieldType := schemaData[key]
+		if _, ok := definitions.Find(key); ok {
+			fieldType = FieldType(key, schemaData)
+		}
+		renamed, err := canonicalizeValues(database, collection, key, fieldType)
+		if err != nil {
+			return err
+		}
+		if !renamed && wal.Exists(orderedPath(database, collection, key)) {
+			continue
+		}
+		if err := rebuildOrdered(database, collection, key, fieldType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canonicalizeValues moves numbers which were indexed in an older format, such as "1e+06", to the
+// file for their canonical form, reporting whether any were moved
+func canonicalizeValues(database, collection, key, fieldType string) (bool, error) {
+	if fieldType != "INT" && fieldType != "FLOAT" && fieldType != "ANY" {
+		return false, nil
+	}
+	fieldPath := filepath.Join(config.Config.IndexDir, database, collection, key)
+	files, err := wal.ListFiles(fieldPath)
+	if err != nil {
+		return false, err
+	}
+	renamed := false
+	for _, file := range files {
+		fileName := filepath.Base(file)
+		if fileName == ORDERED_FILE_NAME || fileName == ORDERED_DELTA_FILE_NAME || filepath.Dir(file) != fieldPath {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(fileName)
+		if err != nil {
+			continue
+		}
+		value := string(decoded)
+		if fieldType == "ANY" && !strings.ContainsAny(value, "eE") {
+			continue
+		}
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			continue
+		}
+		canonical := valueFileName(json.Number(value))
+		if canonical == fileName {
+			continue
+		}
+		data, err := wal.ReadFile(file)
+		if err != nil {
+			return renamed, err
+		}
+		if err := wal.AppendFile(filepath.Join(fieldPath, canonical), data); err != nil {
+			return renamed, err
+		}
+		if err := wal.Remove(file); err != nil {
+			return renamed, err
+		}
+		renamed = true
+	}
+	return renamed, nil
+}
+
+func rebuildOrdered(database, collection, key, fieldType string) error {
+	fieldPath := filepath.Join(config.Config.IndexDir, database, collection, key)
+	files, err := wal.ListFiles(fieldPath)
+	if err != nil {
+		return err
+	}
+	lines := make([]string, 0, len(files))
+	for _, file := range files {
+		fileName := filepath.Base(file)
+		if fileName == ORDERED_FILE_NAME || fileName == ORDERED_DELTA_FILE_NAME || fileName == valueFileName(nil) || filepath.Dir(file) != fieldPath {
+			continue
+		}
+		line, err := orderedLine(fieldType, fileName)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	if err := removeDelta(database, collection, key); err != nil {
+		return err
+	}
+	return writeOrderedLines(orderedPath(database, collection, key), lines)
+}
+
+// Matches reports whether a stored value compares to value with operator, using the same
+// ordering as the index. It is used to filter on fields which are not indexed. Null and missing
+// values never match.
+func Matches(fieldType, operator string, stored interface{}, value string) (bool, error) {
+	target, err := OrderedKey(fieldType, value)
+	if err != nil {
+		return false, err
+	}
+	if stored == nil {
+		return false, nil
+	}
+	if !isScalar(stored) {
+		return operator == "!=", nil
+	}
+	stringVal := utils.FormatValue(stored)
+	if len(stringVal) == 0 {
+		stringVal = EMPTY_FIELD_VALUE
+	}
+	storedKey, err := OrderedKey(fieldType, stringVal)
+	if err != nil {
+		return operator == "!=", nil
+	}
+	if fieldType == "ANY" && operator != "!=" && storedKey[:1] != target[:1] {
+		return false, nil
+	}
+	switch operator {
+	case "=":
+		return storedKey == target, nil
+	case "!=":
+		return storedKey != target, nil
+	case ">":
+		return storedKey > target, nil
+	case ">=":
+		return storedKey >= target, nil
+	case "<":
+		return storedKey < target, nil
+	case "<=":
+		return storedKey <= target, nil
+	}
+	return false, errors.New(fmt.Sprintf("Invalid comparison operator: %v", operator))
+}
@@ -0,0 +1,419 @@
+// text.go
+
+package index
+
+import (
+	"ceresdb/config"
+	"ceresdb/utils"
+	"ceresdb/wal"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// TEXT_DIR_NAME is the directory in each collection's index directory which holds its full-text
+// indices. Each one is a directory named after its field holding a file for every term, listing
+// "<id> <term frequency> <number of terms>" for each record containing the term. Removed records
+// are marked with a "-<id>" line rather than rewriting the file, which hides the lines for the
+// record above it.
+const TEXT_DIR_NAME = ".text"
+
+// TEXT_STATS_FILE_NAME is the file of a full-text index holding "<documents> <total terms>
+// <removed lines>", which is all searches need to know about records outside their terms. It
+// cannot clash with a term's file as "." is not part of the URL-safe base64 alphabet.
+const TEXT_STATS_FILE_NAME = ".stats"
+
+// TEXT_COMPACT_SIZE is the number of removed lines a full-text index collects before every term
+// file is rewritten without them, as long as they also outnumber the documents indexed
+const TEXT_COMPACT_SIZE = 1024
+
+// BM25 parameters used to rank search results
+const (
+	BM25_K1 = 1.2
+	BM25_B  = 0.75
+)
+
+// stopWords are left out of full-text indices and searches
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "but": true,
+	"by": true, "for": true, "if": true, "in": true, "into": true, "is": true, "it": true, "no": true,
+	"not": true, "of": true, "on": true, "or": true, "such": true, "that": true, "the": true,
+	"their": true, "then": true, "there": true, "these": true, "they": true, "this": true, "to": true,
+	"was": true, "will": true, "with": true,
+}
+
+func textPath(database, collection, field string) string {
+	return filepath.Join(config.Config.IndexDir, database, collection, TEXT_DIR_NAME, field)
+}
+
+func termFileName(term string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(term))
+}
+
+// Terms splits text into the terms it is indexed and searched by. Text is split into runs of
+// letters and digits which are lowercased and stemmed, leaving out stop words.
+func Terms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	output := make([]string, 0, len(words))
+	for _, word := range words {
+		if stopWords[word] {
+			continue
+		}
+		output = append(output, stem(word))
+	}
+	return output
+}
+
+// isConsonant reports whether the letter at i is a consonant, where "y" is a consonant unless it
+// follows one
+func isConsonant(word string, i int) bool {
+	switch word[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !isConsonant(word, i-1)
+	}
+	return true
+}
+
+// measure counts the vowel-consonant sequences in a word
+func measure(word string) int {
+	count := 0
+	i := 0
+	for i < len(word) && isConsonant(word, i) {
+		i++
+	}
+	for i < len(word) {
+		for i < len(word) && !isConsonant(word, i) {
+			i++
+		}
+		if i >= len(word) {
+			break
+		}
+		for i < len(word) && isConsonant(word, i) {
+			i++
+		}
+		count++
+	}
+	return count
+}
+
+func hasVowel(word string) bool {
+	for i := range word {
+		if !isConsonant(word, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// endsCVC reports whether a word ends consonant-vowel-consonant, where the last consonant is not
+// "w", "x", or "y"
+func endsCVC(word string) bool {
+	n := len(word)
+	return n >= 3 && isConsonant(word, n-3) && !isConsonant(word, n-2) && isConsonant(word, n-1) && !strings.ContainsRune("wxy", rune(word[n-1]))
+}
+
+// stem removes plurals and -ed, -ing, -y, and -e endings from English words, following the first
+// and last steps of the Porter stemmer. Words which are not plain ASCII letters are left as they
+// are.
+func stem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for _, r := range word {
+		if r < 'a' || r > 'z' {
+			return word
+		}
+	}
+
+	switch {
+	case strings.HasSuffix(word, "sses"), strings.HasSuffix(word, "ies"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ss"):
+	case strings.HasSuffix(word, "s"):
+		word = word[:len(word)-1]
+	}
+
+	removed := false
+	switch {
+	case strings.HasSuffix(word, "eed"):
+		if measure(word[:len(word)-3]) > 0 {
+			word = word[:len(word)-1]
+		}
+	case strings.HasSuffix(word, "ed") && hasVowel(word[:len(word)-2]):
+		word = word[:len(word)-2]
+		removed = true
+	case strings.HasSuffix(word, "ing") && hasVowel(word[:len(word)-3]):
+		word = word[:len(word)-3]
+		removed = true
+	}
+	if removed {
+		n := len(word)
+		switch {
+		case strings.HasSuffix(word, "at"), strings.HasSuffix(word, "bl"), strings.HasSuffix(word, "iz"):
+			word += "e"
+		case n >= 2 && word[n-1] == word[n-2] && isConsonant(word, n-1) && !strings.ContainsRune("lsz", rune(word[n-1])):
+			word = word[:n-1]
+		case measure(word) == 1 && endsCVC(word):
+			word += "e"
+		}
+	}
+
+	if strings.HasSuffix(word, "y") && hasVowel(word[:len(word)-1]) {
+		word = word[:len(word)-1] + "i"
+	}
+
+	if strings.HasSuffix(word, "e") {
+		root := word[:len(word)-1]
+		if m := measure(root); m > 1 || (m == 1 && !endsCVC(root)) {
+			word = root
+		}
+	}
+	return word
+}
+
+// termFrequencies returns the number of times each term appears in a value along with the total
+// number of terms. Values which are not strings have no terms.
+func termFrequencies(val interface{}) (map[string]int, int) {
+	text, ok := val.(string)
+	if !ok {
+		return nil, 0
+	}
+	terms := Terms(text)
+	frequencies := make(map[string]int, len(terms))
+	for _, term := range terms {
+		frequencies[term]++
+	}
+	return frequencies, len(terms)
+}
+
+// textStats are the aggregates kept in the stats file of a full-text index
+type textStats struct {
+	documents int
+	total     int
+	removed   int
+}
+
+// posting is a record's entry in the file of a term
+type posting struct {
+	frequency int
+	length    int
+}
+
+func readTextStats(fieldPath string) (textStats, error) {
+	data, err := wal.ReadFile(filepath.Join(fieldPath, TEXT_STATS_FILE_NAME))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return textStats{}, nil
+		}
+		return textStats{}, err
+	}
+	var stats textStats
+	if _, err := fmt.Sscanf(string(data), "%d %d %d", &stats.documents, &stats.total, &stats.removed); err != nil {
+		return textStats{}, errors.New(fmt.Sprintf("Invalid full-text index stats in %v: %v", fieldPath, err))
+	}
+	return stats, nil
+}
+
+func writeTextStats(fieldPath string, stats textStats) error {
+	return wal.WriteFile(filepath.Join(fieldPath, TEXT_STATS_FILE_NAME), []byte(fmt.Sprintf("%v %v %v\n", stats.documents, stats.total, stats.removed)))
+}
+
+// addText writes a record's field to the field's full-text index
+func addText(database, collection, field string, datum map[string]interface{}) error {
+	val, _ := Resolve(datum, field)
+	frequencies, length := termFrequencies(val)
+	if length == 0 {
+		return nil
+	}
+	id := datum[".id"].(string)
+	fieldPath := textPath(database, collection, field)
+	for term, frequency := range frequencies {
+		if err := wal.AppendFile(filepath.Join(fieldPath, termFileName(term)), []byte(fmt.Sprintf("%v %v %v\n", id, frequency, length))); err != nil {
+			return err
+		}
+	}
+	stats, err := readTextStats(fieldPath)
+	if err != nil {
+		return err
+	}
+	stats.documents++
+	stats.total += length
+	return writeTextStats(fieldPath, stats)
+}
+
+// deleteText removes a record's field from the field's full-text index by marking it removed in
+// the file of each of its terms
+func deleteText(database, collection, field string, datum map[string]interface{}) error {
+	val, _ := Resolve(datum, field)
+	frequencies, length := termFrequencies(val)
+	if length == 0 {
+		return nil
+	}
+	id := datum[".id"].(string)
+	fieldPath := textPath(database, collection, field)
+	for term := range frequencies {
+		if err := wal.AppendFile(filepath.Join(fieldPath, termFileName(term)), []byte("-"+id+"\n")); err != nil {
+			return err
+		}
+	}
+	stats, err := readTextStats(fieldPath)
+	if err != nil {
+		return err
+	}
+	stats.documents--
+	stats.total -= length
+	stats.removed += len(frequencies)
+	if stats.removed > TEXT_COMPACT_SIZE && stats.removed > stats.documents {
+		if err := compactText(fieldPath); err != nil {
+			return err
+		}
+		stats.removed = 0
+	}
+	return writeTextStats(fieldPath, stats)
+}
+
+// compactText rewrites every term file of a full-text index without the lines of removed records,
+// removing the files of terms no record contains any more
+func compactText(fieldPath string) error {
+	names, err := wal.ReadDir(fieldPath)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == TEXT_STATS_FILE_NAME {
+			continue
+		}
+		path := filepath.Join(fieldPath, name)
+		postings, err := readPostings(path)
+		if err != nil {
+			return err
+		}
+		if len(postings) == 0 {
+			if err := wal.Remove(path); err != nil {
+				return err
+			}
+			continue
+		}
+		ids := make([]string, 0, len(postings))
+		for id := range postings {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		var builder strings.Builder
+		for _, id := range ids {
+			builder.WriteString(fmt.Sprintf("%v %v %v\n", id, postings[id].frequency, postings[id].length))
+		}
+		if err := wal.WriteFile(path, []byte(builder.String())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPostings reads the file of a term into a map of record IDs to their entries, leaving out
+// records which have been removed since their lines were written
+func readPostings(path string) (map[string]posting, error) {
+	postings := make(map[string]posting)
+	data, err := wal.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return postings, nil
+		}
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "-") {
+			delete(postings, line[1:])
+			continue
+		}
+		parts := strings.Split(line, " ")
+		if len(parts) != 3 {
+			continue
+		}
+		frequency, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, err
+		}
+		postings[parts[0]] = posting{frequency: frequency, length: length}
+	}
+	return postings, nil
+}
+
+// BuildText writes the full-text index of a field from a set of records, replacing anything
+// already in it
+func BuildText(database, collection, field string, data []map[string]interface{}) error {
+	if err := DropText(database, collection, field); err != nil {
+		return err
+	}
+	for _, datum := range data {
+		if err := addText(database, collection, field, datum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DropText removes the full-text index of a field
+func DropText(database, collection, field string) error {
+	return wal.RemoveAll(textPath(database, collection, field))
+}
+
+// Search returns the relevance of every record whose field contains any of the terms of query,
+// read from the files of those terms and the stats of the field's full-text index
+func Search(database, collection, field, query string) (map[string]float64, error) {
+	fieldPath := textPath(database, collection, field)
+	stats, err := readTextStats(fieldPath)
+	if err != nil {
+		return nil, err
+	}
+	lengths := make(map[string]int)
+	postings := make(map[string]map[string]int)
+	for _, term := range utils.RemoveDuplicateValues(Terms(query)) {
+		entries, err := readPostings(filepath.Join(fieldPath, termFileName(term)))
+		if err != nil {
+			return nil, err
+		}
+		postings[term] = make(map[string]int, len(entries))
+		for id, entry := range entries {
+			postings[term][id] = entry.frequency
+			lengths[id] = entry.length
+		}
+	}
+	return Score(stats.documents, stats.total, lengths, postings), nil
+}
+
+// Score ranks documents with BM25, given the number of documents and terms in the whole field, the
+// number of terms in each matching document and the frequency of each search term in the documents
+// containing it
+func Score(documents, total int, lengths map[string]int, postings map[string]map[string]int) map[string]float64 {
+	scores := make(map[string]float64)
+	if documents <= 0 {
+		return scores
+	}
+	count := float64(documents)
+	average := float64(total) / count
+	for _, frequencies := range postings {
+		idf := math.Log(1 + (count-float64(len(frequencies))+0.5)/(float64(len(frequencies))+0.5))
+		for id, frequency := range frequencies {
+			tf := float64(frequency)
+			norm := 1 - BM25_B + BM25_B*float64(lengths[id])/average
+			scores[id] += idf * tf * (BM25_K1 + 1) / (tf + BM25_K1*norm)
+		}
+	}
+	return scores
+}
@@ -4,14 +4,22 @@ package main
 
 import (
 	"ceresdb/aql"
+	"ceresdb/audit"
 	"ceresdb/auth"
+	"ceresdb/collection"
 	"ceresdb/config"
 	"ceresdb/freespace"
+	"ceresdb/index"
 	"ceresdb/logging"
 	"ceresdb/manager"
+	"ceresdb/permit"
 	"ceresdb/queue"
 	"ceresdb/schema"
+	"ceresdb/user"
+	"ceresdb/wal"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -28,13 +36,19 @@ import (
 type Query struct {
 	Auth        string `json:"_auth"`
 	QueryString string `json:"query"`
+	Stream      bool   `json:"stream"`
 }
 
+// STREAM_BUFFER_SIZE is the number of streamed records which can be waiting to be written to the
+// client before the query blocks
+const STREAM_BUFFER_SIZE = 256
+
 type Snapshot struct {
-	FreeSpace freespace.FreeSpaceStruct `json:"free_space"`
-	Schema    schema.SchemaStruct       `json:"schema"`
-	Data      map[string]interface{}    `json:"data"`
-	Indices   map[string]interface{}    `json:"indices"`
+	FreeSpace freespace.FreeSpaceStruct             `json:"free_space"`
+	Schema    schema.SchemaStruct                   `json:"schema"`
+	Policies  map[string]map[string][]schema.Policy `json:"policies"`
+	Data      map[string]interface{}                `json:"data"`
+	Indices   map[string]interface{}                `json:"indices"`
 }
 
 var router *gin.Engine
@@ -47,9 +61,31 @@ func main() {
 	config.ReadConfigFile()
 	logging.Initialize(config.Config.LogLevel)
 	logging.INFO("Starting Ceres server")
+
+	logging.TRACE("Replaying write-ahead log")
+	if err := wal.Recover(); err != nil {
+		logging.FATAL(fmt.Sprintf("Unable to replay write-ahead log: %v", err))
+	}
+	wal.OnAbort(reloadState)
+
 	freespace.LoadFreeSpace()
 	schema.LoadSchema()
-	queue.InitQueue()
+	if err := schema.LoadPolicies(); err != nil {
+		logging.FATAL(fmt.Sprintf("Unable to load policies: %v", err))
+	}
+
+	logging.TRACE("Migrating indices")
+	if err := migrateIndices(); err != nil {
+		logging.FATAL(fmt.Sprintf("Unable to migrate indices: %v", err))
+	}
+	migrateUniqueUsernames()
+	migratePermitScopes()
+
+	queue.InitQueue(handleQuery)
+
+	if err := manager.ResumeIndexBuilds(); err != nil {
+		logging.FATAL(fmt.Sprintf("Unable to resume index builds: %v", err))
+	}
 
 	logging.TRACE("Ensuring data directory exists")
 	os.MkdirAll(config.Config.DataDir, 0755)
@@ -57,12 +93,21 @@ func main() {
 	logging.TRACE("Ensuring _auth database exists")
 	auth.CheckAuthDatabase()
 
+	logging.TRACE("Loading audit log")
+	if err := audit.Load(); err != nil {
+		logging.ERROR(fmt.Sprintf("Unable to verify audit log: %v", err))
+	}
+	if err := audit.CheckDatabase(); err != nil {
+		logging.FATAL(fmt.Sprintf("Unable to create _audit database: %v", err))
+	}
+	if err := auth.LoadTokenSecret(); err != nil {
+		logging.FATAL(fmt.Sprintf("Unable to load token secret: %v", err))
+	}
+
 	if config.Config.Leader != "" {
 		go snapshotProcessor()
 	}
 
-	go queryProcessor()
-
 	routerPort := ":" + strconv.Itoa(config.Config.Port)
 
 	logging.INFO(fmt.Sprintf("Listening for connections on port %v", config.Config.Port))
@@ -75,6 +120,79 @@ func main() {
 	router.Run(routerPort)
 }
 
+// reloadState discards in-memory free space, schema, and policy changes made by a write that was
+// not committed to the write-ahead log
+func reloadState() {
+	if err := freespace.LoadFreeSpace(); err != nil {
+		logging.ERROR(fmt.Sprintf("Unable to reload free space: %v", err))
+	}
+	if err := schema.LoadSchema(); err != nil {
+		logging.ERROR(fmt.Sprintf("Unable to reload schema: %v", err))
+	}
+	if err := schema.LoadPolicies(); err != nil {
+		logging.ERROR(fmt.Sprintf("Unable to reload policies: %v", err))
+	}
+}
+
+// migrateIndices brings the indices of every collection up to date with the current index layout
+func migrateIndices() error {
+	for dbName, db := range schema.Schema.Databases {
+		for colName, col := range db.Collections {
+			wal.Begin()
+			if err := wal.End(index.Migrate(dbName, colName, col.Types)); err != nil {
+				return err
+			}
+			definitions, err := index.ReadDefinitions(dbName, colName)
+			if err != nil {
+				return err
+			}
+			if !definitions.Nulls {
+				if err := collection.Reindex(dbName, colName); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// migrateUniqueUsernames adds the unique constraint on usernames to user and permit collections
+// created before usernames had to be unique. Collections which already hold duplicate usernames
+// are left as they are.
+func migrateUniqueUsernames() {
+	for dbName, db := range schema.Schema.Databases {
+		col, ok := db.Collections["_users"]
+		if !ok || col.Unique["username"] {
+			continue
+		}
+		if err := collection.AddUnique(dbName, "_users", "username"); err != nil {
+			logging.WARN(fmt.Sprintf("Unable to make usernames unique in database %v: %v", dbName, err))
+		}
+	}
+}
+
+// migratePermitScopes adds the collections field to permit collections created before permits
+// could be scoped to collections
+func migratePermitScopes() {
+	for dbName, db := range schema.Schema.Databases {
+		col, ok := db.Collections["_users"]
+		if dbName == "_auth" || !ok {
+			continue
+		}
+		if _, ok := col.Types["collections"]; ok {
+			continue
+		}
+		newSchema := make(map[string]interface{})
+		for key, field := range col.AllFields() {
+			newSchema[key] = field.Document()
+		}
+		newSchema["collections"] = permit.Schema["collections"]
+		if _, err := collection.Migrate(dbName, "_users", newSchema, false); err != nil {
+			logging.WARN(fmt.Sprintf("Unable to add collection scopes to permits in database %v: %v", dbName, err))
+		}
+	}
+}
+
 func snapshotProcessor() {
 	for {
 		if config.Config.FollowerAuth == "" {
@@ -104,47 +222,116 @@ func snapshotProcessor() {
 			continue
 		}
 
-		freespace_bytes, _ := json.Marshal(snapshot.FreeSpace)
-		schema_bytes, _ := json.Marshal(snapshot.Schema)
+		applySnapshot(snapshot)
+		time.Sleep(SNAPSHOT_DELAY * time.Second)
+	}
+}
 
-		json.Unmarshal(freespace_bytes, &freespace.FreeSpace)
-		json.Unmarshal(schema_bytes, &schema.Schema)
+// applySnapshot replaces the local data with a snapshot from the leader while holding the whole
+// catalog so that no query sees a partially applied snapshot
+func applySnapshot(snapshot Snapshot) {
+	locks := queue.NewLockSet()
+	locks.AddCatalog(queue.LockWrite)
+	locks.Acquire()
+	defer locks.Release()
 
-		freespace.WriteFreeSpace()
-		schema.WriteSchema()
+	freespace_bytes, _ := json.Marshal(snapshot.FreeSpace)
+	schema_bytes, _ := json.Marshal(snapshot.Schema)
 
-		err = writeDataToStructure(config.Config.DataDir, snapshot.Data)
-		if err != nil {
-			logging.ERROR(fmt.Sprintf("Unable to write data: %v", err))
-		}
-		err = writeDataToStructure(config.Config.IndexDir, snapshot.Indices)
-		if err != nil {
-			logging.ERROR(fmt.Sprintf("Unable to write indices: %v", err))
-		}
-		time.Sleep(SNAPSHOT_DELAY * time.Second)
+	json.Unmarshal(freespace_bytes, &freespace.FreeSpace)
+	json.Unmarshal(schema_bytes, &schema.Schema)
+
+	schema.Policies = snapshot.Policies
+	if schema.Policies == nil {
+		schema.Policies = make(map[string]map[string][]schema.Policy)
+	}
+
+	freespace.WriteFreeSpace()
+	schema.WriteSchema()
+	schema.WritePolicies()
+
+	err := writeDataToStructure(config.Config.DataDir, snapshot.Data)
+	if err != nil {
+		logging.ERROR(fmt.Sprintf("Unable to write data: %v", err))
+	}
+	err = writeDataToStructure(config.Config.IndexDir, snapshot.Indices)
+	if err != nil {
+		logging.ERROR(fmt.Sprintf("Unable to write indices: %v", err))
 	}
 }
 
-func queryProcessor() {
-	for {
-		if len(queue.Queue) > 0 {
-			if queue.Queue[0] != nil && !queue.Queue[0].Finished {
-				data, err := handleQuery(*queue.Queue[0])
-				queue.Queue[0].Data = data
-				queue.Queue[0].Err = err
-				queue.Queue[0].Finished = true
-			} else {
-				time.Sleep(1 * time.Millisecond)
+// authLocks adds the locks needed to authenticate a query and verify its actions, API keys are
+// looked up in their own collection
+func authLocks(query *queue.QueueObject, locks *queue.LockSet) {
+	locks.Add("_auth._users", queue.LockRead)
+	locks.Add("_auth._roles", queue.LockRead)
+	if user.IsKey(query.Token) {
+		locks.Add("_auth._keys", queue.LockRead)
+	}
+}
+
+// handleQuery runs a query and records it in the audit log, whether or not it succeeds
+func handleQuery(query *queue.QueueObject) ([]map[string]interface{}, error) {
+	entry := audit.Entry{Source: query.Source, Query: query.QueryString, Action: "QUERY"}
+	if query.Token == "" {
+		entry.Username = strings.SplitN(query.Auth, ":", 2)[0]
+	}
+	// A query which panics is still recorded, the queue turns the panic into its error
+	finished := false
+	defer func() {
+		if !finished {
+			entry.Error = "query failed unexpectedly"
+			if auditErr := audit.Record(entry); auditErr != nil {
+				logging.ERROR(fmt.Sprintf("Unable to write audit log: %v", auditErr))
 			}
-		} else {
-			time.Sleep(1 * time.Millisecond)
 		}
+	}()
+	dataOut, err := runQuery(query, &entry)
+	finished = true
+	entry.Success = err == nil
+	if err != nil {
+		entry.Error = err.Error()
 	}
+	if auditErr := audit.Record(entry); auditErr != nil {
+		logging.ERROR(fmt.Sprintf("Unable to write audit log: %v", auditErr))
+	}
+	return dataOut, err
 }
 
-func handleQuery(query queue.QueueObject) ([]map[string]interface{}, error) {
+func runQuery(query *queue.QueueObject, entry *audit.Entry) (dataOut []map[string]interface{}, err error) {
+	if query.Login {
+		entry.Action = "LOGIN"
+		locks := queue.NewLockSet()
+		authLocks(query, locks)
+		locks.Acquire()
+		defer locks.Release()
+		session, err := auth.Authenticate(query.Auth, query.Token)
+		if err != nil {
+			return nil, err
+		}
+		entry.Username, entry.Authenticated = session.Username, true
+		token, expires, err := auth.IssueSession(session.Username)
+		if err != nil {
+			return nil, err
+		}
+		return []map[string]interface{}{{"token": token, "expires": expires.UTC().Format(time.RFC3339)}}, nil
+	}
+
 	if query.Snapshot {
 		logging.DEBUG("Begin handling Snapshot")
+		entry.Action = "SNAPSHOT"
+		locks := queue.NewLockSet()
+		locks.Write = true
+		locks.Acquire()
+		defer locks.Release()
+		session, err := auth.Authenticate(query.Auth, query.Token)
+		if err != nil {
+			return nil, err
+		}
+		entry.Username, entry.Authenticated = session.Username, true
+		if err := auth.VerifySnapshot(session); err != nil {
+			return nil, err
+		}
 		dataOut, err := handleSnapshot()
 		if err != nil {
 			return nil, err
@@ -154,32 +341,126 @@ func handleQuery(query queue.QueueObject) ([]map[string]interface{}, error) {
 	}
 
 	logging.DEBUG("Begin handling query")
-	authString := query.Auth
-	text := query.QueryString
-
-	parts := strings.Split(authString, ":")
-	username := parts[0]
-	password := parts[1]
 
 	logging.TRACE("Parsing AQL")
-	actions, err := aql.Parse(text)
+	actions, err := aql.Parse(query.QueryString)
 	if err != nil {
 		return nil, err
 	}
+
+	entry.Identifiers = audit.Identifiers(actions)
+
+	logging.TRACE("Acquiring locks")
+	locks := queue.Plan(actions)
+	authLocks(query, locks)
+	// Reading the _audit database first copies the latest entries into it
+	syncAudit := false
+	for _, action := range actions {
+		syncAudit = syncAudit || audit.Targets(action)
+	}
+	if syncAudit {
+		locks.Add(audit.DATABASE+"."+audit.COLLECTION, queue.LockWrite)
+	}
+	locks.Acquire()
+	defer locks.Release()
+	// Only a writing query can have a transaction open, any batch seen by a reader belongs to
+	// the writer running alongside it. Rolling back in a defer also closes a transaction left
+	// open by a panic, before the locks are released.
+	defer func() {
+		if locks.Write && wal.Active() {
+			logging.DEBUG("Rolling back transaction")
+			manager.ProcessRollback()
+			if err == nil {
+				dataOut, err = nil, errors.New("transaction was not committed and has been rolled back")
+			}
+		}
+	}()
+
+	// Credentials are checked once, each action only checks the user's role and permits
+	session, err := auth.Authenticate(query.Auth, query.Token)
+	if err != nil {
+		return nil, err
+	}
+	entry.Username, entry.Authenticated = session.Username, true
+
+	if syncAudit && config.Config.Leader == "" {
+		if err := audit.Sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	dataOut, err = processActions(query, session, actions, entry)
+	if err != nil {
+		return nil, err
+	}
+	logging.TRACE(fmt.Sprintf("Data out: %v", dataOut))
+	logging.DEBUG("Done!")
+	return dataOut, nil
+}
+
+func processActions(query *queue.QueueObject, session *auth.Session, actions []aql.Action, entry *audit.Entry) ([]map[string]interface{}, error) {
+	for idx := range actions {
+		actions[idx].User = session.Username
+	}
+
+	if len(actions) > 0 && actions[0].Explain {
+		for idx, action := range actions {
+			if err := auth.VerifyUserAction(session, action); err != nil {
+				return nil, err
+			}
+			if err := auth.ProtectWrite(action); err != nil {
+				return nil, err
+			}
+			access, err := auth.FieldAccess(session, action)
+			if err != nil {
+				return nil, err
+			}
+			actions[idx].Access = access
+			if actions[idx].Policy, err = auth.RowPolicy(session, action); err != nil {
+				return nil, err
+			}
+		}
+		logging.TRACE("Explaining actions")
+		return manager.ProcessExplain(actions)
+	}
+
 	previousIDs := make([]string, 0)
 	dataOut := make([]map[string]interface{}, 0)
 	logging.TRACE("Processing actions")
-	for _, action := range actions {
-		if err := auth.VerifyUserAction(username, password, action); err != nil {
+	for idx, action := range actions {
+		if err := query.Context.Err(); err != nil {
+			return nil, err
+		}
+		if err := auth.VerifyUserAction(session, action); err != nil {
 			return nil, err
 		}
 		if err := auth.ProtectWrite(action); err != nil {
 			return nil, err
 		}
-		data, err := manager.ProcessAction(action, previousIDs, dataOut, false)
+		var data []map[string]interface{}
+		var err error
+		if action.Access, err = auth.FieldAccess(session, action); err != nil {
+			return nil, err
+		}
+		if action.Policy, err = auth.RowPolicy(session, action); err != nil {
+			return nil, err
+		}
+		// Records are gone once deleted, so the ids the action changes are found before it runs
+		affected, err := manager.AffectedIDs(action, audit.RequestedIDs(action, previousIDs, dataOut))
+		if err != nil {
+			return nil, err
+		}
+		// The records of a final GET RECORD can be streamed and paged, earlier actions need all
+		// of their output for the next action
+		if idx == len(actions)-1 && action.Type == "GET" && action.Resource == "RECORD" {
+			data, query.Next, err = manager.ProcessGetRecords(action, query.Emit)
+		} else {
+			data, err = manager.ProcessAction(action, previousIDs, dataOut, false)
+		}
 		if err != nil {
 			return nil, err
 		}
+		entry.IDs = append(entry.IDs, affected...)
 		if data != nil {
 			if len(data) > 0 {
 				if _, ok := data[0][".id"]; ok {
@@ -196,8 +477,6 @@ func handleQuery(query queue.QueueObject) ([]map[string]interface{}, error) {
 		logging.TRACE(fmt.Sprintf("Data: %v", data))
 		dataOut = data
 	}
-	logging.TRACE(fmt.Sprintf("Data out: %v", dataOut))
-	logging.DEBUG("Done!")
 	return dataOut, nil
 }
 
@@ -215,6 +494,7 @@ func handleSnapshot() ([]map[string]interface{}, error) {
 	snapshot.Indices = indices
 	snapshot.FreeSpace = freespace.FreeSpace
 	snapshot.Schema = schema.Schema
+	snapshot.Policies = schema.Policies
 	var outputSingle map[string]interface{}
 	singleBytes, _ := json.Marshal(snapshot)
 	json.Unmarshal(singleBytes, &outputSingle)
@@ -222,11 +502,24 @@ func handleSnapshot() ([]map[string]interface{}, error) {
 	return []map[string]interface{}{outputSingle}, nil
 }
 
+// requestCredentials reads the credentials of a request, which are either basic auth or a bearer
+// token holding a session token or an API key
+func requestCredentials(c *gin.Context) (string, string, bool) {
+	if username, password, hasAuth := c.Request.BasicAuth(); hasAuth {
+		return fmt.Sprintf("%s:%s", username, password), "", true
+	}
+	header := c.GetHeader("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return "", strings.TrimSpace(header[7:]), true
+	}
+	return "", "", false
+}
+
 func handleQueryEndpoint(c *gin.Context) {
 	var query Query
 
-	logging.TRACE("Getting basic auth info")
-	user, password, hasAuth := c.Request.BasicAuth()
+	logging.TRACE("Getting auth info")
+	credentials, token, hasAuth := requestCredentials(c)
 	if !hasAuth {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Authentication required"})
 		return
@@ -234,60 +527,186 @@ func handleQueryEndpoint(c *gin.Context) {
 
 	c.BindJSON(&query)
 
-	query.Auth = fmt.Sprintf("%s:%s", user, password)
+	query.Auth = credentials
 
 	logging.TRACE(fmt.Sprintf("Query: %v", query.QueryString))
+	ctx, cancel := queryContext(c)
+	defer cancel()
 	queueObject := queue.QueueObject{
 		Auth:        query.Auth,
+		Token:       token,
 		QueryString: query.QueryString,
-		Finished:    false,
+		Context:     ctx,
+		Source:      c.ClientIP(),
+	}
+	stream := query.Stream || strings.Contains(c.GetHeader("Accept"), "application/x-ndjson")
+	// The channel is never closed as the query may still be emitting if it outlives its context
+	records := make(chan map[string]interface{}, STREAM_BUFFER_SIZE)
+	if stream {
+		queueObject.Emit = func(datum map[string]interface{}) error {
+			select {
+			case records <- datum:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	if err := queue.AddToQueue(&queueObject); err != nil {
+		logging.ERROR(err.Error())
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
 	}
-	queue.AddToQueue(&queueObject)
-	for !queueObject.Finished {
-		time.Sleep(1 * time.Millisecond)
+	if stream {
+		streamQuery(c, &queueObject, records)
+		return
 	}
-	queue.PopQueue()
+	err := queue.Wait(&queueObject)
 	logging.TRACE("Query finished, sending data")
 
-	if queueObject.Err != nil {
-		logging.ERROR(queueObject.Err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": queueObject.Err.Error()})
+	if err != nil {
+		logging.ERROR(err.Error())
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 	} else {
+		if queueObject.Next != "" {
+			c.Header("X-Ceresdb-Next", queueObject.Next)
+		}
 		c.JSON(http.StatusOK, queueObject.Data)
 	}
 }
 
-func handleSnapshotEndpoint(c *gin.Context) {
-	logging.TRACE("Getting basic auth info")
-	user, password, hasAuth := c.Request.BasicAuth()
+// streamQuery writes the output of a query as newline-delimited JSON, sending records as the
+// query emits them. If the query has more records a final {".next": <token>} line is written.
+func streamQuery(c *gin.Context, queueObject *queue.QueueObject, records chan map[string]interface{}) {
+	done := make(chan error, 1)
+	go func() { done <- queue.Wait(queueObject) }()
+
+	encoder := json.NewEncoder(c.Writer)
+	started := false
+	start := func() {
+		if !started {
+			c.Header("Content-Type", "application/x-ndjson")
+			c.Status(http.StatusOK)
+			started = true
+		}
+	}
+	write := func(datum interface{}) {
+		start()
+		encoder.Encode(datum)
+	}
+
+	var err error
+	for finished := false; !finished; {
+		select {
+		case datum := <-records:
+			write(datum)
+			if len(records) == 0 {
+				c.Writer.Flush()
+			}
+		case err = <-done:
+			finished = true
+		}
+	}
+	for len(records) > 0 {
+		write(<-records)
+	}
+	logging.TRACE("Query finished, sending data")
+
+	if err != nil {
+		logging.ERROR(err.Error())
+		if !started {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		write(gin.H{"error": err.Error()})
+	} else {
+		for _, datum := range queueObject.Data {
+			write(datum)
+		}
+		if queueObject.Next != "" {
+			write(gin.H{".next": queueObject.Next})
+		}
+		start()
+	}
+	c.Writer.Flush()
+}
+
+// queryContext returns the context a query runs under, which is cancelled if the client goes
+// away or the configured query timeout passes
+func queryContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	if config.Config.QueryTimeout > 0 {
+		return context.WithTimeout(c.Request.Context(), time.Duration(config.Config.QueryTimeout)*time.Second)
+	}
+	return context.WithCancel(c.Request.Context())
+}
+
+func errorStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// handleLoginEndpoint issues a session token to a user, which can be sent as a bearer token in
+// place of their password until it expires
+func handleLoginEndpoint(c *gin.Context) {
+	logging.TRACE("Getting auth info")
+	credentials, token, hasAuth := requestCredentials(c)
 	if !hasAuth {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Authentication required"})
 		return
 	}
 
-	if err := auth.VerifyCredentials(user, password); err != nil {
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	queueObject := queue.QueueObject{
+		Auth:    credentials,
+		Token:   token,
+		Login:   true,
+		Context: ctx,
+		Source:  c.ClientIP(),
+	}
+	if err := queue.AddToQueue(&queueObject); err != nil {
 		logging.ERROR(err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
 		return
 	}
+	if err := queue.Wait(&queueObject); err != nil {
+		logging.ERROR(err.Error())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, queueObject.Data[0])
+}
 
-	auth := fmt.Sprintf("%s:%s", user, password)
+func handleSnapshotEndpoint(c *gin.Context) {
+	logging.TRACE("Getting auth info")
+	credentials, token, hasAuth := requestCredentials(c)
+	if !hasAuth {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Authentication required"})
+		return
+	}
 
+	ctx, cancel := queryContext(c)
+	defer cancel()
 	queueObject := queue.QueueObject{
-		Auth:     auth,
-		Finished: false,
+		Auth:     credentials,
+		Token:    token,
 		Snapshot: true,
+		Context:  ctx,
+		Source:   c.ClientIP(),
 	}
-	queue.AddToQueue(&queueObject)
-	for !queueObject.Finished {
-		time.Sleep(1 * time.Millisecond)
+	if err := queue.AddToQueue(&queueObject); err != nil {
+		logging.ERROR(err.Error())
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
 	}
-	queue.PopQueue()
+	err := queue.Wait(&queueObject)
 	logging.TRACE("Snapshot finished, sending data")
 
-	if queueObject.Err != nil {
-		logging.ERROR(queueObject.Err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": queueObject.Err.Error()})
+	if err != nil {
+		logging.ERROR(err.Error())
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 	} else {
 		c.JSON(http.StatusOK, queueObject.Data[0])
 	}
@@ -0,0 +1,112 @@
+// access.go
+
+package manager
+
+import (
+	"ceresdb/aql"
+	"ceresdb/record"
+	"errors"
+	"fmt"
+)
+
+// fieldDenied is the error returned for actions which use a field their permit hides
+func fieldDenied(field string) error {
+	return errors.New(fmt.Sprintf("access denied to field '%v'", field))
+}
+
+// checkAccess rejects actions which filter, order, search, group, aggregate, or join on fields
+// hidden from the user running them, since their results would reveal the hidden values
+func checkAccess(action aql.Action) error {
+	if !action.Access.Restricted() {
+		return nil
+	}
+	fields := append([]string{action.Order, action.Search.Field, action.Join.Right}, action.Group...)
+	for _, aggregate := range action.Aggregates {
+		fields = append(fields, aggregate.Field)
+	}
+	fields = append(fields, filterFields(action.Filter)...)
+	for _, field := range fields {
+		if action.Access.Hidden(field) {
+			return fieldDenied(field)
+		}
+	}
+	return nil
+}
+
+// filterFields returns the fields compared by a filter
+func filterFields(node aql.Node) []string {
+	switch node.Value {
+	case "":
+		return nil
+	case "AND", "OR", "XOR":
+		return append(filterFields(*node.Left), filterFields(*node.Right)...)
+	case "NOT":
+		return filterFields(*node.Right)
+	}
+	if node.Left == nil {
+		return nil
+	}
+	return []string{node.Left.Value}
+}
+
+// hideFields returns a copy of a record without the fields hidden from the user
+func hideFields(datum map[string]interface{}, access aql.Access) map[string]interface{} {
+	if !access.Restricted() {
+		return datum
+	}
+	visible := make(map[string]interface{}, len(datum))
+	for key, val := range datum {
+		if !access.Hidden(key) {
+			visible[key] = val
+		}
+	}
+	return visible
+}
+
+// checkWrite rejects data which sets fields hidden from the user writing it
+func checkWrite(access aql.Access, data []map[string]interface{}) error {
+	if !access.Restricted() {
+		return nil
+	}
+	for _, datum := range data {
+		for key := range datum {
+			if access.Hidden(key) {
+				return fieldDenied(key)
+			}
+		}
+	}
+	return nil
+}
+
+// keepHidden copies the hidden fields of stored records into the data replacing them, so that a
+// PUT by a user who cannot see every field does not erase the fields they cannot see
+func keepHidden(database, collection string, access aql.Access, data []map[string]interface{}) error {
+	if !access.Restricted() {
+		return nil
+	}
+	ids := make([]string, 0, len(data))
+	for _, datum := range data {
+		if id, ok := datum[".id"].(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	stored, err := record.Get(database, collection, ids)
+	if err != nil {
+		return err
+	}
+	storedByID := make(map[string]map[string]interface{}, len(stored))
+	for _, datum := range stored {
+		if id, ok := datum[".id"].(string); ok {
+			storedByID[id] = datum
+		}
+	}
+	for _, datum := range data {
+		id, _ := datum[".id"].(string)
+		for key, val := range storedByID[id] {
+			if access.Hidden(key) {
+				datum[key] = val
+			}
+		}
+	}
+	return nil
+}
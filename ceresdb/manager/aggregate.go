@@ -0,0 +1,404 @@
+// aggregate.go
+
+package manager
+
+import (
+	"ceresdb/aql"
+	"ceresdb/index"
+	"ceresdb/record"
+	"ceresdb/schema"
+	"ceresdb/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// aggregator accumulates a single aggregate for one group. Nulls are skipped by every function.
+type aggregator struct {
+	aql.Aggregate
+	fieldType string
+	count     int
+	intSum    int64
+	floatSum  float64
+	isFloat   bool
+	value     interface{}
+	distinct  map[string]bool
+}
+
+type aggregateGroup struct {
+	values      []interface{}
+	count       int
+	aggregators []*aggregator
+}
+
+// aggregation groups records by the group fields of an AGGREGATE action and accumulates its
+// aggregates for every group
+type aggregation struct {
+	action     aql.Action
+	fieldTypes map[string]string
+	groups     map[string]*aggregateGroup
+}
+
+func newAggregation(action aql.Action, fieldTypes map[string]string) *aggregation {
+	a := &aggregation{action: action, fieldTypes: fieldTypes, groups: make(map[string]*aggregateGroup)}
+	// Aggregating without grouping returns a result even if there are no records
+	if len(action.Group) == 0 {
+		a.groups[""] = a.newGroup([]interface{}{})
+	}
+	return a
+}
+
+func (a *aggregation) newGroup(values []interface{}) *aggregateGroup {
+	g := &aggregateGroup{values: values}
+	for _, aggregate := range a.action.Aggregates {
+		g.aggregators = append(g.aggregators, &aggregator{Aggregate: aggregate, fieldType: a.fieldTypes[aggregate.Field], distinct: make(map[string]bool)})
+	}
+	return g
+}
+
+func (a *aggregation) add(datum map[string]interface{}) error {
+	values := make([]interface{}, len(a.action.Group))
+	keys := make([]string, len(a.action.Group))
+	for idx, field := range a.action.Group {
+		values[idx], _ = index.Resolve(datum, field)
+		keys[idx] = valueKey(values[idx])
+	}
+	key := strings.Join(keys, "\x00")
+	g, ok := a.groups[key]
+	if !ok {
+		g = a.newGroup(values)
+		a.groups[key] = g
+	}
+	g.count++
+	for _, agg := range g.aggregators {
+		if agg.Function == "COUNT" {
+			continue
+		}
+		val, _ := index.Resolve(datum, agg.Field)
+		if err := agg.add(val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (agg *aggregator) add(val interface{}) error {
+	if val == nil {
+		return nil
+	}
+	switch agg.Function {
+	case "SUM", "AVG":
+		intVal, floatVal, isInt, ok := toNumber(val)
+		if !ok {
+			return errors.New(fmt.Sprintf("Cannot %v non-numeric value '%v' of field %v", agg.Function, val, agg.Field))
+		}
+		// Integers are summed exactly until the sum no longer fits
+		if isInt && !agg.isFloat {
+			if (intVal > 0 && agg.intSum > math.MaxInt64-intVal) || (intVal < 0 && agg.intSum < math.MinInt64-intVal) {
+				agg.isFloat = true
+				agg.floatSum += float64(intVal)
+			} else {
+				agg.intSum += intVal
+			}
+		} else {
+			agg.isFloat = true
+			agg.floatSum += floatVal
+		}
+	case "MIN":
+		if agg.value == nil || compareValues(val, agg.value, agg.fieldType) < 0 {
+			agg.value = val
+		}
+	case "MAX":
+		if agg.value == nil || compareValues(val, agg.value, agg.fieldType) > 0 {
+			agg.value = val
+		}
+	case "DISTINCT":
+		agg.distinct[valueKey(val)] = true
+	}
+	agg.count++
+	return nil
+}
+
+func (agg *aggregator) name() string {
+	if agg.Function == "COUNT" {
+		return "count"
+	}
+	return strings.ToLower(agg.Function) + "_" + agg.Field
+}
+
+func (agg *aggregator) result(groupCount int) interface{} {
+	switch agg.Function {
+	case "COUNT":
+		return groupCount
+	case "SUM":
+		if agg.count == 0 {
+			return nil
+		}
+		if agg.isFloat {
+			return agg.floatSum + float64(agg.intSum)
+		}
+		return agg.intSum
+	case "AVG":
+		if agg.count == 0 {
+			return nil
+		}
+		return (agg.floatSum + float64(agg.intSum)) / float64(agg.count)
+	case "DISTINCT":
+		return len(agg.distinct)
+	}
+	return agg.value
+}
+
+// results returns a record for every group, holding its group fields and aggregates, ordered by
+// the group fields
+func (a *aggregation) results() []map[string]interface{} {
+	groups := make([]*aggregateGroup, 0, len(a.groups))
+	for _, g := range a.groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		for idx, field := range a.action.Group {
+			if result := compareValues(groups[i].values[idx], groups[j].values[idx], a.fieldTypes[field]); result != 0 {
+				return result < 0
+			}
+		}
+		return false
+	})
+	output := make([]map[string]interface{}, 0, len(groups))
+	for _, g := range groups {
+		datum := make(map[string]interface{})
+		for idx, field := range a.action.Group {
+			datum[field] = g.values[idx]
+		}
+		for _, agg := range g.aggregators {
+			datum[agg.name()] = agg.result(g.count)
+		}
+		output = append(output, datum)
+	}
+	return output
+}
+
+// ProcessAggregate runs an AGGREGATE action. An AGGREGATE which reads a collection itself is
+// answered from the collection's indices when every field it uses is indexed, otherwise it
+// aggregates the records piped into it.
+func ProcessAggregate(action aql.Action, previousData []map[string]interface{}) ([]map[string]interface{}, error) {
+	var output []map[string]interface{}
+	if action.Resource == "RECORD" {
+		var err error
+		if output, err = aggregateCollection(action); err != nil {
+			return nil, err
+		}
+	} else {
+		a := newAggregation(action, map[string]string{})
+		for _, datum := range previousData {
+			if err := a.add(datum); err != nil {
+				return nil, err
+			}
+		}
+		output = a.results()
+	}
+	if action.OrderDir != "" {
+		output = orderRecords(output, action.Order, "", action.OrderDir)
+	}
+	if action.Limit > 0 && action.Limit < len(output) {
+		output = output[:action.Limit]
+	}
+	return output, nil
+}
+
+func aggregateCollection(action aql.Action) ([]map[string]interface{}, error) {
+	if err := checkAccess(action); err != nil {
+		return nil, err
+	}
+	action.Filter = policyFilter(action)
+	parts := strings.Split(action.Identifier, ".")
+	db := parts[0]
+	col := parts[1]
+	var ids []string
+	var err error
+	if action.Filter.Value != "" {
+		ids, err = ProcessFilter(db, col, action.Filter)
+	} else {
+		ids, err = index.All(db, col)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids = utils.RemoveDuplicateValues(ids)
+	record.SortIDs(ids)
+	schemaData := schema.Get(db, col)
+	a := newAggregation(action, schemaData)
+
+	data, ok, err := indexedValues(db, col, action, ids, schemaData)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		for _, id := range ids {
+			if err := a.add(data[id]); err != nil {
+				return nil, err
+			}
+		}
+		return a.results(), nil
+	}
+
+	for start := 0; start < len(ids); start += STREAM_BATCH_SIZE {
+		end := start + STREAM_BATCH_SIZE
+		if end > len(ids) {
+			end = len(ids)
+		}
+		data, err := record.Get(db, col, ids[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for _, datum := range data {
+			if err := a.add(datum); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return a.results(), nil
+}
+
+// indexedValues reads the values of the fields an AGGREGATE uses from their indices, returning
+// a partial record for each ID. It reports false if any of the fields is not indexed.
+func indexedValues(database, collection string, action aql.Action, ids []string, schemaData map[string]string) (map[string]map[string]interface{}, bool, error) {
+	fields := append([]string{}, action.Group...)
+	for _, aggregate := range action.Aggregates {
+		if aggregate.Field != "" {
+			fields = append(fields, aggregate.Field)
+		}
+	}
+	fields = utils.RemoveDuplicateValues(fields)
+	definitions, err := index.ReadDefinitions(database, collection)
+	if err != nil {
+		return nil, false, err
+	}
+	fieldTypes := make(map[string]string, len(fields))
+	for _, field := range fields {
+		indexed, fieldType := definitions.Indexed(database, field, schemaData)
+		if !indexed || utils.Contains(index.InvalidSchemaTypes, fieldType) {
+			return nil, false, nil
+		}
+		fieldTypes[field] = fieldType
+	}
+
+	data := make(map[string]map[string]interface{}, len(ids))
+	for _, id := range ids {
+		data[id] = make(map[string]interface{}, len(fields))
+	}
+	for _, field := range fields {
+		err := index.Values(database, collection, field, fieldTypes[field], func(value interface{}, valueIDs []string) error {
+			for _, id := range valueIDs {
+				if datum, ok := data[id]; ok {
+					datum[field] = value
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return data, true, nil
+}
+
+// toNumber returns the value of a number, exactly as an int64 when it is an integer
+func toNumber(val interface{}) (int64, float64, bool, bool) {
+	switch typedVal := val.(type) {
+	case int:
+		return int64(typedVal), float64(typedVal), true, true
+	case int64:
+		return typedVal, float64(typedVal), true, true
+	case float64:
+		return 0, typedVal, false, true
+	case json.Number:
+		if intVal, err := typedVal.Int64(); err == nil {
+			return intVal, float64(intVal), true, true
+		}
+		floatVal, err := typedVal.Float64()
+		return 0, floatVal, false, err == nil
+	}
+	return 0, 0, false, false
+}
+
+// valueKey returns a key which is equal for equal values, treating numbers of different Go
+// types as equal when their values are
+func valueKey(val interface{}) string {
+	if val == nil {
+		return "n"
+	}
+	if _, _, _, ok := toNumber(val); ok {
+		return "#" + utils.FormatValue(val)
+	}
+	switch typedVal := val.(type) {
+	case bool:
+		return "b" + utils.FormatValue(typedVal)
+	case string:
+		return "s" + typedVal
+	}
+	jsonVal, _ := json.Marshal(val)
+	return "j" + string(jsonVal)
+}
+
+// valueRank orders values of different kinds, with nulls last
+func valueRank(val interface{}) int {
+	if val == nil {
+		return 4
+	}
+	if _, _, _, ok := toNumber(val); ok {
+		return 1
+	}
+	switch val.(type) {
+	case bool:
+		return 0
+	case string:
+		return 2
+	}
+	return 3
+}
+
+// compareValues compares two values, ordering values of the same kind by their value and using
+// the ordering of the field's index for types which do not sort correctly as strings
+func compareValues(a, b interface{}, fieldType string) int {
+	rankA, rankB := valueRank(a), valueRank(b)
+	if rankA != rankB {
+		return rankA - rankB
+	}
+	switch rankA {
+	case 0:
+		return boolToInt(a.(bool)) - boolToInt(b.(bool))
+	case 1:
+		intA, floatA, isIntA, _ := toNumber(a)
+		intB, floatB, isIntB, _ := toNumber(b)
+		if isIntA && isIntB {
+			if intA < intB {
+				return -1
+			} else if intA > intB {
+				return 1
+			}
+			return 0
+		}
+		if floatA < floatB {
+			return -1
+		} else if floatA > floatB {
+			return 1
+		}
+		return 0
+	case 2:
+		if utils.Contains(schema.TypedStringTypes, fieldType) {
+			keyA, errA := index.OrderedKey(fieldType, a.(string))
+			keyB, errB := index.OrderedKey(fieldType, b.(string))
+			if errA == nil && errB == nil {
+				return strings.Compare(keyA, keyB)
+			}
+		}
+		return strings.Compare(a.(string), b.(string))
+	case 3:
+		return strings.Compare(valueKey(a), valueKey(b))
+	}
+	return 0
+}
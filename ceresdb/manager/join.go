@@ -0,0 +1,183 @@
+// join.go
+
+package manager
+
+import (
+	"ceresdb/aql"
+	"ceresdb/index"
+	"ceresdb/record"
+	"ceresdb/schema"
+	"ceresdb/utils"
+	"strings"
+)
+
+// ProcessJoin matches the records piped into a JOIN action with the records of another collection
+// whose right field equals their left field. Matches are added to each record as a list under the
+// join's name, with records which have no matches given an empty list. Flattened joins instead
+// return a record for every match, holding the matched record's fields prefixed with the join's
+// name as given by flatKey, and drop records which have no matches.
+func ProcessJoin(action aql.Action, previousData []map[string]interface{}) ([]map[string]interface{}, error) {
+	parts := strings.Split(action.Identifier, ".")
+	if err := checkAccess(action); err != nil {
+		return nil, err
+	}
+	matches, err := joinMatches(parts[0], parts[1], action.Join, previousData)
+	if err != nil {
+		return nil, err
+	}
+	var visible func(datum map[string]interface{}) (bool, error)
+	if action.Policy.Value != "" {
+		if visible, err = recordMatcher(parts[0], parts[1], action.Policy); err != nil {
+			return nil, err
+		}
+	}
+	for key, matched := range matches {
+		kept := make([]map[string]interface{}, 0, len(matched))
+		for _, match := range matched {
+			if visible != nil {
+				ok, err := visible(match)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					continue
+				}
+			}
+			kept = append(kept, hideFields(match, action.Access))
+		}
+		matches[key] = kept
+	}
+	output := make([]map[string]interface{}, 0, len(previousData))
+	for _, datum := range previousData {
+		var matched []map[string]interface{}
+		if val, _ := index.Resolve(datum, action.Join.Left); joinable(val) {
+			matched = matches[joinKey(val)]
+		}
+		if !action.Join.Flatten {
+			row := copyRecord(datum)
+			list := make([]interface{}, len(matched))
+			for idx, match := range matched {
+				list[idx] = match
+			}
+			row[action.Join.As] = list
+			output = append(output, row)
+			continue
+		}
+		for _, match := range matched {
+			row := copyRecord(datum)
+			for key, val := range match {
+				row[flatKey(action.Join.As, key)] = val
+			}
+			output = append(output, row)
+		}
+	}
+	return output, nil
+}
+
+// flatKey returns the key a matched record's field is given in a flattened join. System fields
+// such as .id start with a dot, which is swapped for an underscore so that .id becomes <as>._id
+// rather than <as>..id.
+func flatKey(as, key string) string {
+	if strings.HasPrefix(key, ".") {
+		key = "_" + key[1:]
+	}
+	return as + "." + key
+}
+
+// joinMatches returns the records of a collection whose right field equals the left field of
+// any of data, keyed by joinKey. Matches are looked up in the right field's index if it has one,
+// otherwise every record of the collection is read. Either way the values are compared the same
+// way afterwards, as an index holds values of different types which format the same together.
+func joinMatches(database, collection string, join aql.Join, data []map[string]interface{}) (map[string][]map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for _, datum := range data {
+		if val, _ := index.Resolve(datum, join.Left); joinable(val) {
+			values[joinKey(val)] = val
+		}
+	}
+	matches := make(map[string][]map[string]interface{})
+	if len(values) == 0 {
+		return matches, nil
+	}
+
+	schemaData := schema.Get(database, collection)
+	definitions, err := index.ReadDefinitions(database, collection)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	if indexed, _ := definitions.Indexed(database, join.Right, schemaData); indexed && join.Right != ".id" {
+		ids = make([]string, 0, len(values))
+		for _, val := range values {
+			found, err := index.Lookup(database, collection, join.Right, val)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, found...)
+		}
+	} else {
+		all, err := index.All(database, collection)
+		if err != nil {
+			return nil, err
+		}
+		ids = all
+		if join.Right == ".id" {
+			existing := make(map[string]bool, len(all))
+			for _, id := range all {
+				existing[id] = true
+			}
+			ids = make([]string, 0, len(values))
+			for _, val := range values {
+				if id, ok := val.(string); ok && existing[id] {
+					ids = append(ids, id)
+				}
+			}
+		}
+	}
+	ids = utils.RemoveDuplicateValues(ids)
+
+	records, err := record.Get(database, collection, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, datum := range records {
+		val, _ := index.Resolve(datum, join.Right)
+		if !joinable(val) {
+			continue
+		}
+		key := joinKey(val)
+		if _, ok := values[key]; ok {
+			matches[key] = append(matches[key], datum)
+		}
+	}
+	return matches, nil
+}
+
+// joinable reports whether a value can be joined on. Nulls, lists, and dicts never match.
+func joinable(val interface{}) bool {
+	switch val.(type) {
+	case nil, []interface{}, map[string]interface{}:
+		return false
+	}
+	return true
+}
+
+// joinKey returns the key a value is matched on. Values only match values of the same kind, so a
+// number never matches a string which formats the same.
+func joinKey(val interface{}) string {
+	switch val.(type) {
+	case string:
+		return "s" + val.(string)
+	case bool:
+		return "b" + utils.FormatValue(val)
+	}
+	return "n" + utils.FormatValue(val)
+}
+
+func copyRecord(datum map[string]interface{}) map[string]interface{} {
+	output := make(map[string]interface{}, len(datum)+1)
+	for key, val := range datum {
+		output[key] = val
+	}
+	return output
+}
@@ -0,0 +1,179 @@
+// key.go
+
+package manager
+
+import (
+	"ceresdb/aql"
+	"ceresdb/index"
+	"ceresdb/role"
+	"ceresdb/user"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// isAdmin reports whether a user's role lets them manage other users, and so their API keys
+func isAdmin(username string) (bool, error) {
+	ids, err := ProcessFilter("_auth", "_users", aql.Node{Value: "=", Left: &aql.Node{Value: "username"}, Right: &aql.Node{Value: username}})
+	if err != nil {
+		return false, err
+	}
+	data, err := user.Get(ids)
+	if err != nil {
+		return false, err
+	}
+	if len(data) != 1 {
+		return false, nil
+	}
+	definitions, err := Roles()
+	if err != nil {
+		return false, err
+	}
+	userRole, _ := data[0]["role"].(string)
+	return role.Allows(definitions, userRole, "PUT", "USER"), nil
+}
+
+// ownKeys checks that the API keys belong to the user running the action unless they are an
+// admin, who can manage the keys of any user
+func ownKeys(action aql.Action, data []map[string]interface{}) error {
+	admin, err := isAdmin(action.User)
+	if err != nil {
+		return err
+	}
+	for _, datum := range data {
+		if !admin && datum["username"] != action.User {
+			return errors.New("access denied")
+		}
+	}
+	return nil
+}
+
+// getKeys returns the API keys of the user running the action, or every key for admins. Internal
+// reads, which look keys up to authenticate with them, see every key and its hash.
+func getKeys(action aql.Action, internal bool) ([]map[string]interface{}, error) {
+	var ids []string
+	var err error
+	if action.Filter.Value != "" {
+		ids, err = ProcessFilter("_auth", "_keys", action.Filter)
+	} else {
+		ids, err = index.All("_auth", "_keys")
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := user.GetKeys(ids)
+	if err != nil {
+		return nil, err
+	}
+	if !internal {
+		admin, err := isAdmin(action.User)
+		if err != nil {
+			return nil, err
+		}
+		visible := make([]map[string]interface{}, 0, len(data))
+		for _, datum := range data {
+			if admin || datum["username"] == action.User {
+				delete(datum, "hash")
+				visible = append(visible, datum)
+			}
+		}
+		data = visible
+	}
+	if action.OrderDir != "" {
+		data = orderRecords(data, action.Order, "", action.OrderDir)
+	}
+	if action.Limit > 0 && action.Limit < len(data) {
+		data = data[:action.Limit]
+	}
+	return projectRecords(data, action.Projection)
+}
+
+// postKeys creates an API key for each item, returning the keys. A key is only ever returned
+// here, afterwards just its hash is kept.
+func postKeys(action aql.Action, previousData []map[string]interface{}) ([]map[string]interface{}, error) {
+	input := action.Data
+	if len(input) == 0 {
+		input = previousData
+	}
+	keys := make([]string, len(input))
+	data := make([]map[string]interface{}, len(input))
+	for idx, datum := range input {
+		name, ok := datum["name"].(string)
+		if !ok {
+			return nil, errors.New("Invalid key data, required field is 'name'")
+		}
+		username, ok := datum["username"].(string)
+		if !ok {
+			username = action.User
+		}
+		if username != action.User {
+			if err := ownKeys(action, []map[string]interface{}{{"username": username}}); err != nil {
+				return nil, err
+			}
+			ids, err := ProcessFilter("_auth", "_users", aql.Node{Value: "=", Left: &aql.Node{Value: "username"}, Right: &aql.Node{Value: username}})
+			if err != nil {
+				return nil, err
+			}
+			if len(ids) == 0 {
+				return nil, errors.New(fmt.Sprintf("User %v does not exist", username))
+			}
+		}
+		key, err := user.GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		keys[idx] = key
+		data[idx] = map[string]interface{}{"name": name, "username": username, "hash": user.HashKey(key), "created": time.Now().UTC().Format(time.RFC3339)}
+	}
+	if err := user.PostKeys(data); err != nil {
+		return nil, err
+	}
+	output := make([]map[string]interface{}, 0, len(data))
+	for idx, datum := range data {
+		ids, err := ProcessFilter("_auth", "_keys", aql.Node{Value: "=", Left: &aql.Node{Value: "hash"}, Right: &aql.Node{Value: datum["hash"].(string)}})
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 1 {
+			datum[".id"] = ids[0]
+		}
+		delete(datum, "hash")
+		datum["key"] = keys[idx]
+		output = append(output, datum)
+	}
+	return output, nil
+}
+
+// deleteKeys revokes API keys
+func deleteKeys(action aql.Action, ids []string) error {
+	data, err := user.GetKeys(ids)
+	if err != nil {
+		return err
+	}
+	if err := ownKeys(action, data); err != nil {
+		return err
+	}
+	return user.DeleteKeys(ids)
+}
+
+// deleteUserKeys revokes the API keys of users which are being deleted, so that they do not
+// authenticate a new user given the same username
+func deleteUserKeys(ids []string) error {
+	users, err := user.Get(ids)
+	if err != nil {
+		return err
+	}
+	for _, datum := range users {
+		username, _ := datum["username"].(string)
+		keyIDs, err := ProcessFilter("_auth", "_keys", aql.Node{Value: "=", Left: &aql.Node{Value: "username"}, Right: &aql.Node{Value: username}})
+		if err != nil {
+			return err
+		}
+		if len(keyIDs) > 0 {
+			if err := user.DeleteKeys(keyIDs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
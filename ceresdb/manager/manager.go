@@ -10,19 +10,19 @@ import (
 	"ceresdb/index"
 	"ceresdb/logging"
 	"ceresdb/permit"
+	"ceresdb/queue"
 	"ceresdb/record"
 	"ceresdb/schema"
 	"ceresdb/user"
 	"ceresdb/utils"
-	"encoding/base64"
+	"ceresdb/wal"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
+	"regexp"
 	"sort"
-	"strconv"
 	"strings"
 
 	"github.com/itchyny/gojq"
@@ -64,77 +64,25 @@ func ProcessGet(action aql.Action, previousIDs []string, internal bool) ([]map[s
 		if err != nil {
 			return nil, err
 		}
-		if action.OrderDir == "ASC" {
-			data = doOrderASC(data, action.Order)
-		} else if action.OrderDir == "DSC" {
-			data = doOrderDSC(data, action.Order)
+		if action.OrderDir != "" {
+			data = orderRecords(data, action.Order, "", action.OrderDir)
 		}
 		if action.Limit > 0 && action.Limit < len(data) {
 			data = data[:action.Limit]
 		}
-		if len(data) > 0 && len(action.Fields) > 0 {
-			if action.Fields[0] != "*" {
-				keys := make([]string, len(data[0])-len(action.Fields))
-				i := 0
-				for k := range data[0] {
-					if !utils.Contains(action.Fields, k) {
-						keys[i] = k
-						i++
-					}
-				}
-				for idx, val := range data {
-					for _, key := range keys {
-						delete(val, key)
-					}
-					data[idx] = val
-				}
-			}
-		}
-		return data, nil
+		return projectRecords(data, action.Projection)
 	case "RECORD":
+		data, _, err := ProcessGetRecords(action, nil)
+		return data, err
+	case "INDEX":
 		parts := strings.Split(action.Identifier, ".")
-		db := parts[0]
-		col := parts[1]
-		var ids []string
-		var err error
-		if action.Filter.Value != "" {
-			ids, err = ProcessFilter(db, col, action.Filter)
-		} else {
-			ids, err = index.All(db, col)
-		}
-		if err != nil {
-			return nil, err
-		}
-		data, err := record.Get(db, col, ids)
+		data, err := getIndices(parts[0], parts[1])
 		if err != nil {
 			return nil, err
 		}
-		if action.OrderDir == "ASC" {
-			data = doOrderASC(data, action.Order)
-		} else if action.OrderDir == "DSC" {
-			data = doOrderDSC(data, action.Order)
-		}
 		if action.Limit > 0 && action.Limit < len(data) {
 			data = data[:action.Limit]
 		}
-		if len(data) > 0 && len(action.Fields) > 0 {
-			if action.Fields[0] != "*" {
-				keys := make([]string, len(data[0])-len(action.Fields))
-				i := 0
-				for k := range data[0] {
-					if !utils.Contains(action.Fields, k) {
-						keys[i] = k
-						i++
-					}
-				}
-				for idx, val := range data {
-					for _, key := range keys {
-						delete(val, key)
-					}
-					data[idx] = val
-				}
-			}
-		}
 		return data, nil
 	case "USER":
 		var ids []string
@@ -151,39 +99,27 @@ func ProcessGet(action aql.Action, previousIDs []string, internal bool) ([]map[s
 		if err != nil {
 			return nil, err
 		}
-		if action.OrderDir == "ASC" {
-			data = doOrderASC(data, action.Order)
-		} else if action.OrderDir == "DSC" {
-			data = doOrderDSC(data, action.Order)
+		if action.OrderDir != "" {
+			data = orderRecords(data, action.Order, "", action.OrderDir)
 		}
 		if action.Limit > 0 && action.Limit < len(data) {
 			data = data[:action.Limit]
 		}
-		if len(data) > 0 && len(action.Fields) > 0 {
-			if action.Fields[0] != "*" {
-				keys := make([]string, len(data[0])-len(action.Fields))
-				i := 0
-				for k := range data[0] {
-					if !utils.Contains(action.Fields, k) {
-						keys[i] = k
-						i++
-					}
-				}
-				for idx, val := range data {
-					for _, key := range keys {
-						delete(val, key)
-					}
-					data[idx] = val
-				}
-			}
-		}
+		// Passwords are removed before projecting so they cannot be read through a computed field
 		if !internal {
 			for idx, datum := range data {
 				delete(datum, "password")
 				data[idx] = datum
 			}
 		}
-		return data, nil
+		return projectRecords(data, action.Projection)
+	case "KEY":
+		return getKeys(action, internal)
+	case "ROLE":
+		return getRoles(action)
+	case "POLICY":
+		parts := strings.Split(action.Identifier, ".")
+		return getPolicies(parts[0], parts[1]), nil
 	}
 	return nil, errors.New("Invalid resource type")
 }
@@ -207,8 +143,11 @@ func ProcessPost(action aql.Action, previousIDs []string, previousData []map[str
 					return errors.New("Invalid user data, required fields are 'username' and 'role'")
 				}
 			}
-			inputData := []map[string]interface{}{{"username": action.Data[0]["username"].(string), "role": action.Data[0]["role"].(string)}}
-			err := permit.Post(action.Identifier, inputData)
+			datum, err := permitData(action.Data[0])
+			if err != nil {
+				return err
+			}
+			err = permit.Post(action.Identifier, []map[string]interface{}{datum})
 			return err
 		} else {
 			for _, key := range keys {
@@ -216,21 +155,35 @@ func ProcessPost(action aql.Action, previousIDs []string, previousData []map[str
 					return errors.New("Invalid user data, required fields are 'username' and 'role'")
 				}
 			}
-			inputData := []map[string]interface{}{{"username": previousData[0]["username"].(string), "role": previousData[0]["role"].(string)}}
-			err := permit.Post(action.Identifier, inputData)
+			datum, err := permitData(previousData[0])
+			if err != nil {
+				return err
+			}
+			err = permit.Post(action.Identifier, []map[string]interface{}{datum})
 			return err
 		}
+	case "INDEX":
+		parts := strings.Split(action.Identifier, ".")
+		err := postIndex(parts[0], parts[1], action.Fields[0], action.Unique, action.Text)
+		return err
+	case "POLICY":
+		return writePolicies(action.Identifier, action.Data, false)
 	case "RECORD":
 		parts := strings.Split(action.Identifier, ".")
 		db := parts[0]
 		col := parts[1]
-		if len(action.Data) > 0 {
-			err := record.Post(db, col, action.Data)
+		data := action.Data
+		if len(data) == 0 {
+			data = previousData
+		}
+		if err := checkWrite(action.Access, data); err != nil {
 			return err
-		} else {
-			err := record.Post(db, col, previousData)
+		}
+		if err := checkPolicy(db, col, action.Policy, data); err != nil {
 			return err
 		}
+		err := record.Post(db, col, data)
+		return err
 	case "USER":
 		keys := []string{"username", "password", "role"}
 		if len(action.Data) > 0 {
@@ -240,6 +193,9 @@ func ProcessPost(action aql.Action, previousIDs []string, previousData []map[str
 				}
 			}
 			for idx, datum := range action.Data {
+				if err := roleExists(datum["role"]); err != nil {
+					return err
+				}
 				hash, err := bcrypt.GenerateFromPassword([]byte(datum["password"].(string)), bcrypt.DefaultCost)
 				if err != nil {
 					return err
@@ -255,6 +211,9 @@ func ProcessPost(action aql.Action, previousIDs []string, previousData []map[str
 				}
 			}
 			for idx, datum := range previousData {
+				if err := roleExists(datum["role"]); err != nil {
+					return err
+				}
 				hash, err := bcrypt.GenerateFromPassword([]byte(datum["password"].(string)), bcrypt.DefaultCost)
 				if err != nil {
 					return err
@@ -264,27 +223,51 @@ func ProcessPost(action aql.Action, previousIDs []string, previousData []map[str
 			err := user.Post(previousData)
 			return err
 		}
+	case "ROLE":
+		if len(action.Data) > 0 {
+			return writeRoles(action.Data, false)
+		}
+		return writeRoles(previousData, false)
 	}
 	return errors.New("Invalid resource type")
 }
 
-func ProcessPut(action aql.Action, previousIDs []string, previousData []map[string]interface{}) error {
+// permitData returns the fields of a permit which are written, checking its role and collection
+// scopes
+func permitData(input map[string]interface{}) (map[string]interface{}, error) {
+	username, _ := input["username"].(string)
+	role, _ := input["role"].(string)
+	datum := map[string]interface{}{"username": username, "role": role}
+	if collections, ok := input["collections"]; ok && collections != nil {
+		datum["collections"] = collections
+	}
+	definitions, err := Roles()
+	if err != nil {
+		return nil, err
+	}
+	if err := permit.Validate(datum, definitions); err != nil {
+		return nil, err
+	}
+	return datum, nil
+}
+
+func ProcessPut(action aql.Action, previousIDs []string, previousData []map[string]interface{}) ([]map[string]interface{}, error) {
 	switch action.Resource {
 	case "COLLECTION":
 		parts := strings.Split(action.Identifier, ".")
 		db := parts[0]
 		col := parts[1]
-		err := collection.Put(db, col, action.Data[0])
-		return err
+		data, err := collection.Migrate(db, col, action.Data[0], action.DryRun)
+		return data, err
 	case "DATABASE":
 		err := database.Put()
-		return err
+		return nil, err
 	case "PERMIT":
 		keys := []string{"username", "role"}
 		if len(action.Data) > 0 {
 			for _, key := range keys {
 				if _, ok := action.Data[0][key]; !ok {
-					return errors.New("Invalid user data, required fields are 'username', 'password', and 'role'")
+					return nil, errors.New("Invalid user data, required fields are 'username', 'password', and 'role'")
 				}
 			}
 			nodeL := aql.Node{Value: "username"}
@@ -293,19 +276,22 @@ func ProcessPut(action aql.Action, previousIDs []string, previousData []map[stri
 			getAction := aql.Action{Type: "GET", Resource: "PERMIT", Identifier: action.Identifier, Filter: nodeC}
 			data, err := ProcessGet(getAction, []string{}, false)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			if len(data) != 1 {
-				return errors.New("User does not exist")
+				return nil, errors.New("User does not exist")
 			}
-			data[0]["username"] = action.Data[0]["username"].(string)
-			data[0]["role"] = action.Data[0]["role"].(string)
-			err = permit.Put(action.Identifier, data)
-			return err
+			datum, err := permitData(action.Data[0])
+			if err != nil {
+				return nil, err
+			}
+			datum[".id"] = data[0][".id"]
+			err = permit.Put(action.Identifier, []map[string]interface{}{datum})
+			return nil, err
 		} else {
 			for _, key := range keys {
 				if _, ok := previousData[0][key]; !ok {
-					return errors.New("Invalid user data, required fields are 'username', 'password', and 'role'")
+					return nil, errors.New("Invalid user data, required fields are 'username', 'password', and 'role'")
 				}
 			}
 			nodeL := aql.Node{Value: "username"}
@@ -314,62 +300,90 @@ func ProcessPut(action aql.Action, previousIDs []string, previousData []map[stri
 			getAction := aql.Action{Type: "GET", Resource: "PERMIT", Identifier: action.Identifier, Filter: nodeC}
 			data, err := ProcessGet(getAction, []string{}, false)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			if len(data) != 1 {
-				return errors.New("User does not exist")
+				return nil, errors.New("User does not exist")
 			}
-			data[0]["username"] = previousData[0]["username"].(string)
-			data[0]["role"] = previousData[0]["role"].(string)
-			err = permit.Put(action.Identifier, data)
-			return err
+			datum, err := permitData(previousData[0])
+			if err != nil {
+				return nil, err
+			}
+			datum[".id"] = data[0][".id"]
+			err = permit.Put(action.Identifier, []map[string]interface{}{datum})
+			return nil, err
 		}
+	case "POLICY":
+		return nil, writePolicies(action.Identifier, action.Data, true)
 	case "RECORD":
 		parts := strings.Split(action.Identifier, ".")
 		db := parts[0]
 		col := parts[1]
-		if len(action.Data) > 0 {
-			err := record.Put(db, col, action.Data)
-			return err
-		} else {
-			err := record.Put(db, col, previousData)
-			return err
+		data := action.Data
+		if len(data) == 0 {
+			data = previousData
+		}
+		if err := checkWrite(action.Access, data); err != nil {
+			return nil, err
+		}
+		data, err := visibleData(db, col, action.Policy, data)
+		if err != nil {
+			return nil, err
+		}
+		if err := keepHidden(db, col, action.Access, data); err != nil {
+			return nil, err
 		}
+		if err := checkPolicy(db, col, action.Policy, data); err != nil {
+			return nil, err
+		}
+		err = record.Put(db, col, data)
+		return nil, err
 	case "USER":
 		keys := []string{"username", "password", "role"}
 		if len(action.Data) > 0 {
 			for _, key := range keys {
 				if _, ok := action.Data[0][key]; !ok {
-					return errors.New("invalid user data, required fields are 'username', 'password', and 'role'")
+					return nil, errors.New("invalid user data, required fields are 'username', 'password', and 'role'")
 				}
 			}
 			for idx, datum := range action.Data {
+				if err := roleExists(datum["role"]); err != nil {
+					return nil, err
+				}
 				hash, err := bcrypt.GenerateFromPassword([]byte(datum["password"].(string)), bcrypt.DefaultCost)
 				if err != nil {
-					return err
+					return nil, err
 				}
 				action.Data[idx]["password"] = string(hash)
 			}
 			err := user.Put(action.Data)
-			return err
+			return nil, err
 		} else {
 			for _, key := range keys {
 				if _, ok := previousData[0][key]; !ok {
-					return errors.New("invalid user data, required fields are 'username', 'password', and 'role'")
+					return nil, errors.New("invalid user data, required fields are 'username', 'password', and 'role'")
 				}
 			}
 			for idx, datum := range previousData {
+				if err := roleExists(datum["role"]); err != nil {
+					return nil, err
+				}
 				hash, err := bcrypt.GenerateFromPassword([]byte(datum["password"].(string)), bcrypt.DefaultCost)
 				if err != nil {
-					return err
+					return nil, err
 				}
 				previousData[idx]["password"] = string(hash)
 			}
 			err := user.Put(previousData)
-			return err
+			return nil, err
 		}
+	case "ROLE":
+		if len(action.Data) > 0 {
+			return nil, writeRoles(action.Data, true)
+		}
+		return nil, writeRoles(previousData, true)
 	}
-	return errors.New("invalid resource type")
+	return nil, errors.New("invalid resource type")
 }
 
 func ProcessPatch(action aql.Action, previousIDs []string, previousData []map[string]interface{}) error {
@@ -387,23 +401,26 @@ func ProcessPatch(action aql.Action, previousIDs []string, previousData []map[st
 		parts := strings.Split(action.Identifier, ".")
 		db := parts[0]
 		col := parts[1]
-		if action.IDs[0] != "-" {
-			if len(action.Data) > 0 {
-				err := record.Patch(db, col, action.IDs, action.Data[0])
-				return err
-			} else {
-				err := record.Patch(db, col, action.IDs, previousData[0])
-				return err
-			}
-		} else {
-			if len(action.Data) > 0 {
-				err := record.Patch(db, col, previousIDs, action.Data[0])
-				return err
-			} else {
-				err := record.Patch(db, col, previousIDs, previousData[0])
-				return err
-			}
+		data := action.Data
+		if len(data) == 0 {
+			data = previousData
 		}
+		if err := checkWrite(action.Access, data[:1]); err != nil {
+			return err
+		}
+		ids := action.IDs
+		if ids[0] == "-" {
+			ids = previousIDs
+		}
+		ids, err := visibleIDs(db, col, action.Policy, ids)
+		if err != nil {
+			return err
+		}
+		if err := checkPatchPolicy(db, col, action.Policy, ids, data[0]); err != nil {
+			return err
+		}
+		err = record.Patch(db, col, ids, data[0])
+		return err
 	case "USER":
 		err := user.Patch()
 		return err
@@ -430,25 +447,46 @@ func ProcessDelete(action aql.Action, previousIDs []string) error {
 			err := permit.Delete(action.Identifier, previousIDs)
 			return err
 		}
+	case "INDEX":
+		parts := strings.Split(action.Identifier, ".")
+		err := deleteIndex(parts[0], parts[1], action.Fields[0], action.Text)
+		return err
+	case "POLICY":
+		return deletePolicies(action.Identifier, action.IDs)
 	case "RECORD":
 		parts := strings.Split(action.Identifier, ".")
 		db := parts[0]
 		col := parts[1]
-		if action.IDs[0] != "-" {
-			err := record.Delete(db, col, action.IDs)
-			return err
-		} else {
-			err := record.Delete(db, col, previousIDs)
+		ids := action.IDs
+		if ids[0] == "-" {
+			ids = previousIDs
+		}
+		ids, err := visibleIDs(db, col, action.Policy, ids)
+		if err != nil {
 			return err
 		}
+		err = record.Delete(db, col, ids)
+		return err
 	case "USER":
-		if action.IDs[0] != "-" {
-			err := user.Delete(action.IDs)
-			return err
-		} else {
-			err := user.Delete(previousIDs)
+		ids := action.IDs
+		if ids[0] == "-" {
+			ids = previousIDs
+		}
+		if err := deleteUserKeys(ids); err != nil {
 			return err
 		}
+		err := user.Delete(ids)
+		return err
+	case "KEY":
+		if action.IDs[0] != "-" {
+			return deleteKeys(action, action.IDs)
+		}
+		return deleteKeys(action, previousIDs)
+	case "ROLE":
+		if action.IDs[0] != "-" {
+			return deleteRoles(action.IDs)
+		}
+		return deleteRoles(previousIDs)
 	}
 	return errors.New("invalid resource type")
 }
@@ -469,7 +507,7 @@ func ProcessJQ(action aql.Action, previousData []map[string]interface{}) ([]map[
 	inputBytes, _ := json.Marshal(previousData)
 
 	var input []any
-	json.Unmarshal(inputBytes, &input)
+	utils.DecodeJSON(inputBytes, &input)
 
 	iter := query.Run(input) // or query.RunWithContext
 	for {
@@ -489,6 +527,254 @@ func ProcessJQ(action aql.Action, previousData []map[string]interface{}) ([]map[
 	return output, nil
 }
 
+func ProcessBegin() error {
+	if wal.Active() {
+		return errors.New("a transaction is already in progress")
+	}
+	wal.Begin()
+	return nil
+}
+
+func ProcessCommit() error {
+	if !wal.Active() {
+		return errors.New("no transaction is in progress")
+	}
+	return wal.Commit()
+}
+
+func ProcessRollback() error {
+	if !wal.Active() {
+		return errors.New("no transaction is in progress")
+	}
+	wal.Abort()
+	return nil
+}
+
+// getIndices lists the indices of a collection, including fields which are indexed automatically
+func getIndices(database, collection string) ([]map[string]interface{}, error) {
+	schemaData := schema.Get(database, collection)
+	if schemaData == nil {
+		return nil, errors.New(fmt.Sprintf("Collection %v does not exist in database %v", collection, database))
+	}
+	definitions, err := index.ReadDefinitions(database, collection)
+	if err != nil {
+		return nil, err
+	}
+	output := make([]map[string]interface{}, 0)
+	fields := make([]string, 0, len(schemaData))
+	for field := range schemaData {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		if _, ok := definitions.Find(field); ok || !definitions.Automatic(database, field, schemaData) {
+			continue
+		}
+		output = append(output, map[string]interface{}{"field": field, "unique": false, "text": false, "status": index.StatusReady, "auto": true})
+	}
+	for _, definition := range definitions.Indices {
+		datum := map[string]interface{}{"field": definition.Field, "unique": definition.Unique, "text": definition.Text, "status": definition.Status, "auto": false}
+		if definition.Error != "" {
+			datum["error"] = definition.Error
+		}
+		output = append(output, datum)
+	}
+	return output, nil
+}
+
+// validateIndexField checks that a field or path can be indexed. Paths must start with a DICT
+// or ANY field as those are the only fields which can hold nested values. LIST fields are indexed
+// by their elements, which cannot be unique.
+func validateIndexField(collection, field string, unique bool, schemaData map[string]string) error {
+	if fieldType, ok := schemaData[field]; ok {
+		if fieldType == "DICT" || (fieldType == "LIST" && unique) {
+			return errors.New(fmt.Sprintf("Cannot index field %v of type %v", field, fieldType))
+		}
+		return nil
+	}
+	root := strings.Split(field, ".")[0]
+	if fieldType, ok := schemaData[root]; ok && root != field && (fieldType == "DICT" || fieldType == "ANY") {
+		return nil
+	}
+	return errors.New(fmt.Sprintf("Field %v does not exist in collection %v", field, collection))
+}
+
+func postIndex(database, collection, field string, unique, text bool) (err error) {
+	wal.Begin()
+	defer func() { err = wal.End(err) }()
+
+	schemaData := schema.Get(database, collection)
+	if schemaData == nil {
+		return errors.New(fmt.Sprintf("Collection %v does not exist in database %v", collection, database))
+	}
+	if text {
+		return postTextIndex(database, collection, field, schemaData)
+	}
+	if err := validateIndexField(collection, field, unique, schemaData); err != nil {
+		return err
+	}
+	definitions, err := index.ReadDefinitions(database, collection)
+	if err != nil {
+		return err
+	}
+	_, defined := definitions.Find(field)
+	if defined || (definitions.Automatic(database, field, schemaData) && !unique) {
+		return errors.New(fmt.Sprintf("Index on %v already exists", field))
+	}
+	definitions.Set(index.Definition{Field: field, Unique: unique, Status: index.StatusBuilding})
+	if err := index.WriteDefinitions(database, collection, definitions); err != nil {
+		return err
+	}
+	// The build waits for this query's locks to be released, and gives up if the definition
+	// was rolled back in the meantime
+	go buildIndex(database, collection, field, false)
+	return nil
+}
+
+// postTextIndex defines a full-text index on a STRING field, which is built in the background like
+// any other index
+func postTextIndex(database, collection, field string, schemaData map[string]string) error {
+	if fieldType, ok := schemaData[field]; !ok || fieldType != "STRING" {
+		return errors.New(fmt.Sprintf("Cannot add a text index on %v, only STRING fields can have text indices", field))
+	}
+	definitions, err := index.ReadDefinitions(database, collection)
+	if err != nil {
+		return err
+	}
+	if _, defined := definitions.FindText(field); defined {
+		return errors.New(fmt.Sprintf("Text index on %v already exists", field))
+	}
+	definitions.Set(index.Definition{Field: field, Text: true, Status: index.StatusBuilding})
+	if err := index.WriteDefinitions(database, collection, definitions); err != nil {
+		return err
+	}
+	go buildIndex(database, collection, field, true)
+	return nil
+}
+
+func deleteIndex(database, collection, field string, text bool) (err error) {
+	wal.Begin()
+	defer func() { err = wal.End(err) }()
+
+	schemaCol, _ := schema.GetCollection(database, collection)
+	schemaData := schemaCol.Types
+	unique := schemaCol.Unique[field]
+	if schemaData == nil {
+		return errors.New(fmt.Sprintf("Collection %v does not exist in database %v", collection, database))
+	}
+	if text {
+		definitions, err := index.ReadDefinitions(database, collection)
+		if err != nil {
+			return err
+		}
+		if _, defined := definitions.FindText(field); !defined {
+			return errors.New(fmt.Sprintf("Text index on %v does not exist", field))
+		}
+		definitions.RemoveText(field)
+		if err := index.DropText(database, collection, field); err != nil {
+			return err
+		}
+		return index.WriteDefinitions(database, collection, definitions)
+	}
+	if unique {
+		return errors.New(fmt.Sprintf("Index on %v enforces a UNIQUE field in the collection schema", field))
+	}
+	definitions, err := index.ReadDefinitions(database, collection)
+	if err != nil {
+		return err
+	}
+	_, defined := definitions.Find(field)
+	automatic := definitions.Automatic(database, field, schemaData)
+	if !defined && !automatic {
+		return errors.New(fmt.Sprintf("Index on %v does not exist", field))
+	}
+	if defined && automatic {
+		// Only the definition is being dropped, the automatic index stays in place
+		definitions.Remove(field)
+		return index.WriteDefinitions(database, collection, definitions)
+	}
+	// Dropping an automatic index means the remaining fields have to be listed explicitly
+	definitions.Materialize(database, schemaData)
+	definitions.Remove(field)
+	if err := index.Drop(database, collection, field); err != nil {
+		return err
+	}
+	return index.WriteDefinitions(database, collection, definitions)
+}
+
+// buildIndex indexes the existing records of a collection for a new definition, then marks the
+// definition as ready or failed
+func buildIndex(database, collection, field string, text bool) {
+	locks := queue.NewLockSet()
+	locks.Add(database+"."+collection, queue.LockWrite)
+	locks.Acquire()
+	defer locks.Release()
+
+	definitions, err := index.ReadDefinitions(database, collection)
+	if err != nil {
+		logging.ERROR(fmt.Sprintf("Unable to read index definitions for %v.%v: %v", database, collection, err))
+		return
+	}
+	definition, ok := definitions.Find(field)
+	if text {
+		definition, ok = definitions.FindText(field)
+	}
+	if !ok || definition.Status != index.StatusBuilding {
+		return
+	}
+	logging.INFO(fmt.Sprintf("Building index on %v for %v.%v", field, database, collection))
+
+	schemaData := schema.Get(database, collection)
+
+	wal.Begin()
+	err = func() error {
+		ids, err := index.All(database, collection)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		data, err := record.Get(database, collection, ids)
+		if err != nil {
+			return err
+		}
+		if err := index.Build(database, collection, definition, data, schemaData); err != nil {
+			return err
+		}
+		definition.Status = index.StatusReady
+		definitions.Set(definition)
+		return index.WriteDefinitions(database, collection, definitions)
+	}()
+	if err = wal.End(err); err == nil {
+		return
+	}
+
+	logging.ERROR(fmt.Sprintf("Unable to build index on %v for %v.%v: %v", field, database, collection, err))
+	definition.Status = index.StatusFailed
+	definition.Error = err.Error()
+	definitions.Set(definition)
+	wal.Begin()
+	if err := wal.End(index.WriteDefinitions(database, collection, definitions)); err != nil {
+		logging.ERROR(fmt.Sprintf("Unable to mark index on %v for %v.%v as failed: %v", field, database, collection, err))
+	}
+}
+
+// ResumeIndexBuilds restarts the builds of indices which were interrupted by a shutdown
+func ResumeIndexBuilds() error {
+	for dbName, db := range schema.Schema.Databases {
+		for colName := range db.Collections {
+			definitions, err := index.ReadDefinitions(dbName, colName)
+			if err != nil {
+				return err
+			}
+			for _, definition := range definitions.Indices {
+				if definition.Status == index.StatusBuilding {
+					go buildIndex(dbName, colName, definition.Field, definition.Text)
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func ProcessAction(action aql.Action, previousIDs []string, previousData []map[string]interface{}, internal bool) ([]map[string]interface{}, error) {
 	switch action.Type {
 	case "GET":
@@ -498,14 +784,18 @@ func ProcessAction(action aql.Action, previousIDs []string, previousData []map[s
 		if config.Config.Leader != "" {
 			return nil, errors.New("write actions are not permitted on follower databases")
 		}
+		// New API keys are returned as they cannot be read again
+		if action.Resource == "KEY" {
+			return postKeys(action, previousData)
+		}
 		err := ProcessPost(action, previousIDs, previousData)
 		return nil, err
 	case "PUT":
 		if config.Config.Leader != "" {
 			return nil, errors.New("write actions are not permitted on follower databases")
 		}
-		err := ProcessPut(action, previousIDs, previousData)
-		return nil, err
+		data, err := ProcessPut(action, previousIDs, previousData)
+		return data, err
 	case "PATCH":
 		if config.Config.Leader != "" {
 			return nil, errors.New("write actions are not permitted on follower databases")
@@ -521,10 +811,25 @@ func ProcessAction(action aql.Action, previousIDs []string, previousData []map[s
 	case "COUNT":
 		data, err := ProcessCount(action, previousIDs)
 		return data, err
+	case "AGGREGATE":
+		data, err := ProcessAggregate(action, previousData)
+		return data, err
+	case "JOIN":
+		data, err := ProcessJoin(action, previousData)
+		return data, err
 	case "JQ":
 		data, err := ProcessJQ(action, previousData)
 		logging.TRACE(fmt.Sprintf("Data 2: %v", data))
 		return data, err
+	case "BEGIN":
+		err := ProcessBegin()
+		return previousData, err
+	case "COMMIT":
+		err := ProcessCommit()
+		return previousData, err
+	case "ROLLBACK":
+		err := ProcessRollback()
+		return previousData, err
 	}
 	return nil, nil
 }
@@ -532,13 +837,17 @@ func ProcessAction(action aql.Action, previousIDs []string, previousData []map[s
 func doOrderASC(in []map[string]interface{}, key string) []map[string]interface{} {
 	if len(in) > 0 {
 		if _, ok := in[0][key].(string); ok {
-			sort.Slice(in, func(i, j int) bool { return in[i][key].(string) < in[j][key].(string) })
+			sort.SliceStable(in, func(i, j int) bool { return in[i][key].(string) < in[j][key].(string) })
 		} else if _, ok := in[0][key].(int); ok {
-			sort.Slice(in, func(i, j int) bool { return in[i][key].(int) < in[j][key].(int) })
+			sort.SliceStable(in, func(i, j int) bool { return in[i][key].(int) < in[j][key].(int) })
+		} else if _, ok := in[0][key].(int64); ok {
+			sort.SliceStable(in, func(i, j int) bool { return in[i][key].(int64) < in[j][key].(int64) })
 		} else if _, ok := in[0][key].(float64); ok {
-			sort.Slice(in, func(i, j int) bool { return in[i][key].(float64) < in[j][key].(float64) })
+			sort.SliceStable(in, func(i, j int) bool { return in[i][key].(float64) < in[j][key].(float64) })
+		} else if _, ok := in[0][key].(json.Number); ok {
+			sort.SliceStable(in, func(i, j int) bool { return numberLess(in[i][key].(json.Number), in[j][key].(json.Number)) })
 		} else if _, ok := in[0][key].(bool); ok {
-			sort.Slice(in, func(i, j int) bool { return boolToInt(in[i][key].(bool)) < boolToInt(in[j][key].(bool)) })
+			sort.SliceStable(in, func(i, j int) bool { return boolToInt(in[i][key].(bool)) < boolToInt(in[j][key].(bool)) })
 		}
 	}
 	return in
@@ -547,189 +856,134 @@ func doOrderASC(in []map[string]interface{}, key string) []map[string]interface{
 func doOrderDSC(in []map[string]interface{}, key string) []map[string]interface{} {
 	if len(in) > 0 {
 		if _, ok := in[0][key].(string); ok {
-			sort.Slice(in, func(i, j int) bool { return in[i][key].(string) > in[j][key].(string) })
+			sort.SliceStable(in, func(i, j int) bool { return in[i][key].(string) > in[j][key].(string) })
 		} else if _, ok := in[0][key].(int); ok {
-			sort.Slice(in, func(i, j int) bool { return in[i][key].(int) > in[j][key].(int) })
+			sort.SliceStable(in, func(i, j int) bool { return in[i][key].(int) > in[j][key].(int) })
+		} else if _, ok := in[0][key].(int64); ok {
+			sort.SliceStable(in, func(i, j int) bool { return in[i][key].(int64) > in[j][key].(int64) })
 		} else if _, ok := in[0][key].(float64); ok {
-			sort.Slice(in, func(i, j int) bool { return in[i][key].(float64) > in[j][key].(float64) })
+			sort.SliceStable(in, func(i, j int) bool { return in[i][key].(float64) > in[j][key].(float64) })
+		} else if _, ok := in[0][key].(json.Number); ok {
+			sort.SliceStable(in, func(i, j int) bool { return numberLess(in[j][key].(json.Number), in[i][key].(json.Number)) })
 		} else if _, ok := in[0][key].(bool); ok {
-			sort.Slice(in, func(i, j int) bool { return boolToInt(in[i][key].(bool)) > boolToInt(in[j][key].(bool)) })
+			sort.SliceStable(in, func(i, j int) bool { return boolToInt(in[i][key].(bool)) > boolToInt(in[j][key].(bool)) })
 		}
 	}
 	return in
 }
 
-func doAnd(A, B []string) []string {
-	sort.Strings(A)
-	sort.Strings(B)
-	out := make([]string, 0)
-	for idx, val := range A {
-		if len(B) == 0 {
-			break
-		}
-		for B[0] < val {
-			B = B[1:]
-			if len(B) == 0 {
-				break
-			}
-		}
-		if len(B) > 0 {
-			if B[0] == A[idx] {
-				out = append(out, val)
-			}
+// sortedSet returns the distinct IDs of a list in ascending order, leaving the list as it is
+func sortedSet(ids []string) []string {
+	set := append([]string(nil), ids...)
+	sort.Strings(set)
+	output := set[:0]
+	for idx, id := range set {
+		if idx == 0 || id != set[idx-1] {
+			output = append(output, id)
 		}
 	}
-	out = utils.RemoveDuplicateValues(out)
-	return out
+	return output
 }
 
-func doOr(A, B []string) []string {
-	sort.Strings(A)
-	sort.Strings(B)
+// mergeSets walks two sets of IDs in sorted order in a single pass, keeping the IDs which are
+// only in A, in both, or only in B as asked
+func mergeSets(A, B []string, onlyA, both, onlyB bool) []string {
+	a, b := sortedSet(A), sortedSet(B)
 	out := make([]string, 0)
-	for idx, val := range A {
-		if len(B) == 0 {
-			out = append(out, A[idx:]...)
-			break
-		}
-		for B[0] < val {
-			out = append(out, B[0])
-			B = B[1:]
-			if len(B) == 0 {
-				out = append(out, A[idx:]...)
-				break
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || (i < len(a) && a[i] < b[j]):
+			if onlyA {
+				out = append(out, a[i])
 			}
-		}
-		if len(B) > 0 {
-			if B[0] != val {
-				out = append(out, val)
+			i++
+		case i == len(a) || b[j] < a[i]:
+			if onlyB {
+				out = append(out, b[j])
+			}
+			j++
+		default:
+			if both {
+				out = append(out, a[i])
 			}
+			i++
+			j++
 		}
 	}
-	out = append(out, B...)
-	out = utils.RemoveDuplicateValues(out)
 	return out
 }
 
+func doAnd(A, B []string) []string {
+	return mergeSets(A, B, false, true, false)
+}
+
+func doOr(A, B []string) []string {
+	return mergeSets(A, B, true, true, true)
+}
+
 func doNot(A, B []string) []string {
-	sort.Strings(A)
-	sort.Strings(B)
-	out := make([]string, 0)
-	for idx, val := range A {
-		if len(B) == 0 {
-			out = append(out, A[idx:]...)
-			break
-		}
-		for B[0] < val {
-			B = B[1:]
-			if len(B) == 0 {
-				out = append(out, A[idx:]...)
-				break
-			}
-		}
-		if len(B) > 0 {
-			if B[0] != val {
-				out = append(out, val)
-			}
-		}
-	}
-	out = utils.RemoveDuplicateValues(out)
-	return out
+	return mergeSets(A, B, true, false, false)
 }
 
 func doXor(A, B []string) []string {
-	sort.Strings(A)
-	sort.Strings(B)
-	out := make([]string, 0)
-	for idx, val := range A {
-		if len(B) == 0 {
-			out = append(out, A[idx:]...)
-			break
-		}
-		for B[0] < val {
-			out = append(out, B[0])
-			B = B[1:]
-			if len(B) == 0 {
-				out = append(out, A[idx:]...)
-				break
-			}
-		}
-		if len(B) > 0 {
-			if B[0] == val {
-				B = B[1:]
-			} else {
-				out = append(out, val)
-			}
-		} else {
-			out = append(out, val)
-		}
-	}
-	out = utils.RemoveDuplicateValues(out)
-	return out
+	return mergeSets(A, B, true, false, true)
 }
 
-func doBoolComparison(left, right bool, operator string) bool {
-	switch operator {
-	case "=":
-		return left == right
-	case "!=":
-		return left != right
+// doOrderTyped orders records on a field whose values do not sort correctly as strings, such as
+// timestamps and durations, using the same ordering as the field's index
+func doOrderTyped(in []map[string]interface{}, key, fieldType, direction string) []map[string]interface{} {
+	if direction != "ASC" && direction != "DSC" {
+		return in
 	}
-	return false
-}
-
-func doFloatComparison(left, right float64, operator string) bool {
-	switch operator {
-	case ">":
-		return left > right
-	case ">=":
-		return left >= right
-	case "<":
-		return left < right
-	case "<=":
-		return left <= right
-	case "=":
-		return left == right
-	case "!=":
-		return left != right
+	keys := make(map[string]string, len(in))
+	for _, datum := range in {
+		stringVal, _ := datum[key].(string)
+		keys[datum[".id"].(string)], _ = index.OrderedKey(fieldType, stringVal)
 	}
-	return false
+	sort.SliceStable(in, func(i, j int) bool {
+		left, right := keys[in[i][".id"].(string)], keys[in[j][".id"].(string)]
+		if direction == "DSC" {
+			return left > right
+		}
+		return left < right
+	})
+	return in
 }
 
-func doIntComparison(left, right int, operator string) bool {
-	switch operator {
-	case ">":
-		return left > right
-	case ">=":
-		return left >= right
-	case "<":
-		return left < right
-	case "<=":
-		return left <= right
-	case "=":
-		return left == right
-	case "!=":
-		return left != right
+// orderRecords orders records on a field using the ordering of the field's index, with records
+// which do not have a value for the field coming last in their original order
+func orderRecords(in []map[string]interface{}, key, fieldType, direction string) []map[string]interface{} {
+	withValue := make([]map[string]interface{}, 0, len(in))
+	withoutValue := make([]map[string]interface{}, 0)
+	for _, datum := range in {
+		if datum[key] == nil {
+			withoutValue = append(withoutValue, datum)
+		} else {
+			withValue = append(withValue, datum)
+		}
 	}
-	return false
+	if utils.Contains(schema.TypedStringTypes, fieldType) {
+		withValue = doOrderTyped(withValue, key, fieldType, direction)
+	} else if direction == "ASC" {
+		withValue = doOrderASC(withValue, key)
+	} else if direction == "DSC" {
+		withValue = doOrderDSC(withValue, key)
+	}
+	return append(withValue, withoutValue...)
 }
 
-func doStringComparison(left, right string, operator string) bool {
-	switch operator {
-	case ">":
-		return left > right
-	case ">=":
-		return left >= right
-	case "<":
-		return left < right
-	case "<=":
-		return left <= right
-	case "=":
-		return left == right
-	case "!=":
-		return left != right
+// numberLess compares numbers which were read without a declared type, exactly when both are
+// integers
+func numberLess(a, b json.Number) bool {
+	intA, errA := a.Int64()
+	intB, errB := b.Int64()
+	if errA == nil && errB == nil {
+		return intA < intB
 	}
-	return false
+	floatA, _ := a.Float64()
+	floatB, _ := b.Float64()
+	return floatA < floatB
 }
 
 func boolToInt(boolVal bool) int {
@@ -739,203 +993,260 @@ func boolToInt(boolVal bool) int {
 	return 0
 }
 
-func doFilterBool(database, collection, key string, node aql.Node) ([]string, error) {
-	filePath := filepath.Join(config.Config.IndexDir, database, collection, key)
-	stringValues, _ := FilePathWalkDir(filePath)
-	values := make(map[bool]string, 0)
-	keys := make([]bool, 0)
-	for _, value := range stringValues {
-		decodedVal, _ := base64.StdEncoding.DecodeString(filepath.Base(value))
-		boolVal, _ := strconv.ParseBool(string(decodedVal))
-		values[boolVal] = value
-		keys = append(keys, boolVal)
-	}
-	sort.Slice(keys, func(i, j int) bool { return boolToInt(keys[i]) < boolToInt(keys[j]) })
-	output := make([]string, 0)
-	compVal, _ := strconv.ParseBool(node.Right.Value)
-	for _, key := range keys {
-		if doBoolComparison(key, compVal, node.Value) {
-			dat, _ := os.ReadFile(values[key])
-			ids := strings.Split(string(dat), "\n")
-			ids = ids[:len(ids)-1]
-			output = append(output, ids...)
+// scanRecords returns the IDs of the records in a collection which match
+func scanRecords(database, collection string, match func(datum map[string]interface{}) (bool, error)) ([]string, error) {
+	ids, err := index.All(database, collection)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
 		}
+		return nil, err
 	}
-	return output, nil
+	return matchRecords(database, collection, ids, match)
 }
 
-func doFilterFloat(database, collection, key string, node aql.Node) ([]string, error) {
-	filePath := filepath.Join(config.Config.IndexDir, database, collection, key)
-	stringValues, _ := FilePathWalkDir(filePath)
-	values := make(map[float64]string, 0)
-	keys := make([]float64, 0)
-	for _, value := range stringValues {
-		decodedVal, _ := base64.StdEncoding.DecodeString(filepath.Base(value))
-		floatVal, _ := strconv.ParseFloat(string(decodedVal), 64)
-		values[floatVal] = value
-		keys = append(keys, floatVal)
-	}
-	sort.Float64s(keys)
+// matchRecords returns the IDs of the given records which match
+func matchRecords(database, collection string, ids []string, match func(datum map[string]interface{}) (bool, error)) ([]string, error) {
 	output := make([]string, 0)
-	compVal, _ := strconv.ParseFloat(node.Right.Value, 64)
-	for _, key := range keys {
-		if doFloatComparison(key, compVal, node.Value) {
-			dat, _ := os.ReadFile(values[key])
-			ids := strings.Split(string(dat), "\n")
-			ids = ids[:len(ids)-1]
-			output = append(output, ids...)
-		}
+	if len(ids) == 0 {
+		return output, nil
 	}
-	return output, nil
-}
-
-func doFilterInt(database, collection, key string, node aql.Node) ([]string, error) {
-	filePath := filepath.Join(config.Config.IndexDir, database, collection, key)
-	stringValues, _ := FilePathWalkDir(filePath)
-	values := make(map[int]string, 0)
-	keys := make([]int, 0)
-	for _, value := range stringValues {
-		decodedVal, _ := base64.StdEncoding.DecodeString(filepath.Base(value))
-		intVal, _ := strconv.Atoi(string(decodedVal))
-		values[intVal] = value
-		keys = append(keys, intVal)
+	data, err := record.Get(database, collection, utils.RemoveDuplicateValues(ids))
+	if err != nil {
+		return nil, err
 	}
-	sort.Ints(keys)
-	output := make([]string, 0)
-	compVal, _ := strconv.Atoi(node.Right.Value)
-	for _, key := range keys {
-		if doIntComparison(key, compVal, node.Value) {
-			dat, _ := os.ReadFile(values[key])
-			ids := strings.Split(string(dat), "\n")
-			ids = ids[:len(ids)-1]
-			output = append(output, ids...)
+	for _, datum := range data {
+		matched, err := match(datum)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			output = append(output, datum[".id"].(string))
 		}
 	}
 	return output, nil
 }
 
-func doFilterString(database, collection, key string, node aql.Node) ([]string, error) {
-	filePath := filepath.Join(config.Config.IndexDir, database, collection, key)
-	stringValues, _ := FilePathWalkDir(filePath)
-	values := make(map[string]string, 0)
-	keys := make([]string, 0)
-	for _, value := range stringValues {
-		decodedVal, _ := base64.StdEncoding.DecodeString(filepath.Base(value))
-		stringVal := string(decodedVal)
-		if stringVal == index.EMPTY_FIELD_VALUE {
-			stringVal = ""
-		}
-		values[stringVal] = value
-		keys = append(keys, stringVal)
+// leafIndexed reports whether a filter condition can be answered from an index, along with the
+// type its field's values are compared as. CONTAINS needs an index of a LIST field's elements,
+// EXISTS and IS MISSING need an index holding every scalar value, and string patterns are matched
+// against the index of a STRING field.
+func leafIndexed(database string, node aql.Node, definitions index.Definitions, schemaData map[string]string) (bool, string) {
+	key := node.Left.Value
+	if node.Value == "CONTAINS" {
+		return definitions.ElementsIndexed(key, schemaData), "ANY"
 	}
-	sort.Strings(keys)
-	output := make([]string, 0)
-	compVal := node.Right.Value
-	for _, key := range keys {
-		if doStringComparison(key, compVal, node.Value) {
-			dat, _ := os.ReadFile(values[key])
-			ids := strings.Split(string(dat), "\n")
-			ids = ids[:len(ids)-1]
-			output = append(output, ids...)
-		}
+	indexed, fieldType := definitions.Indexed(database, key, schemaData)
+	switch node.Value {
+	case "EXISTS", "IS NOT NULL", "IS MISSING":
+		indexed = indexed && !utils.Contains(index.InvalidSchemaTypes, fieldType)
+	case "LIKE", "ILIKE", "STARTSWITH", "MATCHES":
+		indexed = indexed && fieldType == "STRING"
 	}
-	return output, nil
+	return indexed, fieldType
 }
 
-func doFilter(database, collection string, node aql.Node) ([]string, error) {
+// indexLeaf answers a filter condition from its field's index
+func indexLeaf(database, collection string, node aql.Node, fieldType string) ([]string, error) {
 	key := node.Left.Value
-	switch schema.Schema.Databases[database].Collections[collection].Types[key] {
-	case "BOOL":
-		out, err := doFilterBool(database, collection, key, node)
-		return out, err
-	case "INT":
-		out, err := doFilterInt(database, collection, key, node)
-		return out, err
-	case "FLOAT":
-		out, err := doFilterFloat(database, collection, key, node)
-		return out, err
-	case "STRING":
-		out, err := doFilterString(database, collection, key, node)
-		return out, err
-	}
-	return []string{}, nil
-}
-
-func ProcessFilter(database, collection string, node aql.Node) ([]string, error) {
 	switch node.Value {
-	case ">":
-		output, err := doFilter(database, collection, node)
-		return output, err
-	case ">=":
-		output, err := doFilter(database, collection, node)
-		return output, err
-	case "=":
-		output, err := doFilter(database, collection, node)
-		return output, err
-	case "<":
-		output, err := doFilter(database, collection, node)
-		return output, err
-	case "<=":
-		output, err := doFilter(database, collection, node)
-		return output, err
-	case "!=":
-		output, err := doFilter(database, collection, node)
-		return output, err
-	case "AND":
-		left, err := ProcessFilter(database, collection, *node.Left)
+	case "CONTAINS":
+		return index.Range(database, collection, key, "ANY", "=", node.Right.Value)
+	case "IN":
+		values, err := inValues(node)
 		if err != nil {
 			return nil, err
 		}
-		right, err := ProcessFilter(database, collection, *node.Right)
-		if err != nil {
-			return nil, err
+		output := make([]string, 0)
+		for _, val := range values {
+			ids, err := index.Range(database, collection, key, fieldType, "=", val)
+			if err != nil {
+				return nil, err
+			}
+			output = doOr(output, ids)
 		}
-		output := doAnd(left, right)
 		return output, nil
-	case "OR":
-		left, err := ProcessFilter(database, collection, *node.Left)
+	case "EXISTS", "IS NOT NULL":
+		// The index holds every non-null value of the field
+		output := make([]string, 0)
+		err := index.Ordered(database, collection, key, false, func(ids []string) (bool, error) {
+			output = append(output, ids...)
+			return true, nil
+		})
+		return output, err
+	case "IS NULL":
+		return index.Null(database, collection, key)
+	case "IS MISSING":
+		// The field is missing from every record which is not in its index
+		all, err := index.All(database, collection)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		present, err := indexLeaf(database, collection, aql.Node{Value: "EXISTS", Left: node.Left}, fieldType)
 		if err != nil {
 			return nil, err
 		}
-		right, err := ProcessFilter(database, collection, *node.Right)
+		nulls, err := index.Null(database, collection, key)
 		if err != nil {
 			return nil, err
 		}
-		output := doOr(left, right)
-		return output, nil
-	case "NOT":
-		left, err := index.All(database, collection)
-		right, err := ProcessFilter(database, collection, *node.Right)
+		return doNot(all, doOr(present, nulls)), nil
+	case "LIKE", "ILIKE", "STARTSWITH", "MATCHES":
+		// Patterns are matched against the distinct values in the index, starting from their
+		// literal prefix
+		prefix, match, err := stringMatcher(node.Value, node.Right.Value)
 		if err != nil {
 			return nil, err
 		}
-		output := doNot(left, right)
-		return output, nil
-	case "XOR":
-		left, err := ProcessFilter(database, collection, *node.Left)
+		return index.PrefixMatch(database, collection, key, prefix, match)
+	}
+	return index.Range(database, collection, key, fieldType, node.Value, node.Right.Value)
+}
+
+// leafMatcher returns the check a filter condition makes against each record when its field has
+// no index to answer it from
+func leafMatcher(node aql.Node, fieldType string) (func(datum map[string]interface{}) (bool, error), error) {
+	key := node.Left.Value
+	switch node.Value {
+	case ">", ">=", "=", "<", "<=", "!=":
+		return func(datum map[string]interface{}) (bool, error) {
+			val, _ := index.Resolve(datum, key)
+			return index.Matches(fieldType, node.Value, val, node.Right.Value)
+		}, nil
+	case "CONTAINS":
+		return func(datum map[string]interface{}) (bool, error) {
+			val, _ := index.Resolve(datum, key)
+			list, ok := val.([]interface{})
+			if !ok {
+				return false, nil
+			}
+			for _, element := range list {
+				if matched, _ := index.Matches("ANY", "=", element, node.Right.Value); matched {
+					return true, nil
+				}
+			}
+			return false, nil
+		}, nil
+	case "IN":
+		values, err := inValues(node)
 		if err != nil {
 			return nil, err
 		}
-		right, err := ProcessFilter(database, collection, *node.Right)
+		return func(datum map[string]interface{}) (bool, error) {
+			val, _ := index.Resolve(datum, key)
+			for _, value := range values {
+				matched, err := index.Matches(fieldType, "=", val, value)
+				if err != nil || matched {
+					return matched, err
+				}
+			}
+			return false, nil
+		}, nil
+	case "EXISTS", "IS NOT NULL":
+		return func(datum map[string]interface{}) (bool, error) {
+			val, ok := index.Resolve(datum, key)
+			return ok && val != nil, nil
+		}, nil
+	case "IS NULL":
+		return func(datum map[string]interface{}) (bool, error) {
+			val, ok := index.Resolve(datum, key)
+			return ok && val == nil, nil
+		}, nil
+	case "IS MISSING":
+		return func(datum map[string]interface{}) (bool, error) {
+			_, ok := index.Resolve(datum, key)
+			return !ok, nil
+		}, nil
+	case "LIKE", "ILIKE", "STARTSWITH", "MATCHES":
+		prefix, match, err := stringMatcher(node.Value, node.Right.Value)
 		if err != nil {
 			return nil, err
 		}
-		output := doXor(left, right)
-		return output, nil
+		return func(datum map[string]interface{}) (bool, error) {
+			val, _ := index.Resolve(datum, key)
+			stringVal, ok := val.(string)
+			return ok && strings.HasPrefix(stringVal, prefix) && (match == nil || match(stringVal)), nil
+		}, nil
 	}
-	return nil, nil
+	return nil, errors.New(fmt.Sprintf("Invalid comparison operator: %v", node.Value))
 }
 
-func FilePathWalkDir(root string) ([]string, error) {
-	var files []string
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+// stringMatcher returns the literal prefix every value matching a string pattern starts with,
+// along with a function which checks the rest of the pattern if there is more to it
+func stringMatcher(operator, pattern string) (string, func(string) bool, error) {
+	switch operator {
+	case "STARTSWITH":
+		return pattern, nil, nil
+	case "LIKE", "ILIKE":
+		expr := "(?s)^"
+		if operator == "ILIKE" {
+			expr = "(?is)^"
+		}
+		prefix := ""
+		literal := true
+		escaped := false
+		for _, char := range pattern {
+			switch {
+			case escaped:
+				expr += regexp.QuoteMeta(string(char))
+				escaped = false
+			case char == '\\':
+				escaped = true
+				continue
+			case char == '%':
+				expr += ".*"
+				literal = false
+			case char == '_':
+				expr += "."
+				literal = false
+			default:
+				expr += regexp.QuoteMeta(string(char))
+			}
+			if literal && operator == "LIKE" {
+				prefix += string(char)
+			}
+		}
+		re, err := regexp.Compile(expr + "$")
 		if err != nil {
-			return err
+			return "", nil, err
 		}
-		if !info.IsDir() {
-			files = append(files, path)
+		return prefix, re.MatchString, nil
+	case "MATCHES":
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return "", nil, errors.New(fmt.Sprintf("Invalid regular expression %v: %v", pattern, err))
 		}
-		return nil
-	})
-	return files, err
+		return "", re.MatchString, nil
+	}
+	return "", nil, errors.New(fmt.Sprintf("Invalid comparison operator: %v", operator))
+}
+
+// inValues returns the values in the list of an IN filter, formatted as they are compared
+func inValues(node aql.Node) ([]string, error) {
+	var values []interface{}
+	if err := utils.DecodeJSON([]byte(node.Right.Value), &values); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid filter value %v for operator IN", node.Right.Value))
+	}
+	output := make([]string, 0, len(values))
+	for _, val := range values {
+		if val == nil || !joinable(val) {
+			return nil, errors.New(fmt.Sprintf("Invalid filter value %v for operator IN, values must be scalars", node.Right.Value))
+		}
+		output = append(output, utils.FormatValue(val))
+	}
+	return output, nil
+}
+
+// ProcessFilter returns the IDs of the records in a collection which match a filter, evaluating
+// its conditions in the order chosen by planFilter
+func ProcessFilter(database, collection string, node aql.Node) ([]string, error) {
+	plan, err := planFilter(database, collection, node)
+	if err != nil {
+		return nil, err
+	}
+	return plan.execute(database, collection, nil, false)
+}
+
+func FilePathWalkDir(root string) ([]string, error) {
+	return wal.ListFiles(root)
 }
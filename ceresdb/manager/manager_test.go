@@ -0,0 +1,474 @@
+package manager
+
+import (
+	"ceresdb/aql"
+	"ceresdb/collection"
+	"ceresdb/config"
+	"ceresdb/freespace"
+	"ceresdb/index"
+	"ceresdb/permit"
+	"ceresdb/record"
+	"ceresdb/role"
+	"ceresdb/schema"
+	"ceresdb/user"
+	"ceresdb/utils"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// createDatabase points the config at a home directory of the test's own, holding a catalog with
+// only empty databases and the AQL patterns, so that tests never touch the shared fixtures
+func createDatabase(t *testing.T, databases ...string) {
+	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb/config/config.json")
+	config.ReadConfigFile()
+	home := t.TempDir()
+	patterns, _ := os.ReadFile(filepath.Join(config.Config.HomeDir, "config", "aql.json"))
+	os.MkdirAll(filepath.Join(home, "config"), 0755)
+	os.WriteFile(filepath.Join(home, "config", "aql.json"), patterns, 0644)
+	config.Config.HomeDir = home
+	config.Config.DataDir = filepath.Join(home, "data")
+	config.Config.IndexDir = filepath.Join(home, "indices")
+	freespace.FreeSpace = freespace.FreeSpaceStruct{Databases: make(map[string]freespace.FreeSpaceDatabase)}
+	schema.Schema = schema.SchemaStruct{Databases: make(map[string]schema.SchemaDatabase)}
+	for _, database := range databases {
+		os.MkdirAll(filepath.Join(config.Config.DataDir, database), 0755)
+		os.MkdirAll(filepath.Join(config.Config.IndexDir, database), 0755)
+		freespace.FreeSpace.Databases[database] = freespace.FreeSpaceDatabase{}
+		schema.PostDatabase(database)
+	}
+	schema.LoadPolicies()
+	freespace.WriteFreeSpace()
+	schema.WriteSchema()
+	t.Cleanup(func() {
+		freespace.FreeSpace = freespace.FreeSpaceStruct{}
+		schema.Schema = schema.SchemaStruct{}
+	})
+}
+
+func TestDeleteIndex(t *testing.T) {
+	createDatabase(t, "mgr")
+	collection.Post("mgr", "foo", map[string]interface{}{"name": "STRING", "count": "INT"})
+
+	// Dropping a ready UNIQUE index on an automatically indexed field only drops the constraint
+	definitions, _ := index.ReadDefinitions("mgr", "foo")
+	definitions.Set(index.Definition{Field: "name", Unique: true, Status: index.StatusReady})
+	index.WriteDefinitions("mgr", "foo", definitions)
+	if err := deleteIndex("mgr", "foo", "name", false); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	definitions, _ = index.ReadDefinitions("mgr", "foo")
+	if _, ok := definitions.Find("name"); ok || !definitions.Auto || !definitions.Automatic("mgr", "name", schema.Get("mgr", "foo")) {
+		t.Errorf("Definitions were incorrect, got: %v, want: %v", definitions, "automatic indices without the constraint")
+	}
+
+	// Dropping an automatic index lists the remaining fields explicitly
+	if err := deleteIndex("mgr", "foo", "name", false); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	definitions, _ = index.ReadDefinitions("mgr", "foo")
+	if _, ok := definitions.Find("count"); definitions.Auto || !ok {
+		t.Errorf("Definitions were incorrect, got: %v, want: %v", definitions, "an explicit index on count")
+	}
+	if err := deleteIndex("mgr", "foo", "name", false); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+}
+
+func TestGetRecordsPages(t *testing.T) {
+	createDatabase(t, "mgr")
+	collection.Post("mgr", "foo", map[string]interface{}{"name": "STRING", "count": "INT", "flag": "BOOL"})
+
+	// Every record has several indexed values, so each is listed more than once in the index
+	data := make([]map[string]interface{}, 0)
+	for idx := 0; idx < 5; idx++ {
+		data = append(data, map[string]interface{}{"name": fmt.Sprintf("name-%d", idx), "count": idx, "flag": idx%2 == 0})
+	}
+	if _, err := ProcessAction(aql.Action{Type: "POST", Resource: "RECORD", Identifier: "mgr.foo", Data: data}, nil, nil, false); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+
+	seen := make(map[string]bool)
+	action := aql.Action{Type: "GET", Resource: "RECORD", Identifier: "mgr.foo", Limit: 2}
+	for _, expected := range []int{2, 2, 1} {
+		page, next, err := ProcessGetRecords(action, nil)
+		if err != nil {
+			t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+		}
+		if len(page) != expected {
+			t.Errorf("Length was incorrect, got: %v, want: %v", len(page), expected)
+		}
+		for _, datum := range page {
+			if seen[datum[".id"].(string)] {
+				t.Errorf("Record was returned twice: %v", datum[".id"])
+			}
+			seen[datum[".id"].(string)] = true
+		}
+		action.After = next
+	}
+	if action.After != "" || len(seen) != 5 {
+		t.Errorf("Pages were incorrect, got: %v records and token %v, want: %v", len(seen), action.After, "5 records and no token")
+	}
+
+	page, _, _ := ProcessGetRecords(aql.Action{Type: "GET", Resource: "RECORD", Identifier: "mgr.foo", Offset: 2, Limit: 10}, nil)
+	if len(page) != 3 {
+		t.Errorf("Length was incorrect, got: %v, want: %v", len(page), 3)
+	}
+}
+
+func TestJoinMatches(t *testing.T) {
+	createDatabase(t, "mgr")
+	collection.Post("mgr", "indexed", map[string]interface{}{"code": "STRING"})
+	collection.Post("mgr", "scanned", map[string]interface{}{"code": "STRING"})
+	index.WriteDefinitions("mgr", "scanned", index.Definitions{Auto: false, Indices: []index.Definition{}, Nulls: true})
+	for _, col := range []string{"indexed", "scanned"} {
+		data := []map[string]interface{}{{"code": "5"}, {"code": "6"}}
+		if _, err := ProcessAction(aql.Action{Type: "POST", Resource: "RECORD", Identifier: "mgr." + col, Data: data}, nil, nil, false); err != nil {
+			t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+		}
+	}
+
+	// A number never matches a string, whether or not the right field is indexed
+	previousData := []map[string]interface{}{{"ref": int64(5)}, {"ref": "5"}, {"ref": "7"}}
+	for _, col := range []string{"indexed", "scanned"} {
+		join := aql.Join{Left: "ref", Right: "code", As: "codes"}
+		data, err := ProcessJoin(aql.Action{Type: "JOIN", Resource: "RECORD", Identifier: "mgr." + col, Join: join}, previousData)
+		if err != nil {
+			t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+		}
+		counts := []int{}
+		for _, datum := range data {
+			counts = append(counts, len(datum["codes"].([]interface{})))
+		}
+		if fmt.Sprint(counts) != "[0 1 0]" {
+			t.Errorf("Matches for %v were incorrect, got: %v, want: %v", col, counts, "[0 1 0]")
+		}
+	}
+
+	// Flattened matches are prefixed with the join's name, with the matched record's .id as _id
+	join := aql.Join{Left: "ref", Right: "code", As: "codes", Flatten: true}
+	data, err := ProcessJoin(aql.Action{Type: "JOIN", Resource: "RECORD", Identifier: "mgr.indexed", Join: join}, previousData)
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if len(data) != 1 {
+		t.Fatalf("Length was incorrect, got: %v, want: %v", len(data), 1)
+	}
+	keys := make([]string, 0, len(data[0]))
+	for key := range data[0] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if fmt.Sprint(keys) != "[codes._id codes.code ref]" {
+		t.Errorf("Keys were incorrect, got: %v, want: %v", keys, "[codes._id codes.code ref]")
+	}
+	if id, ok := data[0]["codes._id"].(string); !ok || id == "" || data[0]["codes.code"] != "5" {
+		t.Errorf("Record was incorrect, got: %v, want: %v", data[0], "the record with code 5")
+	}
+}
+
+// createOrders fills a collection with orders of two tenants, returning the IDs of the records by
+// their amount
+func createOrders(t *testing.T) map[string]string {
+	collection.Post("mgr", "orders", map[string]interface{}{"tenant": "STRING", "amount": "INT", "secret": "STRING"})
+	data := []map[string]interface{}{
+		{"tenant": "a", "amount": 1, "secret": "s1"},
+		{"tenant": "a", "amount": 2, "secret": "s2"},
+		{"tenant": "b", "amount": 10, "secret": "s10"},
+	}
+	if _, err := ProcessAction(aql.Action{Type: "POST", Resource: "RECORD", Identifier: "mgr.orders", Data: data}, nil, nil, false); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	return orderIDs()
+}
+
+func orderIDs() map[string]string {
+	data, _, _ := ProcessGetRecords(aql.Action{Type: "GET", Resource: "RECORD", Identifier: "mgr.orders"}, nil)
+	ids := make(map[string]string)
+	for _, datum := range data {
+		ids[utils.FormatValue(datum["amount"])] = datum[".id"].(string)
+	}
+	return ids
+}
+
+// maxActual returns the largest number of records any node of a serialized plan matched
+func maxActual(planMap map[string]interface{}) int {
+	actual := int(planMap["actual"].(float64))
+	children, _ := planMap["children"].([]interface{})
+	for _, child := range children {
+		if childActual := maxActual(child.(map[string]interface{})); childActual > actual {
+			actual = childActual
+		}
+	}
+	return actual
+}
+
+func TestPolicyReads(t *testing.T) {
+	createDatabase(t, "mgr")
+	createOrders(t)
+	policy, err := aql.ParseFilter("tenant = \"a\"")
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	access := aql.Access{Deny: []string{"secret"}}
+	action := aql.Action{Type: "GET", Resource: "RECORD", Identifier: "mgr.orders", Policy: policy, Access: access}
+
+	// Final and earlier GETs only return the records within the policy, without hidden fields
+	final, _, err := ProcessGetRecords(action, nil)
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	piped, err := ProcessAction(action, nil, nil, false)
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	for _, data := range [][]map[string]interface{}{final, piped} {
+		if len(data) != 2 {
+			t.Errorf("Length was incorrect, got: %v, want: %v", len(data), 2)
+		}
+		for _, datum := range data {
+			if _, ok := datum["secret"]; ok || datum["tenant"] != "a" {
+				t.Errorf("Record was incorrect, got: %v, want: %v", datum, "tenant a without secret")
+			}
+		}
+	}
+	filtered := action
+	filtered.Filter, _ = aql.ParseFilter("tenant = \"b\"")
+	if data, _, _ := ProcessGetRecords(filtered, nil); len(data) != 0 {
+		t.Errorf("Length was incorrect, got: %v, want: %v", len(data), 0)
+	}
+
+	// Using a hidden field to filter, order, or group by is rejected
+	hidden := action
+	hidden.Filter, _ = aql.ParseFilter("secret = \"s10\"")
+	if _, _, err := ProcessGetRecords(hidden, nil); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+	hidden = action
+	hidden.Order, hidden.OrderDir = "secret", "ASC"
+	if _, err := ProcessAction(hidden, nil, nil, false); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+
+	aggregate := aql.Action{Type: "AGGREGATE", Resource: "RECORD", Identifier: "mgr.orders", Policy: policy, Access: access}
+	aggregate.Aggregates = []aql.Aggregate{{Function: "COUNT"}, {Function: "SUM", Field: "amount"}}
+	data, err := ProcessAction(aggregate, nil, nil, false)
+	if err != nil || len(data) != 1 || utils.FormatValue(data[0]["count"]) != "2" || utils.FormatValue(data[0]["sum_amount"]) != "3" {
+		t.Errorf("Aggregates were incorrect, got: %v, %v, want: %v", data, err, "count 2 and sum 3")
+	}
+	aggregate.Group = []string{"secret"}
+	if _, err := ProcessAction(aggregate, nil, nil, false); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+
+	// EXPLAIN never counts more records than a GET returns, and leaves out estimates and the policy
+	for _, filter := range []string{"", "tenant = \"b\"", "tenant = \"a\"", "NOT tenant = \"a\"", "amount > 0 OR tenant = \"b\""} {
+		explained := action
+		explained.Filter = aql.Node{}
+		if filter != "" {
+			explained.Filter, _ = aql.ParseFilter(filter)
+		}
+		returned, _, _ := ProcessGetRecords(explained, nil)
+		data, err := ProcessExplain([]aql.Action{explained})
+		if err != nil {
+			t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+			continue
+		}
+		planBytes, _ := json.Marshal(data[0]["plan"])
+		if data[0]["actual"] != len(returned) || strings.Contains(string(planBytes), "estimated") || strings.Contains(string(planBytes), "\"a\"") && !strings.Contains(filter, "\"a\"") {
+			t.Errorf("Explain of %q was incorrect, got: %v %s, want: %v", filter, data[0]["actual"], planBytes, len(returned))
+		}
+		if _, ok := data[0]["estimated"]; ok {
+			t.Errorf("Explain of %q was incorrect, got: %v, want: %v", filter, data[0], "no estimate")
+		}
+		if actual := maxActual(data[0]["plan"].(map[string]interface{})); actual > 2 || filter == "tenant = \"b\"" && actual != 0 {
+			t.Errorf("Explain of %q was incorrect, got: %v %s, want: %v", filter, actual, planBytes, "no condition matching records outside the policy")
+		}
+	}
+
+	join := aql.Action{Type: "JOIN", Resource: "RECORD", Identifier: "mgr.orders", Policy: policy, Access: access}
+	join.Join = aql.Join{Left: "t", Right: "tenant", As: "orders"}
+	data, err = ProcessAction(join, nil, []map[string]interface{}{{"t": "a"}, {"t": "b"}}, false)
+	if err != nil || len(data) != 2 || len(data[0]["orders"].([]interface{})) != 2 || len(data[1]["orders"].([]interface{})) != 0 {
+		t.Errorf("Join was incorrect, got: %v, %v, want: %v", data, err, "two matches for a and none for b")
+	}
+	for _, match := range data[0]["orders"].([]interface{}) {
+		if _, ok := match.(map[string]interface{})["secret"]; ok {
+			t.Errorf("Match was incorrect, got: %v, want: %v", match, "no secret")
+		}
+	}
+	join.Join.Right = "secret"
+	if _, err := ProcessAction(join, nil, []map[string]interface{}{{"t": "s10"}}, false); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+
+	explained, err := ProcessExplain([]aql.Action{action})
+	if err != nil || len(explained) != 1 || explained[0]["actual"] != 2 {
+		t.Errorf("Explain was incorrect, got: %v, %v, want: %v", explained, err, "2 records")
+	}
+	if _, err := ProcessExplain([]aql.Action{hidden}); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+}
+
+func TestPolicyWrites(t *testing.T) {
+	createDatabase(t, "mgr")
+	ids := createOrders(t)
+	policy, _ := aql.ParseFilter("tenant = \"a\"")
+	access := aql.Access{Deny: []string{"secret"}}
+	write := func(actionType string, actionIDs []string, data []map[string]interface{}) error {
+		action := aql.Action{Type: actionType, Resource: "RECORD", Identifier: "mgr.orders", IDs: actionIDs, Data: data, Policy: policy, Access: access}
+		_, err := ProcessAction(action, nil, nil, false)
+		return err
+	}
+	stored := func(amount string) map[string]interface{} {
+		data, _ := record.Get("mgr", "orders", []string{ids[amount]})
+		if len(data) != 1 {
+			return nil
+		}
+		return data[0]
+	}
+
+	// Only the records within the policy are affected by a write asking for others as well
+	requested := []string{ids["1"], ids["2"], ids["10"]}
+	for _, actionType := range []string{"PATCH", "DELETE", "PUT"} {
+		action := aql.Action{Type: actionType, Resource: "RECORD", Identifier: "mgr.orders", Policy: policy}
+		affected, err := AffectedIDs(action, requested)
+		if err != nil || len(affected) != 2 || utils.Contains(affected, ids["10"]) {
+			t.Errorf("IDs were incorrect for %v, got: %v, %v, want: %v", actionType, affected, err, "the ids of tenant a")
+		}
+	}
+	if affected, _ := AffectedIDs(aql.Action{Type: "DELETE", Resource: "RECORD", Identifier: "mgr.orders"}, requested); len(affected) != 3 {
+		t.Errorf("IDs were incorrect, got: %v, want: %v", affected, requested)
+	}
+
+	// Records outside the policy cannot be created or moved into it, and are left alone otherwise
+	if err := write("POST", nil, []map[string]interface{}{{"tenant": "b", "amount": 20}}); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+	if err := write("PUT", nil, []map[string]interface{}{{".id": ids["10"], "tenant": "a", "amount": 11}}); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if datum := stored("10"); datum["tenant"] != "b" || utils.FormatValue(datum["amount"]) != "10" {
+		t.Errorf("Record was incorrect, got: %v, want: %v", datum, "unchanged")
+	}
+	if err := write("PUT", nil, []map[string]interface{}{{".id": ids["1"], "tenant": "b", "amount": 1}}); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+	if err := write("PATCH", []string{ids["1"], ids["10"]}, []map[string]interface{}{{"amount": 5}}); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if utils.FormatValue(stored("1")["amount"]) != "5" || utils.FormatValue(stored("10")["amount"]) != "10" {
+		t.Errorf("Records were incorrect, got: %v, %v, want: %v", stored("1"), stored("10"), "only the record within the policy patched")
+	}
+	if err := write("PATCH", []string{ids["2"]}, []map[string]interface{}{{"tenant": "b"}}); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+
+	// Hidden fields cannot be written, and a PUT keeps their stored values
+	if err := write("PATCH", []string{ids["2"]}, []map[string]interface{}{{"secret": "x"}}); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+	if err := write("POST", nil, []map[string]interface{}{{"tenant": "a", "amount": 3, "secret": "x"}}); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+	if err := write("PUT", nil, []map[string]interface{}{{".id": ids["2"], "tenant": "a", "amount": 4}}); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if datum := stored("2"); datum["secret"] != "s2" || utils.FormatValue(datum["amount"]) != "4" {
+		t.Errorf("Record was incorrect, got: %v, want: %v", datum, "amount 4 with secret s2")
+	}
+
+	if err := write("DELETE", []string{ids["1"], ids["2"], ids["10"]}, nil); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if remaining := orderIDs(); len(remaining) != 1 || remaining["10"] != ids["10"] {
+		t.Errorf("Records were incorrect, got: %v, want: %v", remaining, "only the record outside the policy")
+	}
+}
+
+func TestDeleteRolesInUse(t *testing.T) {
+	createDatabase(t, "mgr", "_auth")
+	collection.Post("_auth", "_users", user.Schema)
+	collection.Post("_auth", "_roles", role.Schema)
+	collection.Post("mgr", "_users", permit.Schema)
+	collection.Post("mgr", "orders", map[string]interface{}{"tenant": "STRING"})
+	roleID := func() []string {
+		ids, _ := ProcessFilter("_auth", "_roles", aql.Node{Value: "=", Left: &aql.Node{Value: "name"}, Right: &aql.Node{Value: "auditor"}})
+		return ids
+	}
+	if err := writeRoles([]map[string]interface{}{{"name": "auditor", "inherits": []interface{}{"READ"}}}, false); err != nil {
+		t.Fatalf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+
+	// Each place a role can be assigned keeps it from being deleted until it is removed from there
+	steps := []struct {
+		use    string
+		assign func() error
+		remove func() error
+	}{
+		{
+			"users",
+			func() error {
+				return user.Post([]map[string]interface{}{{"username": "u", "password": "p", "role": "auditor"}})
+			},
+			func() error {
+				ids, _ := index.All("_auth", "_users")
+				return user.Delete(ids)
+			},
+		},
+		{
+			"permits in database mgr",
+			func() error {
+				return permit.Post("mgr", []map[string]interface{}{{"username": "u", "role": "auditor"}})
+			},
+			func() error {
+				ids, _ := index.All("mgr", "_users")
+				return record.Delete("mgr", "_users", ids)
+			},
+		},
+		{
+			"permits for collection mgr.orders",
+			func() error {
+				scopes := map[string]interface{}{"orders": map[string]interface{}{"role": "auditor"}}
+				return permit.Post("mgr", []map[string]interface{}{{"username": "u", "role": "READ", "collections": scopes}})
+			},
+			func() error {
+				ids, _ := index.All("mgr", "_users")
+				return record.Delete("mgr", "_users", ids)
+			},
+		},
+		{
+			"policy own of collection mgr.orders",
+			func() error {
+				return writePolicies("mgr.orders", []map[string]interface{}{{"name": "own", "role": "auditor", "filter": "tenant = \"a\""}}, false)
+			},
+			func() error {
+				return deletePolicies("mgr.orders", []string{"own"})
+			},
+		},
+	}
+	for _, step := range steps {
+		if err := step.assign(); err != nil {
+			t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+		}
+		want := fmt.Sprintf("Role auditor is assigned to %v", step.use)
+		if err := deleteRoles(roleID()); err == nil || err.Error() != want {
+			t.Errorf("Error was incorrect, got: %v, want: %v", err, want)
+		}
+		if err := step.remove(); err != nil {
+			t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+		}
+	}
+
+	if err := deleteRoles(roleID()); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if ids := roleID(); len(ids) != 0 {
+		t.Errorf("Roles were incorrect, got: %v, want: %v", ids, "[]")
+	}
+}
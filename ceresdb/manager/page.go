@@ -0,0 +1,278 @@
+// page.go
+
+package manager
+
+import (
+	"ceresdb/aql"
+	"ceresdb/index"
+	"ceresdb/record"
+	"ceresdb/schema"
+	"ceresdb/utils"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// STREAM_BATCH_SIZE is the number of records read from disk at a time when results are streamed
+const STREAM_BATCH_SIZE = 1000
+
+// pageToken is the continuation token handed back when a GET RECORD query has more results.
+// Unordered queries continue after the last record returned, while ordered and searched queries
+// have to be re-sorted and so continue from an offset.
+type pageToken struct {
+	Collection string `json:"c"`
+	Order      string `json:"r,omitempty"`
+	After      string `json:"a,omitempty"`
+	Offset     int    `json:"o,omitempty"`
+}
+
+func encodeToken(token pageToken) string {
+	tokenBytes, _ := json.Marshal(token)
+	return base64.RawURLEncoding.EncodeToString(tokenBytes)
+}
+
+// decodeToken reads a continuation token, checking that it was issued for the same collection
+// and ordering as the query it is used with
+func decodeToken(action aql.Action) (pageToken, error) {
+	var token pageToken
+	tokenBytes, err := base64.RawURLEncoding.DecodeString(action.After)
+	if err != nil {
+		return token, errors.New(fmt.Sprintf("Invalid continuation token '%v'", action.After))
+	}
+	if err := json.Unmarshal(tokenBytes, &token); err != nil {
+		return token, errors.New(fmt.Sprintf("Invalid continuation token '%v'", action.After))
+	}
+	if token.Collection != action.Identifier || token.Order != tokenOrder(action) {
+		return token, errors.New("Continuation token does not match the query")
+	}
+	return token, nil
+}
+
+func tokenOrder(action aql.Action) string {
+	if action.OrderDir == "" {
+		if action.Search.Field != "" {
+			return "SEARCH " + action.Search.Field + " " + action.Search.Terms
+		}
+		return ""
+	}
+	return action.OrderDir + " " + action.Order
+}
+
+// pageBounds returns the slice of a result set of length total which starts at start and holds at
+// most limit items, where a limit of zero means no limit
+func pageBounds(total, start, limit int) (int, int) {
+	if start > total {
+		start = total
+	}
+	end := total
+	if limit > 0 && start+limit < total {
+		end = start + limit
+	}
+	return start, end
+}
+
+// ProcessGetRecords runs a GET RECORD action, returning a page of records along with the
+// continuation token for the next page, which is empty when there are no more records. Unordered
+// queries only read the records on the page. Searched queries return the matching records from
+// most to least relevant unless they are ordered. If emit is set each record is passed to it as it
+// is read instead of being returned.
+func ProcessGetRecords(action aql.Action, emit func(map[string]interface{}) error) ([]map[string]interface{}, string, error) {
+	parts := strings.Split(action.Identifier, ".")
+	db := parts[0]
+	col := parts[1]
+	if err := checkAccess(action); err != nil {
+		return nil, "", err
+	}
+	action.Filter = policyFilter(action)
+	token := pageToken{Collection: action.Identifier, Order: tokenOrder(action)}
+	if action.After != "" {
+		var err error
+		if token, err = decodeToken(action); err != nil {
+			return nil, "", err
+		}
+	}
+
+	var ids []string
+	var err error
+	if action.Filter.Value != "" {
+		ids, err = ProcessFilter(db, col, action.Filter)
+	} else {
+		ids, err = index.All(db, col)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	ids = utils.RemoveDuplicateValues(ids)
+	record.SortIDs(ids)
+	if action.Search.Field != "" {
+		scores, err := searchScores(db, col, action.Search)
+		if err != nil {
+			return nil, "", err
+		}
+		ids = rankIDs(ids, scores)
+	}
+
+	output := make([]map[string]interface{}, 0)
+	send := func(data []map[string]interface{}) error {
+		for _, datum := range data {
+			datum, err := projectRecord(hideFields(datum, action.Access), action.Projection)
+			if err != nil {
+				return err
+			}
+			if emit == nil {
+				output = append(output, datum)
+			} else if err := emit(datum); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if action.OrderDir != "" {
+		start, end := pageBounds(len(ids), token.Offset+action.Offset, action.Limit)
+		next := ""
+		if end < len(ids) {
+			token.Offset = end
+			next = encodeToken(token)
+		}
+		// Walking the field's index only reads the records on the page, without one every
+		// matching record has to be read and sorted
+		orderedIDs, ok, err := orderByIndex(db, col, action.Order, action.OrderDir, ids, end)
+		if err != nil {
+			return nil, "", err
+		}
+		var data []map[string]interface{}
+		if ok {
+			data, err = getInOrder(db, col, orderedIDs[start:end])
+			if err != nil {
+				return nil, "", err
+			}
+		} else {
+			data, err = record.Get(db, col, ids)
+			if err != nil {
+				return nil, "", err
+			}
+			data = orderRecords(data, action.Order, schema.Get(db, col)[action.Order], action.OrderDir)[start:end]
+		}
+		if err := send(data); err != nil {
+			return nil, "", err
+		}
+		return output, next, nil
+	}
+
+	if action.Search.Field != "" {
+		start, end := pageBounds(len(ids), token.Offset+action.Offset, action.Limit)
+		next := ""
+		if end < len(ids) {
+			token.Offset = end
+			next = encodeToken(token)
+		}
+		data, err := getInOrder(db, col, ids[start:end])
+		if err != nil {
+			return nil, "", err
+		}
+		if err := send(data); err != nil {
+			return nil, "", err
+		}
+		return output, next, nil
+	}
+
+	if token.After != "" {
+		ids = ids[sort.Search(len(ids), func(i int) bool { return record.ComparePositions(ids[i], token.After) > 0 }):]
+	}
+	start, end := pageBounds(len(ids), action.Offset, action.Limit)
+	next := ""
+	if end < len(ids) && end > start {
+		token.After = ids[end-1]
+		next = encodeToken(token)
+	}
+	ids = ids[start:end]
+	batchSize := len(ids)
+	if emit != nil {
+		batchSize = STREAM_BATCH_SIZE
+	}
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		ids = ids[len(batch):]
+		data, err := record.Get(db, col, batch)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := send(data); err != nil {
+			return nil, "", err
+		}
+	}
+	return output, next, nil
+}
+
+// orderByIndex orders record IDs by walking the index of the field they are ordered on, stopping
+// once it has the first count IDs. Records with the same value keep the order they are stored in
+// and records without a value come last. It reports false if the field has no usable index.
+func orderByIndex(database, collection, key, direction string, ids []string, count int) ([]string, bool, error) {
+	schemaData := schema.Get(database, collection)
+	fieldType, ok := schemaData[key]
+	if !ok || utils.Contains(index.InvalidSchemaTypes, fieldType) {
+		return nil, false, nil
+	}
+	definitions, err := index.ReadDefinitions(database, collection)
+	if err != nil {
+		return nil, false, err
+	}
+	if indexed, _ := definitions.Indexed(database, key, schemaData); !indexed {
+		return nil, false, nil
+	}
+
+	matching := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		matching[id] = true
+	}
+	output := make([]string, 0, count)
+	seen := make(map[string]bool, count)
+	err = index.Ordered(database, collection, key, direction == "DSC", func(valueIDs []string) (bool, error) {
+		record.SortIDs(valueIDs)
+		for _, id := range valueIDs {
+			if matching[id] && !seen[id] {
+				output = append(output, id)
+				seen[id] = true
+			}
+		}
+		return len(output) < count, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	for _, id := range ids {
+		if len(output) >= count {
+			break
+		}
+		if !seen[id] {
+			output = append(output, id)
+		}
+	}
+	return output, true, nil
+}
+
+// getInOrder reads records, returning them in the order of their IDs
+func getInOrder(database, collection string, ids []string) ([]map[string]interface{}, error) {
+	data, err := record.Get(database, collection, ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]map[string]interface{}, len(data))
+	for _, datum := range data {
+		byID[datum[".id"].(string)] = datum
+	}
+	output := make([]map[string]interface{}, 0, len(data))
+	for _, id := range ids {
+		if datum, ok := byID[id]; ok {
+			output = append(output, datum)
+		}
+	}
+	return output, nil
+}
@@ -0,0 +1,390 @@
+// plan.go
+
+package manager
+
+import (
+	"ceresdb/aql"
+	"ceresdb/index"
+	"ceresdb/schema"
+	"ceresdb/utils"
+	"encoding/json"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// filterPlan is a node in the plan a filter is run with. Conditions record whether they are read
+// from an index or by scanning records, and every node records how many records it was estimated
+// to match and how many it actually did.
+type filterPlan struct {
+	Operation string        `json:"operation"`
+	Field     string        `json:"field,omitempty"`
+	Value     string        `json:"value,omitempty"`
+	Access    string        `json:"access,omitempty"`
+	Estimated int           `json:"estimated"`
+	Actual    int           `json:"actual"`
+	Skipped   bool          `json:"skipped,omitempty"`
+	Children  []*filterPlan `json:"children,omitempty"`
+	node      aql.Node
+	fieldType string
+}
+
+// defaultSelectivity is the share of records a condition is assumed to match when there is no
+// index to estimate it from
+var defaultSelectivity = map[string]float64{
+	"=":           0.1,
+	"!=":          0.9,
+	">":           0.33,
+	">=":          0.33,
+	"<":           0.33,
+	"<=":          0.33,
+	"CONTAINS":    0.1,
+	"IN":          0.2,
+	"EXISTS":      0.9,
+	"IS NOT NULL": 0.9,
+	"IS NULL":     0.05,
+	"IS MISSING":  0.05,
+	"LIKE":        0.25,
+	"ILIKE":       0.25,
+	"STARTSWITH":  0.1,
+	"MATCHES":     0.25,
+}
+
+// planner estimates how many records the conditions of a filter match from the statistics of a
+// collection's indices
+type planner struct {
+	database    string
+	collection  string
+	definitions index.Definitions
+	schemaData  map[string]string
+	total       int
+}
+
+// planFilter builds the plan for a filter on a collection
+func planFilter(database, collection string, node aql.Node) (*filterPlan, error) {
+	schemaData := schema.Get(database, collection)
+	definitions, err := index.ReadDefinitions(database, collection)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := index.All(database, collection)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// The list of all records holds a line for each of a record's indexed values
+	total := len(utils.RemoveDuplicateValues(ids))
+	p := planner{database: database, collection: collection, definitions: definitions, schemaData: schemaData, total: total}
+	return p.plan(node), nil
+}
+
+func (p planner) plan(node aql.Node) *filterPlan {
+	switch node.Value {
+	case "AND", "OR", "XOR":
+		plan := &filterPlan{Operation: node.Value, node: node}
+		for _, child := range []*aql.Node{node.Left, node.Right} {
+			childPlan := p.plan(*child)
+			// Chains of the same operator are flattened so all of their conditions are ordered
+			// together
+			if childPlan.Operation == node.Value {
+				plan.Children = append(plan.Children, childPlan.Children...)
+			} else {
+				plan.Children = append(plan.Children, childPlan)
+			}
+		}
+		plan.Estimated = p.combine(plan)
+		return plan
+	case "NOT":
+		child := p.plan(*node.Right)
+		return &filterPlan{Operation: "NOT", Children: []*filterPlan{child}, Estimated: p.total - child.Estimated, node: node}
+	}
+	indexed, fieldType := leafIndexed(p.database, node, p.definitions, p.schemaData)
+	plan := &filterPlan{Operation: node.Value, Field: node.Left.Value, Access: "scan", node: node, fieldType: fieldType}
+	if node.Right != nil {
+		plan.Value = node.Right.Value
+	}
+	if indexed {
+		plan.Access = "index"
+	}
+	plan.Estimated = p.estimate(plan)
+	return plan
+}
+
+// combine estimates the records matched by an AND, OR, or XOR from its conditions, which are
+// assumed to be independent of each other
+func (p planner) combine(plan *filterPlan) int {
+	if plan.Operation == "AND" {
+		if p.total == 0 {
+			return 0
+		}
+		estimate := float64(p.total)
+		for _, child := range plan.Children {
+			estimate *= float64(child.Estimated) / float64(p.total)
+		}
+		return int(math.Round(estimate))
+	}
+	estimate := 0
+	for _, child := range plan.Children {
+		estimate += child.Estimated
+	}
+	if estimate > p.total {
+		return p.total
+	}
+	return estimate
+}
+
+// estimate returns the number of records a condition is expected to match
+func (p planner) estimate(plan *filterPlan) int {
+	if plan.Access == "index" {
+		if estimate, ok := p.indexEstimate(plan); ok {
+			return int(math.Max(0, math.Min(float64(estimate), float64(p.total))))
+		}
+	}
+	return int(math.Round(defaultSelectivity[plan.Operation] * float64(p.total)))
+}
+
+// indexEstimate reads the number of records an indexed condition matches from the field's index.
+// Equality is counted exactly while ranges are estimated from where their bound falls in the
+// field's sorted values.
+func (p planner) indexEstimate(plan *filterPlan) (int, bool) {
+	db, col, key := p.database, p.collection, plan.Field
+	fraction := func(value string) (float64, bool) {
+		fraction, err := index.Fraction(db, col, key, plan.fieldType, value)
+		return fraction, err == nil
+	}
+	switch plan.Operation {
+	case "=", "CONTAINS":
+		count, err := index.Count(db, col, key, plan.fieldType, plan.Value)
+		return count, err == nil
+	case "!=":
+		count, err := index.Count(db, col, key, plan.fieldType, plan.Value)
+		return p.total - count, err == nil
+	case "<", "<=":
+		below, ok := fraction(plan.Value)
+		return int(math.Round(below * float64(p.total))), ok
+	case ">", ">=":
+		below, ok := fraction(plan.Value)
+		return int(math.Round((1 - below) * float64(p.total))), ok
+	case "IN":
+		values, err := inValues(plan.node)
+		if err != nil {
+			return 0, false
+		}
+		estimate := 0
+		for _, val := range values {
+			count, err := index.Count(db, col, key, plan.fieldType, val)
+			if err != nil {
+				return 0, false
+			}
+			estimate += count
+		}
+		return estimate, true
+	case "IS NULL", "EXISTS", "IS NOT NULL":
+		nulls, err := index.Null(db, col, key)
+		if plan.Operation == "IS NULL" {
+			return len(nulls), err == nil
+		}
+		return p.total - len(nulls), err == nil
+	case "STARTSWITH", "LIKE":
+		prefix, _, err := stringMatcher(plan.Operation, plan.Value)
+		if err != nil || prefix == "" {
+			return 0, false
+		}
+		low, okLow := fraction(prefix)
+		high, okHigh := fraction(prefix + string(utf8.MaxRune))
+		return int(math.Round((high - low) * float64(p.total))), okLow && okHigh
+	}
+	return 0, false
+}
+
+// indexOnly reports whether every condition in a plan is read from an index
+func (plan *filterPlan) indexOnly() bool {
+	if plan.Access != "" {
+		return plan.Access == "index"
+	}
+	for _, child := range plan.Children {
+		if !child.indexOnly() {
+			return false
+		}
+	}
+	return true
+}
+
+func (plan *filterPlan) skip() {
+	plan.Skipped = true
+	for _, child := range plan.Children {
+		child.skip()
+	}
+}
+
+// execute runs a plan, returning the IDs of the matching records and recording how many each
+// node matched. Once restricted is set only the candidate records are considered, so conditions
+// which run after more selective ones read fewer records.
+func (plan *filterPlan) execute(database, collection string, candidates []string, restricted bool) ([]string, error) {
+	var output []string
+	var err error
+	switch plan.Operation {
+	case "AND":
+		output, err = plan.executeAnd(database, collection, candidates, restricted)
+	case "OR", "XOR":
+		for idx, child := range plan.Children {
+			ids, err := child.execute(database, collection, candidates, restricted)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case idx == 0:
+				output = ids
+			case plan.Operation == "OR":
+				output = doOr(output, ids)
+			default:
+				output = doXor(output, ids)
+			}
+		}
+	case "NOT":
+		universe := candidates
+		if !restricted {
+			universe, err = index.All(database, collection)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		ids, err := plan.Children[0].execute(database, collection, candidates, restricted)
+		if err != nil {
+			return nil, err
+		}
+		output = doNot(universe, ids)
+	default:
+		output, err = plan.executeLeaf(database, collection, candidates, restricted)
+	}
+	if err != nil {
+		return nil, err
+	}
+	plan.Actual = len(output)
+	return output, nil
+}
+
+// executeAnd runs the conditions of an AND which are read from indices first, from the most to
+// the least selective, followed by those which scan records. Each condition only considers the
+// records matched so far, and once none are left the rest are skipped.
+func (plan *filterPlan) executeAnd(database, collection string, candidates []string, restricted bool) ([]string, error) {
+	sort.SliceStable(plan.Children, func(i, j int) bool {
+		left, right := plan.Children[i], plan.Children[j]
+		if left.indexOnly() != right.indexOnly() {
+			return left.indexOnly()
+		}
+		return left.Estimated < right.Estimated
+	})
+	for _, child := range plan.Children {
+		if restricted && len(candidates) == 0 {
+			child.skip()
+			continue
+		}
+		ids, err := child.execute(database, collection, candidates, restricted)
+		if err != nil {
+			return nil, err
+		}
+		candidates, restricted = ids, true
+	}
+	return candidates, nil
+}
+
+func (plan *filterPlan) executeLeaf(database, collection string, candidates []string, restricted bool) ([]string, error) {
+	if plan.Access == "index" {
+		ids, err := indexLeaf(database, collection, plan.node, plan.fieldType)
+		if err != nil || !restricted {
+			return ids, err
+		}
+		return doAnd(ids, candidates), nil
+	}
+	match, err := leafMatcher(plan.node, plan.fieldType)
+	if err != nil {
+		return nil, err
+	}
+	if restricted {
+		return matchRecords(database, collection, candidates, match)
+	}
+	return scanRecords(database, collection, match)
+}
+
+// filterSource returns the database and collection an action's filter runs against
+func filterSource(action aql.Action) (string, string, bool) {
+	if action.Type != "GET" && action.Type != "AGGREGATE" {
+		return "", "", false
+	}
+	switch action.Resource {
+	case "RECORD":
+		parts := strings.Split(action.Identifier, ".")
+		return parts[0], parts[1], true
+	case "PERMIT":
+		return action.Identifier, "_users", true
+	case "USER":
+		return "_auth", "_users", true
+	case "ROLE":
+		return "_auth", "_roles", true
+	}
+	return "", "", false
+}
+
+// ProcessExplain describes how each action of a query would read its records without running it.
+// Filters are planned and then evaluated so the plan holds both the estimated and the actual
+// number of records matched by each condition, but nothing is written. For users with a policy
+// the filter is only evaluated against the records the policy lets them read, and the estimates,
+// which come from the statistics of the whole collection, are left out.
+func ProcessExplain(actions []aql.Action) ([]map[string]interface{}, error) {
+	output := make([]map[string]interface{}, 0, len(actions))
+	for _, action := range actions {
+		item := map[string]interface{}{"type": action.Type, "resource": action.Resource, "identifier": action.Identifier}
+		output = append(output, item)
+		database, collection, ok := filterSource(action)
+		if !ok {
+			continue
+		}
+		if err := checkAccess(action); err != nil {
+			return nil, err
+		}
+		ids, err := index.All(database, collection)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		ids = utils.RemoveDuplicateValues(ids)
+		restricted := action.Policy.Value != ""
+		if ids, err = visibleIDs(database, collection, action.Policy, ids); err != nil {
+			return nil, err
+		}
+		var plan *filterPlan
+		if action.Filter.Value != "" {
+			if plan, err = planFilter(database, collection, action.Filter); err != nil {
+				return nil, err
+			}
+			if _, err := plan.execute(database, collection, sortedSet(ids), restricted); err != nil {
+				return nil, err
+			}
+		} else {
+			plan = &filterPlan{Operation: "ALL", Access: "index", Estimated: len(ids), Actual: len(ids)}
+		}
+		var planMap map[string]interface{}
+		planBytes, _ := json.Marshal(plan)
+		json.Unmarshal(planBytes, &planMap)
+		item["plan"] = planMap
+		item["actual"] = plan.Actual
+		if restricted {
+			dropEstimates(planMap)
+			continue
+		}
+		item["estimated"] = plan.Estimated
+	}
+	return output, nil
+}
+
+// dropEstimates removes the estimated number of records from every node of a serialized plan
+func dropEstimates(planMap map[string]interface{}) {
+	delete(planMap, "estimated")
+	children, _ := planMap["children"].([]interface{})
+	for _, child := range children {
+		if childMap, ok := child.(map[string]interface{}); ok {
+			dropEstimates(childMap)
+		}
+	}
+}
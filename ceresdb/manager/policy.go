@@ -0,0 +1,275 @@
+// policy.go
+
+package manager
+
+import (
+	"ceresdb/aql"
+	"ceresdb/index"
+	"ceresdb/record"
+	"ceresdb/schema"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// getPolicies returns the policies of a collection
+func getPolicies(database, collection string) []map[string]interface{} {
+	policies := schema.GetPolicies(database, collection)
+	output := make([]map[string]interface{}, 0, len(policies))
+	for _, policy := range policies {
+		datum := map[string]interface{}{"name": policy.Name, "filter": policy.Filter}
+		if policy.Role != "" {
+			datum["role"] = policy.Role
+		}
+		if policy.User != "" {
+			datum["user"] = policy.User
+		}
+		output = append(output, datum)
+	}
+	return output
+}
+
+// parsePolicy checks a policy's data, which names it and gives its filter along with either the
+// role or the user it applies to
+func parsePolicy(datum map[string]interface{}) (schema.Policy, error) {
+	var policy schema.Policy
+	for key, val := range datum {
+		strVal, ok := val.(string)
+		if !ok {
+			return policy, errors.New(fmt.Sprintf("Invalid policy data, field '%v' must be a string", key))
+		}
+		switch key {
+		case "name":
+			policy.Name = strVal
+		case "role":
+			policy.Role = strVal
+		case "user":
+			policy.User = strVal
+		case "filter":
+			policy.Filter = strVal
+		default:
+			return policy, errors.New(fmt.Sprintf("Invalid policy field '%v', valid fields are 'name', 'role', 'user', and 'filter'", key))
+		}
+	}
+	if policy.Name == "" || policy.Filter == "" {
+		return policy, errors.New("Invalid policy data, required fields are 'name' and 'filter'")
+	}
+	if (policy.Role == "") == (policy.User == "") {
+		return policy, errors.New("Invalid policy data, a policy applies to either a 'role' or a 'user'")
+	}
+	if policy.Role != "" {
+		if err := roleExists(policy.Role); err != nil {
+			return policy, err
+		}
+	}
+	if _, err := aql.ParseFilter(policy.Filter); err != nil {
+		return policy, errors.New(fmt.Sprintf("Invalid filter for policy %v: %v", policy.Name, err))
+	}
+	return policy, nil
+}
+
+// writePolicies adds policies to a collection, or replaces those with the same names if replace
+// is set
+func writePolicies(identifier string, data []map[string]interface{}, replace bool) error {
+	parts := strings.Split(identifier, ".")
+	if _, ok := schema.GetCollection(parts[0], parts[1]); !ok {
+		return errors.New(fmt.Sprintf("Collection %v does not exist", identifier))
+	}
+	policies := append([]schema.Policy{}, schema.GetPolicies(parts[0], parts[1])...)
+	for _, datum := range data {
+		policy, err := parsePolicy(datum)
+		if err != nil {
+			return err
+		}
+		existing := -1
+		for idx := range policies {
+			if policies[idx].Name == policy.Name {
+				existing = idx
+			}
+		}
+		switch {
+		case replace && existing < 0:
+			return errors.New(fmt.Sprintf("Policy %v does not exist", policy.Name))
+		case replace:
+			policies[existing] = policy
+		case existing >= 0:
+			return errors.New(fmt.Sprintf("Policy %v already exists", policy.Name))
+		default:
+			policies = append(policies, policy)
+		}
+	}
+	return schema.SetPolicies(parts[0], parts[1], policies)
+}
+
+// deletePolicies removes policies from a collection by name
+func deletePolicies(identifier string, names []string) error {
+	parts := strings.Split(identifier, ".")
+	policies := make([]schema.Policy, 0)
+	for _, policy := range schema.GetPolicies(parts[0], parts[1]) {
+		found := false
+		for _, name := range names {
+			found = found || policy.Name == name
+		}
+		if !found {
+			policies = append(policies, policy)
+		}
+	}
+	return schema.SetPolicies(parts[0], parts[1], policies)
+}
+
+// policyFilter returns an action's filter with the policy of the user running it ANDed in
+func policyFilter(action aql.Action) aql.Node {
+	if action.Policy.Value == "" {
+		return action.Filter
+	}
+	if action.Filter.Value == "" {
+		return action.Policy
+	}
+	filter, policy := action.Filter, action.Policy
+	return aql.Node{Value: "AND", Left: &filter, Right: &policy}
+}
+
+// visibleIDs returns the records out of ids which the policy of the user running an action lets
+// them access
+func visibleIDs(database, collection string, policy aql.Node, ids []string) ([]string, error) {
+	if policy.Value == "" || len(ids) == 0 {
+		return ids, nil
+	}
+	plan, err := planFilter(database, collection, policy)
+	if err != nil {
+		return nil, err
+	}
+	return plan.execute(database, collection, sortedSet(ids), true)
+}
+
+// AffectedIDs narrows the ids a write action asks to change down to those it changes, which for
+// records are only the ones within the policy of the user writing them
+func AffectedIDs(action aql.Action, ids []string) ([]string, error) {
+	if action.Resource != "RECORD" || action.Policy.Value == "" {
+		return ids, nil
+	}
+	parts := strings.Split(action.Identifier, ".")
+	return visibleIDs(parts[0], parts[1], action.Policy, ids)
+}
+
+// recordMatcher returns a check of whether a record in memory matches a filter, such as one
+// which is about to be written
+func recordMatcher(database, collection string, node aql.Node) (func(datum map[string]interface{}) (bool, error), error) {
+	schemaData := schema.Get(database, collection)
+	definitions, err := index.ReadDefinitions(database, collection)
+	if err != nil {
+		return nil, err
+	}
+	var build func(node aql.Node) (func(datum map[string]interface{}) (bool, error), error)
+	build = func(node aql.Node) (func(datum map[string]interface{}) (bool, error), error) {
+		switch node.Value {
+		case "AND", "OR", "XOR":
+			left, err := build(*node.Left)
+			if err != nil {
+				return nil, err
+			}
+			right, err := build(*node.Right)
+			if err != nil {
+				return nil, err
+			}
+			return func(datum map[string]interface{}) (bool, error) {
+				leftMatched, err := left(datum)
+				if err != nil {
+					return false, err
+				}
+				rightMatched, err := right(datum)
+				if err != nil {
+					return false, err
+				}
+				switch node.Value {
+				case "AND":
+					return leftMatched && rightMatched, nil
+				case "OR":
+					return leftMatched || rightMatched, nil
+				}
+				return leftMatched != rightMatched, nil
+			}, nil
+		case "NOT":
+			child, err := build(*node.Right)
+			if err != nil {
+				return nil, err
+			}
+			return func(datum map[string]interface{}) (bool, error) {
+				matched, err := child(datum)
+				return !matched, err
+			}, nil
+		}
+		_, fieldType := leafIndexed(database, node, definitions, schemaData)
+		return leafMatcher(node, fieldType)
+	}
+	return build(node)
+}
+
+// checkPolicy rejects records being written which the policy of the user writing them would not
+// let them access afterwards, so users cannot write records outside of their policies
+func checkPolicy(database, collection string, policy aql.Node, data []map[string]interface{}) error {
+	if policy.Value == "" {
+		return nil
+	}
+	match, err := recordMatcher(database, collection, policy)
+	if err != nil {
+		return err
+	}
+	for _, datum := range data {
+		matched, err := match(datum)
+		if err != nil {
+			return err
+		}
+		if !matched {
+			return errors.New(fmt.Sprintf("access denied, record does not satisfy the policies on collection %v.%v", database, collection))
+		}
+	}
+	return nil
+}
+
+// visibleData returns the records of a PUT which the policy of the user writing them lets them
+// access, the rest are left as they are
+func visibleData(database, collection string, policy aql.Node, data []map[string]interface{}) ([]map[string]interface{}, error) {
+	if policy.Value == "" {
+		return data, nil
+	}
+	ids := make([]string, 0, len(data))
+	for _, datum := range data {
+		if id, ok := datum[".id"].(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	ids, err := visibleIDs(database, collection, policy, ids)
+	if err != nil {
+		return nil, err
+	}
+	visible := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		visible[id] = true
+	}
+	output := make([]map[string]interface{}, 0, len(data))
+	for _, datum := range data {
+		if id, ok := datum[".id"].(string); ok && visible[id] {
+			output = append(output, datum)
+		}
+	}
+	return output, nil
+}
+
+// checkPatchPolicy rejects patches which would leave records outside the policy of the user
+// patching them
+func checkPatchPolicy(database, collection string, policy aql.Node, ids []string, patch map[string]interface{}) error {
+	if policy.Value == "" || len(ids) == 0 {
+		return nil
+	}
+	data, err := record.Get(database, collection, ids)
+	if err != nil {
+		return err
+	}
+	for _, datum := range data {
+		for key, val := range patch {
+			datum[key] = val
+		}
+	}
+	return checkPolicy(database, collection, policy, data)
+}
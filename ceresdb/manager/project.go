@@ -0,0 +1,176 @@
+// project.go
+
+package manager
+
+import (
+	"ceresdb/aql"
+	"ceresdb/utils"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// projectRecord builds the output of a GET action's field list for a record. Fields whose paths
+// do not exist in the record are left out, while computed fields with a missing or null operand
+// are null.
+func projectRecord(datum map[string]interface{}, projection []aql.Projection) (map[string]interface{}, error) {
+	if len(projection) == 0 {
+		return datum, nil
+	}
+	output := make(map[string]interface{}, len(projection))
+	for _, field := range projection {
+		if field.Name == "*" {
+			for key, val := range datum {
+				output[key] = val
+			}
+			continue
+		}
+		if field.Expr.Op == "PATH" {
+			if val, ok := resolvePath(datum, field.Expr); ok {
+				output[field.Name] = val
+			}
+			continue
+		}
+		val, err := evaluate(datum, field.Expr)
+		if err != nil {
+			return nil, err
+		}
+		output[field.Name] = val
+	}
+	return output, nil
+}
+
+// projectRecords applies projectRecord to every record of data
+func projectRecords(data []map[string]interface{}, projection []aql.Projection) ([]map[string]interface{}, error) {
+	if len(projection) == 0 {
+		return data, nil
+	}
+	output := make([]map[string]interface{}, len(data))
+	for idx, datum := range data {
+		projected, err := projectRecord(datum, projection)
+		if err != nil {
+			return nil, err
+		}
+		output[idx] = projected
+	}
+	return output, nil
+}
+
+// resolvePath returns the value at a field path. A key which matches the whole path, such as
+// ".id" or the fields of a flattened join, is used before the path is walked.
+func resolvePath(datum map[string]interface{}, expr aql.Expr) (interface{}, bool) {
+	if val, ok := datum[expr.Path]; ok {
+		return val, true
+	}
+	var current interface{} = datum
+	for _, step := range expr.Steps {
+		if step.IsIndex {
+			list, ok := current.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			idx := step.Index
+			if idx < 0 {
+				idx += len(list)
+			}
+			if idx < 0 || idx >= len(list) {
+				return nil, false
+			}
+			current = list[idx]
+			continue
+		}
+		currentMap, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = currentMap[step.Key]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func evaluate(datum map[string]interface{}, expr aql.Expr) (interface{}, error) {
+	switch expr.Op {
+	case "LITERAL":
+		return expr.Value, nil
+	case "PATH":
+		val, _ := resolvePath(datum, expr)
+		return val, nil
+	case "NEG":
+		val, err := evaluate(datum, expr.Args[0])
+		if err != nil || val == nil {
+			return nil, err
+		}
+		intVal, floatVal, isInt, ok := toNumber(val)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Cannot negate non-numeric value '%v'", val))
+		}
+		if isInt && intVal != math.MinInt64 {
+			return -intVal, nil
+		}
+		return -floatVal, nil
+	}
+	left, err := evaluate(datum, expr.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	right, err := evaluate(datum, expr.Args[1])
+	if err != nil {
+		return nil, err
+	}
+	if left == nil || right == nil {
+		return nil, nil
+	}
+	return applyOperator(expr.Op, left, right)
+}
+
+// applyOperator applies an arithmetic operator to two values. Integers are kept exact unless the
+// result no longer fits, division always returns a float, and "+" joins strings.
+func applyOperator(op string, left, right interface{}) (interface{}, error) {
+	_, leftIsString := left.(string)
+	_, rightIsString := right.(string)
+	if op == "+" && (leftIsString || rightIsString) {
+		return utils.FormatValue(left) + utils.FormatValue(right), nil
+	}
+	intLeft, floatLeft, isIntLeft, okLeft := toNumber(left)
+	intRight, floatRight, isIntRight, okRight := toNumber(right)
+	if !okLeft || !okRight {
+		return nil, errors.New(fmt.Sprintf("Cannot apply %v to '%v' and '%v'", op, left, right))
+	}
+	isInt := isIntLeft && isIntRight
+	switch op {
+	case "+":
+		if isInt && !((intRight > 0 && intLeft > math.MaxInt64-intRight) || (intRight < 0 && intLeft < math.MinInt64-intRight)) {
+			return intLeft + intRight, nil
+		}
+		return floatLeft + floatRight, nil
+	case "-":
+		if isInt && !((intRight < 0 && intLeft > math.MaxInt64+intRight) || (intRight > 0 && intLeft < math.MinInt64+intRight)) {
+			return intLeft - intRight, nil
+		}
+		return floatLeft - floatRight, nil
+	case "*":
+		if isInt {
+			product := intLeft * intRight
+			if intLeft == 0 || (product/intLeft == intRight && !(intLeft == -1 && intRight == math.MinInt64)) {
+				return product, nil
+			}
+		}
+		return floatLeft * floatRight, nil
+	case "/":
+		if floatRight == 0 {
+			return nil, errors.New(fmt.Sprintf("Cannot divide '%v' by zero", left))
+		}
+		return floatLeft / floatRight, nil
+	case "%":
+		if !isInt {
+			return nil, errors.New(fmt.Sprintf("Cannot apply %% to non-integer values '%v' and '%v'", left, right))
+		}
+		if intRight == 0 {
+			return nil, errors.New(fmt.Sprintf("Cannot divide '%v' by zero", left))
+		}
+		return intLeft % intRight, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Invalid operator %v", op))
+}
@@ -0,0 +1,209 @@
+// role.go
+
+package manager
+
+import (
+	"ceresdb/aql"
+	"ceresdb/index"
+	"ceresdb/permit"
+	"ceresdb/role"
+	"ceresdb/schema"
+	"ceresdb/utils"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Roles returns the custom role definitions by name. Instances which have not been migrated yet
+// have no custom roles.
+func Roles() (map[string]role.Definition, error) {
+	definitions := make(map[string]role.Definition)
+	if _, ok := schema.GetCollection("_auth", "_roles"); !ok {
+		return definitions, nil
+	}
+	ids, err := index.All("_auth", "_roles")
+	if err != nil {
+		return nil, err
+	}
+	data, err := role.Get(ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, datum := range data {
+		definition, err := role.Parse(datum)
+		if err != nil {
+			return nil, err
+		}
+		definitions[definition.Name] = definition
+	}
+	return definitions, nil
+}
+
+// roleExists checks that a role is built in or has been defined
+func roleExists(name interface{}) error {
+	definitions, err := Roles()
+	if err != nil {
+		return err
+	}
+	roleName, _ := name.(string)
+	if _, ok := role.Lookup(definitions, roleName); !ok {
+		return errors.New(fmt.Sprintf("Role %v does not exist", name))
+	}
+	return nil
+}
+
+// getRoles returns the custom roles
+func getRoles(action aql.Action) ([]map[string]interface{}, error) {
+	var ids []string
+	var err error
+	if action.Filter.Value != "" {
+		ids, err = ProcessFilter("_auth", "_roles", action.Filter)
+	} else {
+		ids, err = index.All("_auth", "_roles")
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := role.Get(ids)
+	if err != nil {
+		return nil, err
+	}
+	if action.OrderDir != "" {
+		data = orderRecords(data, action.Order, "", action.OrderDir)
+	}
+	if action.Limit > 0 && action.Limit < len(data) {
+		data = data[:action.Limit]
+	}
+	return projectRecords(data, action.Projection)
+}
+
+// writeRoles defines new roles, or replaces the definitions of existing ones if replace is set.
+// The roles they inherit must exist and a role can never end up inheriting itself.
+func writeRoles(data []map[string]interface{}, replace bool) error {
+	definitions, err := Roles()
+	if err != nil {
+		return err
+	}
+	records := make([]map[string]interface{}, 0, len(data))
+	for _, datum := range data {
+		definition, err := role.Parse(datum)
+		if err != nil {
+			return err
+		}
+		if _, ok := role.Builtin[definition.Name]; ok {
+			return errors.New(fmt.Sprintf("Role %v is built in and cannot be changed", definition.Name))
+		}
+		ids, err := ProcessFilter("_auth", "_roles", aql.Node{Value: "=", Left: &aql.Node{Value: "name"}, Right: &aql.Node{Value: definition.Name}})
+		if err != nil {
+			return err
+		}
+		if !replace && len(ids) > 0 {
+			return errors.New(fmt.Sprintf("Role %v already exists", definition.Name))
+		}
+		if replace && len(ids) == 0 {
+			return errors.New(fmt.Sprintf("Role %v does not exist", definition.Name))
+		}
+		datum := definition.Document()
+		if replace {
+			datum[".id"] = ids[0]
+		}
+		definitions[definition.Name] = definition
+		records = append(records, datum)
+	}
+	for _, datum := range records {
+		if err := role.Check(definitions, datum["name"].(string)); err != nil {
+			return err
+		}
+	}
+	if replace {
+		return role.Put(records)
+	}
+	return role.Post(records)
+}
+
+// deleteRoles removes custom roles, which cannot be removed while another role inherits them or
+// a user has them
+func deleteRoles(ids []string) error {
+	data, err := role.Get(ids)
+	if err != nil {
+		return err
+	}
+	definitions, err := Roles()
+	if err != nil {
+		return err
+	}
+	deleted := make(map[string]bool)
+	for _, datum := range data {
+		deleted[datum["name"].(string)] = true
+	}
+	for name := range deleted {
+		for _, definition := range definitions {
+			if deleted[definition.Name] {
+				continue
+			}
+			for _, parent := range definition.Inherits {
+				if parent == name {
+					return errors.New(fmt.Sprintf("Role %v is inherited by role %v", name, definition.Name))
+				}
+			}
+		}
+		use, err := roleUse(name)
+		if err != nil {
+			return err
+		}
+		if use != "" {
+			return errors.New(fmt.Sprintf("Role %v is assigned to %v", name, use))
+		}
+	}
+	return role.Delete(ids)
+}
+
+// roleUse describes what a role is still assigned to, whether users, the permits of a database
+// or their scopes for a collection, or a collection's policies, or returns an empty string when
+// it is not assigned to anything
+func roleUse(name string) (string, error) {
+	userIDs, err := ProcessFilter("_auth", "_users", aql.Node{Value: "=", Left: &aql.Node{Value: "role"}, Right: &aql.Node{Value: name}})
+	if err != nil {
+		return "", err
+	}
+	if len(userIDs) > 0 {
+		return "users", nil
+	}
+	for dbName, db := range schema.Schema.Databases {
+		if _, ok := db.Collections["_users"]; dbName == "_auth" || !ok {
+			continue
+		}
+		ids, err := index.All(dbName, "_users")
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", err
+		}
+		data, err := permit.Get(dbName, utils.RemoveDuplicateValues(ids))
+		if err != nil {
+			return "", err
+		}
+		for _, datum := range data {
+			if datum["role"] == name {
+				return fmt.Sprintf("permits in database %v", dbName), nil
+			}
+			collections, _ := datum["collections"].(map[string]interface{})
+			for colName, scope := range collections {
+				if scope, ok := scope.(map[string]interface{}); ok && scope["role"] == name {
+					return fmt.Sprintf("permits for collection %v.%v", dbName, colName), nil
+				}
+			}
+		}
+	}
+	for dbName, collections := range schema.Policies {
+		for colName, policies := range collections {
+			for _, policy := range policies {
+				if policy.Role == name {
+					return fmt.Sprintf("policy %v of collection %v.%v", policy.Name, dbName, colName), nil
+				}
+			}
+		}
+	}
+	return "", nil
+}
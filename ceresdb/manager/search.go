@@ -0,0 +1,90 @@
+// search.go
+
+package manager
+
+import (
+	"ceresdb/aql"
+	"ceresdb/index"
+	"ceresdb/record"
+	"ceresdb/schema"
+	"ceresdb/utils"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// searchScores returns the relevance of every record of a collection whose field contains any of
+// the search terms. Fields with a full-text index are read from it, otherwise every record is read
+// and scored the same way.
+func searchScores(database, collection string, search aql.Search) (map[string]float64, error) {
+	schemaData := schema.Get(database, collection)
+	if _, ok := schemaData[strings.Split(search.Field, ".")[0]]; !ok {
+		return nil, errors.New(fmt.Sprintf("Field %v does not exist in collection %v", search.Field, collection))
+	}
+	definitions, err := index.ReadDefinitions(database, collection)
+	if err != nil {
+		return nil, err
+	}
+	if definition, ok := definitions.FindText(search.Field); ok && definition.Status == index.StatusReady {
+		return index.Search(database, collection, search.Field, search.Terms)
+	}
+
+	lengths := make(map[string]int)
+	postings := make(map[string]map[string]int)
+	for _, term := range index.Terms(search.Terms) {
+		postings[term] = make(map[string]int)
+	}
+	ids, err := index.All(database, collection)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]float64{}, nil
+		}
+		return nil, err
+	}
+	data, err := record.Get(database, collection, utils.RemoveDuplicateValues(ids))
+	if err != nil {
+		return nil, err
+	}
+	for _, datum := range data {
+		val, _ := index.Resolve(datum, search.Field)
+		text, ok := val.(string)
+		if !ok {
+			continue
+		}
+		terms := index.Terms(text)
+		if len(terms) == 0 {
+			continue
+		}
+		id := datum[".id"].(string)
+		lengths[id] = len(terms)
+		for _, term := range terms {
+			if frequencies, ok := postings[term]; ok {
+				frequencies[id]++
+			}
+		}
+	}
+	total := 0
+	for _, length := range lengths {
+		total += length
+	}
+	return index.Score(len(lengths), total, lengths, postings), nil
+}
+
+// rankIDs keeps the IDs which matched a search, ordering them from most to least relevant. Records
+// which are equally relevant keep the order they are stored in.
+func rankIDs(ids []string, scores map[string]float64) []string {
+	matched := make([]string, 0, len(scores))
+	for id := range scores {
+		matched = append(matched, id)
+	}
+	ranked := doAnd(ids, matched)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if scores[ranked[i]] != scores[ranked[j]] {
+			return scores[ranked[i]] > scores[ranked[j]]
+		}
+		return record.ComparePositions(ranked[i], ranked[j]) < 0
+	})
+	return ranked
+}
@@ -6,6 +6,7 @@ import (
 	"ceresdb/freespace"
 	"ceresdb/index"
 	"ceresdb/record"
+	"ceresdb/role"
 	"ceresdb/schema"
 	"os"
 	"path/filepath"
@@ -157,3 +158,61 @@ func TestPatch(t *testing.T) {
 		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
 	}
 }
+
+func TestScope(t *testing.T) {
+	datum := map[string]interface{}{"username": "foo", "role": "READ"}
+	role, access, err := Scope(datum, "events")
+	if role != "READ" || access.Restricted() || err != nil {
+		t.Errorf("Scope was incorrect, got: %v, %v, %v, want: %v", role, access, err, "READ")
+	}
+
+	datum["collections"] = map[string]interface{}{
+		"events":  map[string]interface{}{"deny": []interface{}{"email", "address.city"}},
+		"reports": map[string]interface{}{"role": "WRITE", "allow": []interface{}{"title", "body"}},
+	}
+	role, access, err = Scope(datum, "events")
+	if role != "READ" || !reflect.DeepEqual(access.Deny, []string{"email", "address"}) || !access.Hidden("address.city") || err != nil {
+		t.Errorf("Scope was incorrect, got: %v, %v, %v, want: %v", role, access, err, "READ with email and address denied")
+	}
+	role, access, err = Scope(datum, "reports")
+	if role != "WRITE" || !reflect.DeepEqual(access.Allow, []string{"title", "body"}) || err != nil {
+		t.Errorf("Scope was incorrect, got: %v, %v, %v, want: %v", role, access, err, "WRITE with title and body allowed")
+	}
+	if _, _, err := Scope(datum, "billing"); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "user is not permitted to access this collection")
+	}
+	role, _, err = Scope(datum, "")
+	if role != "READ" || err != nil {
+		t.Errorf("Scope was incorrect, got: %v, %v, want: %v", role, err, "READ")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := []map[string]interface{}{
+		{"username": "foo", "role": "READ"},
+		{"username": "foo", "role": "READ", "collections": map[string]interface{}{"events": map[string]interface{}{"role": "WRITE", "allow": []interface{}{"a"}, "deny": []interface{}{}}}},
+		{"username": "foo", "role": "AUDITOR", "collections": map[string]interface{}{"events": map[string]interface{}{"role": "AUDITOR"}}},
+	}
+	definitions := map[string]role.Definition{"AUDITOR": {Name: "AUDITOR", Inherits: []string{"READ"}}}
+	for _, datum := range valid {
+		if err := Validate(datum, definitions); err != nil {
+			t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+		}
+	}
+
+	invalid := []map[string]interface{}{
+		{"username": "foo", "role": "READ", "collections": []interface{}{"events"}},
+		{"username": "foo", "role": "READ", "collections": map[string]interface{}{"events": "READ"}},
+		{"username": "foo", "role": "READ", "collections": map[string]interface{}{"events": map[string]interface{}{"role": "OWNER"}}},
+		{"username": "foo", "role": "READ", "collections": map[string]interface{}{"events": map[string]interface{}{"deny": []interface{}{1}}}},
+		{"username": "foo", "role": "READ", "collections": map[string]interface{}{"events": map[string]interface{}{"hide": []interface{}{"a"}}}},
+		{"username": "foo", "role": "READ", "collections": map[string]interface{}{"events": map[string]interface{}{"deny": []interface{}{"address.city"}}}},
+		{"username": "foo", "role": "READ", "collections": map[string]interface{}{"events": map[string]interface{}{"allow": []interface{}{""}}}},
+		{"username": "foo", "role": "OWNER"},
+	}
+	for _, datum := range invalid {
+		if err := Validate(datum, definitions); err == nil {
+			t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+		}
+	}
+}
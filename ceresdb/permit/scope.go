@@ -0,0 +1,97 @@
+// scope.go
+
+package permit
+
+import (
+	"ceresdb/aql"
+	"ceresdb/role"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Schema is the schema of the collection permits are stored in. Collections optionally limits a
+// permit to some of the database's collections, see Scope.
+var Schema = map[string]interface{}{"username": "STRING UNIQUE", "role": "STRING", "collections": "DICT"}
+
+// Scope returns the role a permit grants on a collection and the fields it can access there. A
+// permit without collections grants its role on every collection. Otherwise only the collections
+// it lists can be accessed, each with its own role, which defaults to the permit's, and its own
+// allow and deny lists of fields. An empty collection scopes the database itself.
+func Scope(datum map[string]interface{}, collection string) (string, aql.Access, error) {
+	role, _ := datum["role"].(string)
+	collections, ok := datum["collections"].(map[string]interface{})
+	if !ok || collection == "" {
+		return role, aql.Access{}, nil
+	}
+	scope, ok := collections[collection].(map[string]interface{})
+	if !ok {
+		return "", aql.Access{}, errors.New("user is not permitted to access this collection")
+	}
+	if scopeRole, ok := scope["role"].(string); ok {
+		role = scopeRole
+	}
+	// Paths in deny lists written before they were rejected hide the whole field they start at
+	deny := fieldList(scope["deny"])
+	for idx, field := range deny {
+		deny[idx] = strings.Split(field, ".")[0]
+	}
+	access := aql.Access{Allow: fieldList(scope["allow"]), Deny: deny}
+	return role, access, nil
+}
+
+func fieldList(val interface{}) []string {
+	items, _ := val.([]interface{})
+	fields := make([]string, 0, len(items))
+	for _, item := range items {
+		if field, ok := item.(string); ok {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// Validate checks the role and collection scopes of a permit before it is written. Roles must be
+// built in or one of the custom role definitions, and allow and deny list top-level field names.
+func Validate(datum map[string]interface{}, definitions map[string]role.Definition) error {
+	permitRole, _ := datum["role"].(string)
+	if _, ok := role.Lookup(definitions, permitRole); !ok {
+		return errors.New(fmt.Sprintf("Invalid role %v, role does not exist", datum["role"]))
+	}
+	val, ok := datum["collections"]
+	if !ok || val == nil {
+		return nil
+	}
+	collections, ok := val.(map[string]interface{})
+	if !ok {
+		return errors.New("Invalid permit collections, must be a dictionary of collection names to scopes")
+	}
+	for name, scopeVal := range collections {
+		scope, ok := scopeVal.(map[string]interface{})
+		if !ok {
+			return errors.New(fmt.Sprintf("Invalid scope for collection %v, must be a dictionary", name))
+		}
+		for key, val := range scope {
+			switch key {
+			case "role":
+				scopeRole, _ := val.(string)
+				if _, ok := role.Lookup(definitions, scopeRole); !ok {
+					return errors.New(fmt.Sprintf("Invalid role %v for collection %v, role does not exist", val, name))
+				}
+			case "allow", "deny":
+				items, ok := val.([]interface{})
+				if !ok || len(fieldList(val)) != len(items) {
+					return errors.New(fmt.Sprintf("Invalid %v for collection %v, must be a list of field names", key, name))
+				}
+				for _, field := range fieldList(val) {
+					if field == "" || strings.Contains(field, ".") {
+						return errors.New(fmt.Sprintf("Invalid %v field '%v' for collection %v, fields are hidden as a whole so paths cannot be listed", key, field, name))
+					}
+				}
+			default:
+				return errors.New(fmt.Sprintf("Invalid scope option %v for collection %v, valid options are 'role', 'allow', and 'deny'", key, name))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+// lock.go
+
+package queue
+
+import (
+	"ceresdb/aql"
+	"ceresdb/utils"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type LockMode int
+
+const (
+	LockNone LockMode = iota
+	LockRead
+	LockWrite
+)
+
+// LockSet is every lock a query holds while it runs. Locks are always acquired in the same order
+// (the write lock, then the catalog, then collections sorted by name) so that queries cannot
+// deadlock each other.
+type LockSet struct {
+	// Write serializes the query against every other query which writes
+	Write bool
+	// Catalog guards the set of databases and collections along with their schemas
+	Catalog LockMode
+	// Collections maps "<database>.<collection>" to the access the query needs
+	Collections map[string]LockMode
+}
+
+var writeLock sync.Mutex
+var catalogLock sync.RWMutex
+var collectionLocks = make(map[string]*sync.RWMutex)
+var collectionLocksMutex sync.Mutex
+
+func NewLockSet() *LockSet {
+	return &LockSet{Catalog: LockRead, Collections: make(map[string]LockMode)}
+}
+
+// Add records that the query needs a collection with at least the given access
+func (l *LockSet) Add(collection string, mode LockMode) {
+	if mode > l.Collections[collection] {
+		l.Collections[collection] = mode
+	}
+	if mode == LockWrite {
+		l.Write = true
+	}
+}
+
+// AddCatalog records that the query needs the catalog with at least the given access
+func (l *LockSet) AddCatalog(mode LockMode) {
+	if mode > l.Catalog {
+		l.Catalog = mode
+	}
+	if mode == LockWrite {
+		l.Write = true
+	}
+}
+
+func (l *LockSet) sortedCollections() []string {
+	keys := make([]string, 0, len(l.Collections))
+	for key := range l.Collections {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func collectionLock(collection string) *sync.RWMutex {
+	collectionLocksMutex.Lock()
+	defer collectionLocksMutex.Unlock()
+	lock, ok := collectionLocks[collection]
+	if !ok {
+		lock = &sync.RWMutex{}
+		collectionLocks[collection] = lock
+	}
+	return lock
+}
+
+// Acquire blocks until every lock in the set is held
+func (l *LockSet) Acquire() {
+	if l.Write {
+		writeLock.Lock()
+	}
+	switch l.Catalog {
+	case LockWrite:
+		// Holding the whole catalog excludes every other query, so collection locks are not needed
+		catalogLock.Lock()
+		return
+	case LockRead:
+		catalogLock.RLock()
+	}
+	for _, collection := range l.sortedCollections() {
+		switch l.Collections[collection] {
+		case LockWrite:
+			collectionLock(collection).Lock()
+		case LockRead:
+			collectionLock(collection).RLock()
+		}
+	}
+}
+
+// Release gives up every lock in the set in the reverse order they were acquired
+func (l *LockSet) Release() {
+	switch l.Catalog {
+	case LockWrite:
+		catalogLock.Unlock()
+	case LockRead:
+		collections := l.sortedCollections()
+		for idx := len(collections) - 1; idx >= 0; idx-- {
+			switch l.Collections[collections[idx]] {
+			case LockWrite:
+				collectionLock(collections[idx]).Unlock()
+			case LockRead:
+				collectionLock(collections[idx]).RUnlock()
+			}
+		}
+		catalogLock.RUnlock()
+	}
+	if l.Write {
+		writeLock.Unlock()
+	}
+}
+
+// Plan works out the locks needed to run a parsed query, including the reads made while
+// verifying the user's permissions for each action
+func Plan(actions []aql.Action) *LockSet {
+	locks := NewLockSet()
+	writeTypes := []string{"POST", "PUT", "PATCH", "DELETE"}
+	locks.Add("_auth._users", LockRead)
+	for _, action := range actions {
+		// Explaining a query never runs it, so it only has to read
+		mode := LockRead
+		if utils.Contains(writeTypes, action.Type) && !action.Explain {
+			mode = LockWrite
+		}
+		switch action.Type {
+		case "BEGIN", "COMMIT", "ROLLBACK":
+			locks.Write = locks.Write || !action.Explain
+			continue
+		}
+		switch action.Resource {
+		case "DATABASE", "COLLECTION", "POLICY":
+			// Policies are kept alongside the schema and read while verifying every record action
+			locks.AddCatalog(mode)
+			if action.Resource != "DATABASE" {
+				locks.Add(permitCollection(action.Identifier), LockRead)
+			}
+		case "RECORD", "INDEX":
+			locks.Add(permitCollection(action.Identifier), LockRead)
+			locks.Add(action.Identifier, mode)
+		case "PERMIT":
+			locks.Add(permitCollection(action.Identifier), mode)
+		case "USER":
+			// Deleting a user revokes their API keys
+			locks.Add("_auth._users", mode)
+			locks.Add("_auth._keys", mode)
+		case "KEY":
+			locks.Add("_auth._keys", mode)
+		case "ROLE":
+			locks.Add("_auth._roles", mode)
+			// Deleting a role checks that no permit or policy in any database is assigned it
+			if action.Type == "DELETE" && mode == LockWrite {
+				locks.AddCatalog(LockWrite)
+			}
+		}
+	}
+	return locks
+}
+
+// permitCollection returns the collection holding the permits for the database an identifier
+// belongs to
+func permitCollection(identifier string) string {
+	return strings.Split(identifier, ".")[0] + "._users"
+}
@@ -1,24 +1,112 @@
+// queue.go
+
+// Package queue schedules incoming queries onto a fixed pool of workers. Queries wait in a
+// bounded channel, and AddToQueue fails fast with ErrQueueFull instead of letting the backlog
+// grow without limit. Each worker acquires the locks a query needs (see LockSet) before it runs,
+// so reads of a collection can run in parallel while writes are serialized.
 package queue
 
+import (
+	"ceresdb/config"
+	"ceresdb/logging"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+const DEFAULT_QUEUE_DEPTH = 1024
+
 type QueueObject struct {
 	Auth        string
 	QueryString string
 	Data        []map[string]interface{}
-	Finished    bool
 	Err         error
 	Snapshot    bool
+	Context     context.Context
+	// Token is the bearer token a request authenticated with instead of a username and password,
+	// and Login asks for a session token to be issued rather than a query to be run
+	Token string
+	Login bool
+	// Emit receives the records of a final GET RECORD action as they are read when results are
+	// streamed, and Next is set to the continuation token if the action has more records
+	Emit func(map[string]interface{}) error
+	Next string
+	// Source is the address the request came from, which is kept in the audit log
+	Source string
+	done   chan struct{}
 }
 
-var Queue []*QueueObject
+// Handler runs a single query on a worker
+type Handler func(queueObject *QueueObject) ([]map[string]interface{}, error)
+
+var ErrQueueFull = errors.New("query queue is full, try again later")
+
+var jobs chan *QueueObject
+
+// InitQueue starts the worker pool which runs queued queries with handler
+func InitQueue(handler Handler) {
+	workers := config.Config.QueryWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	depth := config.Config.QueueDepth
+	if depth <= 0 {
+		depth = DEFAULT_QUEUE_DEPTH
+	}
+	jobs = make(chan *QueueObject, depth)
+	for i := 0; i < workers; i++ {
+		go worker(handler)
+	}
+}
+
+func worker(handler Handler) {
+	for queueObject := range jobs {
+		// Skip queries whose caller has already given up on them
+		if err := queueObject.Context.Err(); err != nil {
+			queueObject.Err = err
+		} else {
+			run(handler, queueObject)
+		}
+		close(queueObject.done)
+	}
+}
 
-func InitQueue() {
-	Queue = make([]*QueueObject, 0)
+// run runs a query with handler, turning a panic into the query's error so that one query cannot
+// stop the worker or the server. Handlers release what they hold in defers, which still run.
+func run(handler Handler, queueObject *QueueObject) {
+	defer func() {
+		if r := recover(); r != nil {
+			logging.ERROR(fmt.Sprintf("Query panicked: %v\n%s", r, debug.Stack()))
+			queueObject.Data, queueObject.Err = nil, errors.New(fmt.Sprintf("query failed unexpectedly: %v", r))
+		}
+	}()
+	queueObject.Data, queueObject.Err = handler(queueObject)
 }
 
-func AddToQueue(queueObject *QueueObject) {
-	Queue = append(Queue, queueObject)
+// AddToQueue schedules a query to be run, returning ErrQueueFull if too many queries are
+// already waiting
+func AddToQueue(queueObject *QueueObject) error {
+	if queueObject.Context == nil {
+		queueObject.Context = context.Background()
+	}
+	queueObject.done = make(chan struct{})
+	select {
+	case jobs <- queueObject:
+		return nil
+	default:
+		return ErrQueueFull
+	}
 }
 
-func PopQueue() {
-	Queue = Queue[1:]
+// Wait blocks until a query has finished or its context is cancelled, returning the error
+// from whichever happened first
+func Wait(queueObject *QueueObject) error {
+	select {
+	case <-queueObject.done:
+		return queueObject.Err
+	case <-queueObject.Context.Done():
+		return queueObject.Context.Err()
+	}
 }
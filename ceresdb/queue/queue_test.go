@@ -0,0 +1,256 @@
+package queue
+
+import (
+	"ceresdb/aql"
+	"ceresdb/config"
+	"context"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPlan(t *testing.T) {
+	actions := []aql.Action{
+		{Type: "GET", Resource: "RECORD", Identifier: "foo.bar"},
+		{Type: "FILTER"},
+		{Type: "PATCH", Resource: "RECORD", Identifier: "foo.baz"},
+	}
+	expectedCollections := map[string]LockMode{
+		"_auth._users": LockRead,
+		"foo._users":   LockRead,
+		"foo.bar":      LockRead,
+		"foo.baz":      LockWrite,
+	}
+
+	locks := Plan(actions)
+
+	if !reflect.DeepEqual(locks.Collections, expectedCollections) {
+		t.Errorf("Collections were incorrect, got: %v, want: %v", locks.Collections, expectedCollections)
+	}
+	if !locks.Write {
+		t.Errorf("Write was incorrect, got: %v, want: %v", locks.Write, true)
+	}
+	if locks.Catalog != LockRead {
+		t.Errorf("Catalog was incorrect, got: %v, want: %v", locks.Catalog, LockRead)
+	}
+
+	actions = []aql.Action{
+		{Type: "GET", Resource: "RECORD", Identifier: "foo.bar"},
+		{Type: "COUNT"},
+	}
+
+	locks = Plan(actions)
+
+	if locks.Write {
+		t.Errorf("Write was incorrect, got: %v, want: %v", locks.Write, false)
+	}
+
+	actions = []aql.Action{
+		{Type: "DELETE", Resource: "COLLECTION", Identifier: "foo.bar"},
+	}
+
+	locks = Plan(actions)
+
+	if locks.Catalog != LockWrite {
+		t.Errorf("Catalog was incorrect, got: %v, want: %v", locks.Catalog, LockWrite)
+	}
+
+	actions = []aql.Action{
+		{Type: "POST", Resource: "POLICY", Identifier: "foo.bar"},
+	}
+
+	locks = Plan(actions)
+
+	if locks.Catalog != LockWrite || locks.Collections["foo._users"] != LockRead {
+		t.Errorf("Locks were incorrect, got: %v, %v, want: %v", locks.Catalog, locks.Collections, "catalog write with permits read")
+	}
+
+	actions = []aql.Action{
+		{Type: "POST", Resource: "ROLE"},
+	}
+
+	locks = Plan(actions)
+
+	if locks.Catalog != LockRead || locks.Collections["_auth._roles"] != LockWrite || !locks.Write {
+		t.Errorf("Locks were incorrect, got: %v, %v, want: %v", locks.Catalog, locks.Collections, "roles write")
+	}
+
+	actions = []aql.Action{
+		{Type: "DELETE", Resource: "ROLE", IDs: []string{"abc"}},
+	}
+
+	locks = Plan(actions)
+
+	if locks.Catalog != LockWrite || !locks.Write {
+		t.Errorf("Locks were incorrect, got: %v, %v, want: %v", locks.Catalog, locks.Collections, "catalog write")
+	}
+
+	actions = []aql.Action{
+		{Type: "BEGIN"},
+		{Type: "GET", Resource: "USER"},
+		{Type: "COMMIT"},
+	}
+
+	locks = Plan(actions)
+
+	if !locks.Write {
+		t.Errorf("Write was incorrect, got: %v, want: %v", locks.Write, true)
+	}
+}
+
+func TestParallelReads(t *testing.T) {
+	first := NewLockSet()
+	first.Add("foo.bar", LockRead)
+	second := NewLockSet()
+	second.Add("foo.bar", LockRead)
+
+	first.Acquire()
+	acquired := make(chan bool)
+	go func() {
+		second.Acquire()
+		second.Release()
+		acquired <- true
+	}()
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Errorf("Read lock was not acquired while another read lock was held")
+	}
+	first.Release()
+}
+
+func TestWriteExcludesRead(t *testing.T) {
+	writer := NewLockSet()
+	writer.Add("foo.bar", LockWrite)
+	reader := NewLockSet()
+	reader.Add("foo.bar", LockRead)
+	other := NewLockSet()
+	other.Add("foo.baz", LockRead)
+
+	writer.Acquire()
+	acquired := make(chan bool, 1)
+	go func() {
+		reader.Acquire()
+		acquired <- true
+		reader.Release()
+	}()
+
+	otherAcquired := make(chan bool)
+	go func() {
+		other.Acquire()
+		other.Release()
+		otherAcquired <- true
+	}()
+	select {
+	case <-otherAcquired:
+	case <-time.After(time.Second):
+		t.Errorf("Read lock on another collection was not acquired while a write lock was held")
+	}
+
+	select {
+	case <-acquired:
+		t.Errorf("Read lock was acquired while a write lock was held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	writer.Release()
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Errorf("Read lock was not acquired after the write lock was released")
+	}
+}
+
+func TestAddToQueue(t *testing.T) {
+	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb/config/config.json")
+	config.ReadConfigFile()
+	config.Config.QueryWorkers = 1
+	config.Config.QueueDepth = 1
+
+	release := make(chan bool)
+	var running sync.WaitGroup
+	running.Add(1)
+	InitQueue(func(queueObject *QueueObject) ([]map[string]interface{}, error) {
+		if queueObject.QueryString == "block" {
+			running.Done()
+			<-release
+		}
+		return []map[string]interface{}{{"query": queueObject.QueryString}}, nil
+	})
+
+	blocking := QueueObject{QueryString: "block"}
+	if err := AddToQueue(&blocking); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	running.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	waiting := QueueObject{QueryString: "wait", Context: ctx}
+	if err := AddToQueue(&waiting); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+
+	full := QueueObject{QueryString: "full"}
+	if err := AddToQueue(&full); err != ErrQueueFull {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, ErrQueueFull)
+	}
+
+	if err := Wait(&waiting); err != context.DeadlineExceeded {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, context.DeadlineExceeded)
+	}
+
+	close(release)
+	if err := Wait(&blocking); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	expectedData := []map[string]interface{}{{"query": "block"}}
+	if !reflect.DeepEqual(blocking.Data, expectedData) {
+		t.Errorf("Data was incorrect, got: %v, want: %v", blocking.Data, expectedData)
+	}
+}
+
+func TestPanic(t *testing.T) {
+	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb/config/config.json")
+	config.ReadConfigFile()
+	config.Config.QueryWorkers = 1
+	config.Config.QueueDepth = 2
+
+	// A query which panics fails on its own, releasing its locks, and the worker carries on
+	InitQueue(func(queueObject *QueueObject) ([]map[string]interface{}, error) {
+		locks := NewLockSet()
+		locks.Add("foo.bar", LockWrite)
+		locks.Acquire()
+		defer locks.Release()
+		if queueObject.QueryString == "panic" {
+			var data map[string]interface{}
+			data["id"] = 1
+		}
+		return []map[string]interface{}{{"query": queueObject.QueryString}}, nil
+	})
+
+	panicking := QueueObject{QueryString: "panic"}
+	following := QueueObject{QueryString: "follow"}
+	if err := AddToQueue(&panicking); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if err := AddToQueue(&following); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if err := Wait(&panicking); err == nil || panicking.Data != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+	done := make(chan error)
+	go func() { done <- Wait(&following) }()
+	select {
+	case err := <-done:
+		if err != nil || !reflect.DeepEqual(following.Data, []map[string]interface{}{{"query": "follow"}}) {
+			t.Errorf("Data was incorrect, got: %v, %v, want: %v", following.Data, err, "follow")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Query after the panic did not finish")
+	}
+}
@@ -8,9 +8,8 @@ import (
 	"ceresdb/index"
 	"ceresdb/schema"
 	"ceresdb/utils"
-	"encoding/json"
+	"ceresdb/wal"
 	"fmt"
-	"os"
 	"sort"
 	"strconv"
 	"strings"
@@ -30,18 +29,19 @@ type ToOverWriteStruct struct {
 
 func readData(dbIdent, colIdent, fileIdent string, blocks [][]int) ([]map[string]interface{}, error) {
 	blockIdx := 0
-	cursor.Initialize(blocks[0][0], blocks[0][1], cursor.ModeRead)
+	c := cursor.New(blocks[0][0], blocks[0][1], cursor.ModeRead)
 	output := make([]map[string]interface{}, 0)
 
 	path := config.Config.DataDir + "/" + dbIdent + "/" + colIdent + "/" + fileIdent
-	f, err := os.Open(path)
+	f, err := wal.Open(path)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 	r := bufio.NewReader(f)
 	s, e := utils.ReadLine(r)
 	for e == nil {
-		op, dat, _, err := cursor.Next(s, nil)
+		op, dat, _, err := c.Next(s, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -53,7 +53,7 @@ func readData(dbIdent, colIdent, fileIdent string, blocks [][]int) ([]map[string
 			if blockIdx >= len(blocks) {
 				break
 			}
-			cursor.Advance(blocks[blockIdx][0], blocks[blockIdx][1])
+			c.Advance(blocks[blockIdx][0], blocks[blockIdx][1])
 		}
 		s, e = utils.ReadLine(r)
 	}
@@ -64,34 +64,37 @@ func writeData(dbIdent, colIdent, fileIdent string, blocks [][]int, data []map[s
 	blockIdx := 0
 	dataIdx := 0
 	dataLen := len(data)
-	cursor.Initialize(blocks[0][0], blocks[0][1], cursor.ModeWrite)
+	c := cursor.New(blocks[0][0], blocks[0][1], cursor.ModeWrite)
 	newContents := make([]string, 0)
 
 	path := config.Config.DataDir + "/" + dbIdent + "/" + colIdent + "/" + fileIdent
-	f, err := os.Open(path)
+	f, err := wal.Open(path)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 	r := bufio.NewReader(f)
 	s, e := utils.ReadLine(r)
 	for e == nil {
 		if dataIdx < dataLen {
-			data[dataIdx][".id"] = fmt.Sprintf("%s.%d", fileIdent, cursor.Index+1)
-			op, _, dat, err := cursor.Next(s, data[dataIdx])
+			data[dataIdx][".id"] = fmt.Sprintf("%s.%d", fileIdent, c.Index+1)
+			op, _, dat, err := c.Next(s, data[dataIdx])
 			if err != nil {
 				return err
 			}
 			switch op {
 			case cursor.OpWrite:
 				newContents = append(newContents, dat)
-				index.Add(dbIdent, colIdent, data[dataIdx], schemaData)
+				if err := index.Add(dbIdent, colIdent, data[dataIdx], schemaData); err != nil {
+					return err
+				}
 				dataIdx += 1
 			case cursor.OpJump:
 				newContents = append(newContents, s+"\n")
 			case cursor.OpNext:
 				blockIdx += 1
 				newContents = append(newContents, s+"\n")
-				cursor.Advance(blocks[blockIdx][0], blocks[blockIdx][1])
+				c.Advance(blocks[blockIdx][0], blocks[blockIdx][1])
 			}
 		} else {
 			newContents = append(newContents, s+"\n")
@@ -101,44 +104,45 @@ func writeData(dbIdent, colIdent, fileIdent string, blocks [][]int, data []map[s
 
 	// Write out the new contents
 	output := strings.Join(newContents[:], "")
-	f, _ = os.Create(path)
-	defer f.Close()
-	f.Write([]byte(output))
-
-	return nil
+	return wal.WriteFile(path, []byte(output))
 }
 
-func overwriteData(dbIdent, colIdent, fileIdent string, blocks [][]int, data []map[string]interface{}, schemaData map[string]string) error {
+func overwriteData(dbIdent, colIdent, fileIdent string, blocks [][]int, data []map[string]interface{}, schemaData map[string]string, updateIndex bool) error {
 	blockIdx := 0
 	dataIdx := 0
 	dataLen := len(data)
-	cursor.Initialize(blocks[0][0], blocks[0][1], cursor.ModeWrite)
+	c := cursor.New(blocks[0][0], blocks[0][1], cursor.ModeWrite)
 	newContents := make([]string, 0)
 
 	path := config.Config.DataDir + "/" + dbIdent + "/" + colIdent + "/" + fileIdent
-	f, err := os.Open(path)
+	f, err := wal.Open(path)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 	r := bufio.NewReader(f)
 	s, e := utils.ReadLine(r)
 	for e == nil {
 		if dataIdx < dataLen {
-			op, datum, dat, err := cursor.Next(s, data[dataIdx])
+			op, datum, dat, err := c.Next(s, data[dataIdx])
 			if err != nil {
 				return err
 			}
 			switch op {
 			case cursor.OpWrite:
 				newContents = append(newContents, dat)
-				index.Update(dbIdent, colIdent, datum, data[dataIdx], schemaData)
+				if updateIndex {
+					if err := index.Update(dbIdent, colIdent, datum, data[dataIdx], schemaData); err != nil {
+						return err
+					}
+				}
 				dataIdx += 1
 			case cursor.OpJump:
 				newContents = append(newContents, s+"\n")
 			case cursor.OpNext:
 				blockIdx += 1
 				newContents = append(newContents, s+"\n")
-				cursor.Advance(blocks[blockIdx][0], blocks[blockIdx][1])
+				c.Advance(blocks[blockIdx][0], blocks[blockIdx][1])
 			}
 		} else {
 			newContents = append(newContents, s+"\n")
@@ -148,27 +152,24 @@ func overwriteData(dbIdent, colIdent, fileIdent string, blocks [][]int, data []m
 
 	// Write out the new contents
 	output := strings.Join(newContents[:], "")
-	f, _ = os.Create(path)
-	defer f.Close()
-	f.Write([]byte(output))
-
-	return nil
+	return wal.WriteFile(path, []byte(output))
 }
 
 func patchData(dbIdent, colIdent, fileIdent string, blocks [][]int, data map[string]interface{}, schemaData map[string]string) error {
 	blockIdx := 0
-	cursor.Initialize(blocks[0][0], blocks[0][1], cursor.ModePatch)
+	c := cursor.New(blocks[0][0], blocks[0][1], cursor.ModePatch)
 	newContents := make([]string, 0)
 
 	path := config.Config.DataDir + "/" + dbIdent + "/" + colIdent + "/" + fileIdent
-	f, err := os.Open(path)
+	f, err := wal.Open(path)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 	r := bufio.NewReader(f)
 	s, e := utils.ReadLine(r)
 	for e == nil {
-		op, datum, dat, err := cursor.Next(s, data)
+		op, datum, dat, err := c.Next(s, data)
 		if err != nil {
 			return err
 		}
@@ -176,8 +177,10 @@ func patchData(dbIdent, colIdent, fileIdent string, blocks [][]int, data map[str
 		case cursor.OpWrite:
 			newContents = append(newContents, dat)
 			newDatum := make(map[string]interface{})
-			json.Unmarshal([]byte(dat), &newDatum)
-			index.Update(dbIdent, colIdent, datum, newDatum, schemaData)
+			utils.DecodeJSON([]byte(dat), &newDatum)
+			if err := index.Update(dbIdent, colIdent, datum, newDatum, schemaData); err != nil {
+				return err
+			}
 		case cursor.OpJump:
 			newContents = append(newContents, s+"\n")
 		case cursor.OpNext:
@@ -186,38 +189,37 @@ func patchData(dbIdent, colIdent, fileIdent string, blocks [][]int, data map[str
 			if blockIdx >= len(blocks) {
 				break
 			}
-			cursor.Advance(blocks[blockIdx][0], blocks[blockIdx][1])
+			c.Advance(blocks[blockIdx][0], blocks[blockIdx][1])
 		}
 		s, e = utils.ReadLine(r)
 	}
 
 	// Write out the new contents
 	output := strings.Join(newContents[:], "")
-	f, _ = os.Create(path)
-	defer f.Close()
-	f.Write([]byte(output))
-
-	return nil
+	return wal.WriteFile(path, []byte(output))
 }
 
 func deleteData(dbIdent, colIdent, fileIdent string, blocks [][]int, schemaData map[string]string) error {
 	blockIdx := 0
-	cursor.Initialize(blocks[0][0], blocks[0][1], cursor.ModeDelete)
+	c := cursor.New(blocks[0][0], blocks[0][1], cursor.ModeDelete)
 	newContents := make([]string, 0)
 
 	path := config.Config.DataDir + "/" + dbIdent + "/" + colIdent + "/" + fileIdent
-	f, err := os.Open(path)
+	f, err := wal.Open(path)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 	r := bufio.NewReader(f)
 	s, e := utils.ReadLine(r)
 	for e == nil {
-		op, datum, dat, _ := cursor.Next(s, nil)
+		op, datum, dat, _ := c.Next(s, nil)
 		switch op {
 		case cursor.OpDelete:
 			newContents = append(newContents, dat)
-			index.Delete(dbIdent, colIdent, datum, schemaData)
+			if err := index.Delete(dbIdent, colIdent, datum, schemaData); err != nil {
+				return err
+			}
 		case cursor.OpJump:
 			newContents = append(newContents, s+"\n")
 		case cursor.OpNext:
@@ -226,21 +228,20 @@ func deleteData(dbIdent, colIdent, fileIdent string, blocks [][]int, schemaData
 			if blockIdx >= len(blocks) {
 				break
 			}
-			cursor.Advance(blocks[blockIdx][0], blocks[blockIdx][1])
+			c.Advance(blocks[blockIdx][0], blocks[blockIdx][1])
 		}
 		s, e = utils.ReadLine(r)
 	}
 
 	// Write out the new contents
 	output := strings.Join(newContents[:], "")
-	f, _ = os.Create(path)
-	defer f.Close()
-	f.Write([]byte(output))
-
-	return nil
+	return wal.WriteFile(path, []byte(output))
 }
 
-func Delete(database, collection string, ids []string) error {
+func Delete(database, collection string, ids []string) (err error) {
+	wal.Begin()
+	defer func() { err = wal.End(err) }()
+
 	schemaData := schema.Get(database, collection)
 
 	toDelete := make(map[string][]int)
@@ -287,9 +288,7 @@ func Delete(database, collection string, ids []string) error {
 	}
 	freespace.FreeSpace.Databases[database] = db
 
-	freespace.WriteFreeSpace()
-
-	return nil
+	return freespace.WriteFreeSpace()
 }
 
 func Get(database, collection string, ids []string) ([]map[string]interface{}, error) {
@@ -317,11 +316,48 @@ func Get(database, collection string, ids []string) ([]map[string]interface{}, e
 		}
 		output = append(output, data...)
 	}
+	schema.NormalizeData(database, collection, output)
+	sort.SliceStable(output, func(i, j int) bool {
+		idA, _ := output[i][".id"].(string)
+		idB, _ := output[j][".id"].(string)
+		return ComparePositions(idA, idB) < 0
+	})
 
 	return output, nil
 }
 
-func Post(database, collection string, data []map[string]interface{}) error {
+// ComparePositions compares where two records are stored, so that records can be listed in a
+// stable order. IDs are made up of the data file's ID and the record's line within it.
+func ComparePositions(a, b string) int {
+	fileA, lineA := splitID(a)
+	fileB, lineB := splitID(b)
+	if fileA != fileB {
+		if fileA < fileB {
+			return -1
+		}
+		return 1
+	}
+	return lineA - lineB
+}
+
+// SortIDs sorts record IDs into the order their records are stored in
+func SortIDs(ids []string) {
+	sort.Slice(ids, func(i, j int) bool { return ComparePositions(ids[i], ids[j]) < 0 })
+}
+
+func splitID(id string) (string, int) {
+	parts := strings.SplitN(id, ".", 2)
+	if len(parts) < 2 {
+		return parts[0], -1
+	}
+	line, _ := strconv.Atoi(parts[1])
+	return parts[0], line
+}
+
+func Post(database, collection string, data []map[string]interface{}) (err error) {
+	wal.Begin()
+	defer func() { err = wal.End(err) }()
+
 	if err := schema.ValidateDataAgainstSchema(database, collection, data); err != nil {
 		return err
 	}
@@ -385,9 +421,9 @@ func Post(database, collection string, data []map[string]interface{}) error {
 		for idx := 0; idx < config.Config.StorageLineLimit; idx++ {
 			output += "\n"
 		}
-		f, _ := os.Create(path)
-		f.Write([]byte(output))
-		f.Close()
+		if err := wal.WriteFile(path, []byte(output)); err != nil {
+			return err
+		}
 		writable := ToWriteStruct{Blocks: make([][]int, 0), Data: make([]map[string]interface{}, 0)}
 		for _, block := range val.Blocks {
 			blockSize := block[1] - block[0] + 1
@@ -428,7 +464,9 @@ func Post(database, collection string, data []map[string]interface{}) error {
 	}
 	freespace.FreeSpace.Databases[database] = db
 
-	freespace.WriteFreeSpace()
+	if err := freespace.WriteFreeSpace(); err != nil {
+		return err
+	}
 
 	for key, val := range toWrite {
 		err := writeData(database, collection, key, val.Blocks, val.Data, schemaData)
@@ -440,8 +478,11 @@ func Post(database, collection string, data []map[string]interface{}) error {
 	return nil
 }
 
-func Patch(database, collection string, ids []string, data map[string]interface{}) error {
-	if err := schema.ValidateDataAgainstSchema(database, collection, []map[string]interface{}{data}); err != nil {
+func Patch(database, collection string, ids []string, data map[string]interface{}) (err error) {
+	wal.Begin()
+	defer func() { err = wal.End(err) }()
+
+	if err := schema.ValidatePatchAgainstSchema(database, collection, data); err != nil {
 		return err
 	}
 	schemaData := schema.Get(database, collection)
@@ -472,12 +513,28 @@ func Patch(database, collection string, ids []string, data map[string]interface{
 	return nil
 }
 
-func Put(database, collection string, data []map[string]interface{}) error {
+func Put(database, collection string, data []map[string]interface{}) (err error) {
+	wal.Begin()
+	defer func() { err = wal.End(err) }()
+
 	if err := schema.ValidateDataAgainstSchema(database, collection, data); err != nil {
 		return err
 	}
 	schemaData := schema.Get(database, collection)
 
+	return overwrite(database, collection, data, schemaData, true)
+}
+
+// Rewrite replaces records in place without touching the collection's indices, for callers which
+// rebuild the indices themselves
+func Rewrite(database, collection string, data []map[string]interface{}) (err error) {
+	wal.Begin()
+	defer func() { err = wal.End(err) }()
+
+	return overwrite(database, collection, data, schema.Get(database, collection), false)
+}
+
+func overwrite(database, collection string, data []map[string]interface{}, schemaData map[string]string, updateIndex bool) error {
 	toOverWrite := make(map[string]ToOverWriteStruct)
 
 	for _, datum := range data {
@@ -499,7 +556,7 @@ func Put(database, collection string, data []map[string]interface{}) error {
 	// Build up range blocks
 	for key, val := range toOverWrite {
 		blocks := utils.BuildRangeBlocks((val.Indices))
-		err := overwriteData(database, collection, key, blocks, val.Data, schemaData)
+		err := overwriteData(database, collection, key, blocks, val.Data, schemaData, updateIndex)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,210 @@
+// role.go
+
+package role
+
+import (
+	"ceresdb/record"
+	"ceresdb/utils"
+	"errors"
+	"fmt"
+)
+
+// Schema is the schema of the collection custom roles are stored in
+var Schema = map[string]interface{}{"name": "STRING UNIQUE", "inherits": "LIST", "privileges": "LIST"}
+
+// WILDCARD matches any action or resource in a privilege
+const WILDCARD = "*"
+
+// Actions and Resources are what a privilege can grant
+var Actions = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+var Resources = []string{"DATABASE", "COLLECTION", "RECORD", "PERMIT", "INDEX", "POLICY", "USER", "KEY", "ROLE", "AUDIT", "SNAPSHOT"}
+
+// Privilege allows an action on a resource
+type Privilege struct {
+	Action   string `json:"action"`
+	Resource string `json:"resource"`
+}
+
+// Definition is a named role, which has its own privileges and those of every role it inherits
+type Definition struct {
+	Name       string
+	Inherits   []string
+	Privileges []Privilege
+}
+
+// Builtin are the roles every instance has. READ can read everything but the audit log and
+// snapshots and manage its own API keys, WRITE can also write records and create databases, and ADMIN can do anything.
+var Builtin = map[string]Definition{
+	"READ": {
+		Name: "READ",
+		Privileges: []Privilege{
+			{Action: "GET", Resource: "DATABASE"},
+			{Action: "GET", Resource: "COLLECTION"},
+			{Action: "GET", Resource: "RECORD"},
+			{Action: "GET", Resource: "PERMIT"},
+			{Action: "GET", Resource: "INDEX"},
+			{Action: "GET", Resource: "POLICY"},
+			{Action: "GET", Resource: "USER"},
+			{Action: "GET", Resource: "KEY"},
+			{Action: "GET", Resource: "ROLE"},
+			{Action: "POST", Resource: "KEY"},
+			{Action: "DELETE", Resource: "KEY"},
+		},
+	},
+	"WRITE": {
+		Name:     "WRITE",
+		Inherits: []string{"READ"},
+		Privileges: []Privilege{
+			{Action: "POST", Resource: "RECORD"},
+			{Action: "PUT", Resource: "RECORD"},
+			{Action: "PATCH", Resource: "RECORD"},
+			{Action: "DELETE", Resource: "RECORD"},
+			{Action: "POST", Resource: "DATABASE"},
+			{Action: "PUT", Resource: "DATABASE"},
+			{Action: "PATCH", Resource: "DATABASE"},
+			{Action: "DELETE", Resource: "DATABASE"},
+		},
+	},
+	"ADMIN": {
+		Name:       "ADMIN",
+		Inherits:   []string{"WRITE"},
+		Privileges: []Privilege{{Action: WILDCARD, Resource: WILDCARD}},
+	},
+}
+
+// Lookup returns the definition of a role, built in roles take precedence over custom ones
+func Lookup(definitions map[string]Definition, name string) (Definition, bool) {
+	if definition, ok := Builtin[name]; ok {
+		return definition, true
+	}
+	definition, ok := definitions[name]
+	return definition, ok
+}
+
+// Allows reports whether a role grants an action on a resource, either itself or through a role
+// it inherits. Unknown roles grant nothing.
+func Allows(definitions map[string]Definition, name, action, resource string) bool {
+	return allows(definitions, name, action, resource, make(map[string]bool))
+}
+
+func allows(definitions map[string]Definition, name, action, resource string, visited map[string]bool) bool {
+	if visited[name] {
+		return false
+	}
+	visited[name] = true
+	definition, ok := Lookup(definitions, name)
+	if !ok {
+		return false
+	}
+	for _, privilege := range definition.Privileges {
+		if (privilege.Action == WILDCARD || privilege.Action == action) && (privilege.Resource == WILDCARD || privilege.Resource == resource) {
+			return true
+		}
+	}
+	for _, parent := range definition.Inherits {
+		if allows(definitions, parent, action, resource, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// Document returns the record a role is stored as
+func (d Definition) Document() map[string]interface{} {
+	inherits := make([]interface{}, len(d.Inherits))
+	for idx, parent := range d.Inherits {
+		inherits[idx] = parent
+	}
+	privileges := make([]interface{}, len(d.Privileges))
+	for idx, privilege := range d.Privileges {
+		privileges[idx] = map[string]interface{}{"action": privilege.Action, "resource": privilege.Resource}
+	}
+	return map[string]interface{}{"name": d.Name, "inherits": inherits, "privileges": privileges}
+}
+
+// Parse reads the definition of a role from its record, checking its privileges
+func Parse(datum map[string]interface{}) (Definition, error) {
+	name, _ := datum["name"].(string)
+	if name == "" {
+		return Definition{}, errors.New("Invalid role data, required field is 'name'")
+	}
+	for key := range datum {
+		if !utils.Contains([]string{"name", "inherits", "privileges", ".id"}, key) {
+			return Definition{}, errors.New(fmt.Sprintf("Invalid role field '%v', valid fields are 'name', 'inherits', and 'privileges'", key))
+		}
+	}
+	definition := Definition{Name: name, Inherits: []string{}, Privileges: []Privilege{}}
+	if val, ok := datum["inherits"]; ok && val != nil {
+		items, ok := val.([]interface{})
+		if !ok {
+			return Definition{}, errors.New(fmt.Sprintf("Invalid inherits for role %v, must be a list of role names", name))
+		}
+		for _, item := range items {
+			parent, ok := item.(string)
+			if !ok {
+				return Definition{}, errors.New(fmt.Sprintf("Invalid inherits for role %v, must be a list of role names", name))
+			}
+			definition.Inherits = append(definition.Inherits, parent)
+		}
+	}
+	if val, ok := datum["privileges"]; ok && val != nil {
+		items, ok := val.([]interface{})
+		if !ok {
+			return Definition{}, errors.New(fmt.Sprintf("Invalid privileges for role %v, must be a list of dictionaries with 'action' and 'resource'", name))
+		}
+		for _, item := range items {
+			fields, ok := item.(map[string]interface{})
+			if !ok {
+				return Definition{}, errors.New(fmt.Sprintf("Invalid privileges for role %v, must be a list of dictionaries with 'action' and 'resource'", name))
+			}
+			action, _ := fields["action"].(string)
+			resource, _ := fields["resource"].(string)
+			if action != WILDCARD && !utils.Contains(Actions, action) {
+				return Definition{}, errors.New(fmt.Sprintf("Invalid privilege action %v for role %v", fields["action"], name))
+			}
+			if resource != WILDCARD && !utils.Contains(Resources, resource) {
+				return Definition{}, errors.New(fmt.Sprintf("Invalid privilege resource %v for role %v", fields["resource"], name))
+			}
+			definition.Privileges = append(definition.Privileges, Privilege{Action: action, Resource: resource})
+		}
+	}
+	return definition, nil
+}
+
+// Check makes sure every role a role inherits exists and that it does not inherit itself
+func Check(definitions map[string]Definition, name string) error {
+	return check(definitions, name, []string{})
+}
+
+func check(definitions map[string]Definition, name string, path []string) error {
+	if utils.Contains(path, name) {
+		return errors.New(fmt.Sprintf("Invalid inherits for role %v, roles cannot inherit themselves", path[0]))
+	}
+	definition, ok := Lookup(definitions, name)
+	if !ok {
+		return errors.New(fmt.Sprintf("Role %v does not exist", name))
+	}
+	path = append(path, name)
+	for _, parent := range definition.Inherits {
+		if err := check(definitions, parent, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func Delete(ids []string) error {
+	return record.Delete("_auth", "_roles", ids)
+}
+
+func Get(ids []string) ([]map[string]interface{}, error) {
+	return record.Get("_auth", "_roles", ids)
+}
+
+func Post(data []map[string]interface{}) error {
+	return record.Post("_auth", "_roles", data)
+}
+
+func Put(data []map[string]interface{}) error {
+	return record.Put("_auth", "_roles", data)
+}
@@ -0,0 +1,85 @@
+package role
+
+import (
+	"testing"
+)
+
+func TestAllows(t *testing.T) {
+	definitions := map[string]Definition{
+		"AUDITOR": {Name: "AUDITOR", Inherits: []string{"READ"}},
+		"EDITOR":  {Name: "EDITOR", Inherits: []string{"AUDITOR"}, Privileges: []Privilege{{Action: "PATCH", Resource: "RECORD"}}},
+		"LOOP":    {Name: "LOOP", Inherits: []string{"LOOP"}},
+	}
+	tests := []struct {
+		role     string
+		action   string
+		resource string
+		want     bool
+	}{
+		{"READ", "GET", "RECORD", true},
+		{"READ", "POST", "RECORD", false},
+		{"READ", "POST", "KEY", true},
+		{"READ", "GET", "AUDIT", false},
+		{"ADMIN", "GET", "AUDIT", true},
+		{"WRITE", "POST", "RECORD", true},
+		{"WRITE", "POST", "COLLECTION", false},
+		{"ADMIN", "DELETE", "USER", true},
+		{"AUDITOR", "GET", "USER", true},
+		{"AUDITOR", "PATCH", "RECORD", false},
+		{"EDITOR", "PATCH", "RECORD", true},
+		{"EDITOR", "GET", "COLLECTION", true},
+		{"EDITOR", "DELETE", "RECORD", false},
+		{"LOOP", "GET", "RECORD", false},
+		{"OWNER", "GET", "RECORD", false},
+	}
+	for _, test := range tests {
+		if got := Allows(definitions, test.role, test.action, test.resource); got != test.want {
+			t.Errorf("Allows was incorrect for %v %v %v, got: %v, want: %v", test.role, test.action, test.resource, got, test.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	datum := map[string]interface{}{
+		"name":       "EDITOR",
+		"inherits":   []interface{}{"READ"},
+		"privileges": []interface{}{map[string]interface{}{"action": "PATCH", "resource": "RECORD"}, map[string]interface{}{"action": "*", "resource": "INDEX"}},
+	}
+	definition, err := Parse(datum)
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if len(definition.Inherits) != 1 || len(definition.Privileges) != 2 || definition.Privileges[1].Action != WILDCARD {
+		t.Errorf("Definition was incorrect, got: %v, want: %v", definition, "EDITOR inheriting READ with two privileges")
+	}
+
+	invalid := []map[string]interface{}{
+		{"inherits": []interface{}{"READ"}},
+		{"name": "EDITOR", "inherits": "READ"},
+		{"name": "EDITOR", "privileges": []interface{}{map[string]interface{}{"action": "COUNT", "resource": "RECORD"}}},
+		{"name": "EDITOR", "privileges": []interface{}{map[string]interface{}{"action": "GET", "resource": "TABLE"}}},
+		{"name": "EDITOR", "level": 1},
+	}
+	for _, datum := range invalid {
+		if _, err := Parse(datum); err == nil {
+			t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	definitions := map[string]Definition{
+		"AUDITOR": {Name: "AUDITOR", Inherits: []string{"READ"}},
+		"MISSING": {Name: "MISSING", Inherits: []string{"OWNER"}},
+		"A":       {Name: "A", Inherits: []string{"B"}},
+		"B":       {Name: "B", Inherits: []string{"AUDITOR", "A"}},
+	}
+	if err := Check(definitions, "AUDITOR"); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	for _, name := range []string{"MISSING", "A", "B"} {
+		if err := Check(definitions, name); err == nil {
+			t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+		}
+	}
+}
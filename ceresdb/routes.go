@@ -6,6 +6,7 @@ func initializeRoutes() {
 	apiRoutes := router.Group("/api")
 	{
 		apiRoutes.POST("/query", handleQueryEndpoint)
+		apiRoutes.POST("/login", handleLoginEndpoint)
 		apiRoutes.GET("/snapshot", handleSnapshotEndpoint)
 	}
 }
@@ -0,0 +1,454 @@
+// field.go
+
+package schema
+
+import (
+	"ceresdb/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var validTypes = []string{"INT", "BOOL", "FLOAT", "STRING", "DICT", "LIST", "ANY", "TIMESTAMP", "DATE", "DURATION", "UUID"}
+
+// Modifiers which can follow a field's type, e.g. "STRING UNIQUE"
+var validModifiers = []string{"UNIQUE", "REQUIRED", "NULLABLE"}
+
+// Keys which can be set when a field is defined as a dictionary
+var validFieldKeys = []string{"type", "unique", "required", "nullable", "default", "enum", "items", "fields"}
+
+// Field is the full definition of a field in a collection's schema. Fields can be written as a
+// type string such as "STRING", "LIST<INT>", or "STRING UNIQUE", or as a dictionary of the
+// options below.
+type Field struct {
+	Type string `json:"type"`
+	// Unique fields cannot share a value between two records, see SchemaCollection.Unique
+	Unique bool `json:"unique,omitempty"`
+	// Required fields must be present in every record which is written in full
+	Required bool `json:"required,omitempty"`
+	// Nullable fields accept null in place of a value of their type
+	Nullable bool `json:"nullable,omitempty"`
+	// Default is filled in when a record written in full does not include the field
+	Default interface{} `json:"default,omitempty"`
+	// Enum limits the field to a fixed set of values
+	Enum []interface{} `json:"enum,omitempty"`
+	// Items is the definition of every element of a LIST
+	Items *Field `json:"items,omitempty"`
+	// Fields is the schema of a DICT
+	Fields map[string]Field `json:"fields,omitempty"`
+}
+
+func invalidType(typeName string) error {
+	return errors.New(fmt.Sprintf("Invalid schema type: %v, valid types are 'INT', 'BOOL', 'FLOAT', 'STRING', 'DICT', 'LIST', 'ANY', 'TIMESTAMP', 'DATE', 'DURATION', or 'UUID'", typeName))
+}
+
+// ParseType splits a field's type such as "STRING UNIQUE" into the type and its modifiers
+func ParseType(val string) (string, []string) {
+	parts := strings.Fields(val)
+	if len(parts) == 0 {
+		return "", []string{}
+	}
+	return parts[0], parts[1:]
+}
+
+// parseTypeName parses a type such as "INT" or "LIST<INT>" into a field
+func parseTypeName(key, typeName string) (Field, error) {
+	if strings.HasPrefix(typeName, "LIST<") && strings.HasSuffix(typeName, ">") {
+		items, err := parseTypeName(key, typeName[5:len(typeName)-1])
+		if err != nil {
+			return Field{}, err
+		}
+		return Field{Type: "LIST", Items: &items}, nil
+	}
+	if !utils.Contains(validTypes, typeName) {
+		return Field{}, invalidType(typeName)
+	}
+	return Field{Type: typeName}, nil
+}
+
+// ParseField parses the definition of a field from either its string or dictionary form
+func ParseField(key string, val interface{}) (Field, error) {
+	switch typedVal := val.(type) {
+	case string:
+		typeName, modifiers := ParseType(typedVal)
+		field, err := parseTypeName(key, typeName)
+		if err != nil {
+			return field, err
+		}
+		for _, modifier := range modifiers {
+			switch modifier {
+			case "UNIQUE":
+				field.Unique = true
+			case "REQUIRED":
+				field.Required = true
+			case "NULLABLE":
+				field.Nullable = true
+			default:
+				return field, errors.New(fmt.Sprintf("Invalid schema modifier for field %v: %v, valid modifiers are 'UNIQUE', 'REQUIRED', or 'NULLABLE'", key, modifier))
+			}
+		}
+		return field, field.validate(key)
+	case map[string]interface{}:
+		return parseFieldMap(key, typedVal)
+	}
+	return Field{}, errors.New(fmt.Sprintf("Invalid schema type for field %v: %v", key, val))
+}
+
+func parseFieldMap(key string, val map[string]interface{}) (Field, error) {
+	for option := range val {
+		if !utils.Contains(validFieldKeys, option) {
+			return Field{}, errors.New(fmt.Sprintf("Invalid schema option for field %v: %v", key, option))
+		}
+	}
+	typeName, ok := val["type"].(string)
+	if !ok {
+		return Field{}, errors.New(fmt.Sprintf("Schema for field %v must include a 'type'", key))
+	}
+	field, err := parseTypeName(key, typeName)
+	if err != nil {
+		return field, err
+	}
+	for _, option := range []string{"unique", "required", "nullable"} {
+		optionVal, ok := val[option]
+		if !ok {
+			continue
+		}
+		boolVal, ok := optionVal.(bool)
+		if !ok {
+			return field, errors.New(fmt.Sprintf("Schema option '%v' for field %v must be a boolean", option, key))
+		}
+		switch option {
+		case "unique":
+			field.Unique = boolVal
+		case "required":
+			field.Required = boolVal
+		case "nullable":
+			field.Nullable = boolVal
+		}
+	}
+	if items, ok := val["items"]; ok {
+		if field.Type != "LIST" || field.Items != nil {
+			return field, errors.New(fmt.Sprintf("Schema option 'items' for field %v is only supported on LIST fields without an element type", key))
+		}
+		itemField, err := ParseField(key+"[]", items)
+		if err != nil {
+			return field, err
+		}
+		field.Items = &itemField
+	}
+	if fields, ok := val["fields"]; ok {
+		fieldsMap, ok := fields.(map[string]interface{})
+		if field.Type != "DICT" || !ok {
+			return field, errors.New(fmt.Sprintf("Schema option 'fields' for field %v must be a dictionary on a DICT field", key))
+		}
+		field.Fields = make(map[string]Field)
+		for subKey, subVal := range fieldsMap {
+			subField, err := ParseField(key+"."+subKey, subVal)
+			if err != nil {
+				return field, err
+			}
+			if subField.Unique {
+				return field, errors.New(fmt.Sprintf("UNIQUE is only supported on top-level fields, not %v.%v", key, subKey))
+			}
+			field.Fields[subKey] = subField
+		}
+	}
+	if enum, ok := val["enum"]; ok {
+		enumList, ok := enum.([]interface{})
+		if !ok || len(enumList) == 0 {
+			return field, errors.New(fmt.Sprintf("Schema option 'enum' for field %v must be a non-empty list", key))
+		}
+		field.Enum = enumList
+	}
+	field.Default = val["default"]
+	return field, field.validate(key)
+}
+
+// validate checks that a field's options are consistent with each other
+func (f Field) validate(key string) error {
+	if f.Unique && utils.Contains([]string{"DICT", "LIST", "ANY"}, f.Type) {
+		return errors.New(fmt.Sprintf("Modifier UNIQUE is not supported for field %v of type %v", key, f.Type))
+	}
+	if f.Items != nil && f.Items.Unique {
+		return errors.New(fmt.Sprintf("UNIQUE is only supported on top-level fields, not the elements of %v", key))
+	}
+	for _, val := range f.Enum {
+		if _, err := f.withoutEnum().check(copyValue(val)); err != nil {
+			return errors.New(fmt.Sprintf("Enum value '%v' for field %v does not conform to schema type %v", val, key, f.TypeName()))
+		}
+	}
+	if f.Default != nil {
+		if _, err := f.check(copyValue(f.Default)); err != nil {
+			return errors.New(fmt.Sprintf("Default value '%v' for field %v is invalid: %v", f.Default, key, err))
+		}
+	}
+	return nil
+}
+
+func (f Field) withoutEnum() Field {
+	f.Enum = nil
+	return f
+}
+
+// TypeName returns the field's type as it would be written in a type string, e.g. "LIST<INT>"
+func (f Field) TypeName() string {
+	if f.Items != nil {
+		return "LIST<" + f.Items.TypeName() + ">"
+	}
+	return f.Type
+}
+
+// simple reports whether the field can be written as a type string
+func (f Field) simple() bool {
+	if f.Default != nil || f.Enum != nil || f.Fields != nil {
+		return false
+	}
+	return f.Items == nil || (f.Items.simple() && !f.Items.Required && !f.Items.Nullable)
+}
+
+// Document returns the field in the form it is written in a schema document
+func (f Field) Document() interface{} {
+	if !f.simple() {
+		return f
+	}
+	output := f.TypeName()
+	if f.Unique {
+		output += " UNIQUE"
+	}
+	if f.Required {
+		output += " REQUIRED"
+	}
+	if f.Nullable {
+		output += " NULLABLE"
+	}
+	return output
+}
+
+// mismatch builds the error for a value which does not match the field
+func (f Field) mismatch(val interface{}) error {
+	return errors.New(fmt.Sprintf("value '%v' does not conform to schema type %v", val, f.TypeName()))
+}
+
+// check validates a value against the field, including any nested fields, and returns it in the
+// form it is stored in. INT values are stored as exact 64-bit integers and FLOAT values as float64.
+func (f Field) check(val interface{}) (interface{}, error) {
+	if val == nil {
+		// ANY fields accept any value, null included
+		if f.Nullable || f.Type == "ANY" {
+			return nil, nil
+		}
+		return nil, errors.New("value cannot be null")
+	}
+	switch f.Type {
+	case "STRING":
+		if _, ok := val.(string); !ok {
+			return nil, f.mismatch(val)
+		}
+	case "INT":
+		intVal, ok := toInt(val)
+		if !ok {
+			return nil, f.mismatch(val)
+		}
+		val = intVal
+	case "FLOAT":
+		floatVal, ok := toFloat(val)
+		if !ok {
+			return nil, f.mismatch(val)
+		}
+		val = floatVal
+	case "BOOL":
+		if _, ok := val.(bool); !ok {
+			return nil, f.mismatch(val)
+		}
+	case "TIMESTAMP", "DATE", "DURATION", "UUID":
+		stringVal, ok := val.(string)
+		if !ok {
+			return nil, f.mismatch(val)
+		}
+		canonical, err := Canonical(f.Type, stringVal)
+		if err != nil {
+			return nil, err
+		}
+		val = canonical
+	case "DICT":
+		dictVal, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, f.mismatch(val)
+		}
+		if f.Fields != nil {
+			if err := checkFields(dictVal, f.Fields, false); err != nil {
+				return nil, err
+			}
+		}
+	case "LIST":
+		listVal, ok := val.([]interface{})
+		if !ok {
+			return nil, f.mismatch(val)
+		}
+		if f.Items != nil {
+			for idx, item := range listVal {
+				checked, err := f.Items.check(item)
+				if err != nil {
+					return nil, errors.New(fmt.Sprintf("element %v: %v", idx, err))
+				}
+				listVal[idx] = checked
+			}
+		}
+	}
+	if f.Enum != nil {
+		for _, enumVal := range f.Enum {
+			if equalValues(val, enumVal) {
+				return val, nil
+			}
+		}
+		return nil, errors.New(fmt.Sprintf("value '%v' is not one of %v", val, f.Enum))
+	}
+	return val, nil
+}
+
+// normalize converts the numbers in a stored value to the form check stores them in, leaving any
+// value which does not match the field as it is
+func (f Field) normalize(val interface{}) interface{} {
+	switch f.Type {
+	case "INT":
+		if intVal, ok := toInt(val); ok {
+			return intVal
+		}
+	case "FLOAT":
+		if floatVal, ok := toFloat(val); ok {
+			return floatVal
+		}
+	case "DICT":
+		if dictVal, ok := val.(map[string]interface{}); ok && f.Fields != nil {
+			normalizeFields(dictVal, f.Fields)
+		}
+	case "LIST":
+		if listVal, ok := val.([]interface{}); ok && f.Items != nil {
+			for idx, item := range listVal {
+				listVal[idx] = f.Items.normalize(item)
+			}
+		}
+	}
+	return val
+}
+
+func normalizeFields(datum map[string]interface{}, fields map[string]Field) {
+	for key, val := range datum {
+		if field, ok := fields[key]; ok {
+			datum[key] = field.normalize(val)
+		}
+	}
+}
+
+// toInt converts a decoded number to an int64, failing for numbers with a fractional part or
+// which do not fit in 64 bits
+func toInt(val interface{}) (int64, bool) {
+	switch typedVal := val.(type) {
+	case int64:
+		return typedVal, true
+	case int:
+		return int64(typedVal), true
+	case json.Number:
+		if intVal, err := typedVal.Int64(); err == nil {
+			return intVal, true
+		}
+		floatVal, err := typedVal.Float64()
+		if err != nil {
+			return 0, false
+		}
+		return toInt(floatVal)
+	case float64:
+		if typedVal == math.Trunc(typedVal) && typedVal >= math.MinInt64 && typedVal < math.MaxInt64 {
+			return int64(typedVal), true
+		}
+	}
+	return 0, false
+}
+
+// toFloat converts a decoded number to a float64
+func toFloat(val interface{}) (float64, bool) {
+	switch typedVal := val.(type) {
+	case float64:
+		return typedVal, true
+	case int64:
+		return float64(typedVal), true
+	case int:
+		return float64(typedVal), true
+	case json.Number:
+		floatVal, err := typedVal.Float64()
+		return floatVal, err == nil
+	}
+	return 0, false
+}
+
+// isNumber reports whether a value is a decoded number
+func isNumber(val interface{}) bool {
+	switch val.(type) {
+	case json.Number, float64, int64, int:
+		return true
+	}
+	return false
+}
+
+// equalValues compares two values, treating numbers as equal however they were decoded
+func equalValues(a, b interface{}) bool {
+	if isNumber(a) && isNumber(b) {
+		return utils.FormatValue(a) == utils.FormatValue(b)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// checkFields validates the keys of a record or DICT against the fields of its schema, filling in
+// defaults. Partial records, such as the data of a PATCH, are not checked for missing fields.
+func checkFields(datum map[string]interface{}, fields map[string]Field, partial bool) error {
+	keys := make([]string, 0, len(datum))
+	for key := range datum {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == ".id" {
+			continue
+		}
+		field, ok := fields[key]
+		if !ok {
+			return errors.New(fmt.Sprintf("Key does not exist in collection schema: %v", key))
+		}
+		checked, err := field.check(datum[key])
+		if err != nil {
+			return errors.New(fmt.Sprintf("key '%v': %v", key, err))
+		}
+		datum[key] = checked
+	}
+	if partial {
+		return nil
+	}
+	for key, field := range fields {
+		if _, ok := datum[key]; ok {
+			continue
+		}
+		if field.Default != nil {
+			datum[key], _ = field.check(copyValue(field.Default))
+		} else if field.Required {
+			return errors.New(fmt.Sprintf("key '%v': required field is missing", key))
+		}
+	}
+	return nil
+}
+
+// copyValue deep copies a default so that records never share nested maps or lists
+func copyValue(val interface{}) interface{} {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return val
+	}
+	var output interface{}
+	if err := utils.DecodeJSON(data, &output); err != nil {
+		return val
+	}
+	return output
+}
@@ -0,0 +1,141 @@
+// migrate.go
+
+package schema
+
+import (
+	"ceresdb/utils"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Convert casts a value stored under an earlier schema to the field's type. Values which cannot
+// be converted without losing information are reported as errors.
+func (f Field) Convert(val interface{}) (interface{}, error) {
+	if val == nil {
+		return nil, nil
+	}
+	switch f.Type {
+	case "ANY":
+		return val, nil
+	case "STRING":
+		if isNumber(val) {
+			return utils.FormatValue(val), nil
+		}
+		switch typedVal := val.(type) {
+		case string:
+			return typedVal, nil
+		case bool:
+			return strconv.FormatBool(typedVal), nil
+		}
+	case "INT":
+		if intVal, ok := toInt(val); ok {
+			return intVal, nil
+		}
+		if stringVal, ok := val.(string); ok {
+			if intVal, err := strconv.ParseInt(strings.TrimSpace(stringVal), 10, 64); err == nil {
+				return intVal, nil
+			}
+		}
+	case "FLOAT":
+		if floatVal, ok := toFloat(val); ok {
+			return floatVal, nil
+		}
+		if stringVal, ok := val.(string); ok {
+			if floatVal, err := strconv.ParseFloat(strings.TrimSpace(stringVal), 64); err == nil {
+				return floatVal, nil
+			}
+		}
+	case "BOOL":
+		switch typedVal := val.(type) {
+		case bool:
+			return typedVal, nil
+		case string:
+			switch strings.ToLower(strings.TrimSpace(typedVal)) {
+			case "true":
+				return true, nil
+			case "false":
+				return false, nil
+			}
+		}
+	case "TIMESTAMP", "DATE", "DURATION", "UUID":
+		if stringVal, ok := val.(string); ok {
+			if canonical, err := Canonical(f.Type, stringVal); err == nil {
+				return canonical, nil
+			}
+			// Dates become timestamps at midnight UTC
+			if f.Type == "TIMESTAMP" {
+				if t, err := ParseDate(stringVal); err == nil {
+					return t.Format(time.RFC3339Nano), nil
+				}
+			}
+		}
+	case "DICT":
+		if dictVal, ok := val.(map[string]interface{}); ok {
+			if f.Fields == nil {
+				return dictVal, nil
+			}
+			return convertFields(dictVal, f.Fields)
+		}
+	case "LIST":
+		if listVal, ok := val.([]interface{}); ok {
+			if f.Items == nil {
+				return listVal, nil
+			}
+			output := make([]interface{}, len(listVal))
+			for idx, item := range listVal {
+				converted, err := f.Items.Convert(item)
+				if err != nil {
+					return nil, errors.New(fmt.Sprintf("element %v: %v", idx, err))
+				}
+				output[idx] = converted
+			}
+			return output, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("value '%v' cannot be converted to schema type %v", val, f.TypeName()))
+}
+
+// convertFields converts the keys of a record or DICT to the fields of a schema, dropping keys
+// which the schema no longer has
+func convertFields(datum map[string]interface{}, fields map[string]Field) (map[string]interface{}, error) {
+	keys := make([]string, 0, len(datum))
+	for key := range datum {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	output := make(map[string]interface{}, len(datum))
+	for _, key := range keys {
+		if key == ".id" {
+			output[key] = datum[key]
+			continue
+		}
+		field, ok := fields[key]
+		if !ok {
+			continue
+		}
+		converted, err := field.Convert(datum[key])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("key '%v': %v", key, err))
+		}
+		output[key] = converted
+	}
+	return output, nil
+}
+
+// MigrateRecord converts a record stored under an earlier schema to the collection's schema,
+// dropping fields which have been removed and filling in defaults
+func (c SchemaCollection) MigrateRecord(datum map[string]interface{}) (map[string]interface{}, error) {
+	fields := c.AllFields()
+	output, err := convertFields(datum, fields)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFields(output, fields, false); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
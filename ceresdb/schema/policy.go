@@ -0,0 +1,86 @@
+// policy.go
+
+package schema
+
+import (
+	"ceresdb/config"
+	"ceresdb/utils"
+	"ceresdb/wal"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Policy limits the records of a collection a role or a user can access to those matching a
+// filter. The filter may compare fields with the user's own fields, written $user.<field>.
+type Policy struct {
+	Name   string `json:"name"`
+	Role   string `json:"role,omitempty"`
+	User   string `json:"user,omitempty"`
+	Filter string `json:"filter"`
+}
+
+// Policies holds the row-level policies of each collection by database and collection name. Like
+// Schema, changes are serialized by the queue package's catalog lock.
+var Policies map[string]map[string][]Policy
+
+// LoadPolicies reads the policies kept alongside the schema, an instance without any has no file
+func LoadPolicies() error {
+	Policies = make(map[string]map[string][]Policy)
+	path := filepath.Join(config.Config.HomeDir, "policies.json")
+	byteValue, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return utils.DecodeJSON(byteValue, &Policies)
+}
+
+func WritePolicies() error {
+	path := filepath.Join(config.Config.HomeDir, "policies.json")
+	contents, _ := json.MarshalIndent(Policies, "", "    ")
+	return wal.WriteFile(path, contents)
+}
+
+// GetPolicies returns the policies of a collection
+func GetPolicies(database, collection string) []Policy {
+	return Policies[database][collection]
+}
+
+// SetPolicies replaces the policies of a collection
+func SetPolicies(database, collection string, policies []Policy) error {
+	if len(policies) == 0 {
+		return DeletePolicies(database, collection)
+	}
+	if Policies == nil {
+		Policies = make(map[string]map[string][]Policy)
+	}
+	if Policies[database] == nil {
+		Policies[database] = make(map[string][]Policy)
+	}
+	Policies[database][collection] = policies
+	return WritePolicies()
+}
+
+// DeletePolicies removes the policies of a collection, or of every collection in a database when
+// collection is empty
+func DeletePolicies(database, collection string) error {
+	if _, ok := Policies[database]; !ok {
+		return nil
+	}
+	if collection == "" {
+		delete(Policies, database)
+	} else {
+		if _, ok := Policies[database][collection]; !ok {
+			return nil
+		}
+		delete(Policies[database], collection)
+		if len(Policies[database]) == 0 {
+			delete(Policies, database)
+		}
+	}
+	return WritePolicies()
+}
@@ -5,16 +5,24 @@ package schema
 import (
 	"ceresdb/config"
 	"ceresdb/utils"
+	"ceresdb/wal"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
 )
 
 type SchemaCollection struct {
+	// Types maps each field to its base type, e.g. "LIST" for a "LIST<INT>" field
 	Types map[string]string
+	// Unique holds the fields which no two records in the collection may share a value for
+	Unique map[string]bool
+	// Fields holds the full definition of fields which have more than a type, such as defaults
+	Fields map[string]Field
 }
 
 type SchemaDatabase struct {
@@ -27,6 +35,12 @@ type SchemaStruct struct {
 
 var Schema SchemaStruct
 
+// Lock guards Schema. A write which is discarded reloads it from disk while queries on other
+// collections may be reading it, and index builds read it while other collections are created,
+// so it is read through Get and GetCollection and changed through SetCollection and the
+// functions like it rather than directly.
+var Lock sync.RWMutex
+
 func LoadSchema() error {
 	path := filepath.Join(config.Config.HomeDir, "schema.json")
 
@@ -44,13 +58,13 @@ func LoadSchema() error {
 	var f interface{}
 
 	// Read the JSON
-	err = json.Unmarshal(byteValue, &f)
+	err = utils.DecodeJSON(byteValue, &f)
 	if err != nil {
 		return err
 	}
 
 	itemsMap := f.(map[string]interface{})
-	Schema.Databases = make(map[string]SchemaDatabase)
+	databases := make(map[string]SchemaDatabase)
 
 	// Loop through the top-level items (database names)
 	for dbKey, dbVal := range itemsMap {
@@ -60,20 +74,20 @@ func LoadSchema() error {
 
 		// Loop through the 2nd-level items (collection names)
 		for colKey, colVal := range dbItemsMap {
-			colItem := SchemaCollection{}
-			colItem.Types = make(map[string]string)
-			colItemsMap := colVal.(map[string]interface{})
-
-			// Loop through the 3rd-level items (types)
-			for typeKey, typeVal := range colItemsMap {
-				colItem.Types[typeKey] = typeVal.(string)
+			colItem, err := ParseCollection(colVal.(map[string]interface{}))
+			if err != nil {
+				return err
 			}
 
 			dbItem.Collections[colKey] = colItem
 		}
-		Schema.Databases[dbKey] = dbItem
+		databases[dbKey] = dbItem
 	}
 
+	Lock.Lock()
+	Schema.Databases = databases
+	Lock.Unlock()
+
 	return nil
 }
 
@@ -81,83 +95,187 @@ func WriteSchema() error {
 	path := filepath.Join(config.Config.HomeDir, "schema.json")
 
 	output := make(map[string]interface{})
+	Lock.RLock()
 	for dbKey, db := range Schema.Databases {
 		dbInterface := make(map[string]interface{})
 		for colKey, col := range db.Collections {
-			colInterface := make(map[string]string)
-			for typeKey, typeVal := range col.Types {
-
-				colInterface[typeKey] = typeVal
-			}
-			dbInterface[colKey] = colInterface
+			dbInterface[colKey] = col.Document()
 		}
 		output[dbKey] = dbInterface
 	}
+	Lock.RUnlock()
 
 	freeSpaceContents, _ := json.MarshalIndent(output, "", "    ")
-	_ = ioutil.WriteFile(path, freeSpaceContents, 0644)
-
-	return nil
+	return wal.WriteFile(path, freeSpaceContents)
 }
 
 func ValidateSchemaCollection(schemaCollection map[string]string) error {
-	validTypes := []string{"INT", "BOOL", "FLOAT", "STRING", "DICT", "LIST", "ANY"}
 	for _, val := range schemaCollection {
 		if !utils.Contains(validTypes, val) {
-			return errors.New(fmt.Sprintf("Invalid schema type: %v, valid types are 'INT', 'BOOL', 'FLOAT', 'STRING', 'DICT', 'LIST', or 'ANY'", val))
+			return invalidType(val)
 		}
 	}
 	return nil
 }
 
+// ParseCollection builds a collection's schema from a map of field names to definitions
+func ParseCollection(newSchema map[string]interface{}) (SchemaCollection, error) {
+	schemaCol := SchemaCollection{Types: make(map[string]string)}
+	for key, val := range newSchema {
+		field, err := ParseField(key, val)
+		if err != nil {
+			return schemaCol, err
+		}
+		schemaCol.Types[key] = field.Type
+		if field.Unique {
+			if schemaCol.Unique == nil {
+				schemaCol.Unique = make(map[string]bool)
+			}
+			schemaCol.Unique[key] = true
+		}
+		if !field.simple() || field.Required || field.Nullable || field.Items != nil {
+			if schemaCol.Fields == nil {
+				schemaCol.Fields = make(map[string]Field)
+			}
+			schemaCol.Fields[key] = field
+		}
+	}
+	if err := ValidateSchemaCollection(schemaCol.Types); err != nil {
+		return schemaCol, err
+	}
+	return schemaCol, nil
+}
+
+// Field returns the full definition of a field in the collection
+func (c SchemaCollection) Field(key string) (Field, bool) {
+	if field, ok := c.Fields[key]; ok {
+		return field, true
+	}
+	fieldType, ok := c.Types[key]
+	return Field{Type: fieldType, Unique: c.Unique[key]}, ok
+}
+
+// AllFields returns the full definition of every field in the collection
+func (c SchemaCollection) AllFields() map[string]Field {
+	output := make(map[string]Field, len(c.Types))
+	for key := range c.Types {
+		output[key], _ = c.Field(key)
+	}
+	return output
+}
+
+// Document returns a collection's schema in the form it is written in schema.json. Collections
+// whose fields are all written as type strings keep their original map[string]string form.
+func (c SchemaCollection) Document() interface{} {
+	output := make(map[string]interface{})
+	stringOutput := make(map[string]string)
+	for key, field := range c.AllFields() {
+		output[key] = field.Document()
+		if stringVal, ok := output[key].(string); ok {
+			stringOutput[key] = stringVal
+		}
+	}
+	if len(stringOutput) == len(output) {
+		return stringOutput
+	}
+	return output
+}
+
+// UniqueFields returns the fields of a collection which must be unique in sorted order
+func (c SchemaCollection) UniqueFields() []string {
+	output := make([]string, 0, len(c.Unique))
+	for key, unique := range c.Unique {
+		if unique {
+			output = append(output, key)
+		}
+	}
+	sort.Strings(output)
+	return output
+}
+
 func Get(database, collection string) map[string]string {
-	return Schema.Databases[database].Collections[collection].Types
+	col, _ := GetCollection(database, collection)
+	return col.Types
+}
+
+// GetCollection returns the schema of a collection and whether it exists
+func GetCollection(database, collection string) (SchemaCollection, bool) {
+	Lock.RLock()
+	defer Lock.RUnlock()
+	col, ok := Schema.Databases[database].Collections[collection]
+	return col, ok
+}
+
+// DatabaseExists reports whether a database is in the schema
+func DatabaseExists(database string) bool {
+	Lock.RLock()
+	defer Lock.RUnlock()
+	_, ok := Schema.Databases[database]
+	return ok
+}
+
+// PostDatabase adds an empty database to the schema
+func PostDatabase(database string) {
+	Lock.Lock()
+	defer Lock.Unlock()
+	Schema.Databases[database] = SchemaDatabase{}
+}
+
+// DeleteDatabase removes a database and its collections from the schema
+func DeleteDatabase(database string) {
+	Lock.Lock()
+	defer Lock.Unlock()
+	delete(Schema.Databases, database)
+}
+
+// SetCollection adds the schema of a collection or replaces its existing one
+func SetCollection(database, collection string, col SchemaCollection) {
+	Lock.Lock()
+	defer Lock.Unlock()
+	schemaDB := Schema.Databases[database]
+	if schemaDB.Collections == nil {
+		schemaDB.Collections = make(map[string]SchemaCollection)
+	}
+	schemaDB.Collections[collection] = col
+	Schema.Databases[database] = schemaDB
+}
+
+// DeleteCollection removes the schema of a collection
+func DeleteCollection(database, collection string) {
+	Lock.Lock()
+	defer Lock.Unlock()
+	delete(Schema.Databases[database].Collections, collection)
 }
 
+// ValidateDataAgainstSchema checks records which are written in full against the collection's
+// schema, filling in the defaults of any fields they leave out
 func ValidateDataAgainstSchema(database, collection string, data []map[string]interface{}) error {
-	schemaCollection := Schema.Databases[database].Collections[collection]
+	col, _ := GetCollection(database, collection)
+	fields := col.AllFields()
 	for idx, datum := range data {
-		for key, val := range datum {
-			if key == ".id" {
-				continue
-			}
-			if _, ok := schemaCollection.Types[key]; !ok {
-				return errors.New(fmt.Sprintf("Key does not exist in collection schema: %v", key))
-			}
-
-			switch schemaCollection.Types[key] {
-			case "STRING":
-				if _, ok := val.(string); !ok {
-					return errors.New(fmt.Sprintf("Value '%v' at key '%v' in record %v does not conform to schema type %v", val, key, idx, schemaCollection.Types[key]))
-				}
-			case "INT":
-				// To us it's an int value
-				// But under the hood golang is converting it to a float64 when coming from a JSON
-				// string
-				// It won't be an issue since the data gets stored as text anyway
-				if _, ok := val.(float64); !ok {
-					if _, ok := val.(int); !ok {
-						return errors.New(fmt.Sprintf("Value '%v' at key '%v' in record %v does not conform to schema type %v", val, key, idx, schemaCollection.Types[key]))
-					}
-				}
-			case "FLOAT":
-				if _, ok := val.(float64); !ok {
-					return errors.New(fmt.Sprintf("Value '%v' at key '%v' in record %v does not conform to schema type %v", val, key, idx, schemaCollection.Types[key]))
-				}
-			case "BOOL":
-				if _, ok := val.(bool); !ok {
-					return errors.New(fmt.Sprintf("Value '%v' at key '%v' in record %v does not conform to schema type %v", val, key, idx, schemaCollection.Types[key]))
-				}
-			case "DICT":
-				if _, ok := val.(map[string]interface{}); !ok {
-					return errors.New(fmt.Sprintf("Value '%v' at key '%v' in record %v does not conform to schema type %v", val, key, idx, schemaCollection.Types[key]))
-				}
-			case "LIST":
-				if _, ok := val.([]interface{}); !ok {
-					return errors.New(fmt.Sprintf("Value '%v' at key '%v' in record %v does not conform to schema type %v", val, key, idx, schemaCollection.Types[key]))
-				}
-			}
+		if err := checkFields(datum, fields, false); err != nil {
+			return errors.New(fmt.Sprintf("Record %v does not conform to the collection schema, %v", idx, err))
 		}
 	}
 	return nil
 }
+
+// ValidatePatchAgainstSchema checks the fields set by a PATCH against the collection's schema
+func ValidatePatchAgainstSchema(database, collection string, data map[string]interface{}) error {
+	col, _ := GetCollection(database, collection)
+	fields := col.AllFields()
+	if err := checkFields(data, fields, true); err != nil {
+		return errors.New(fmt.Sprintf("Patch does not conform to the collection schema, %v", err))
+	}
+	return nil
+}
+
+// NormalizeData converts the numbers in records read from storage to the types of their fields,
+// so that INT fields are read as exact 64-bit integers
+func NormalizeData(database, collection string, data []map[string]interface{}) {
+	col, _ := GetCollection(database, collection)
+	fields := col.AllFields()
+	for _, datum := range data {
+		normalizeFields(datum, fields)
+	}
+}
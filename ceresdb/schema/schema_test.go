@@ -48,6 +48,48 @@ func TestLoadSchema(t *testing.T) {
 	}
 }
 
+func TestSetCollection(t *testing.T) {
+	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb-schema/config/config.json")
+	config.ReadConfigFile()
+	LoadSchema()
+
+	PostDatabase("foobar")
+	if !DatabaseExists("foobar") {
+		t.Errorf("Database was incorrect, got: %v, want: %v", false, true)
+	}
+	SetCollection("foobar", "baz", SchemaCollection{Types: map[string]string{"a": "INT"}})
+	if types := Get("foobar", "baz"); !reflect.DeepEqual(types, map[string]string{"a": "INT"}) {
+		t.Errorf("Types were incorrect, got: %v, want: %v", types, map[string]string{"a": "INT"})
+	}
+
+	// Reloading the schema while it is read must not race
+	done := make(chan bool)
+	go func() {
+		for idx := 0; idx < 100; idx++ {
+			LoadSchema()
+		}
+		done <- true
+	}()
+	for idx := 0; idx < 100; idx++ {
+		GetCollection("db1", "foo")
+		NormalizeData("db1", "foo", []map[string]interface{}{{"foo": "bar"}})
+	}
+	<-done
+
+	if _, ok := GetCollection("foobar", "baz"); ok {
+		t.Errorf("Collection was incorrect, got: %v, want: %v", ok, false)
+	}
+	SetCollection("foobar", "baz", SchemaCollection{Types: map[string]string{"a": "INT"}})
+	DeleteCollection("foobar", "baz")
+	if _, ok := GetCollection("foobar", "baz"); ok {
+		t.Errorf("Collection was incorrect, got: %v, want: %v", ok, false)
+	}
+	DeleteDatabase("foobar")
+	if DatabaseExists("foobar") {
+		t.Errorf("Database was incorrect, got: %v, want: %v", true, false)
+	}
+}
+
 func TestSchemaNoFile(t *testing.T) {
 	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb-schema/config/config.json")
 	config.ReadConfigFile()
@@ -108,6 +150,48 @@ func TestValidateSchemaCollection(t *testing.T) {
 	}
 }
 
+func TestParseCollection(t *testing.T) {
+	newSchema := map[string]interface{}{"a": "STRING UNIQUE", "b": "INT"}
+	expectedCollection := SchemaCollection{Types: map[string]string{"a": "STRING", "b": "INT"}, Unique: map[string]bool{"a": true}}
+	schemaCol, err := ParseCollection(newSchema)
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if !reflect.DeepEqual(schemaCol, expectedCollection) {
+		t.Errorf("Collection was incorrect, got: %v, want: %v", schemaCol, expectedCollection)
+	}
+	expectedDocument := map[string]string{"a": "STRING UNIQUE", "b": "INT"}
+	if !reflect.DeepEqual(schemaCol.Document(), expectedDocument) {
+		t.Errorf("Document was incorrect, got: %v, want: %v", schemaCol.Document(), expectedDocument)
+	}
+
+	for _, val := range []interface{}{"STRING PRIMARY", "DICT UNIQUE", "FOOBAR", 1} {
+		if _, err := ParseCollection(map[string]interface{}{"a": val}); err == nil {
+			t.Errorf("Error for %v was incorrect, got: %v, want: %v", val, err, "<non-nil>")
+		}
+	}
+}
+
+func TestAnyNullable(t *testing.T) {
+	Schema.Databases["foobar"] = SchemaDatabase{Collections: map[string]SchemaCollection{"baz": {Types: map[string]string{"a": "ANY", "b": "STRING"}}}}
+
+	inputData := []map[string]interface{}{{".id": "abc", "a": nil, "b": "foo"}}
+	if err := ValidateDataAgainstSchema("foobar", "baz", inputData); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if err := ValidatePatchAgainstSchema("foobar", "baz", map[string]interface{}{"a": nil}); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if err := ValidatePatchAgainstSchema("foobar", "baz", map[string]interface{}{"b": nil}); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+
+	newCol, _ := ParseCollection(map[string]interface{}{"a": "ANY", "b": "STRING"})
+	if _, err := newCol.MigrateRecord(map[string]interface{}{".id": "abc", "a": nil, "b": "foo"}); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+}
+
 func TestValidateDataAgainstSchema(t *testing.T) {
 	Schema.Databases["foobar"] = SchemaDatabase{Collections: map[string]SchemaCollection{"baz": {Types: map[string]string{"a": "INT", "b": "BOOL", "c": "FLOAT", "d": "STRING", "e": "DICT", "f": "LIST"}}}}
 
@@ -159,3 +243,209 @@ func TestValidateDataAgainstSchema(t *testing.T) {
 		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
 	}
 }
+
+func TestParseField(t *testing.T) {
+	field, err := ParseField("a", "LIST<INT> REQUIRED")
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	expectedField := Field{Type: "LIST", Required: true, Items: &Field{Type: "INT"}}
+	if !reflect.DeepEqual(field, expectedField) {
+		t.Errorf("Field was incorrect, got: %v, want: %v", field, expectedField)
+	}
+	if field.Document() != "LIST<INT> REQUIRED" {
+		t.Errorf("Document was incorrect, got: %v, want: %v", field.Document(), "LIST<INT> REQUIRED")
+	}
+
+	fieldMap := map[string]interface{}{
+		"type":    "DICT",
+		"default": map[string]interface{}{"city": "Paris"},
+		"fields": map[string]interface{}{
+			"city":    map[string]interface{}{"type": "STRING", "enum": []interface{}{"Paris", "Rome"}},
+			"zip":     "STRING NULLABLE",
+			"tags":    map[string]interface{}{"type": "LIST", "items": "STRING"},
+			"visited": "BOOL",
+		},
+	}
+	field, err = ParseField("address", fieldMap)
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if field.Fields["city"].Enum == nil || !field.Fields["zip"].Nullable || field.Fields["tags"].Items.Type != "STRING" {
+		t.Errorf("Field was incorrect, got: %v", field)
+	}
+
+	invalid := []interface{}{
+		"LIST<FOOBAR>",
+		"INT OPTIONAL",
+		map[string]interface{}{"type": "INT", "foo": true},
+		map[string]interface{}{"required": true},
+		map[string]interface{}{"type": "INT", "default": "foo"},
+		map[string]interface{}{"type": "STRING", "enum": []interface{}{1.0}},
+		map[string]interface{}{"type": "STRING", "enum": []interface{}{"a"}, "default": "b"},
+		map[string]interface{}{"type": "STRING", "fields": map[string]interface{}{}},
+		map[string]interface{}{"type": "DICT", "fields": map[string]interface{}{"b": "STRING UNIQUE"}},
+		map[string]interface{}{"type": "LIST<INT>", "items": "STRING"},
+	}
+	for _, val := range invalid {
+		if _, err := ParseField("a", val); err == nil {
+			t.Errorf("Error for %v was incorrect, got: %v, want: %v", val, err, "<non-nil>")
+		}
+	}
+}
+
+func TestValidateRichSchema(t *testing.T) {
+	schemaCol, err := ParseCollection(map[string]interface{}{
+		"name":    "STRING REQUIRED",
+		"age":     "INT NULLABLE",
+		"scores":  "LIST<INT>",
+		"status":  map[string]interface{}{"type": "STRING", "enum": []interface{}{"active", "inactive"}, "default": "active"},
+		"address": map[string]interface{}{"type": "DICT", "fields": map[string]interface{}{"city": "STRING REQUIRED", "zip": "STRING"}},
+	})
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	Schema.Databases["foobar"] = SchemaDatabase{Collections: map[string]SchemaCollection{"rich": schemaCol}}
+
+	inputData := []map[string]interface{}{{"name": "foo", "age": nil, "scores": []interface{}{1.0, 2.0}, "address": map[string]interface{}{"city": "Paris"}}}
+	err = ValidateDataAgainstSchema("foobar", "rich", inputData)
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if inputData[0]["status"] != "active" {
+		t.Errorf("Default was incorrect, got: %v, want: %v", inputData[0]["status"], "active")
+	}
+
+	invalid := []map[string]interface{}{
+		{"age": 1.0},
+		{"name": nil},
+		{"name": "foo", "scores": []interface{}{"a"}},
+		{"name": "foo", "status": "deleted"},
+		{"name": "foo", "address": map[string]interface{}{"zip": "75001"}},
+		{"name": "foo", "address": map[string]interface{}{"city": "Paris", "country": "France"}},
+	}
+	for _, datum := range invalid {
+		if err := ValidateDataAgainstSchema("foobar", "rich", []map[string]interface{}{datum}); err == nil {
+			t.Errorf("Error for %v was incorrect, got: %v, want: %v", datum, err, "<non-nil>")
+		}
+	}
+
+	err = ValidatePatchAgainstSchema("foobar", "rich", map[string]interface{}{"age": 2.0})
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	err = ValidatePatchAgainstSchema("foobar", "rich", map[string]interface{}{"name": nil})
+	if err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+}
+
+func TestMigrateRecord(t *testing.T) {
+	schemaCol, _ := ParseCollection(map[string]interface{}{
+		"a": "STRING",
+		"b": "INT",
+		"c": "FLOAT",
+		"d": "BOOL",
+		"e": "LIST<INT>",
+		"f": map[string]interface{}{"type": "STRING", "default": "foo"},
+	})
+
+	datum := map[string]interface{}{".id": "abc", "a": 1.5, "b": "2", "c": 3, "d": "true", "e": []interface{}{"1", 2.0}, "g": "removed"}
+	expected := map[string]interface{}{".id": "abc", "a": "1.5", "b": int64(2), "c": 3.0, "d": true, "e": []interface{}{int64(1), int64(2)}, "f": "foo"}
+	migrated, err := schemaCol.MigrateRecord(datum)
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	if !reflect.DeepEqual(migrated, expected) {
+		t.Errorf("Record was incorrect, got: %v, want: %v", migrated, expected)
+	}
+
+	for _, datum := range []map[string]interface{}{{"b": 1.5}, {"b": "foo"}, {"d": 1.0}, {"e": []interface{}{"foo"}}, {"c": true}} {
+		if _, err := schemaCol.MigrateRecord(datum); err == nil {
+			t.Errorf("Error for %v was incorrect, got: %v, want: %v", datum, err, "<non-nil>")
+		}
+	}
+}
+
+func TestValidateIntPrecision(t *testing.T) {
+	Schema.Databases["foobar"] = SchemaDatabase{Collections: map[string]SchemaCollection{"ints": {Types: map[string]string{"a": "INT", "b": "FLOAT"}}}}
+
+	inputData := []map[string]interface{}{{"a": json.Number("9007199254740993"), "b": json.Number("2")}, {"a": json.Number("3.0"), "b": 1.5}}
+	err := ValidateDataAgainstSchema("foobar", "ints", inputData)
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	expectedData := []map[string]interface{}{{"a": int64(9007199254740993), "b": 2.0}, {"a": int64(3), "b": 1.5}}
+	if !reflect.DeepEqual(inputData, expectedData) {
+		t.Errorf("Data was incorrect, got: %v, want: %v", inputData, expectedData)
+	}
+
+	for _, val := range []interface{}{json.Number("1.5"), json.Number("1e30"), 1.5} {
+		if err := ValidateDataAgainstSchema("foobar", "ints", []map[string]interface{}{{"a": val}}); err == nil {
+			t.Errorf("Error for %v was incorrect, got: %v, want: %v", val, err, "<non-nil>")
+		}
+	}
+
+	readData := []map[string]interface{}{{"a": json.Number("9007199254740993"), "b": json.Number("2")}}
+	NormalizeData("foobar", "ints", readData)
+	if !reflect.DeepEqual(readData, []map[string]interface{}{{"a": int64(9007199254740993), "b": 2.0}}) {
+		t.Errorf("Data was incorrect, got: %v, want: %v", readData, expectedData[0])
+	}
+}
+
+func TestValidateTemporalTypes(t *testing.T) {
+	Schema.Databases["foobar"] = SchemaDatabase{Collections: map[string]SchemaCollection{"times": {Types: map[string]string{"a": "TIMESTAMP", "b": "DATE", "c": "DURATION", "d": "UUID"}}}}
+
+	inputData := []map[string]interface{}{{"a": "2026-01-01T02:30:00.500+02:00", "b": "2026-01-31", "c": "90m", "d": "{7A3F1E0C-9B2D-4C5E-8F61-2D3C4B5A6978}"}}
+	err := ValidateDataAgainstSchema("foobar", "times", inputData)
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	expectedData := []map[string]interface{}{{"a": "2026-01-01T00:30:00.5Z", "b": "2026-01-31", "c": "1h30m0s", "d": "7a3f1e0c-9b2d-4c5e-8f61-2d3c4b5a6978"}}
+	if !reflect.DeepEqual(inputData, expectedData) {
+		t.Errorf("Data was incorrect, got: %v, want: %v", inputData, expectedData)
+	}
+
+	for _, datum := range []map[string]interface{}{{"a": "2026-01-01"}, {"a": 1.0}, {"b": "2026-02-30"}, {"c": "ten minutes"}, {"d": "not-a-uuid"}} {
+		if err := ValidateDataAgainstSchema("foobar", "times", []map[string]interface{}{datum}); err == nil {
+			t.Errorf("Error for %v was incorrect, got: %v, want: %v", datum, err, "<non-nil>")
+		}
+	}
+
+	schemaCol, _ := ParseCollection(map[string]interface{}{"a": "TIMESTAMP"})
+	migrated, err := schemaCol.MigrateRecord(map[string]interface{}{"a": "2026-01-01"})
+	if err != nil || migrated["a"] != "2026-01-01T00:00:00Z" {
+		t.Errorf("Record was incorrect, got: %v, want: %v", migrated, "2026-01-01T00:00:00Z")
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb-schema/config/config.json")
+	config.ReadConfigFile()
+	config.Config.HomeDir = t.TempDir()
+
+	if err := LoadPolicies(); err != nil || len(Policies) != 0 {
+		t.Errorf("Policies were incorrect, got: %v, %v, want: %v", Policies, err, "none")
+	}
+
+	policies := []Policy{{Name: "tenant", Role: "READ", Filter: "tenant = $user.tenant"}}
+	if err := SetPolicies("foo", "bar", policies); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	SetPolicies("foo", "baz", policies)
+	if err := LoadPolicies(); err != nil || !reflect.DeepEqual(GetPolicies("foo", "bar"), policies) {
+		t.Errorf("Policies were incorrect, got: %v, %v, want: %v", GetPolicies("foo", "bar"), err, policies)
+	}
+
+	DeletePolicies("foo", "bar")
+	LoadPolicies()
+	if GetPolicies("foo", "bar") != nil || !reflect.DeepEqual(GetPolicies("foo", "baz"), policies) {
+		t.Errorf("Policies were incorrect, got: %v, want: %v", Policies, "only foo.baz")
+	}
+
+	DeletePolicies("foo", "")
+	LoadPolicies()
+	if len(Policies) != 0 {
+		t.Errorf("Policies were incorrect, got: %v, want: %v", Policies, "none")
+	}
+}
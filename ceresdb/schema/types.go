@@ -0,0 +1,79 @@
+// types.go
+
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DATE_LAYOUT is the canonical form of DATE values
+const DATE_LAYOUT = "2006-01-02"
+
+// TypedStringTypes are the types whose values are stored as strings in a canonical form, but which
+// are ordered by the value they represent rather than as strings. TIMESTAMP, DATE and DURATION
+// values are ordered by time and UUID values by their canonical form.
+var TypedStringTypes = []string{"TIMESTAMP", "DATE", "DURATION", "UUID"}
+
+// ParseTimestamp parses an RFC 3339 timestamp such as "2026-01-01T00:00:00Z"
+func ParseTimestamp(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(value))
+	if err != nil {
+		return t, errors.New(fmt.Sprintf("Invalid TIMESTAMP value: %v, timestamps must be in RFC 3339 format, e.g. 2026-01-01T00:00:00Z", value))
+	}
+	return t, nil
+}
+
+// ParseDate parses a date such as "2026-01-01"
+func ParseDate(value string) (time.Time, error) {
+	t, err := time.Parse(DATE_LAYOUT, strings.TrimSpace(value))
+	if err != nil {
+		return t, errors.New(fmt.Sprintf("Invalid DATE value: %v, dates must be in the format YYYY-MM-DD", value))
+	}
+	return t, nil
+}
+
+// ParseDuration parses a duration such as "1h30m"
+func ParseDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil {
+		return d, errors.New(fmt.Sprintf("Invalid DURATION value: %v, durations must be a number with a unit, e.g. 1h30m or 250ms", value))
+	}
+	return d, nil
+}
+
+// Canonical returns the form a TIMESTAMP, DATE, DURATION, or UUID value is stored in. Timestamps
+// are stored in UTC, durations as Go duration strings, and UUIDs in lowercase.
+func Canonical(fieldType, value string) (string, error) {
+	switch fieldType {
+	case "TIMESTAMP":
+		t, err := ParseTimestamp(value)
+		if err != nil {
+			return "", err
+		}
+		return t.UTC().Format(time.RFC3339Nano), nil
+	case "DATE":
+		t, err := ParseDate(value)
+		if err != nil {
+			return "", err
+		}
+		return t.Format(DATE_LAYOUT), nil
+	case "DURATION":
+		d, err := ParseDuration(value)
+		if err != nil {
+			return "", err
+		}
+		return d.String(), nil
+	case "UUID":
+		u, err := uuid.Parse(strings.TrimSpace(value))
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Invalid UUID value: %v", value))
+		}
+		return u.String(), nil
+	}
+	return value, nil
+}
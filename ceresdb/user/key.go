@@ -0,0 +1,52 @@
+// key.go
+
+package user
+
+import (
+	"ceresdb/record"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// KEY_PREFIX starts every API key so they can be told apart from session tokens
+const KEY_PREFIX = "ceres_"
+
+// KeySchema is the schema of the collection API keys are stored in. Only a hash of each key is
+// kept, the key itself is shown once when it is created.
+var KeySchema = map[string]interface{}{"name": "STRING", "username": "STRING", "hash": "STRING UNIQUE", "created": "TIMESTAMP"}
+
+// GenerateKey returns a new random API key
+func GenerateKey() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return KEY_PREFIX + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// IsKey reports whether a bearer token is an API key rather than a session token
+func IsKey(token string) bool {
+	return strings.HasPrefix(token, KEY_PREFIX)
+}
+
+// HashKey returns the hash an API key is stored and looked up by. Keys are long and random so,
+// unlike passwords, they do not need a slow hash.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func DeleteKeys(ids []string) error {
+	return record.Delete("_auth", "_keys", ids)
+}
+
+func GetKeys(ids []string) ([]map[string]interface{}, error) {
+	return record.Get("_auth", "_keys", ids)
+}
+
+func PostKeys(data []map[string]interface{}) error {
+	return record.Post("_auth", "_keys", data)
+}
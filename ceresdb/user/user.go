@@ -5,6 +5,10 @@ import (
 	"errors"
 )
 
+// Schema is the schema of the collection users are stored in. Attributes holds any other fields
+// of a user, which collection policies can compare records with.
+var Schema = map[string]interface{}{"username": "STRING UNIQUE", "password": "STRING", "role": "STRING", "attributes": "DICT"}
+
 func Delete(ids []string) error {
 	err := record.Delete("_auth", "_users", ids)
 	return err
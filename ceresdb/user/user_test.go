@@ -158,3 +158,20 @@ func TestPatch(t *testing.T) {
 		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
 	}
 }
+
+func TestGenerateKey(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	other, _ := GenerateKey()
+	if !IsKey(key) || key == other {
+		t.Errorf("Keys were incorrect, got: %v, %v, want: %v", key, other, "distinct keys starting with "+KEY_PREFIX)
+	}
+	if IsKey("eyJhbGciOiJIUzI1NiJ9.e30.sig") {
+		t.Errorf("IsKey was incorrect, got: %v, want: %v", true, false)
+	}
+	if HashKey(key) != HashKey(key) || HashKey(key) == HashKey(other) || len(HashKey(key)) != 64 {
+		t.Errorf("Hash was incorrect, got: %v, want: %v", HashKey(key), "a 64 character digest unique to the key")
+	}
+}
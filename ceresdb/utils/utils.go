@@ -4,7 +4,12 @@ package utils
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
 	"sort"
+	"strconv"
 )
 
 func BuildRangeBlocks(indices []int) [][]int {
@@ -107,3 +112,36 @@ func RemoveDuplicateValues(stringSlice []string) []string {
 	}
 	return list
 }
+
+// DecodeJSON unmarshals JSON with numbers decoded as json.Number so that integers keep their
+// exact value instead of being converted to float64
+func DecodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// FormatValue formats a value as a string, writing numbers in a single canonical form so that
+// equal numbers format the same however they were decoded, e.g. 3, 3.0, and int64(3) are all "3"
+func FormatValue(val interface{}) string {
+	switch typedVal := val.(type) {
+	case json.Number:
+		if intVal, err := typedVal.Int64(); err == nil {
+			return strconv.FormatInt(intVal, 10)
+		}
+		if floatVal, err := typedVal.Float64(); err == nil {
+			return FormatValue(floatVal)
+		}
+		return typedVal.String()
+	case float64:
+		if typedVal == math.Trunc(typedVal) && math.Abs(typedVal) < 1<<63 {
+			return strconv.FormatInt(int64(typedVal), 10)
+		}
+		return strconv.FormatFloat(typedVal, 'g', -1, 64)
+	case int:
+		return strconv.Itoa(typedVal)
+	case int64:
+		return strconv.FormatInt(typedVal, 10)
+	}
+	return fmt.Sprintf("%v", val)
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"bufio"
+	"encoding/json"
 	"os"
 	"reflect"
 	"testing"
@@ -69,3 +70,25 @@ func TestContains(t *testing.T) {
 		t.Errorf("Contained was incorrect, got: %v, want: %v", containedF, false)
 	}
 }
+
+func TestDecodeJSON(t *testing.T) {
+	var data map[string]interface{}
+	err := DecodeJSON([]byte(`{"a": 9007199254740993, "b": 1.5}`), &data)
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	expected := map[string]interface{}{"a": json.Number("9007199254740993"), "b": json.Number("1.5")}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("Data was incorrect, got: %v, want: %v", data, expected)
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	inputs := []interface{}{json.Number("3"), json.Number("3.0"), 3.0, 3, int64(3), json.Number("9007199254740993"), 1000000.0, 1.5, json.Number("1.50"), "3.0", true}
+	expected := []string{"3", "3", "3", "3", "3", "9007199254740993", "1000000", "1.5", "1.5", "3.0", "true"}
+	for idx, input := range inputs {
+		if output := FormatValue(input); output != expected[idx] {
+			t.Errorf("Value for %v was incorrect, got: %v, want: %v", input, output, expected[idx])
+		}
+	}
+}
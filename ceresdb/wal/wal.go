@@ -0,0 +1,742 @@
+// wal.go
+
+// Package wal implements the write-ahead log that keeps data files, indices, free space and
+// schema consistent with each other. Every mutation stages its file changes in memory, the
+// complete set of changes is appended to the log and fsynced, and only then are the changes
+// applied to the files themselves. Entries left in the log after a crash are replayed on startup,
+// and an entry which could not be applied is replayed before another batch is begun.
+//
+// There is a single open batch per process. The queue package only lets one query write at a
+// time, so concurrent readers never see another query's staged writes for the collections they
+// have locked.
+package wal
+
+import (
+	"bytes"
+	"ceresdb/config"
+	"ceresdb/logging"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	OpWrite     = "write"
+	OpAppend    = "append"
+	OpRemove    = "remove"
+	OpRemoveAll = "remove_all"
+	OpMkdir     = "mkdir"
+)
+
+const LOG_FILE_NAME = "wal.log"
+
+type Operation struct {
+	Type   string `json:"type"`
+	Path   string `json:"path"`
+	Offset int64  `json:"offset,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+}
+
+type Entry struct {
+	ID         uint64      `json:"id"`
+	Checksum   uint32      `json:"checksum"`
+	Operations []Operation `json:"operations"`
+}
+
+// stagedFile is the pending state of a single file within the current batch
+type stagedFile struct {
+	seq      int
+	removed  bool
+	replaced bool
+	contents []byte
+	offset   int64
+	appended []byte
+}
+
+type batch struct {
+	depth   int
+	seq     int
+	files   map[string]*stagedFile
+	dirs    map[string]int
+	removed map[string]int
+}
+
+var mutex sync.RWMutex
+var current *batch
+var nextID uint64
+var abortHooks []func()
+
+// applyMutex serializes logging and applying entries. failed is the id of an entry which was
+// logged but could not be applied, no other batch is committed until it has been replayed.
+var applyMutex sync.Mutex
+var failed uint64
+
+func logPath() string {
+	return filepath.Join(config.Config.HomeDir, LOG_FILE_NAME)
+}
+
+func newBatch() *batch {
+	return &batch{files: make(map[string]*stagedFile), dirs: make(map[string]int), removed: make(map[string]int)}
+}
+
+// OnAbort registers a function to be called after a batch has been discarded so that in-memory
+// state derived from the discarded writes can be reloaded from disk
+func OnAbort(hook func()) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	abortHooks = append(abortHooks, hook)
+}
+
+// Begin opens a batch. Batches nest, only the outermost Commit writes to the log.
+func Begin() {
+	replayFailed()
+	mutex.Lock()
+	defer mutex.Unlock()
+	if current == nil {
+		current = newBatch()
+	}
+	current.depth++
+}
+
+// Active reports whether a batch is currently open
+func Active() bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return current != nil
+}
+
+// Commit closes the innermost batch. When the outermost batch is closed its operations are
+// logged, fsynced, and applied.
+func Commit() error {
+	mutex.Lock()
+	if current == nil {
+		mutex.Unlock()
+		return errors.New("no write-ahead log batch is open")
+	}
+	current.depth--
+	if current.depth > 0 {
+		mutex.Unlock()
+		return nil
+	}
+	b := current
+	current = nil
+	operations := b.operations()
+	if len(operations) == 0 {
+		mutex.Unlock()
+		return nil
+	}
+	nextID++
+	entry := Entry{ID: nextID, Operations: operations}
+	mutex.Unlock()
+
+	applyMutex.Lock()
+	defer applyMutex.Unlock()
+	if failed != 0 {
+		runAbortHooks()
+		return errors.New(fmt.Sprintf("Unable to commit, write-ahead log entry %d has not been applied yet", failed))
+	}
+	if err := appendEntry(entry); err != nil {
+		runAbortHooks()
+		return err
+	}
+	if err := applyOperations(operations); err != nil {
+		// Every operation is idempotent so a failed entry can be retried as a whole
+		if err = applyOperations(operations); err != nil {
+			logging.ERROR(fmt.Sprintf("Unable to apply write-ahead log entry %d, it will be replayed before the next write: %v", entry.ID, err))
+			failed = entry.ID
+			runAbortHooks()
+			return err
+		}
+	}
+	return truncateLog()
+}
+
+// replayFailed replays an entry which could not be applied when it was committed. It only runs
+// while no batch is open so that the next batch is staged against the files the entry describes.
+func replayFailed() {
+	applyMutex.Lock()
+	defer applyMutex.Unlock()
+	if failed == 0 || Active() {
+		return
+	}
+	if err := replayLog(); err != nil {
+		logging.ERROR(fmt.Sprintf("Unable to replay write-ahead log entry %d: %v", failed, err))
+		return
+	}
+	if err := truncateLog(); err != nil {
+		logging.ERROR(fmt.Sprintf("Unable to truncate write-ahead log: %v", err))
+		return
+	}
+	logging.INFO(fmt.Sprintf("Replayed write-ahead log entry %d", failed))
+	failed = 0
+	runAbortHooks()
+}
+
+// Abort discards the open batch, including any enclosing batches
+func Abort() {
+	mutex.Lock()
+	wasActive := current != nil
+	current = nil
+	mutex.Unlock()
+	if wasActive {
+		runAbortHooks()
+	}
+}
+
+func runAbortHooks() {
+	mutex.RLock()
+	hooks := append([]func(){}, abortHooks...)
+	mutex.RUnlock()
+	for _, hook := range hooks {
+		hook()
+	}
+}
+
+// Recover replays any entries left in the log by a previous run. Entries that were not
+// completely written are ignored since none of their operations were applied.
+func Recover() error {
+	if err := replayLog(); err != nil {
+		return err
+	}
+	return truncateLog()
+}
+
+// replayLog applies every complete entry in the log
+func replayLog() error {
+	data, err := os.ReadFile(logPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			logging.WARN("Ignoring incomplete write-ahead log entry")
+			continue
+		}
+		if checksum(entry.Operations) != entry.Checksum {
+			logging.WARN(fmt.Sprintf("Ignoring corrupt write-ahead log entry %d", entry.ID))
+			continue
+		}
+		logging.INFO(fmt.Sprintf("Replaying write-ahead log entry %d", entry.ID))
+		if err := applyOperations(entry.Operations); err != nil {
+			return err
+		}
+		mutex.Lock()
+		if entry.ID > nextID {
+			nextID = entry.ID
+		}
+		mutex.Unlock()
+	}
+	return nil
+}
+
+func checksum(operations []Operation) uint32 {
+	operationBytes, _ := json.Marshal(operations)
+	return crc32.ChecksumIEEE(operationBytes)
+}
+
+func appendEntry(entry Entry) error {
+	entry.Checksum = checksum(entry.Operations)
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(logPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(entryBytes, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func truncateLog() error {
+	f, err := os.OpenFile(logPath(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+func applyOperations(operations []Operation) error {
+	for _, op := range operations {
+		if err := applyOperation(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyOperation performs a single logged operation. Every operation is idempotent so that
+// replaying an entry which was already partially or fully applied is safe.
+func applyOperation(op Operation) error {
+	switch op.Type {
+	case OpRemove:
+		if err := os.Remove(op.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	case OpRemoveAll:
+		return os.RemoveAll(op.Path)
+	case OpMkdir:
+		return os.MkdirAll(op.Path, 0755)
+	case OpWrite, OpAppend:
+		if err := os.MkdirAll(filepath.Dir(op.Path), 0755); err != nil {
+			return err
+		}
+		flags := os.O_CREATE | os.O_WRONLY
+		if op.Type == OpWrite {
+			flags |= os.O_TRUNC
+		}
+		f, err := os.OpenFile(op.Path, flags, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if op.Type == OpAppend {
+			if err := f.Truncate(op.Offset); err != nil {
+				return err
+			}
+		}
+		if _, err := f.WriteAt(op.Data, op.Offset); err != nil {
+			return err
+		}
+		return f.Sync()
+	}
+	return errors.New(fmt.Sprintf("Invalid write-ahead log operation: %v", op.Type))
+}
+
+// operations flattens the staged state of the batch into the ordered list of operations to log
+func (b *batch) operations() []Operation {
+	type sequenced struct {
+		seq int
+		op  Operation
+	}
+	pending := make([]sequenced, 0, len(b.files)+len(b.dirs)+len(b.removed))
+	for path, seq := range b.removed {
+		pending = append(pending, sequenced{seq: seq, op: Operation{Type: OpRemoveAll, Path: path}})
+	}
+	for path, seq := range b.dirs {
+		pending = append(pending, sequenced{seq: seq, op: Operation{Type: OpMkdir, Path: path}})
+	}
+	for path, file := range b.files {
+		var op Operation
+		switch {
+		case file.removed:
+			op = Operation{Type: OpRemove, Path: path}
+		case file.replaced:
+			op = Operation{Type: OpWrite, Path: path, Data: file.contents}
+		default:
+			op = Operation{Type: OpAppend, Path: path, Offset: file.offset, Data: file.appended}
+		}
+		pending = append(pending, sequenced{seq: file.seq, op: op})
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].seq < pending[j].seq })
+	output := make([]Operation, len(pending))
+	for idx, val := range pending {
+		output[idx] = val.op
+	}
+	return output
+}
+
+// removedByDir reports whether a path lives below a directory removed within the batch
+func (b *batch) removedByDir(path string) bool {
+	for dir := range b.removed {
+		if isBelow(path, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func isBelow(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
+}
+
+// read returns the contents of a file as seen from within the batch
+func (b *batch) read(path string) ([]byte, error) {
+	if file, ok := b.files[path]; ok {
+		if file.removed {
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+		}
+		if file.replaced {
+			return append([]byte{}, file.contents...), nil
+		}
+		base, err := readBase(path, b.removedByDir(path))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(base)) > file.offset {
+			base = base[:file.offset]
+		}
+		return append(base, file.appended...), nil
+	}
+	if b.removedByDir(path) {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	return os.ReadFile(path)
+}
+
+func readBase(path string, removed bool) ([]byte, error) {
+	if removed {
+		return []byte{}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && os.IsNotExist(err) {
+		return []byte{}, nil
+	}
+	return data, err
+}
+
+// baseSize returns the size of a file on disk without reading it, so appending stays cheap however
+// large the file grows
+func baseSize(path string, removed bool) (int64, error) {
+	if removed {
+		return 0, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (b *batch) stage(path string) *stagedFile {
+	b.seq++
+	file, ok := b.files[path]
+	if !ok {
+		file = &stagedFile{}
+		b.files[path] = file
+	}
+	file.seq = b.seq
+	return file
+}
+
+// ReadFile returns the contents of a file including any writes staged in the open batch
+func ReadFile(path string) ([]byte, error) {
+	path = filepath.Clean(path)
+	mutex.RLock()
+	if current == nil {
+		mutex.RUnlock()
+		return os.ReadFile(path)
+	}
+	defer mutex.RUnlock()
+	return current.read(path)
+}
+
+// File is an open file as seen from within the open batch
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Closer
+	Size() (int64, error)
+}
+
+type diskFile struct {
+	*os.File
+}
+
+func (f diskFile) Size() (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+type stagedReader struct {
+	*bytes.Reader
+}
+
+func (f stagedReader) Close() error {
+	return nil
+}
+
+func (f stagedReader) Size() (int64, error) {
+	return f.Reader.Size(), nil
+}
+
+func openDisk(path string) (File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return diskFile{f}, nil
+}
+
+// Open returns a reader over a file including any writes staged in the open batch
+func Open(path string) (File, error) {
+	path = filepath.Clean(path)
+	mutex.RLock()
+	if current == nil {
+		mutex.RUnlock()
+		return openDisk(path)
+	}
+	_, staged := current.files[path]
+	if !staged && !current.removedByDir(path) {
+		mutex.RUnlock()
+		return openDisk(path)
+	}
+	data, err := current.read(path)
+	mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return stagedReader{bytes.NewReader(data)}, nil
+}
+
+// Exists reports whether a file exists once the writes staged in the open batch are considered
+func Exists(path string) bool {
+	_, err := ReadFile(path)
+	return err == nil
+}
+
+// ListFiles returns every file below root including files created or removed in the open batch
+func ListFiles(root string) ([]string, error) {
+	root = filepath.Clean(root)
+	var files []string
+	mutex.RLock()
+	defer mutex.RUnlock()
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if current != nil {
+			if file, ok := current.files[path]; ok && file.removed {
+				return nil
+			}
+			if _, ok := current.files[path]; !ok && current.removedByDir(path) {
+				return nil
+			}
+		}
+		files = append(files, path)
+		return nil
+	})
+	if err != nil && (current == nil || !os.IsNotExist(err)) {
+		return files, err
+	}
+	if current != nil {
+		listed := make(map[string]bool, len(files))
+		for _, path := range files {
+			listed[path] = true
+		}
+		for path, file := range current.files {
+			if file.removed || listed[path] || !strings.HasPrefix(path, root+string(os.PathSeparator)) {
+				continue
+			}
+			files = append(files, path)
+		}
+		sort.Strings(files)
+	}
+	return files, nil
+}
+
+// ReadDir returns the names of the entries directly within a directory including entries
+// created or removed in the open batch
+func ReadDir(path string) ([]string, error) {
+	path = filepath.Clean(path)
+	mutex.RLock()
+	defer mutex.RUnlock()
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	infos, err := ioutil.ReadDir(path)
+	if err != nil && (current == nil || !os.IsNotExist(err)) {
+		return nil, err
+	}
+	for _, info := range infos {
+		child := filepath.Join(path, info.Name())
+		if current != nil {
+			if current.removedByDir(child) && !current.stagedBelow(child) {
+				continue
+			}
+			if file, ok := current.files[child]; ok && file.removed {
+				continue
+			}
+		}
+		seen[info.Name()] = true
+		names = append(names, info.Name())
+	}
+	if current != nil {
+		staged := make([]string, 0, len(current.files)+len(current.dirs))
+		for filePath, file := range current.files {
+			if !file.removed {
+				staged = append(staged, filePath)
+			}
+		}
+		for dirPath := range current.dirs {
+			staged = append(staged, dirPath)
+		}
+		for _, stagedPath := range staged {
+			if !strings.HasPrefix(stagedPath, path+string(os.PathSeparator)) {
+				continue
+			}
+			name := strings.Split(stagedPath[len(path)+1:], string(os.PathSeparator))[0]
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		if len(seen) == 0 && err != nil && !current.stagedBelow(path) {
+			return nil, err
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// stagedBelow reports whether anything at or below a path is created within the batch
+func (b *batch) stagedBelow(path string) bool {
+	for filePath, file := range b.files {
+		if !file.removed && isBelow(filePath, path) {
+			return true
+		}
+	}
+	for dirPath := range b.dirs {
+		if isBelow(dirPath, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// stageWrite runs a staging function inside the open batch, or inside a batch of its own
+// which is committed immediately when no batch is open
+func stageWrite(fn func(b *batch) error) error {
+	replayFailed()
+	mutex.Lock()
+	if current != nil {
+		defer mutex.Unlock()
+		return fn(current)
+	}
+	current = newBatch()
+	current.depth = 1
+	if err := fn(current); err != nil {
+		current = nil
+		mutex.Unlock()
+		return err
+	}
+	mutex.Unlock()
+	return Commit()
+}
+
+// WriteFile stages replacing the contents of a file
+func WriteFile(path string, data []byte) error {
+	path = filepath.Clean(path)
+	return stageWrite(func(b *batch) error {
+		file := b.stage(path)
+		file.removed = false
+		file.replaced = true
+		file.contents = append([]byte{}, data...)
+		file.appended = nil
+		return nil
+	})
+}
+
+// AppendFile stages appending data to the end of a file, creating it if needed
+func AppendFile(path string, data []byte) error {
+	path = filepath.Clean(path)
+	return stageWrite(func(b *batch) error {
+		_, staged := b.files[path]
+		if !staged {
+			size, err := baseSize(path, b.removedByDir(path))
+			if err != nil {
+				return err
+			}
+			file := b.stage(path)
+			file.offset = size
+			file.appended = append([]byte{}, data...)
+			return nil
+		}
+		file := b.stage(path)
+		switch {
+		case file.removed:
+			file.removed = false
+			file.replaced = true
+			file.contents = append([]byte{}, data...)
+		case file.replaced:
+			file.contents = append(file.contents, data...)
+		default:
+			file.appended = append(file.appended, data...)
+		}
+		return nil
+	})
+}
+
+// Remove stages removing a file
+func Remove(path string) error {
+	path = filepath.Clean(path)
+	return stageWrite(func(b *batch) error {
+		if _, err := b.read(path); err != nil {
+			return err
+		}
+		file := b.stage(path)
+		file.removed = true
+		file.replaced = false
+		file.contents = nil
+		file.appended = nil
+		return nil
+	})
+}
+
+// MkdirAll stages creating a directory along with any missing parents
+func MkdirAll(path string) error {
+	path = filepath.Clean(path)
+	return stageWrite(func(b *batch) error {
+		b.seq++
+		b.dirs[path] = b.seq
+		return nil
+	})
+}
+
+// RemoveAll stages removing a directory and everything beneath it
+func RemoveAll(path string) error {
+	path = filepath.Clean(path)
+	return stageWrite(func(b *batch) error {
+		for filePath := range b.files {
+			if isBelow(filePath, path) {
+				delete(b.files, filePath)
+			}
+		}
+		for dirPath := range b.dirs {
+			if isBelow(dirPath, path) {
+				delete(b.dirs, dirPath)
+			}
+		}
+		b.seq++
+		b.removed[path] = b.seq
+		return nil
+	})
+}
+
+// End closes a batch opened with Begin, committing it when err is nil and discarding it otherwise
+func End(err error) error {
+	if err != nil {
+		Abort()
+		return err
+	}
+	return Commit()
+}
@@ -0,0 +1,267 @@
+package wal
+
+import (
+	"ceresdb/config"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func initialize() string {
+	os.Setenv("CERESDB_CONFIG_PATH", "../../test/.ceresdb/config/config.json")
+	config.ReadConfigFile()
+	dirPath := filepath.Join(config.Config.HomeDir, "wal-test")
+	os.RemoveAll(dirPath)
+	os.MkdirAll(dirPath, 0755)
+	return dirPath
+}
+
+func TestWriteFileNoBatch(t *testing.T) {
+	dirPath := initialize()
+	defer os.RemoveAll(dirPath)
+
+	filePath := filepath.Join(dirPath, "foo", "bar")
+	err := WriteFile(filePath, []byte("hello"))
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	data, _ := os.ReadFile(filePath)
+	if string(data) != "hello" {
+		t.Errorf("Data was incorrect, got: %v, want: %v", string(data), "hello")
+	}
+	logData, _ := os.ReadFile(logPath())
+	if len(logData) != 0 {
+		t.Errorf("Log was incorrect, got: %v, want: %v", string(logData), "")
+	}
+}
+
+func TestCommit(t *testing.T) {
+	dirPath := initialize()
+	defer os.RemoveAll(dirPath)
+
+	filePath := filepath.Join(dirPath, "bar")
+	os.WriteFile(filePath, []byte("a\n"), 0644)
+
+	Begin()
+	AppendFile(filePath, []byte("b\n"))
+	AppendFile(filePath, []byte("c\n"))
+
+	data, _ := os.ReadFile(filePath)
+	if string(data) != "a\n" {
+		t.Errorf("Data was incorrect before commit, got: %v, want: %v", string(data), "a\n")
+	}
+	data, _ = ReadFile(filePath)
+	if string(data) != "a\nb\nc\n" {
+		t.Errorf("Staged data was incorrect, got: %v, want: %v", string(data), "a\nb\nc\n")
+	}
+
+	err := Commit()
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	data, _ = os.ReadFile(filePath)
+	if string(data) != "a\nb\nc\n" {
+		t.Errorf("Data was incorrect after commit, got: %v, want: %v", string(data), "a\nb\nc\n")
+	}
+}
+
+func TestNestedCommit(t *testing.T) {
+	dirPath := initialize()
+	defer os.RemoveAll(dirPath)
+
+	filePath := filepath.Join(dirPath, "bar")
+
+	Begin()
+	Begin()
+	WriteFile(filePath, []byte("foo"))
+	Commit()
+
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Errorf("File was written before the outer batch was committed")
+	}
+
+	Commit()
+	data, _ := os.ReadFile(filePath)
+	if string(data) != "foo" {
+		t.Errorf("Data was incorrect, got: %v, want: %v", string(data), "foo")
+	}
+}
+
+func TestAbort(t *testing.T) {
+	dirPath := initialize()
+	defer os.RemoveAll(dirPath)
+
+	filePath := filepath.Join(dirPath, "bar")
+	os.WriteFile(filePath, []byte("foo"), 0644)
+
+	hookCalled := false
+	OnAbort(func() { hookCalled = true })
+	defer func() { abortHooks = nil }()
+
+	Begin()
+	WriteFile(filePath, []byte("bar"))
+	Remove(filePath)
+	if _, err := ReadFile(filePath); !os.IsNotExist(err) {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, os.ErrNotExist)
+	}
+	Abort()
+
+	data, _ := os.ReadFile(filePath)
+	if string(data) != "foo" {
+		t.Errorf("Data was incorrect, got: %v, want: %v", string(data), "foo")
+	}
+	if !hookCalled {
+		t.Errorf("Abort hook was not called")
+	}
+	if Active() {
+		t.Errorf("Batch was still active after abort")
+	}
+}
+
+func TestRemoveAll(t *testing.T) {
+	dirPath := initialize()
+	defer os.RemoveAll(dirPath)
+
+	subPath := filepath.Join(dirPath, "foo")
+	os.MkdirAll(subPath, 0755)
+	os.WriteFile(filepath.Join(subPath, "bar"), []byte("bar"), 0644)
+	os.WriteFile(filepath.Join(subPath, "baz"), []byte("baz"), 0644)
+
+	Begin()
+	RemoveAll(subPath)
+	AppendFile(filepath.Join(subPath, "baz"), []byte("hello"))
+
+	expectedFiles := []string{filepath.Join(subPath, "baz")}
+	files, _ := ListFiles(dirPath)
+	if !reflect.DeepEqual(files, expectedFiles) {
+		t.Errorf("Files were incorrect, got: %v, want: %v", files, expectedFiles)
+	}
+	Commit()
+
+	if _, err := os.Stat(filepath.Join(subPath, "bar")); !os.IsNotExist(err) {
+		t.Errorf("Removed file still exists")
+	}
+	data, _ := os.ReadFile(filepath.Join(subPath, "baz"))
+	if string(data) != "hello" {
+		t.Errorf("Data was incorrect, got: %v, want: %v", string(data), "hello")
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	dirPath := initialize()
+	defer os.RemoveAll(dirPath)
+
+	os.MkdirAll(filepath.Join(dirPath, "foo"), 0755)
+
+	Begin()
+	MkdirAll(filepath.Join(dirPath, "bar"))
+	WriteFile(filepath.Join(dirPath, "baz", "hello"), []byte(""))
+	RemoveAll(filepath.Join(dirPath, "foo"))
+
+	expectedNames := []string{"bar", "baz"}
+	names, _ := ReadDir(dirPath)
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("Names were incorrect, got: %v, want: %v", names, expectedNames)
+	}
+	Abort()
+
+	expectedNames = []string{"foo"}
+	names, _ = ReadDir(dirPath)
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("Names were incorrect, got: %v, want: %v", names, expectedNames)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	dirPath := initialize()
+	defer os.RemoveAll(dirPath)
+
+	filePath := filepath.Join(dirPath, "bar")
+	appendPath := filepath.Join(dirPath, "baz")
+	os.WriteFile(appendPath, []byte("a\nb\n"), 0644)
+
+	// Simulate a crash after the entry was logged but before its writes were applied, with
+	// the append partially applied already
+	operations := []Operation{
+		{Type: OpWrite, Path: filePath, Data: []byte("foo")},
+		{Type: OpAppend, Path: appendPath, Offset: 2, Data: []byte("c\n")},
+	}
+	appendEntry(Entry{ID: 1, Operations: operations})
+	f, _ := os.OpenFile(logPath(), os.O_APPEND|os.O_WRONLY, 0644)
+	torn, _ := json.Marshal(Entry{ID: 2, Operations: []Operation{{Type: OpWrite, Path: filePath, Data: []byte("bar")}}})
+	f.Write(torn[:len(torn)/2])
+	f.Close()
+
+	err := Recover()
+	if err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	data, _ := os.ReadFile(filePath)
+	if string(data) != "foo" {
+		t.Errorf("Data was incorrect, got: %v, want: %v", string(data), "foo")
+	}
+	data, _ = os.ReadFile(appendPath)
+	if string(data) != "a\nc\n" {
+		t.Errorf("Appended data was incorrect, got: %v, want: %v", string(data), "a\nc\n")
+	}
+	logData, _ := os.ReadFile(logPath())
+	if len(logData) != 0 {
+		t.Errorf("Log was incorrect, got: %v, want: %v", string(logData), "")
+	}
+}
+
+func TestFailedCommit(t *testing.T) {
+	dirPath := initialize()
+	defer os.RemoveAll(dirPath)
+
+	hookCalls := 0
+	OnAbort(func() { hookCalls++ })
+	defer func() { abortHooks = nil }()
+
+	// A file in place of the directory makes the entry impossible to apply
+	blockerPath := filepath.Join(dirPath, "foo")
+	filePath := filepath.Join(blockerPath, "bar")
+	otherPath := filepath.Join(dirPath, "baz")
+	os.WriteFile(blockerPath, []byte(""), 0644)
+
+	Begin()
+	WriteFile(filePath, []byte("bar"))
+	if err := Commit(); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+	if hookCalls != 1 {
+		t.Errorf("Abort hook calls were incorrect, got: %v, want: %v", hookCalls, 1)
+	}
+
+	// Further writes are refused while the entry cannot be replayed
+	Begin()
+	WriteFile(otherPath, []byte("baz"))
+	if err := Commit(); err == nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<non-nil>")
+	}
+	if _, err := os.Stat(otherPath); !os.IsNotExist(err) {
+		t.Errorf("File was written while an entry was unapplied")
+	}
+
+	// Once it can be applied the entry is replayed before the next batch
+	os.Remove(blockerPath)
+	Begin()
+	data, _ := ReadFile(filePath)
+	if string(data) != "bar" {
+		t.Errorf("Data was incorrect, got: %v, want: %v", string(data), "bar")
+	}
+	WriteFile(otherPath, []byte("baz"))
+	if err := Commit(); err != nil {
+		t.Errorf("Error was incorrect, got: %v, want: %v", err, "<nil>")
+	}
+	data, _ = os.ReadFile(otherPath)
+	if string(data) != "baz" {
+		t.Errorf("Data was incorrect, got: %v, want: %v", string(data), "baz")
+	}
+	logData, _ := os.ReadFile(logPath())
+	if len(logData) != 0 {
+		t.Errorf("Log was incorrect, got: %v, want: %v", string(logData), "")
+	}
+}